@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sujiththirumalaisamy/test/pkg/ingest"
+)
+
+// Options of the ingest binary, the defaults come from ingest.DefaultConfig
+func parseConfig() *ingest.Config {
+	c := ingest.DefaultConfig()
+	registerFlags(flag.CommandLine, c)
+	flag.Parse()
+	if err := applyConfigFile(flag.CommandLine); err != nil {
+		fail(ingest.WithKind(ingest.ErrorConfig, err))
+	}
+	return c
+}
+
+// Options as a reload sees them: the defaults, the command line and then the
+// config file, read again
+func reloadConfig() (*ingest.Config, error) {
+	c := ingest.DefaultConfig()
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	registerFlags(fs, c)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+	return c, applyConfigFile(fs)
+}
+
+// Path of -config, empty without
+var configFile string
+
+// Set the options of the config file, "<flag> = <value>" lines, that were
+// not given on the command line
+func applyConfigFile(fs *flag.FlagSet) error {
+	if configFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected <flag> = <value>", configFile, i+1)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "config" || given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", configFile, i+1, err)
+		}
+	}
+	return nil
+}
+
+func registerFlags(fs *flag.FlagSet, c *ingest.Config) {
+	fs.StringVar(&configFile, "config", configFile, "file of \"<flag> = <value>\" lines applied under the command line; SIGHUP or changing it reloads the settings that are safe to change at runtime")
+	fs.BoolVar(&c.TrimSilence, "trim-silence", c.TrimSilence, "pause audio segment output during long silences")
+	fs.DurationVar(&c.SilenceTimeout, "silence-timeout", c.SilenceTimeout, "how long audio must stay silent before it is recorded as a silence interval")
+	fs.UintVar(&c.SilenceLevel, "silence-level", c.SilenceLevel, "audio level in -dBov (0-127, larger is quieter) from which a packet counts as silence")
+	fs.BoolVar(&c.LegacyCodecs, "legacy-codecs", c.LegacyCodecs, "accept G.722, G.711 and iLBC audio from telephony gateways")
+	fs.BoolVar(&c.DTMF, "dtmf", c.DTMF, "negotiate telephone-event and report the DTMF digits publishers send as dtmf.received events")
+	fs.BoolVar(&c.OpusFEC, "opus-fec", c.OpusFEC, "negotiate Opus inband FEC and conceal packets lost before a packet carrying it")
+	fs.BoolVar(&c.OpusStereo, "opus-stereo", c.OpusStereo, "accept stereo Opus from publishers announcing sprop-stereo=1, which send mono otherwise")
+	fs.BoolVar(&c.OpusDTX, "opus-dtx", c.OpusDTX, "ask publishers to use Opus DTX, sending next to nothing during silence")
+	fs.BoolVar(&c.AudioRED, "audio-red", c.AudioRED, "negotiate redundant audio (audio/red) and recover lost Opus packets from the redundant copies")
+	fs.BoolVar(&c.VideoFEC, "video-fec", c.VideoFEC, "negotiate ULPFEC for video (video/red and video/ulpfec) and recover lost VP8 packets from it")
+	fs.DurationVar(&c.MaxSessionDuration, "max-session-duration", c.MaxSessionDuration, "sessions are ended and their recording finalized after this long, e.g. 4h; 0 for no limit")
+	fs.StringVar(&c.MaxSessionSize, "max-session-size", c.MaxSessionSize, "sessions are ended and their recording finalized once their outputs take up this much, e.g. 2GB; empty for no limit")
+	fs.StringVar(&c.OutputTemplate, "output-template", c.OutputTemplate, "Go template of the paths finalized recordings are also linked to, with .SessionID, .Tenant, .Publisher, .TrackKind, .Rendition, .Timestamp and .Ext, e.g. \"archive/{{.SessionID}}/{{.TrackKind}}/{{.Timestamp}}\"")
+	fs.DurationVar(&c.ResumeWindow, "resume-window", c.ResumeWindow, "how long after a crash a publisher reconnecting to the same session continues its recording, 0 disables")
+	fs.BoolVar(&c.H264, "h264", c.H264, "accept H.264 video besides VP8; route it to the cmaf sink, e.g. \"h264=cmaf\", to package it without FFmpeg")
+	fs.BoolVar(&c.RotateRecordings, "rotate-recordings", c.RotateRecordings, "re-encode WebM recordings of video mobile publishers sent rotated so they play upright")
+	fs.StringVar(&c.STTCommand, "stt-command", c.STTCommand, "speech-to-text command reading a WAV chunk on stdin and printing the transcript")
+	fs.StringVar(&c.STTURL, "stt-url", c.STTURL, "speech-to-text HTTP endpoint accepting a WAV chunk and answering with the transcript")
+	fs.DurationVar(&c.CaptionInterval, "caption-interval", c.CaptionInterval, "length of the audio chunks transcribed into WebVTT segments")
+	fs.StringVar(&c.CaptionLanguage, "caption-language", c.CaptionLanguage, "language of the captions advertised in the master playlist")
+	fs.StringVar(&c.HTTPAddr, "http-addr", c.HTTPAddr, "address of the HTTP server serving the HLS output")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "certificate file (PEM) to serve HTTPS with, browsers need a secure context for getUserMedia")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "private key file (PEM) of -tls-cert")
+	fs.StringVar(&c.ACMEDomains, "acme-domains", c.ACMEDomains, "comma separated domains to obtain certificates from Let's Encrypt for, instead of -tls-cert")
+	fs.StringVar(&c.ACMEEmail, "acme-email", c.ACMEEmail, "contact email of the ACME account")
+	fs.StringVar(&c.ACMECacheDir, "acme-cache-dir", c.ACMECacheDir, "directory ACME certificates and account keys are kept in")
+	fs.StringVar(&c.ACMEHTTPAddr, "acme-http-addr", c.ACMEHTTPAddr, "address answering ACME HTTP-01 challenges (port 80 as seen from the internet) and redirecting everything else to HTTPS")
+	fs.StringVar(&c.AllowedOrigins, "allowed-origins", c.AllowedOrigins, "comma separated web origins allowed to call the signaling and playback endpoints (\"https://*.example.com\" for subdomains, \"*\" for any, with CORS headers), empty leaves origins unchecked")
+	fs.BoolVar(&c.CORSCredentials, "cors-credentials", c.CORSCredentials, "let allowed origins send cookies along, e.g. the playback token cookie")
+	fs.StringVar(&c.SegmentBaseURL, "segment-base-url", c.SegmentBaseURL, "CDN or bucket URL segments are rewritten to in served playlists")
+	fs.StringVar(&c.SegmentSigner, "segment-signer", c.SegmentSigner, "how segment URLs are signed: token (HMAC) or s3 (SigV4 pre-signed)")
+	fs.StringVar(&c.SegmentSignKey, "segment-sign-key", c.SegmentSignKey, "shared secret for token signed segment URLs")
+	fs.DurationVar(&c.SegmentURLTTL, "segment-url-ttl", c.SegmentURLTTL, "validity of signed segment URLs")
+	fs.IntVar(&c.ScreenFrameRate, "screen-fps", c.ScreenFrameRate, "frame rate screen share tracks are encoded at")
+	fs.StringVar(&c.ScreenSize, "screen-size", c.ScreenSize, "frame size screen share tracks are decoded at")
+	fs.DurationVar(&c.ThumbnailInterval, "thumbnail-interval", c.ThumbnailInterval, "how often thumbnail.jpg is refreshed from the video, 0 disables thumbnails")
+	fs.BoolVar(&c.ThumbnailSprites, "thumbnail-sprites", c.ThumbnailSprites, "also assemble preview sprites and a thumbnails.vtt track")
+	fs.DurationVar(&c.PreviewInterval, "preview-interval", c.PreviewInterval, "frame interval of the data channel preview feed, 0 disables it")
+	fs.BoolVar(&c.DriftCorrection, "drift-correction", c.DriftCorrection, "insert silence and duplicate or drop video frames when outputs drift from the publisher's clock")
+	fs.DurationVar(&c.DriftThreshold, "drift-threshold", c.DriftThreshold, "drift from the publisher's clock that triggers a correction")
+	fs.BoolVar(&c.GapFill, "gap-fill", c.GapFill, "fill timeline gaps left by packet loss with silence and repeated video frames")
+	fs.DurationVar(&c.MaxGapFill, "max-gap-fill", c.MaxGapFill, "longest gap filled as packet loss, longer gaps are outages")
+	fs.DurationVar(&c.MaxGapBridge, "max-gap-bridge", c.MaxGapBridge, "longest outage (e.g. a throttled browser tab) bridged with silence and held frames plus a playlist discontinuity, 0 leaves outages as they are")
+	fs.StringVar(&c.WebhookURL, "webhook-url", c.WebhookURL, "URL session lifecycle events are POSTed to as JSON, empty disables webhooks")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", c.WebhookSecret, "key of the HMAC-SHA256 body signature sent in X-Ingest-Signature")
+	fs.StringVar(&c.WebhookEvents, "webhook-events", c.WebhookEvents, "comma separated event types delivered, empty for all")
+	fs.IntVar(&c.WebhookRetries, "webhook-retries", c.WebhookRetries, "times a failed webhook delivery is retried with exponential backoff")
+	fs.StringVar(&c.EventBusURL, "event-bus-url", c.EventBusURL, "nats:// or redis:// URL session events are published to, empty disables it")
+	fs.StringVar(&c.EventBusPrefix, "event-bus-prefix", c.EventBusPrefix, "prefix of the event subjects (channels), events go to <prefix>.<type>")
+	fs.StringVar(&c.NodeID, "node-id", c.NodeID, "identifies this node in events, the hostname by default")
+	fs.StringVar(&c.PublicURL, "public-url", c.PublicURL, "base URL viewers reach this node at, sent in events so a control plane can route them")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "how long draining (POST /drain or SIGTERM) waits for sessions to end before closing them")
+	fs.StringVar(&c.ClusterURL, "cluster-url", c.ClusterURL, "Redis (redis://) the nodes of a cluster register their sessions in, so requests for a session are redirected to its node; requires -public-url")
+	fs.StringVar(&c.PublishKey, "publish-key", c.PublishKey, "HS256 secret of the publish tokens (JWTs with \"sid\" and \"exp\" claims) publishers must present, empty leaves publishing open")
+	fs.StringVar(&c.PublishKeyFile, "publish-key-file", c.PublishKeyFile, "PEM public key of RS256 or ES256 publish tokens, instead of -publish-key")
+	fs.StringVar(&c.PolicyFile, "policy-file", c.PolicyFile, "file of \"<publisher> bitrate=<bps> height=<px> fps=<n>\" lines limiting the video of publishers, \"*\" for everyone else")
+	fs.StringVar(&c.TenantsFile, "tenants-file", c.TenantsFile, "file of \"<tenant> sessions=<n> storage=<size>\" lines with the quotas of the tenants in publish tokens, \"*\" for tenants not listed")
+	fs.StringVar(&c.DTLSCertFile, "dtls-cert-file", c.DTLSCertFile, "PEM file the DTLS certificate is kept in across restarts (generated if missing) so publishers see a stable fingerprint, empty for a new certificate every start")
+	fs.StringVar(&c.DTLSKeyLogFile, "dtls-keylog-file", os.Getenv("SSLKEYLOGFILE"), "file DTLS secrets are appended to in NSS key log format, so packet captures can be decrypted in Wireshark (defaults to $SSLKEYLOGFILE, for debugging only)")
+	fs.StringVar(&c.RTPDumpDir, "rtp-dump-dir", c.RTPDumpDir, "directory the incoming RTP and RTCP of every track is dumped to as a pcap file, for inspection in Wireshark or the replay command")
+	fs.StringVar(&c.PinnedFingerprints, "pinned-fingerprints", c.PinnedFingerprints, "comma separated DTLS fingerprints (\"sha-256 AB:CD:...\") publishers must connect with, empty accepts any")
+	fs.StringVar(&c.PlaybackKey, "playback-key", c.PlaybackKey, "HMAC key of the per-session playback tokens viewers must present for playlists, recordings and WHEP, empty leaves playback to -auth")
+	fs.BoolVar(&c.EncryptSegments, "encrypt-segments", c.EncryptSegments, "encrypt live HLS segments at rest with a key per session, which players fetch from /keys/<session>")
+	fs.StringVar(&c.CatalogDB, "catalog", c.CatalogDB, "SQLite database recording finalized sessions and their recordings, queried at /recordings (needs a build with -tags sqlite)")
+	fs.StringVar(&c.CatalogDriver, "catalog-driver", c.CatalogDriver, "database/sql driver the catalog is opened with")
+	fs.StringVar(&c.Retention, "retention", c.Retention, "rules finished sessions' recordings, VOD renditions and metadata are deleted by, e.g. \"age=168h,count=100,size=500GB\"; empty keeps everything")
+	fs.DurationVar(&c.PlaybackTokenTTL, "playback-token-ttl", c.PlaybackTokenTTL, "default lifetime of issued playback tokens")
+	fs.StringVar(&c.Auth, "auth", c.Auth, "auth provider of the HTTP endpoints: none, static, jwt, introspection or http")
+	fs.StringVar(&c.AuthTokensFile, "auth-tokens-file", c.AuthTokensFile, "file of \"<token> <scope>,<scope>\" lines for static auth")
+	fs.StringVar(&c.AuthJWKSURL, "auth-jwks-url", c.AuthJWKSURL, "JWKS URL publishing the keys JWTs are signed with")
+	fs.StringVar(&c.AuthIssuer, "auth-issuer", c.AuthIssuer, "required iss claim of JWTs")
+	fs.StringVar(&c.AuthURL, "auth-url", c.AuthURL, "token introspection endpoint, or external authorizer URL for http auth")
+	fs.StringVar(&c.AuthClientID, "auth-client-id", c.AuthClientID, "client ID used to authenticate to the introspection endpoint")
+	fs.StringVar(&c.AuthClientSecret, "auth-client-secret", c.AuthClientSecret, "client secret used to authenticate to the introspection endpoint")
+	fs.BoolVar(&c.AudioWriteThrough, "audio-write-through", c.AudioWriteThrough, "write audio payloads to FFmpeg as they arrive instead of batching them, for the lowest latency")
+	fs.DurationVar(&c.AudioBuffer, "audio-buffer", c.AudioBuffer, "audio queued between the RTP reader and the FFmpeg writer, packets arriving while it is full are dropped")
+	fs.IntVar(&c.AudioBatchSize, "audio-batch-size", c.AudioBatchSize, "audio payloads written to FFmpeg at once")
+	fs.DurationVar(&c.AudioFlushInterval, "audio-flush-interval", c.AudioFlushInterval, "longest a partial batch of audio waits before it is written to FFmpeg")
+	fs.DurationVar(&c.AudioLatencyTarget, "audio-latency-target", c.AudioLatencyTarget, "ingest-to-write latency budget the audio batch size and flush interval adapt to, e.g. 20ms, 0 keeps them fixed")
+	fs.StringVar(&c.WritePolicy, "write-policy", c.WritePolicy, "what a track does while FFmpeg doesn't keep up and its write queue is full: drop-oldest, drop-newest, or block for up to -write-timeout before dropping")
+	fs.IntVar(&c.WriteQueue, "write-queue", c.WriteQueue, "payloads queued per track ahead of its sinks")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "how long a write may block before FFmpeg is reported as stalled")
+	fs.StringVar(&c.AudioFilters, "audio-filters", c.AudioFilters, "audio filters of each output (audio, mix) joined with +, of loudnorm[:LUFS], highpass[:Hz] and compressor[:ratio], e.g. \"audio=highpass+loudnorm,mix=loudnorm:-23\"")
+	fs.StringVar(&c.SegmentFormats, "segment-formats", c.SegmentFormats, "container of the HLS segments of each output (audio, video, screen, mix, composite), e.g. \"video=ts,mix=ts\"; ts writes MPEG-TS, with audio re-encoded to AAC")
+	fs.IntVar(&c.PlaylistWindow, "playlist-window", c.PlaylistWindow, "segments listed in the live HLS playlists of tracks")
+	fs.StringVar(&c.PlaylistTags, "playlist-tags", c.PlaylistTags, "tags added to the live HLS playlists of tracks, e.g. \"#EXT-X-INDEPENDENT-SEGMENTS,#EXT-X-START:TIME-OFFSET=-1\"")
+	fs.StringVar(&c.Routes, "routes", c.Routes, "sinks each track kind or codec is routed to, e.g. \"audio=hls+webm,video=hls+rtmp,pcmu=discard\"; sinks are hls, cmaf, webm, ivf, ogg, rtmp, whep, mix, composite and discard")
+	fs.StringVar(&c.RTMPURL, "rtmp-url", c.RTMPURL, "URL the rtmp sink pushes to, {kind} is replaced with audio or video; without it a session's audio and camera are pushed muxed")
+	fs.StringVar(&c.SinkDurability, "sink-durability", c.SinkDurability, "per sink \"fsync\" (sync each finished segment to disk) or \"buffered\" (the default), e.g. \"webm=fsync,hls=buffered\"")
+	fs.Float64Var(&c.Pacing, "pacing", c.Pacing, "multiple of a stream's average bitrate video is paced at when forwarded to WHEP and SFU viewers, smoothing keyframe bursts; 0 disables pacing")
+	fs.StringVar(&c.Features, "features", c.Features, "experimental subsystems enabled by default: ll-hls, moq, sfu (comma separated, toggled at runtime on /features)")
+	fs.StringVar(&c.CompositeLayout, "composite-layout", c.CompositeLayout, "layout of the composite sink: grid, or pip for the first publisher with the others inset")
+	fs.StringVar(&c.CompositeSize, "composite-size", c.CompositeSize, "frame size of the composite sink")
+	fs.StringVar(&c.VODRenditions, "vod-renditions", c.VODRenditions, "renditions the webm recording of a session is transcoded to once it ends, as name:height:bitrate[:codec], e.g. \"720p:720:2800k,360p:360:800k\"")
+	fs.IntVar(&c.VODConcurrency, "vod-concurrency", c.VODConcurrency, "VOD transcodes run at the same time")
+	fs.IntVar(&c.ICEUDPPort, "ice-udp-port", c.ICEUDPPort, "UDP port all sessions share for ICE, which also lets later sessions skip STUN once the NAT mapping is known; 0 uses a port per session")
+	fs.IntVar(&c.ICETCPPort, "ice-tcp-port", c.ICETCPPort, "TCP port ICE-TCP candidates are gathered on, for publishers on networks blocking UDP; 0 disables ICE-TCP")
+	fs.StringVar(&c.ICEInterfaces, "ice-interfaces", c.ICEInterfaces, "network interfaces ICE gathers candidates on, e.g. \"eth1\" on multi-homed servers where the default interface is wrong; empty for all")
+	fs.StringVar(&c.ICEIPFamily, "ice-ip-family", c.ICEIPFamily, "IP family ICE gathers candidates of, ipv4 or ipv6; empty for both")
+	fs.StringVar(&c.STUNServer, "stun-server", c.STUNServer, "STUN server server reflexive ICE candidates are gathered with, empty for none")
+	fs.BoolVar(&c.LANMode, "lan", c.LANMode, "LAN mode for air-gapped and on-prem deployments: only host candidates are gathered, without STUN or TURN")
+	fs.StringVar(&c.MDNS, "mdns", c.MDNS, "mDNS candidate handling: query resolves publishers' .local candidates, gather also announces ours as .local names, off discards them")
+	fs.StringVar(&c.TURNServers, "turn-servers", c.TURNServers, "TURN servers used and announced to WHIP clients, e.g. \"turn:turn.example.com:3478?transport=tcp,turns:turn.example.com:5349\" for TURN over TCP and TLS")
+	fs.StringVar(&c.TURNUsername, "turn-username", c.TURNUsername, "username of the TURN servers")
+	fs.StringVar(&c.TURNCredential, "turn-credential", c.TURNCredential, "credential of the TURN servers")
+	fs.IntVar(&c.AudioBandwidth, "audio-bandwidth", c.AudioBandwidth, "audio bitrate in bits per second publishers are asked to stay under (b=AS/TIAS in the answer), 0 for no cap")
+	fs.IntVar(&c.VideoBandwidth, "video-bandwidth", c.VideoBandwidth, "video bitrate in bits per second publishers are asked to stay under (b=AS/TIAS in the answer), 0 for no cap")
+	fs.DurationVar(&c.RTCPXRInterval, "rtcp-xr", c.RTCPXRInterval, "interval of the RTCP Extended Reports (receiver reference time, loss RLE) sent to publishers, 0 disables them")
+	fs.DurationVar(&c.RTCPRRInterval, "rtcp-rr", c.RTCPRRInterval, "interval of the RTCP Receiver Reports sent to publishers, and of the round trip and packet loss samples of GET /sessions/<id>/link")
+	fs.IntVar(&c.ReplayWindow, "replay-window", c.ReplayWindow, "sequence numbers behind the newest packet of a track that may still arrive; duplicates and older packets are dropped before the muxers, 0 lets them through")
+	fs.IntVar(&c.FFmpegSpares, "ffmpeg-spares", c.FFmpegSpares, "idle FFmpeg processes kept started per pipeline so new tracks skip process startup")
+	fs.DurationVar(&c.FFmpegShutdownTimeout, "ffmpeg-shutdown-timeout", c.FFmpegShutdownTimeout, "how long FFmpeg processes get to finalize their outputs once their session ended, before their process group is sent SIGTERM, and SIGKILL as long again later")
+	fs.StringVar(&c.RTPListen, "rtp-listen", c.RTPListen, "UDP address accepting plain RTP, e.g. from a SIP trunk or ffmpeg -f rtp, each source published as a session; the server then runs without a pasted offer")
+	fs.StringVar(&c.RTPPayloadTypes, "rtp-payload-types", c.RTPPayloadTypes, "codecs of the dynamic payload types of plain RTP (opus, vp8, h264, pcmu, pcma, g722), 0, 8 and 9 are always PCMU, PCMA and G.722")
+	fs.DurationVar(&c.RTPIdleTimeout, "rtp-idle-timeout", c.RTPIdleTimeout, "how long a plain RTP source may stop sending before its session ends")
+	fs.StringVar(&c.RTSPURLs, "rtsp-url", c.RTSPURLs, "comma separated rtsp:// URLs of cameras to pull H.264 and AAC from, each published as a session; the server then runs without a pasted offer")
+	fs.BoolVar(&c.MoQ, "moq", c.MoQ, "experimental: accept Media over QUIC style object streams on POST /moq, published as sessions like WHIP, to compare QUIC based contribution latency with WebRTC")
+	fs.Float64Var(&c.FFmpegCPULimit, "ffmpeg-cpu-limit", c.FFmpegCPULimit, "CPUs the FFmpegs of a session may use together, e.g. 1.5, enforced through a cgroup v2 per session; 0 for no limit")
+	fs.StringVar(&c.FFmpegMemoryLimit, "ffmpeg-memory-limit", c.FFmpegMemoryLimit, "memory the FFmpegs of a session may use together, e.g. 1GB, enforced through a cgroup v2 per session; empty for no limit")
+	fs.StringVar(&c.SignalSocket, "signal-socket", c.SignalSocket, "path of a Unix socket serving the WHIP, WHEP, SFU and preview signaling endpoints to processes on the same host, without credential scopes; access is up to the socket's permissions")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", c.GRPCAddr, "address of the gRPC control plane (CreateSession, Signal, ListSessions, StopSession, StreamStats, see pkg/ingest/control.proto), over TLS with -tls-cert and cleartext HTTP/2 otherwise; empty for none")
+	fs.DurationVar(&c.TrackEndTimeout, "track-end-timeout", c.TrackEndTimeout, "how long a track may stop sending before its outputs are finalized, 0 to wait for RTCP BYE or a stopped transceiver")
+	fs.DurationVar(&c.RTPStallTimeout, "rtp-stall-timeout", c.RTPStallTimeout, "how long a track may stop sending before a NACK and, for video, a PLI are sent, and twice that before a track.stalled event; 0 disables")
+	fs.DurationVar(&c.RTPStallTeardown, "rtp-stall-teardown", c.RTPStallTeardown, "how long every track of a session may stop sending before the session is closed, 0 keeps stalled sessions")
+	fs.StringVar(&c.Encoder, "encoder", c.Encoder, "backend of the hls and rtmp sinks: ffmpeg, or gstreamer running gst-launch-1.0 pipelines with MPEG-TS HLS segments")
+	fs.StringVar(&c.DefaultPriority, "default-priority", c.DefaultPriority, "priority class of new sessions, \"broadcast\" or \"best-effort\"")
+	fs.Float64Var(&c.CPUWatermark, "cpu-watermark", c.CPUWatermark, "CPU usage (0-1) from which best-effort sessions are degraded and then preempted, 0 disables")
+
+}
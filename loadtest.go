@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+	"github.com/sujiththirumalaisamy/test/pkg/ingest"
+)
+
+// Histogram of the server's audio pipeline latency in /metrics
+const pipelineLatencyMetric = `ingest_pipeline_write_latency_seconds_bucket{track="audio",le="`
+
+// "loadtest [flags]" publishes sample files from many in-process publishers
+// over WHIP, to measure what a server sustains before going to production
+func loadtest() {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	server := flags.String("url", "http://localhost:8080", "base URL of the server under test")
+	publishers := flags.Int("publishers", 10, "number of publishers")
+	ramp := flags.Duration("ramp", 200*time.Millisecond, "delay between starting publishers")
+	duration := flags.Duration("duration", time.Minute, "how long every publisher sends once all started")
+	audioFile := flags.String("audio", "", "Ogg Opus file publishers send, looped")
+	videoFile := flags.String("video", "", "IVF VP8 file publishers send, looped")
+	token := flags.String("token", "", "bearer token of the WHIP requests, a signal scoped credential")
+	metricsToken := flags.String("metrics-token", "", "bearer token for the server's /metrics, to report pipeline latency")
+	flags.Parse(os.Args[2:]) //nolint:errcheck
+
+	var tracks []*loadTrack
+	if *audioFile != "" {
+		track, err := loadOpus(*audioFile)
+		if err != nil {
+			fail(ingest.WithKind(ingest.ErrorConfig, err))
+		}
+		tracks = append(tracks, track)
+	}
+	if *videoFile != "" {
+		track, err := loadVP8(*videoFile)
+		if err != nil {
+			fail(ingest.WithKind(ingest.ErrorConfig, err))
+		}
+		tracks = append(tracks, track)
+	}
+	if len(tracks) == 0 {
+		fail(ingest.WithKind(ingest.ErrorConfig, errors.New("loadtest needs -audio and/or -video sample files")))
+	}
+
+	test := &loadTest{server: strings.TrimSuffix(*server, "/"), token: *token, tracks: tracks, loss: map[uint32]*lossReport{}}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := test.publish(stop); err != nil {
+				fmt.Println("Publisher failed:", err)
+				test.failed.Add(1)
+			}
+		}()
+		time.Sleep(*ramp)
+	}
+
+	time.Sleep(*duration)
+	latency, latencyErr := pipelineLatency(test.server, *metricsToken)
+	close(stop)
+	wg.Wait()
+
+	test.report(*publishers, latency, latencyErr)
+}
+
+// loadTrack is a sample file read into memory, sent by every publisher
+type loadTrack struct {
+	codec   webrtc.RTPCodecCapability
+	samples []media.Sample
+}
+
+// Opus packets of an Ogg file, a page at a time like pion's examples
+func loadOpus(path string) (*loadTrack, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ogg, _, err := oggreader.NewWith(f)
+	if err != nil {
+		return nil, err
+	}
+	track := &loadTrack{codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}}
+	var granule uint64
+	for {
+		page, header, err := ogg.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		samples := header.GranulePosition - granule
+		granule = header.GranulePosition
+		track.samples = append(track.samples, media.Sample{Data: page, Duration: time.Duration(samples) * time.Second / 48000})
+	}
+
+	if len(track.samples) == 0 {
+		return nil, fmt.Errorf("no Opus packets in %s", path)
+	}
+	return track, nil
+}
+
+// VP8 frames of an IVF file, at the frame rate of its timebase
+func loadVP8(path string) (*loadTrack, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ivf, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		return nil, err
+	}
+	if header.FourCC != "VP80" {
+		return nil, fmt.Errorf("%s holds %s, not VP8", path, header.FourCC)
+	}
+	frameDuration := time.Duration(float64(header.TimebaseNumerator) / float64(header.TimebaseDenominator) * float64(time.Second))
+
+	track := &loadTrack{codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}}
+	for {
+		frame, _, err := ivf.ParseNextFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		track.samples = append(track.samples, media.Sample{Data: frame, Duration: frameDuration})
+	}
+
+	if len(track.samples) == 0 {
+		return nil, fmt.Errorf("no VP8 frames in %s", path)
+	}
+	return track, nil
+}
+
+type loadTest struct {
+	server string
+	token  string
+	tracks []*loadTrack
+
+	connected atomic.Int64
+	failed    atomic.Int64
+
+	mu          sync.Mutex
+	connectTime []time.Duration
+	loss        map[uint32]*lossReport // By SSRC of the publishers' tracks
+}
+
+// lossReport is the first and latest Receiver Report block the server sent
+// about a track
+type lossReport struct {
+	firstLost, lastLost uint32
+	firstSeq, lastSeq   uint32
+}
+
+// publish connects one publisher over WHIP and sends the tracks until stopped
+func (t *loadTest) publish(stop <-chan struct{}) error {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return err
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	connected := make(chan struct{})
+	var connectOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			connectOnce.Do(func() { close(connected) })
+		}
+	})
+
+	var locals []*webrtc.TrackLocalStaticSample
+	for i, track := range t.tracks {
+		local, err := webrtc.NewTrackLocalStaticSample(track.codec, fmt.Sprintf("loadtest-%d", i), "loadtest")
+		if err != nil {
+			return err
+		}
+		sender, err := pc.AddTrack(local)
+		if err != nil {
+			return err
+		}
+		go t.readReports(sender)
+		locals = append(locals, local)
+	}
+
+	start := time.Now()
+	location, err := t.signal(pc)
+	if err != nil {
+		return err
+	}
+	defer t.hangUp(location)
+
+	select {
+	case <-connected:
+	case <-time.After(15 * time.Second):
+		return errors.New("timed out connecting")
+	case <-stop:
+		return errors.New("stopped before connecting")
+	}
+	t.connected.Add(1)
+	t.mu.Lock()
+	t.connectTime = append(t.connectTime, time.Since(start))
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i, track := range t.tracks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendLooped(locals[i], track.samples, stop)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// Send the samples over and over at their pace until stopped
+func sendLooped(local *webrtc.TrackLocalStaticSample, samples []media.Sample, stop <-chan struct{}) {
+	next := time.Now()
+	for i := 0; ; i = (i + 1) % len(samples) {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		if err := local.WriteSample(samples[i]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			fmt.Println("Error sending sample:", err)
+		}
+		next = next.Add(samples[i].Duration)
+	}
+}
+
+// POST the offer to the WHIP endpoint, returning the session resource
+func (t *loadTest) signal(pc *webrtc.PeerConnection) (string, error) {
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return "", err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		return "", err
+	}
+	<-gatherComplete
+
+	req, err := http.NewRequest(http.MethodPost, t.server+"/whip", strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("WHIP answered %s: %s", resp.Status, strings.TrimSpace(string(answer)))
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		return "", err
+	}
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	return location.String(), nil
+}
+
+// End the session of a publisher
+func (t *loadTest) hangUp(location string) {
+	req, err := http.NewRequest(http.MethodDelete, location, nil)
+	if err != nil {
+		return
+	}
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Keep the Receiver Reports the server sends about a publisher's track
+func (t *loadTest) readReports(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			rr, ok := packet.(*rtcp.ReceiverReport)
+			if !ok {
+				continue
+			}
+			t.mu.Lock()
+			for _, block := range rr.Reports {
+				if loss := t.loss[block.SSRC]; loss != nil {
+					loss.lastLost, loss.lastSeq = block.TotalLost, block.LastSequenceNumber
+				} else {
+					t.loss[block.SSRC] = &lossReport{block.TotalLost, block.TotalLost, block.LastSequenceNumber, block.LastSequenceNumber}
+				}
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *loadTest) report(publishers int, latency map[string]float64, latencyErr error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Printf("Sessions: %d of %d connected, %d failed\n", t.connected.Load(), publishers, t.failed.Load())
+	if len(t.connectTime) > 0 {
+		sort.Slice(t.connectTime, func(i, j int) bool { return t.connectTime[i] < t.connectTime[j] })
+		fmt.Printf("Connect time: median %v, max %v\n", t.connectTime[len(t.connectTime)/2].Round(time.Millisecond), t.connectTime[len(t.connectTime)-1].Round(time.Millisecond))
+	}
+
+	var lost, expected int64
+	for _, loss := range t.loss {
+		lost += int64(loss.lastLost) - int64(loss.firstLost)
+		expected += int64(loss.lastSeq) - int64(loss.firstSeq)
+	}
+	if expected > 0 {
+		fmt.Printf("Packet loss: %.2f%% (%d of %d packets, from the server's receiver reports)\n", float64(lost)*100/float64(expected), lost, expected)
+	} else {
+		fmt.Println("Packet loss: no receiver reports received")
+	}
+
+	if latencyErr != nil {
+		fmt.Println("Pipeline latency: unavailable,", latencyErr)
+		return
+	}
+	fmt.Printf("Pipeline latency: p50 %s, p95 %s, p99 %s\n", formatBound(latency["0.5"]), formatBound(latency["0.95"]), formatBound(latency["0.99"]))
+}
+
+func formatBound(seconds float64) string {
+	if math.IsInf(seconds, 1) {
+		return "above the largest bucket"
+	}
+	return fmt.Sprintf("<= %v", time.Duration(seconds*float64(time.Second)))
+}
+
+// Quantiles of the server's audio pipeline latency, as the upper bound of
+// the histogram bucket they fall into
+func pipelineLatency(server, token string) (map[string]float64, error) {
+	req, err := http.NewRequest(http.MethodGet, server+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/metrics answered %s", resp.Status)
+	}
+
+	type bucket struct {
+		bound float64
+		count float64
+	}
+	var buckets []bucket
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		rest, ok := strings.CutPrefix(scanner.Text(), pipelineLatencyMetric)
+		if !ok {
+			continue
+		}
+		bound, count, _ := strings.Cut(rest, `"} `)
+		b := bucket{bound: math.Inf(1)}
+		if bound != "+Inf" {
+			if b.bound, err = strconv.ParseFloat(bound, 64); err != nil {
+				return nil, err
+			}
+		}
+		if b.count, err = strconv.ParseFloat(count, 64); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	if len(buckets) == 0 || buckets[len(buckets)-1].count == 0 {
+		return nil, errors.New("no audio pipeline writes observed")
+	}
+
+	total := buckets[len(buckets)-1].count
+	quantiles := map[string]float64{}
+	for _, q := range []string{"0.5", "0.95", "0.99"} {
+		want, _ := strconv.ParseFloat(q, 64)
+		for _, b := range buckets {
+			if b.count >= want*total {
+				quantiles[q] = b.bound
+				break
+			}
+		}
+	}
+	return quantiles, nil
+}
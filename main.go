@@ -5,416 +5,244 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/pion/interceptor"
-	"github.com/pion/interceptor/pkg/intervalpli"
 	"github.com/pion/webrtc/v4"
+	"github.com/sujiththirumalaisamy/test/pkg/ingest"
 )
 
-type streamHandler struct {
-	rtpChan        chan []byte
-	processedChan  chan []byte
-	done           chan struct{}
-	ffmpegStdin    io.WriteCloser
-	workerCount    int
-	metricsEnabled bool
-}
-
-func newStreamHandler(workers int) *streamHandler {
-	return &streamHandler{
-		rtpChan:        make(chan []byte, 100), // Smaller buffer to reduce latency
-		processedChan:  make(chan []byte, 100), // Processed packets ready for FFmpeg
-		done:           make(chan struct{}),
-		workerCount:    workers,
-		metricsEnabled: true,
+func main() {
+	// "replay [flags] dump.pcap..." publishes RTP dumps instead of a pasted offer
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		loadtest()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		doctor()
+		return
 	}
-}
-
-func (h *streamHandler) processRTPPackets(track *webrtc.TrackRemote) {
-	defer close(h.processedChan)
-
-	packetCounter := uint64(0)
-	lastMetricTime := time.Now()
-
-	workers := make(chan struct{}, h.workerCount)
 
-	for {
-		select {
-		case <-h.done:
-			return
-		default:
-			rtpPacket, _, err := track.ReadRTP()
+	cfg := parseConfig()
+	server, err := ingest.NewServer(cfg)
+	if err != nil {
+		fail(ingest.WithKind(ingest.ErrorConfig, err))
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			fmt.Println("HTTP server stopped:", err)
+		}
+	}()
+	go func() {
+		if err := server.ListenSignalSocket(); err != nil {
+			fmt.Println("Signaling socket stopped:", err)
+		}
+	}()
+	go func() {
+		if err := server.ListenGRPC(); err != nil {
+			fmt.Println("gRPC control plane stopped:", err)
+		}
+	}()
+
+	// SIGTERM drains the node before exiting, for rolling restarts
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM)
+	go func() {
+		<-terminate
+		server.Drain()
+	}()
+	go func() {
+		<-server.Drained()
+		os.Exit(0)
+	}()
+
+	// SIGHUP, or a change of the config file, reloads the settings that are
+	// safe to change without ending live sessions
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go watchConfigFile(hangup)
+	go func() {
+		for range hangup {
+			cfg, err := reloadConfig()
+			if err == nil {
+				err = server.Reload(cfg)
+			}
 			if err != nil {
-				fmt.Println("Error reading RTP:", err)
-				return
+				fmt.Println("Error reloading configuration:", err)
 			}
+		}
+	}()
 
+	// Cameras are pulled and plain RTP publishers bridged in until the server
+	// was drained, there is no offer to wait for
+	if cfg.RTSPURLs != "" || cfg.RTPListen != "" {
+		server.PullRTSP()
+		if err := server.ListenRTP(); err != nil {
 			select {
-			case workers <- struct{}{}: // Acquire worker
-				go func(packet []byte) {
-					defer func() { <-workers }() // Release worker
-
-					// Process packet in parallel
-					payload := make([]byte, len(packet))
-					copy(payload, packet)
-
-					select {
-					case h.processedChan <- payload:
-						if h.metricsEnabled {
-							packetCounter++
-							if time.Since(lastMetricTime) >= time.Second {
-								fmt.Printf("Processed %d packets/sec\n", packetCounter)
-								packetCounter = 0
-								lastMetricTime = time.Now()
-							}
-						}
-					default:
-						if h.metricsEnabled {
-							fmt.Println("Packet dropped: buffer full")
-						}
-					}
-				}(rtpPacket.Payload)
+			case <-server.Drained():
 			default:
-				if h.metricsEnabled {
-					fmt.Println("Worker pool full, dropping packet")
-				}
+				fail(ingest.WithKind(ingest.ErrorConfig, err))
 			}
 		}
+		select {} // Exits once drained
 	}
-}
-
-func (h *streamHandler) writeToFFmpeg() {
-	const batchSize = 5 // Process packets in small batches for efficiency
-	batch := make([][]byte, 0, batchSize)
 
-	flushBatch := func() {
-		if len(batch) == 0 {
-			return
-		}
-
-		for _, payload := range batch {
-			if _, err := h.ffmpegStdin.Write(payload); err != nil {
-				fmt.Println("Error writing to FFmpeg:", err)
-				return
-			}
-		}
-		batch = batch[:0]
+	// Wait for the offer to be pasted, carrying the publish token in a
+	// "token" field when -publish-key is set
+	offer := signalingOffer{}
+	in, err := readUntilNewline()
+	if err == nil {
+		err = decode(in, &offer)
 	}
-
-	ticker := time.NewTicker(5 * time.Millisecond)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case payload, ok := <-h.processedChan:
-			if !ok {
-				flushBatch()
-				return
-			}
-
-			batch = append(batch, payload)
-			if len(batch) >= batchSize {
-				flushBatch()
-			}
-
-		case <-ticker.C:
-			flushBatch()
-		}
+	if err != nil {
+		fail(err)
 	}
-}
 
-func (h *streamHandler) startFFmpeg() error {
-	cmd := exec.Command(
-		"ffmpeg",
-		"-fflags", "+nobuffer+fastseek+flush_packets+discardcorrupt",
-		"-flags", "low_delay",
-		"-f", "opus",
-		"-i", "pipe:0",
-		"-c:a", "copy",
-		"-f", "segment",
-		"-segment_time", "0.025",
-		"-segment_format", "ogg",
-		"-segment_list_flags", "+live",
-		"-segment_list_size", "2",
-		"-segment_list", "stream.m3u8",
-		"-segment_format_options", "flush_packets=1",
-		"-max_delay", "0",
-		"-avoid_negative_ts", "make_zero",
-		"-segment_list_type", "m3u8",
-		"-thread_queue_size", "512",
-		"-segment_filename", "stream_%d.ogg",
-	)
+	session, err := server.Publish(offer.Token)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println("Session", session.ID())
 
-	var err error
-	h.ffmpegStdin, err = cmd.StdinPipe()
+	answer, err := session.Answer(offer.SessionDescription)
 	if err != nil {
-		return fmt.Errorf("failed to create stdin pipe: %v", err)
+		session.Close() //nolint:errcheck
+		fail(err)
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// Output the answer in base64 so we can paste it in browser
+	encoded, err := encode(answer)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(encoded)
 
-	return cmd.Start()
+	// Block until the publisher left and the media files were finalized
+	session.Wait()
+	fmt.Println("Done writing media files")
 }
 
-func saveToDisk(writer io.Writer, track *webrtc.TrackRemote) {
-	for {
-		rtpPacket, _, err := track.ReadRTP()
+// Signal a reload whenever the config file's modification time changes
+func watchConfigFile(reload chan<- os.Signal) {
+	if configFile == "" {
+		return
+	}
+	modified := func() time.Time {
+		info, err := os.Stat(configFile)
 		if err != nil {
-			fmt.Println("Error reading RTP:", err)
-			return
+			return time.Time{}
 		}
+		return info.ModTime()
+	}
 
-		if _, err := writer.Write(rtpPacket.Payload); err != nil {
-			fmt.Println("Error writing payload:", err)
-			return
+	last := modified()
+	for range time.Tick(2 * time.Second) {
+		if current := modified(); !current.Equal(last) {
+			last = current
+			reload <- syscall.SIGHUP
 		}
 	}
 }
 
-// nolint:gocognit
-func main() {
-	// Everything below is the Pion WebRTC API! Thanks for using it .
-
-	// Create a MediaEngine object to configure the supported codec
-	m := &webrtc.MediaEngine{}
-
-	// Setup the codecs you want to use.
-	// We'll use a VP8 and Opus but you can also define your own
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
-		PayloadType:        96,
-	}, webrtc.RTPCodecTypeVideo); err != nil {
-		panic(err)
-	}
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
-		PayloadType:        111,
-	}, webrtc.RTPCodecTypeAudio); err != nil {
-		panic(err)
-	}
-
-	// Create a InterceptorRegistry. This is the user configurable RTP/RTCP Pipeline.
-	// This provides NACKs, RTCP Reports and other features. If you use `webrtc.NewPeerConnection`
-	// this is enabled by default. If you are manually managing You MUST create a InterceptorRegistry
-	// for each PeerConnection.
-	i := &interceptor.Registry{}
-
-	// Register a intervalpli factory
-	// This interceptor sends a PLI every 3 seconds. A PLI causes a video keyframe to be generated by the sender.
-	// This makes our video seekable and more error resilent, but at a cost of lower picture quality and higher bitrates
-	// A real world application should process incoming RTCP packets from viewers and forward them to senders
-	intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
-	if err != nil {
-		panic(err)
-	}
-	i.Add(intervalPliFactory)
-
-	// Use the default set of Interceptors
-	if err = webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		panic(err)
-	}
-
-	// Create the API object with the MediaEngine
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
-
-	// Prepare the configuration
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-
-	// Create a new RTCPeerConnection
-	peerConnection, err := api.NewPeerConnection(config)
+// Run dumps written with -rtp-dump-dir through a new session
+func replay() {
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	server, err := ingest.NewServer(parseConfig())
 	if err != nil {
-		panic(err)
+		fail(ingest.WithKind(ingest.ErrorConfig, err))
 	}
 
-	// Allow us to receive 1 audio track, and 1 video track
-	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
-		panic(err)
-	} else if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
-		panic(err)
+	if err := server.Replay(flag.Args()...); err != nil {
+		fail(err)
 	}
+	fmt.Println("Done writing media files")
+}
 
-	// Set a handler for when a new remote track starts
-	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		codec := track.Codec()
-		if strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
-			fmt.Println("Got Opus track, starting ultra-low-latency stream")
-
-			handler := newStreamHandler(4) // Use 4 workers for parallel processing
-
-			if err := handler.startFFmpeg(); err != nil {
-				fmt.Println("Failed to start FFmpeg:", err)
-				return
-			}
-
-			// Start parallel processing pipeline
-			go handler.processRTPPackets(track)
-			go handler.writeToFFmpeg()
-
-			// Create a done channel for cleanup
-			done := make(chan struct{})
-			go func() {
-				<-done
-				close(handler.done)
-				handler.ffmpegStdin.Close()
-			}()
-
-			// Wait for peer connection to close
-			peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-				if s == webrtc.PeerConnectionStateClosed {
-					close(done)
-				}
-			})
-		} else if strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) {
-			fmt.Println("Got VP8 track, streaming directly to FFmpeg")
-
-			cmd := exec.Command(
-				"ffmpeg",
-				"-f", "rawvideo",
-				"-pix_fmt", "yuv420p",
-				"-s", "640x480",
-				"-r", "30",
-				"-i", "pipe:0",
-				"-c:v", "libx264",
-				"-preset", "veryfast",
-				"-tune", "zerolatency",
-				"-f", "segment",
-				"-segment_time", "0.05",
-				"-segment_format", "mp4",
-				"-segment_list_flags", "+live",
-				"-segment_list_size", "2",
-				"-segment_list", "stream.m3u8",
-				"-segment_format_options", "movflags=+frag_keyframe+empty_moov",
-				"-max_delay", "0",
-				"-avoid_negative_ts", "make_zero",
-				"-segment_list_type", "m3u8",
-				"-segment_filename", "stream_%d.mp4",
-			)
-
-			ffmpegStdin, err := cmd.StdinPipe()
-			if err != nil {
-				fmt.Println("Failed to create stdin pipe:", err)
-				return
-			}
-
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-
-			if err := cmd.Start(); err != nil {
-				fmt.Println("Failed to start FFmpeg:", err)
-				return
-			}
-
-			saveToDisk(ffmpegStdin, track)
-		}
-	})
-
-	// Set the handler for ICE connection state
-	// This will notify you when the peer has connected/disconnected
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("Connection State has changed %s \n", connectionState.String())
-
-		if connectionState == webrtc.ICEConnectionStateConnected {
-			fmt.Println("Ctrl+C the remote client to stop the demo")
-		} else if connectionState == webrtc.ICEConnectionStateFailed || connectionState == webrtc.ICEConnectionStateClosed {
-			fmt.Println("Done writing media files")
-
-			// Gracefully shutdown the peer connection
-			if closeErr := peerConnection.Close(); closeErr != nil {
-				panic(closeErr)
-			}
-
-			os.Exit(0)
+// "doctor [flags]" checks the host with the same flags as the server and
+// prints a readiness report, exiting with 1 if sessions would fail
+func doctor() {
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	checks := ingest.Preflight(parseConfig())
+
+	ready := true
+	for _, check := range checks {
+		fmt.Printf("%-4s  %s", check.Status, check.Name)
+		if check.Detail != "" {
+			fmt.Printf(": %s", check.Detail)
 		}
-	})
-
-	// Wait for the offer to be pasted
-	offer := webrtc.SessionDescription{}
-	decode(readUntilNewline(), &offer)
-
-	// Set the remote SessionDescription
-	err = peerConnection.SetRemoteDescription(offer)
-	if err != nil {
-		panic(err)
+		fmt.Println()
+		ready = ready && check.Status != ingest.PreflightFail
 	}
 
-	// Create answer
-	answer, err := peerConnection.CreateAnswer(nil)
-	if err != nil {
-		panic(err)
+	if !ready {
+		fmt.Println("Not ready")
+		os.Exit(1)
 	}
+	fmt.Println("Ready")
+}
 
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-
-	// Sets the LocalDescription, and starts our UDP listeners
-	err = peerConnection.SetLocalDescription(answer)
-	if err != nil {
-		panic(err)
-	}
-
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
-
-	// Output the answer in base64 so we can paste it in browser
-	fmt.Println(encode(peerConnection.LocalDescription()))
+// Offer pasted by the publisher
+type signalingOffer struct {
+	webrtc.SessionDescription
+	Token string `json:"token,omitempty"`
+}
 
-	// Block forever
-	select {}
+// Exit on an error with the code of its kind, see ingest.ExitCode
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(ingest.ExitCode(err))
 }
 
 // Read from stdin until we get a newline
-func readUntilNewline() (in string) {
-	var err error
-
+func readUntilNewline() (in string, err error) {
 	r := bufio.NewReader(os.Stdin)
 	for {
 		in, err = r.ReadString('\n')
 		if err != nil && !errors.Is(err, io.EOF) {
-			panic(err)
+			return "", ingest.WithKind(ingest.ErrorSignaling, err)
 		}
 
 		if in = strings.TrimSpace(in); len(in) > 0 {
 			break
 		}
+		if err != nil {
+			return "", ingest.WithKind(ingest.ErrorSignaling, errors.New("no offer before the end of stdin"))
+		}
 	}
 
 	fmt.Println("")
-	return
+	return in, nil
 }
 
 // JSON encode + base64 a SessionDescription
-func encode(obj *webrtc.SessionDescription) string {
+func encode(obj *webrtc.SessionDescription) (string, error) {
 	b, err := json.Marshal(obj)
 	if err != nil {
-		panic(err)
+		return "", ingest.WithKind(ingest.ErrorSignaling, err)
 	}
 
-	return base64.StdEncoding.EncodeToString(b)
+	return base64.StdEncoding.EncodeToString(b), nil
 }
 
-// Decode a base64 and unmarshal JSON into a SessionDescription
-func decode(in string, obj *webrtc.SessionDescription) {
+// Decode a base64 and unmarshal JSON into a signaling message
+func decode(in string, obj any) error {
 	b, err := base64.StdEncoding.DecodeString(in)
 	if err != nil {
-		panic(err)
+		return ingest.WithKind(ingest.ErrorSignaling, fmt.Errorf("offer isn't base64: %v", err))
 	}
 
 	if err = json.Unmarshal(b, obj); err != nil {
-		panic(err)
+		return ingest.WithKind(ingest.ErrorSignaling, fmt.Errorf("offer isn't JSON: %v", err))
 	}
-}
\ No newline at end of file
+	return nil
+}
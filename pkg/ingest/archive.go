@@ -0,0 +1,125 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// outputPath holds the fields -output-template is executed with
+type outputPath struct {
+	SessionID string
+	Tenant    string
+	Publisher string // Slug of the publisher's user ID
+	TrackKind string // "audio" or "video"
+	Rendition string
+	Timestamp string // Start of the session, e.g. "20261016T150405Z"
+	Ext       string // Of the recording, e.g. ".webm"
+}
+
+// Parse -output-template, nil without one. Paths must stay below the working
+// directory.
+func parseOutputTemplate(spec string) (*template.Template, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %v", err)
+	}
+	sample := outputPath{SessionID: "id", TrackKind: "audio", Rendition: "audio", Timestamp: "20060102T150405Z", Ext: ".webm"}
+	if _, err = executeOutputTemplate(tmpl, sample); err != nil {
+		return nil, fmt.Errorf("invalid output template: %v", err)
+	}
+	return tmpl, nil
+}
+
+func executeOutputTemplate(tmpl *template.Template, fields outputPath) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		return "", err
+	}
+
+	path := filepath.Clean(b.String())
+	if filepath.IsAbs(path) || path == "." || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("output path %q leaves the working directory", b.String())
+	}
+	if filepath.Ext(path) != fields.Ext {
+		path += fields.Ext
+	}
+	return path, nil
+}
+
+// Link the session's finalized recordings into the paths of -output-template,
+// returning the paths. The recordings stay where the API serves them from,
+// the links share their data. A path already taken gets a numbered suffix,
+// so sessions never overwrite each other's outputs.
+func (s *Session) archiveRecordings(tracks []*Track) []string {
+	tmpl := s.server.archiveTemplate()
+	if tmpl == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	fields := outputPath{SessionID: s.id, Tenant: s.tenant, Timestamp: s.started.UTC().Format("20060102T150405Z")}
+	if s.verified {
+		fields.Publisher = userSlug(s.publisher)
+	}
+	s.mu.Unlock()
+
+	var archived []string
+	for _, t := range tracks {
+		for _, name := range []string{recordingName(s.id, t.rendition()), ivfName(s.id, t.rendition()), oggName(s.id, t.rendition())} {
+			if !fileExists(name) {
+				continue
+			}
+
+			fields.TrackKind, fields.Rendition, fields.Ext = t.Kind, t.rendition(), filepath.Ext(name)
+			path, err := executeOutputTemplate(tmpl, fields)
+			if err == nil {
+				path, err = linkUnique(name, path)
+			}
+			if err != nil {
+				fmt.Printf("Error archiving %s: %v\n", name, err)
+				continue
+			}
+			archived = append(archived, path)
+		}
+	}
+	return archived
+}
+
+// Hard link a file to a path, or the first free one numbered after it
+func linkUnique(name, path string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; i < 1000; i++ {
+		candidate := path
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		err := os.Link(name, candidate)
+		if !errors.Is(err, os.ErrExist) {
+			return candidate, err
+		}
+	}
+	return "", fmt.Errorf("no free path like %s", path)
+}
+
+// Remove the directories archiving left empty above a path, up to the
+// working directory
+func removeEmptyParents(path string) {
+	for dir := filepath.Dir(path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ingest
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Outputs whose audio can be filtered
+var audioFilterProfiles = []string{"audio", "mix"}
+
+// FFmpeg filters of the names -audio-filters takes, with the default of
+// their optional parameter
+var audioFilters = map[string]struct {
+	filter string  // Format of the filter, given the parameter
+	param  float64 // Default integrated loudness in LUFS, cutoff in Hz or ratio
+}{
+	"loudnorm":   {"loudnorm=I=%g:TP=-1.5:LRA=11", -16},
+	"highpass":   {"highpass=f=%g", 80},
+	"compressor": {"acompressor=threshold=-18dB:ratio=%g:attack=5:release=50", 3},
+}
+
+// Parse an audio filter table like "audio=highpass+loudnorm,mix=loudnorm:-23"
+// to FFmpeg filter chains by output. Filters run in the order given, each
+// optionally with a parameter after a colon.
+func parseAudioFilters(spec string) (map[string]string, error) {
+	chains := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		profile, names, _ := strings.Cut(entry, "=")
+		profile = strings.TrimSpace(profile)
+		if !slices.Contains(audioFilterProfiles, profile) {
+			return nil, fmt.Errorf("unknown audio filter output %q", profile)
+		}
+
+		var chain []string
+		loudnorm := false
+		for _, name := range strings.Split(names, "+") {
+			name, param, hasParam := strings.Cut(strings.ToLower(strings.TrimSpace(name)), ":")
+			filter, ok := audioFilters[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown audio filter %q", name)
+			}
+			value := filter.param
+			if hasParam {
+				var err error
+				if value, err = strconv.ParseFloat(param, 64); err != nil {
+					return nil, fmt.Errorf("invalid parameter of audio filter %q: %v", name, err)
+				}
+			}
+			chain = append(chain, fmt.Sprintf(filter.filter, value))
+			loudnorm = loudnorm || name == "loudnorm"
+		}
+		if loudnorm {
+			// loudnorm outputs 192kHz in its single pass mode
+			chain = append(chain, "aresample=48000")
+		}
+		chains[profile] = strings.Join(chain, ",")
+	}
+
+	return chains, nil
+}
+
+// Filter the audio of an FFmpeg output through a chain, which needs the copied
+// audio re-encoded
+func withAudioFilter(args []string, chain string) []string {
+	if chain == "" {
+		return args
+	}
+
+	out := make([]string, 0, len(args)+2)
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-c:a" && i+1 < len(args) {
+			encoder := args[i+1]
+			if encoder == "copy" {
+				encoder = "libopus"
+			}
+			out = append(out, "-af", chain, "-c:a", encoder)
+			i++
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
@@ -0,0 +1,48 @@
+package ingest
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Default name and label of the session's next audio track, and whether it
+// is the primary one. The first keeps the audio outputs, the others are
+// recorded as audio2, audio3 and so on.
+func (s *Session) nextAudio() (string, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audioTracks++
+	if s.audioTracks == 1 {
+		return "audio", "Audio 1", true
+	}
+	return fmt.Sprintf("audio%d", s.audioTracks), fmt.Sprintf("Audio %d", s.audioTracks), false
+}
+
+// List the session's audio tracks opened so far as the renditions of an HLS
+// audio group in audio.m3u8, so players can switch between them
+func (s *Session) writeAudioGroup() {
+	s.mu.Lock()
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if s.publisherName != "" {
+		fmt.Fprintf(&b, "#EXT-X-SESSION-DATA:DATA-ID=\"com.apple.hls.title\",VALUE=\"%s\"\n", strings.ReplaceAll(s.publisherName, `"`, "'"))
+	}
+	for _, t := range s.opened {
+		if t.Kind != "audio" {
+			continue
+		}
+		isDefault := "NO"
+		if t.primary {
+			isDefault = "YES"
+		}
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=%q,DEFAULT=%s,AUTOSELECT=YES,URI=\"%s.m3u8\"\n", t.Label, isDefault, t.hlsName())
+	}
+	s.mu.Unlock()
+
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS=\"opus\",AUDIO=\"audio\"\n%s.m3u8\n", s.id)
+	if err := writeFileAtomic(filepath.Join(s.dir, "audio.m3u8"), []byte(b.String())); err != nil {
+		fmt.Println("Error writing audio group playlist:", err)
+	}
+}
@@ -0,0 +1,210 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint scopes a credential can be granted
+const (
+	scopeSignal   = "signal"
+	scopeAdmin    = "admin"
+	scopePlayback = "playback"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// authProvider decides whether a request may use endpoints of a scope,
+// returning the identity it authenticated as
+type authProvider interface {
+	Authorize(r *http.Request, scope string) (identity string, err error)
+}
+
+func newAuthProvider(cfg *Config) (authProvider, error) {
+	switch cfg.Auth {
+	case "", "none":
+		return nil, nil
+	case "static":
+		return newStaticTokenAuth(cfg.AuthTokensFile)
+	case "jwt":
+		if cfg.AuthJWKSURL == "" {
+			return nil, errors.New("jwt auth requires -auth-jwks-url")
+		}
+		return &jwtAuth{keys: newJWKS(cfg.AuthJWKSURL), issuer: cfg.AuthIssuer}, nil
+	case "introspection":
+		if cfg.AuthURL == "" {
+			return nil, errors.New("introspection auth requires -auth-url")
+		}
+		return &introspectionAuth{
+			url:          cfg.AuthURL,
+			clientID:     cfg.AuthClientID,
+			clientSecret: cfg.AuthClientSecret,
+			client:       &http.Client{Timeout: 5 * time.Second},
+		}, nil
+	case "http":
+		if cfg.AuthURL == "" {
+			return nil, errors.New("http auth requires -auth-url")
+		}
+		return &httpAuthorizer{url: cfg.AuthURL, client: &http.Client{Timeout: 5 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth provider %q", cfg.Auth)
+	}
+}
+
+// Bearer token of a request, taken from the Authorization header or, for
+// players that can't set headers, the token query parameter
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+
+	return r.URL.Query().Get("token")
+}
+
+// staticTokenAuth checks tokens against a file of "<token> <scope>,<scope>" lines
+type staticTokenAuth struct {
+	mu     sync.RWMutex
+	tokens map[string][]string
+}
+
+func newStaticTokenAuth(path string) (*staticTokenAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tokens file: %v", err)
+	}
+	defer f.Close()
+
+	a := &staticTokenAuth{tokens: map[string][]string{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		a.tokens[fields[0]] = strings.Split(fields[1], ",")
+	}
+
+	return a, scanner.Err()
+}
+
+func (a *staticTokenAuth) Authorize(r *http.Request, scope string) (string, error) {
+	token := requestToken(r)
+	a.mu.RLock()
+	scopes := a.tokens[token]
+	a.mu.RUnlock()
+	for _, s := range scopes {
+		if s == scope {
+			// Never echo the full secret into logs
+			return "token:" + token[:min(4, len(token))] + "…", nil
+		}
+	}
+
+	return "", errUnauthorized
+}
+
+// jwtAuth accepts JWTs signed by a key of a JWKS endpoint and carrying the
+// scope in their "scope" claim
+type jwtAuth struct {
+	keys   *jwks
+	issuer string
+}
+
+func (a *jwtAuth) Authorize(r *http.Request, scope string) (string, error) {
+	claims, err := parseJWT(requestToken(r), a.keys.key, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if a.issuer != "" && claims.str("iss") != a.issuer {
+		return "", errUnauthorized
+	}
+	if !claims.hasScope(scope) {
+		return "", errUnauthorized
+	}
+
+	return claims.str("sub"), nil
+}
+
+// introspectionAuth validates opaque tokens with an OAuth 2.0 token
+// introspection endpoint (RFC 7662)
+type introspectionAuth struct {
+	url          string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+}
+
+func (a *introspectionAuth) Authorize(r *http.Request, scope string) (string, error) {
+	token := requestToken(r)
+	if token == "" {
+		return "", errUnauthorized
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.url, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(a.clientID, a.clientSecret)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("introspection failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		Active bool   `json:"active"`
+		Scope  string `json:"scope"`
+		Sub    string `json:"sub"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid introspection response: %v", err)
+	}
+	if !result.Active || !(jwtClaims{"scope": result.Scope}).hasScope(scope) {
+		return "", errUnauthorized
+	}
+
+	return result.Sub, nil
+}
+
+// httpAuthorizer delegates the decision to an external service, which gets
+// the credentials of the original request and answers 2xx to allow it
+type httpAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+func (a *httpAuthorizer) Authorize(r *http.Request, scope string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, a.url, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, h := range []string{"Authorization", "Cookie"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Header.Set("X-Original-URI", r.URL.RequestURI())
+	req.Header.Set("X-Original-Method", r.Method)
+	req.Header.Set("X-Auth-Scope", scope)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("authorizer failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", errUnauthorized
+	}
+
+	return resp.Header.Get("X-Auth-User"), nil
+}
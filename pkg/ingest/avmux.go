@@ -0,0 +1,163 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// How long the mux waits for a session's other primary track before it
+// starts with the one it has
+const avMuxWait = 3 * time.Second
+
+// avMux feeds the primary audio and camera tracks of each session to a
+// single FFmpeg over input pipes, for outputs taking one stream with both,
+// like an RTMP URL without {kind}. Media before FFmpeg opened a track's pipe
+// is dropped.
+type avMux struct {
+	output func(session string) []string
+
+	mu       sync.Mutex
+	sessions map[string]*avMuxSession
+}
+
+// The mux of one session
+type avMuxSession struct {
+	inputs  map[string]*inputPipe // By kind
+	tracks  map[string]*Track
+	first   *Track
+	timer   *time.Timer
+	started bool
+	process *ffmpegProcess
+	open    int // Inputs whose tracks didn't end yet
+}
+
+func newAVMux(output func(session string) []string) *avMux {
+	return &avMux{output: output, sessions: map[string]*avMuxSession{}}
+}
+
+func (m *avMux) Open(t *Track) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := m.sessions[t.Session]
+	if !t.primary || (session != nil && (session.started || session.inputs[t.Kind] != nil)) {
+		fmt.Printf("Not muxing %s of session %s, only its first audio track and camera are\n", t.rendition(), t.Session)
+		return nopWriteCloser{io.Discard}, nil
+	}
+
+	input, err := newInputPipe(t.Dir, "mux_"+t.Kind)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		session = &avMuxSession{inputs: map[string]*inputPipe{}, tracks: map[string]*Track{}, first: t}
+		m.sessions[t.Session] = session
+		session.timer = time.AfterFunc(avMuxWait, func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.start(t.Session, session)
+		})
+	}
+	session.inputs[t.Kind] = input
+	session.tracks[t.Kind] = t
+	session.open++
+
+	if len(session.inputs) == 2 {
+		session.timer.Stop()
+		m.start(t.Session, session)
+	}
+	return &avMuxInput{inputPipe: input, mux: m, session: t.Session}, nil
+}
+
+// Start the session's FFmpeg with the inputs it has, audio first
+func (m *avMux) start(id string, session *avMuxSession) {
+	if session.started || session.open == 0 {
+		return
+	}
+	session.started = true
+
+	var args, maps []string
+	for _, kind := range []string{"audio", "video"} {
+		input := session.inputs[kind]
+		if input == nil {
+			continue
+		}
+		args = append(append(args, session.tracks[kind].InputArgs...), "-i", input.path())
+		maps = append(maps, "-map", fmt.Sprintf("%d:%c", len(maps)/2, kind[0]))
+	}
+	args = append(append(args, maps...), m.output(id)...)
+
+	process, err := startFFmpegProcess(args)
+	if err != nil {
+		fmt.Println("Error starting FFmpeg muxing session", id+":", err)
+		m.removeInputs(session)
+		return
+	}
+	session.process = process
+	session.first.processes.add(process)
+	for _, input := range session.inputs {
+		go input.connect()
+	}
+	go watchFFmpeg(process, session.first.control, session.first.Done, session.first.crashed)
+	go func() {
+		process.wait() //nolint:errcheck
+		m.removeInputs(session)
+	}()
+}
+
+func (m *avMux) removeInputs(session *avMuxSession) {
+	for _, input := range session.inputs {
+		input.remove()
+	}
+}
+
+// closed ends a session's input, the last one waits for FFmpeg to finish
+// its output
+func (m *avMux) closed(id string) {
+	m.mu.Lock()
+	session := m.sessions[id]
+	session.open--
+	last := session.open == 0
+	if last {
+		session.timer.Stop()
+		delete(m.sessions, id)
+	}
+	m.mu.Unlock()
+
+	if !last {
+		return
+	}
+	if session.process == nil {
+		m.removeInputs(session)
+		return
+	}
+	session.process.stdin.Close()
+	session.process.wait() //nolint:errcheck
+}
+
+// avMuxInput is the writer of a track fed to the mux
+type avMuxInput struct {
+	*inputPipe
+	mux     *avMux
+	session string
+	once    sync.Once
+}
+
+func (i *avMuxInput) Close() error {
+	err := i.inputPipe.Close()
+	i.once.Do(func() { i.mux.closed(i.session) })
+	return err
+}
+
+// Outputs of the mux pushing a session to an RTMP URL
+func rtmpMuxOutput(url string) func(session string) []string {
+	return func(string) []string {
+		return []string{
+			"-c:a", "aac", "-ar", "44100",
+			"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+			"-f", "flv", url,
+		}
+	}
+}
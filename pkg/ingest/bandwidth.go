@@ -0,0 +1,47 @@
+package ingest
+
+import (
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// SetBandwidth caps the bitrate the publisher is asked to send, in bits per
+// second per track kind, 0 leaving a kind uncapped. It must be called before
+// Answer, and overrides -audio-bandwidth and -video-bandwidth.
+func (s *Session) SetBandwidth(audio, video int) {
+	s.bandwidth = map[string]int{"audio": audio, "video": video}
+}
+
+// Add b=AS and b=TIAS lines with the session's caps to an answer, so
+// browsers constrain their encoders from the first frame instead of waiting
+// for congestion control feedback
+func limitBandwidth(answer *webrtc.SessionDescription, caps map[string]int) (*webrtc.SessionDescription, error) {
+	if caps["audio"] <= 0 && caps["video"] <= 0 {
+		return answer, nil
+	}
+
+	parsed, err := answer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		limit := caps[media.MediaName.Media]
+		if limit <= 0 {
+			continue
+		}
+
+		// AS is in kbps (Chrome), TIAS in bps without overhead (Firefox)
+		media.Bandwidth = append(media.Bandwidth,
+			sdp.Bandwidth{Type: "AS", Bandwidth: uint64((limit + 999) / 1000)},
+			sdp.Bandwidth{Type: "TIAS", Bandwidth: uint64(limit)},
+		)
+	}
+
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return &webrtc.SessionDescription{Type: answer.Type, SDP: string(raw)}, nil
+}
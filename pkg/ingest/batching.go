@@ -0,0 +1,73 @@
+package ingest
+
+import "time"
+
+// Bounds of adaptive audio batching
+const (
+	maxAdaptiveBatch = 64
+	minAdaptiveFlush = time.Millisecond
+	adaptiveWindow   = 250 * time.Millisecond
+)
+
+// adaptiveBatcher tunes the audio batch size and flush interval so payloads
+// reach FFmpeg within a latency budget. Batches shrink while the slowest
+// payload of a window is over budget, and only grow again when the writer is
+// CPU-bound, busy writing for most of the window, where fewer larger writes
+// are what lets it keep up at all.
+type adaptiveBatcher struct {
+	target time.Duration
+	size   int
+	flush  time.Duration
+
+	windowStart time.Time
+	worst       time.Duration // Highest ingest-to-write latency of the window
+	busy        time.Duration // Time spent writing in the window
+}
+
+// newAdaptiveBatcher starts from the configured batching, nil when there is
+// no target and batching stays fixed
+func newAdaptiveBatcher(target time.Duration, size int, flush time.Duration) *adaptiveBatcher {
+	if target <= 0 {
+		return nil
+	}
+
+	return &adaptiveBatcher{
+		target:      target,
+		size:        min(max(size, 1), maxAdaptiveBatch),
+		flush:       min(max(flush, minAdaptiveFlush), target),
+		windowStart: time.Now(),
+	}
+}
+
+// observe records a batch written between start and end, its oldest payload
+// queued at queued. It returns whether the size or flush interval changed.
+func (a *adaptiveBatcher) observe(queued, start, end time.Time) bool {
+	a.worst = max(a.worst, end.Sub(queued))
+	a.busy += end.Sub(start)
+
+	elapsed := end.Sub(a.windowStart)
+	if elapsed < adaptiveWindow {
+		return false
+	}
+	defer a.reset(end)
+
+	size, flush := a.size, a.flush
+	switch {
+	case a.busy*2 > elapsed:
+		size = min(size*2, maxAdaptiveBatch)
+		flush = min(flush*2, a.target)
+	case a.worst > a.target:
+		size = max(size/2, 1)
+		flush = max(flush/2, minAdaptiveFlush)
+	}
+
+	changed := size != a.size || flush != a.flush
+	a.size, a.flush = size, flush
+	return changed
+}
+
+func (a *adaptiveBatcher) reset(now time.Time) {
+	a.windowStart = now
+	a.worst = 0
+	a.busy = 0
+}
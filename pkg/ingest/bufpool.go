@@ -0,0 +1,34 @@
+package ingest
+
+import "sync"
+
+// Pooled payload buffers fit any RTP payload of a typical MTU, larger ones
+// (whole video frames) are allocated as before
+const payloadBufferSize = 1500
+
+// payloadPool recycles the payload copies every packet needs on its way to
+// FFmpeg, which otherwise cost an allocation per packet. Buffers are pooled
+// as array pointers, so returning one doesn't allocate either.
+var payloadPool = sync.Pool{
+	New: func() any { return new([payloadBufferSize]byte) },
+}
+
+// copyPayload copies a payload, into a pooled buffer when it fits. The copy
+// is handed back with releasePayload once it was written.
+func copyPayload(p []byte) []byte {
+	if len(p) > payloadBufferSize {
+		return append([]byte(nil), p...)
+	}
+
+	buf := payloadPool.Get().(*[payloadBufferSize]byte)
+	return append(buf[:0], p...)
+}
+
+// releasePayload returns a buffer of copyPayload to the pool, other slices
+// are left alone
+func releasePayload(p []byte) {
+	if cap(p) != payloadBufferSize {
+		return
+	}
+	payloadPool.Put((*[payloadBufferSize]byte)(p[:payloadBufferSize]))
+}
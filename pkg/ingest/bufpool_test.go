@@ -0,0 +1,71 @@
+package ingest
+
+import "testing"
+
+// Packets per benchmark run, and the size of an Opus payload at 64 kbit/s
+const (
+	benchmarkPackets     = 10_000
+	benchmarkPayloadSize = 160
+)
+
+var (
+	benchmarkPayload = make([]byte, benchmarkPayloadSize)
+	benchmarkSink    []byte // Keeps the unpooled copies on the heap
+)
+
+func BenchmarkCopyPayloadPooled(b *testing.B) {
+	b.ReportAllocs()
+	for range b.N {
+		for range benchmarkPackets {
+			releasePayload(copyPayload(benchmarkPayload))
+		}
+	}
+}
+
+func BenchmarkCopyPayloadUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	for range b.N {
+		for range benchmarkPackets {
+			benchmarkSink = make([]byte, len(benchmarkPayload))
+			copy(benchmarkSink, benchmarkPayload)
+		}
+	}
+}
+
+// Payloads queued on a ring and written on as in the audio pipeline
+func benchmarkRing(b *testing.B, copyPayload func([]byte) []byte, release func([]byte)) {
+	b.ReportAllocs()
+	ring := newPayloadRing(64)
+	for range b.N {
+		for range benchmarkPackets {
+			ring.push(copyPayload(benchmarkPayload))
+			payload, _, _ := ring.pop()
+			release(payload)
+		}
+	}
+}
+
+func BenchmarkPayloadRingPooled(b *testing.B) {
+	benchmarkRing(b, copyPayload, releasePayload)
+}
+
+func BenchmarkPayloadRingUnpooled(b *testing.B) {
+	benchmarkRing(b, func(p []byte) []byte { return append([]byte(nil), p...) }, func([]byte) {})
+}
+
+func TestCopyPayload(t *testing.T) {
+	for _, size := range []int{0, 1, benchmarkPayloadSize, payloadBufferSize, payloadBufferSize + 1} {
+		p := make([]byte, size)
+		for i := range p {
+			p[i] = byte(i)
+		}
+		got := copyPayload(p)
+		if string(got) != string(p) {
+			t.Errorf("copyPayload of %d bytes differs", size)
+		}
+		if pooled := cap(got) == payloadBufferSize; pooled != (size <= payloadBufferSize) {
+			t.Errorf("copyPayload of %d bytes pooled = %v", size, pooled)
+		}
+		releasePayload(got)
+	}
+}
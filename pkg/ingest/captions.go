@@ -0,0 +1,256 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	captionSampleRate = 16000
+	captionWindow     = 5 // Number of caption segments kept in captions.m3u8
+)
+
+// transcriber turns a WAV chunk of 16kHz mono audio into text
+type transcriber interface {
+	Transcribe(wav []byte) (string, error)
+}
+
+// commandTranscriber runs a local process (e.g. whisper.cpp) for every chunk,
+// passing the WAV on stdin and reading the transcript from stdout
+type commandTranscriber struct {
+	name string
+	args []string
+}
+
+func (t *commandTranscriber) Transcribe(wav []byte) (string, error) {
+	cmd := exec.Command(t.name, t.args...)
+	cmd.Stdin = bytes.NewReader(wav)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("transcriber %s failed: %v", t.name, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// httpTranscriber posts every chunk to a speech-to-text API which answers
+// with the plain text transcript
+type httpTranscriber struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpTranscriber) Transcribe(wav []byte) (string, error) {
+	resp, err := t.client.Post(t.url, "audio/wav", bytes.NewReader(wav))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("transcription request failed: %s", resp.Status)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+func newTranscriber(cfg *Config) transcriber {
+	switch {
+	case cfg.STTCommand != "":
+		fields := strings.Fields(cfg.STTCommand)
+		return &commandTranscriber{name: fields[0], args: fields[1:]}
+	case cfg.STTURL != "":
+		return &httpTranscriber{url: cfg.STTURL, client: &http.Client{Timeout: 30 * time.Second}}
+	default:
+		return nil
+	}
+}
+
+// captionWriter decodes the Opus payloads of a track to PCM, feeds
+// fixed size chunks to a transcriber and publishes the results as WebVTT
+// segments referenced from the HLS master playlist, in the directory of the
+// track's session
+type captionWriter struct {
+	backend  transcriber
+	interval time.Duration
+	language string
+	dir      string
+	stream   string // Playlist of the track, the master's variant
+
+	payloads chan []byte
+	decoder  *pcmDecoder
+	segments []string
+	sequence int
+}
+
+func newCaptionWriter(backend transcriber, cfg *Config, t *Track) *captionWriter {
+	return &captionWriter{
+		backend:  backend,
+		interval: cfg.CaptionInterval,
+		language: cfg.CaptionLanguage,
+		dir:      t.Dir,
+		stream:   t.hlsName() + ".m3u8",
+		payloads: make(chan []byte, 100),
+	}
+}
+
+// Write queues a payload for decoding. Transcription is slower than the media
+// so payloads are dropped rather than holding up the recording
+func (c *captionWriter) Write(payload []byte) (int, error) {
+	select {
+	case c.payloads <- append([]byte(nil), payload...):
+	default:
+		fmt.Println("Caption decoder busy, dropping packet")
+	}
+
+	return len(payload), nil
+}
+
+func (c *captionWriter) Close() error {
+	close(c.payloads)
+	return nil
+}
+
+func (c *captionWriter) start(inputArgs []string) error {
+	decoder, err := newPCMDecoder(inputArgs, captionSampleRate)
+	if err != nil {
+		return err
+	}
+	c.decoder = decoder
+
+	if err = c.writeMasterPlaylist(); err != nil {
+		return err
+	}
+
+	go func() {
+		defer decoder.Close()
+		for payload := range c.payloads {
+			if _, err := decoder.Write(payload); err != nil {
+				fmt.Println("Error writing to caption decoder:", err)
+				return
+			}
+		}
+	}()
+	go c.transcribe(decoder)
+
+	return nil
+}
+
+func (c *captionWriter) transcribe(pcm io.Reader) {
+	defer c.decoder.wait()
+
+	chunk := make([]byte, int(c.interval.Seconds()*captionSampleRate)*2)
+	for {
+		n, err := io.ReadFull(pcm, chunk)
+		if n > 0 {
+			c.publish(chunk[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *captionWriter) publish(pcm []byte) {
+	text, err := c.backend.Transcribe(wavFile(pcm))
+	if err != nil {
+		fmt.Println("Error transcribing audio:", err)
+	}
+
+	start := time.Duration(c.sequence) * c.interval
+	end := start + time.Duration(len(pcm)/2)*time.Second/captionSampleRate
+
+	vtt := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n\n"
+	if text != "" {
+		vtt += fmt.Sprintf("%s --> %s\n%s\n", vttTimestamp(start), vttTimestamp(end), text)
+	}
+
+	name := fmt.Sprintf("captions_%d.vtt", c.sequence)
+	if err := writeFileAtomic(filepath.Join(c.dir, name), []byte(vtt)); err != nil {
+		fmt.Println("Error writing captions:", err)
+		return
+	}
+
+	c.sequence++
+	c.segments = append(c.segments, name)
+	if len(c.segments) > captionWindow {
+		c.segments = c.segments[1:]
+	}
+
+	if err := c.writePlaylist((end - start).Seconds()); err != nil {
+		fmt.Println("Error writing captions playlist:", err)
+	}
+}
+
+func (c *captionWriter) writePlaylist(lastDuration float64) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n", int(c.interval.Seconds()+0.5))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", c.sequence-len(c.segments))
+	for i, name := range c.segments {
+		duration := c.interval.Seconds()
+		if i == len(c.segments)-1 {
+			duration = lastDuration
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", duration, name)
+	}
+
+	return writeFileAtomic(filepath.Join(c.dir, "captions.m3u8"), []byte(b.String()))
+}
+
+func (c *captionWriter) writeMasterPlaylist() error {
+	master := "#EXTM3U\n" +
+		fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"Captions\",DEFAULT=YES,AUTOSELECT=YES,LANGUAGE=%q,URI=\"captions.m3u8\"\n", c.language) +
+		"#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS=\"opus\",SUBTITLES=\"subs\"\n" +
+		c.stream + "\n"
+
+	return writeFileAtomic(filepath.Join(c.dir, "master.m3u8"), []byte(master))
+}
+
+// Wrap raw 16-bit little endian mono PCM in a WAV header
+func wavFile(pcm []byte) []byte {
+	le := binary.LittleEndian
+
+	wav := make([]byte, 0, 44+len(pcm))
+	wav = append(wav, "RIFF"...)
+	wav = le.AppendUint32(wav, uint32(36+len(pcm)))
+	wav = append(wav, "WAVEfmt "...)
+	wav = le.AppendUint32(wav, 16)                  // fmt chunk size
+	wav = le.AppendUint16(wav, 1)                   // PCM
+	wav = le.AppendUint16(wav, 1)                   // mono
+	wav = le.AppendUint32(wav, captionSampleRate)   // sample rate
+	wav = le.AppendUint32(wav, captionSampleRate*2) // byte rate
+	wav = le.AppendUint16(wav, 2)                   // block align
+	wav = le.AppendUint16(wav, 16)                  // bits per sample
+	wav = append(wav, "data"...)
+	wav = le.AppendUint32(wav, uint32(len(pcm)))
+
+	return append(wav, pcm...)
+}
+
+func vttTimestamp(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
+
+// Write a file through a rename so HTTP clients never see it half written
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
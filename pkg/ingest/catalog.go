@@ -0,0 +1,309 @@
+package ingest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	catalogSweepInterval = time.Hour
+	catalogTrashTTL      = 7 * 24 * time.Hour // Soft-deleted recordings can be restored for this long
+)
+
+var catalogSchema = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		publisher TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		started INTEGER NOT NULL,
+		ended INTEGER NOT NULL,
+		metadata TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_started ON sessions (started)`,
+	`CREATE TABLE IF NOT EXISTS recordings (
+		file TEXT PRIMARY KEY,
+		session TEXT NOT NULL REFERENCES sessions (id),
+		size INTEGER NOT NULL,
+		created INTEGER NOT NULL,
+		deleted INTEGER,
+		purged INTEGER
+	)`,
+	`CREATE INDEX IF NOT EXISTS recordings_session ON recordings (session)`,
+}
+
+// recordingCatalog keeps the finalized sessions and their recordings in a
+// SQLite database, to be queried over HTTP. Recordings soft-deleted longer
+// than catalogTrashTTL are removed from disk by a sweep, and like those the
+// retention rules deleted, kept in the catalog as purged.
+type recordingCatalog struct {
+	db *sql.DB
+}
+
+// newRecordingCatalog opens the catalog and creates its tables, nil without
+// a catalog database
+func newRecordingCatalog(cfg *Config) (*recordingCatalog, error) {
+	if cfg.CatalogDB == "" {
+		return nil, nil
+	}
+	if !slices.Contains(sql.Drivers(), cfg.CatalogDriver) {
+		return nil, fmt.Errorf("-catalog needs the %q database driver, build with -tags sqlite", cfg.CatalogDriver)
+	}
+
+	db, err := sql.Open(cfg.CatalogDriver, cfg.CatalogDB)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time
+	db.SetMaxOpenConns(1)
+	for _, statement := range catalogSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create catalog: %v", err)
+		}
+	}
+
+	c := &recordingCatalog{db: db}
+	go c.run()
+	return c, nil
+}
+
+// record a finalized session with its recordings
+func (c *recordingCatalog) record(metadata sessionMetadata, publisher string) error {
+	if c == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	ended := time.Now()
+	if metadata.Ended != nil {
+		ended = *metadata.Ended
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO sessions (id, publisher, user_agent, started, ended, metadata) VALUES (?, ?, ?, ?, ?, ?)`,
+		metadata.ID, publisher, metadata.UserAgent, metadata.Started.UnixMilli(), ended.UnixMilli(), string(data)); err != nil {
+		return err
+	}
+	for _, file := range metadata.Outputs {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO recordings (file, session, size, created) VALUES (?, ?, ?, ?)`,
+			file, metadata.ID, info.Size(), info.ModTime().UnixMilli()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (c *recordingCatalog) run() {
+	for {
+		if err := c.sweep(time.Now()); err != nil {
+			fmt.Println("Error sweeping recording catalog:", err)
+		}
+		time.Sleep(catalogSweepInterval)
+	}
+}
+
+// Remove the files of recordings soft-deleted longer than the trash TTL
+func (c *recordingCatalog) sweep(now time.Time) error {
+	rows, err := c.db.Query(`SELECT file FROM recordings WHERE purged IS NULL AND deleted < ?`, now.Add(-catalogTrashTTL).UnixMilli())
+	if err != nil {
+		return err
+	}
+	var files []string
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Error removing recording:", err)
+			continue
+		}
+		if err := c.purge(file, now); err != nil {
+			return err
+		}
+		fmt.Println("Purged recording", file)
+	}
+	return nil
+}
+
+// purge records that a recording's file was removed
+func (c *recordingCatalog) purge(file string, now time.Time) error {
+	if c == nil {
+		return nil
+	}
+
+	_, err := c.db.Exec(`UPDATE recordings SET purged = ? WHERE file = ?`, now.UnixMilli(), file)
+	return err
+}
+
+// catalogEntry is a session as listed by GET /recordings
+type catalogEntry struct {
+	Session    string          `json:"session"`
+	Publisher  string          `json:"publisher"`
+	Started    time.Time       `json:"started"`
+	Ended      time.Time       `json:"ended"`
+	Recordings []catalogFile   `json:"recordings"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+type catalogFile struct {
+	File    string     `json:"file"`
+	Size    int64      `json:"size"`
+	Deleted *time.Time `json:"deleted,omitempty"`
+}
+
+// List the sessions started between from and to, of a publisher if not
+// empty, with their recordings still on disk
+func (c *recordingCatalog) query(from, to time.Time, publisher string, deleted bool) ([]*catalogEntry, error) {
+	conditions := []string{"s.started >= ?", "s.started < ?", "r.purged IS NULL"}
+	args := []any{from.UnixMilli(), to.UnixMilli()}
+	if publisher != "" {
+		conditions = append(conditions, "s.publisher = ?")
+		args = append(args, publisher)
+	}
+	if !deleted {
+		conditions = append(conditions, "r.deleted IS NULL")
+	}
+
+	rows, err := c.db.Query(`SELECT s.id, s.publisher, s.started, s.ended, s.metadata, r.file, r.size, r.deleted
+		FROM sessions s JOIN recordings r ON r.session = s.id
+		WHERE `+strings.Join(conditions, " AND ")+` ORDER BY s.started, r.file`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*catalogEntry{}
+	for rows.Next() {
+		var (
+			id, publisher, metadata, file string
+			started, ended, size          int64
+			deletedAt                     sql.NullInt64
+		)
+		if err := rows.Scan(&id, &publisher, &started, &ended, &metadata, &file, &size, &deletedAt); err != nil {
+			return nil, err
+		}
+
+		if len(entries) == 0 || entries[len(entries)-1].Session != id {
+			entries = append(entries, &catalogEntry{
+				Session:   id,
+				Publisher: publisher,
+				Started:   time.UnixMilli(started),
+				Ended:     time.UnixMilli(ended),
+				Metadata:  json.RawMessage(metadata),
+			})
+		}
+		recording := catalogFile{File: file, Size: size}
+		if deletedAt.Valid {
+			at := time.UnixMilli(deletedAt.Int64)
+			recording.Deleted = &at
+		}
+		entry := entries[len(entries)-1]
+		entry.Recordings = append(entry.Recordings, recording)
+	}
+	return entries, rows.Err()
+}
+
+// Soft-delete a recording, or restore it with a zero time. It reports
+// whether a recording still on disk matched.
+func (c *recordingCatalog) markDeleted(file string, at time.Time) (bool, error) {
+	var deleted any
+	if !at.IsZero() {
+		deleted = at.UnixMilli()
+	}
+	result, err := c.db.Exec(`UPDATE recordings SET deleted = ? WHERE file = ? AND purged IS NULL`, deleted, file)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Whether a recording was soft-deleted, so it isn't served anymore
+func (c *recordingCatalog) isDeleted(file string) bool {
+	if c == nil {
+		return false
+	}
+
+	var deleted sql.NullInt64
+	err := c.db.QueryRow(`SELECT deleted FROM recordings WHERE file = ?`, file).Scan(&deleted)
+	return err == nil && deleted.Valid
+}
+
+// List recordings by the time their session started, from and to in
+// RFC 3339 defaulting to all of them, and publisher. deleted=true includes
+// soft-deleted ones.
+func (s *httpServer) serveRecordings(w http.ResponseWriter, r *http.Request) {
+	from, to := time.UnixMilli(0), time.Now().Add(24*time.Hour)
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if raw := r.URL.Query().Get(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	entries, err := s.catalog.query(from, to, r.URL.Query().Get("publisher"), r.URL.Query().Get("deleted") == "true")
+	if err != nil {
+		fmt.Println("Error querying recording catalog:", err)
+		http.Error(w, "failed to query catalog", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries) //nolint:errcheck
+}
+
+// Soft-delete a recording, it is purged once the trash TTL passed
+func (s *httpServer) serveDeleteRecording(w http.ResponseWriter, r *http.Request) {
+	s.markRecording(w, r, time.Now())
+}
+
+// Restore a soft-deleted recording not purged yet
+func (s *httpServer) serveRestoreRecording(w http.ResponseWriter, r *http.Request) {
+	s.markRecording(w, r, time.Time{})
+}
+
+func (s *httpServer) markRecording(w http.ResponseWriter, r *http.Request, at time.Time) {
+	found, err := s.catalog.markDeleted(r.PathValue("file"), at)
+	if err != nil {
+		fmt.Println("Error updating recording catalog:", err)
+		http.Error(w, "failed to update catalog", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "unknown recording", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,356 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clusterTTL       = 30 * time.Second // Registrations of a node that stopped refreshing them expire after
+	clusterHeartbeat = 10 * time.Second
+
+	clusterSessionKey = "ingest:session:" // Followed by the session ID, holds the owner's URL
+	clusterNodesKey   = "ingest:nodes"    // Hash of the nodes by ID
+)
+
+// cluster registers the sessions of this node in Redis, so any node behind
+// the same hostname can tell where a session lives and redirect requests
+// for it there. Nodes also list themselves with their load.
+type cluster struct {
+	node     string
+	url      string // Public URL of this node
+	redis    *redisClient
+	sessions *sessionRegistry
+	draining atomic.Bool // Other nodes stop sending publishers here
+}
+
+// elsewhereError is returned for a session another node owns
+type elsewhereError struct {
+	session string
+	url     string // Of the node owning it
+}
+
+func (e *elsewhereError) Error() string {
+	return fmt.Sprintf("session %s is published on %s", e.session, e.url)
+}
+
+// clusterNode is how a node lists itself
+type clusterNode struct {
+	ID       string    `json:"id"`
+	URL      string    `json:"url"`
+	Sessions int       `json:"sessions"`
+	Draining bool      `json:"draining,omitempty"`
+	Seen     time.Time `json:"seen"`
+}
+
+// newCluster joins the cluster of -cluster-url, nil when running standalone
+func newCluster(cfg *Config, sessions *sessionRegistry) (*cluster, error) {
+	if cfg.ClusterURL == "" {
+		return nil, nil
+	}
+	if cfg.PublicURL == "" {
+		return nil, errors.New("cluster mode requires -public-url to redirect requests to")
+	}
+	redis, err := newRedisClient(cfg.ClusterURL)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cluster{node: cfg.NodeID, url: strings.TrimSuffix(cfg.PublicURL, "/"), redis: redis, sessions: sessions}
+	if c.node == "" {
+		c.node, _ = os.Hostname()
+	}
+	go c.run()
+	return c, nil
+}
+
+// Refresh the registrations of this node's sessions and of the node itself
+// before they expire
+func (c *cluster) run() {
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		sessions := c.sessions.list()
+		for _, s := range sessions {
+			if _, err := c.redis.do("SET", clusterSessionKey+s.id, c.url, "EX", strconv.Itoa(int(clusterTTL.Seconds()))); err != nil {
+				fmt.Println("Error refreshing session in cluster:", err)
+				break
+			}
+		}
+
+		node, _ := json.Marshal(clusterNode{ID: c.node, URL: c.url, Sessions: len(sessions), Draining: c.draining.Load(), Seen: time.Now()})
+		if _, err := c.redis.do("HSET", clusterNodesKey, c.node, string(node)); err != nil {
+			fmt.Println("Error registering node in cluster:", err)
+		}
+	}
+}
+
+// claim registers a session as this node's, failing with an elsewhereError
+// if another node owns it
+func (c *cluster) claim(id string) error {
+	if c == nil {
+		return nil
+	}
+
+	reply, err := c.redis.do("SET", clusterSessionKey+id, c.url, "NX", "EX", strconv.Itoa(int(clusterTTL.Seconds())))
+	if err != nil {
+		return fmt.Errorf("failed to register session in cluster: %v", err)
+	}
+	if reply == "OK" {
+		return nil
+	}
+
+	if owner := c.owner(id); owner != "" && owner != c.url {
+		return &elsewhereError{session: id, url: owner}
+	}
+	return nil
+}
+
+// release unregisters a session of this node once it ended
+func (c *cluster) release(id string) {
+	if c == nil || c.owner(id) != c.url {
+		return
+	}
+	if _, err := c.redis.do("DEL", clusterSessionKey+id); err != nil {
+		fmt.Println("Error unregistering session from cluster:", err)
+	}
+}
+
+// URL of the node owning a session, empty if none does
+func (c *cluster) owner(id string) string {
+	reply, err := c.redis.do("GET", clusterSessionKey+id)
+	if err != nil {
+		fmt.Println("Error looking up session in cluster:", err)
+	}
+	owner, _ := reply.(string)
+	return owner
+}
+
+// redirect sends requests for a session another node owns to that node,
+// with the same method and body
+func (c *cluster) redirect(session func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := session(r)
+		if id != "" && c.sessions.get(id) == nil {
+			if owner := c.owner(id); owner != "" && owner != c.url {
+				http.Redirect(w, r, owner+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// drain lists this node as draining from the next heartbeat on
+func (c *cluster) drain() {
+	if c != nil {
+		c.draining.Store(true)
+	}
+}
+
+// URL of the least busy other node that isn't draining, empty if there is
+// none
+func (c *cluster) alternative() string {
+	if c == nil {
+		return ""
+	}
+	nodes, err := c.nodes()
+	if err != nil {
+		fmt.Println("Error listing cluster nodes:", err)
+	}
+
+	best := clusterNode{Sessions: -1}
+	for _, node := range nodes {
+		if node.URL != c.url && !node.Draining && (best.Sessions < 0 || node.Sessions < best.Sessions) {
+			best = node
+		}
+	}
+	return best.URL
+}
+
+// List the nodes that registered themselves recently
+func (c *cluster) serveNodes(w http.ResponseWriter, _ *http.Request) {
+	nodes, err := c.nodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes) //nolint:errcheck
+}
+
+// Nodes that registered themselves recently, by ID
+func (c *cluster) nodes() ([]clusterNode, error) {
+	reply, err := c.redis.do("HGETALL", clusterNodesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []clusterNode{}
+	fields, _ := reply.([]any)
+	for i := 1; i < len(fields); i += 2 {
+		var node clusterNode
+		if value, ok := fields[i].(string); !ok || json.Unmarshal([]byte(value), &node) != nil {
+			continue
+		}
+		if time.Since(node.Seen) < clusterTTL {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// Session a WHEP viewer asks for in the session query parameter
+func querySession(r *http.Request) string {
+	return r.URL.Query().Get("session")
+}
+
+// Session named by the id path value
+func idSession(r *http.Request) string {
+	return r.PathValue("id")
+}
+
+// redisClient sends commands to Redis one at a time over a single
+// connection, reconnecting after errors
+type redisClient struct {
+	addr     string
+	password string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid cluster URL %q, expected redis://", rawURL)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	c := &redisClient{addr: addr}
+	c.password, _ = u.User.Password()
+	return c, nil
+}
+
+// do sends a command and returns its reply: a string, an int64, a []any or
+// nil for a nil reply. Redis errors are returned as errors.
+func (c *redisClient) do(args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+	reply, err := c.command(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	if c.password != "" {
+		c.conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+		if _, err := c.command("AUTH", c.password); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) command(args ...string) (any, error) {
+	if _, err := c.conn.Write(respCommand(args...)); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+// redisError is an error reply, the connection stays usable
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Read a RESP reply
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty RESP reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected RESP reply %q", line)
+	}
+}
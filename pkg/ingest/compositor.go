@@ -0,0 +1,364 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const compositeFrameRate = 30
+
+// Layouts of the composite sink
+const (
+	layoutGrid = "grid" // Equal tiles in rows and columns
+	layoutPiP  = "pip"  // The first source fills the frame, the others are inset
+)
+
+// videoCompositor is the sink tiling the video of every track routed to it,
+// from any number of sessions, into a single picture for recording
+// multi-party calls as one file. Sources are decoded to raw frames by
+// FFmpeg, laid out in the order they joined, and re-encoded to
+// composite.m3u8, whose playlist is written by hlsPlaylist.
+type videoCompositor struct {
+	control       *recordingControl
+	width, height int
+	format        string // Container of the composite's segments, empty for MP4
+	window        int    // Segments listed in composite.m3u8
+	tags          []string
+	composed      atomic.Uint32 // 90kHz ticks of the frames written to the encoder, the playlist's clock
+
+	mu      sync.Mutex
+	layout  string
+	sources []*compositeSource // In the order they joined
+	stop    chan struct{}      // Stops the encoder, nil while nothing is composited
+}
+
+type compositeSource struct {
+	compositor *videoCompositor
+	session    string
+	decoder    *exec.Cmd
+	stdin      io.WriteCloser
+	decoded    chan struct{} // Closed once the decoder output was read
+	frame      []byte        // Latest decoded frame, guarded by the compositor
+}
+
+// A rectangle of the composite frame
+type compositeTile struct {
+	x, y, width, height int
+}
+
+func newVideoCompositor(cfg *Config, control *recordingControl, format string, tags []string) (*videoCompositor, error) {
+	width, height, err := parseFrameSize(cfg.CompositeSize)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CompositeLayout != layoutGrid && cfg.CompositeLayout != layoutPiP {
+		return nil, fmt.Errorf("unknown composite layout %q", cfg.CompositeLayout)
+	}
+
+	return &videoCompositor{control: control, width: width, height: height, format: format, window: cfg.PlaylistWindow, tags: tags, layout: cfg.CompositeLayout}, nil
+}
+
+// Parse a frame size like "1280x720", yuv420p needs both to be even
+func parseFrameSize(size string) (int, int, error) {
+	w, h, ok := strings.Cut(size, "x")
+	width, err := strconv.Atoi(w)
+	if !ok || err != nil || width <= 0 || width%2 != 0 {
+		return 0, 0, fmt.Errorf("invalid frame size %q", size)
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil || height <= 0 || height%2 != 0 {
+		return 0, 0, fmt.Errorf("invalid frame size %q", size)
+	}
+
+	return width, height, nil
+}
+
+func (c *videoCompositor) frameSize() int {
+	return c.width * c.height * 3 / 2
+}
+
+func (c *videoCompositor) Open(t *Track) (io.WriteCloser, error) {
+	if t.Kind != "video" {
+		return nil, fmt.Errorf("can't composite %s tracks", t.Kind)
+	}
+
+	// Sources are decoded at the full frame size, the largest tile any
+	// layout uses
+	args := append([]string{}, t.InputArgs...)
+	decoder := exec.Command("ffmpeg", append(args,
+		"-i", "pipe:0",
+		"-f", "rawvideo",
+		"-pix_fmt", "yuv420p",
+		"-s", fmt.Sprintf("%dx%d", c.width, c.height),
+		"pipe:1",
+	)...)
+	decoder.Stderr = os.Stderr
+	isolateProcess(decoder)
+
+	stdin, err := decoder.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+	}
+	stdout, err := decoder.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	if err = decoder.Start(); err != nil {
+		return nil, err
+	}
+
+	source := &compositeSource{compositor: c, session: t.Session, decoder: decoder, stdin: stdin, decoded: make(chan struct{})}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.sources) == 0 {
+		if err = c.startEncoder(); err != nil {
+			stdin.Close()
+			io.Copy(io.Discard, stdout) //nolint:errcheck
+			decoder.Wait()              //nolint:errcheck
+			return nil, err
+		}
+	}
+	c.sources = append(c.sources, source)
+
+	go source.read(stdout)
+	return source, nil
+}
+
+// Called with the lock held
+func (c *videoCompositor) startEncoder() error {
+	playlist := newSinkPlaylist("composite", segmentFilePattern("composite_%d.mp4", c.format, false), c.window, c.tags, c.control)
+	encoder, err := startFFmpegProcess(continueSegments(withSegmentFormat([]string{
+		"-f", "rawvideo",
+		"-pix_fmt", "yuv420p",
+		"-s", fmt.Sprintf("%dx%d", c.width, c.height),
+		"-r", fmt.Sprint(compositeFrameRate),
+		"-i", "pipe:0",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-f", "segment",
+		"-segment_time", "2",
+		"-segment_format", "mp4",
+		"-segment_format_options", "movflags=+frag_keyframe+empty_moov",
+		"-segment_filename", "composite_%d.mp4",
+	}, c.format), map[string]int{playlist.pattern: playlist.first}))
+	if err != nil {
+		return err
+	}
+
+	c.stop = make(chan struct{})
+	go watchFFmpeg(encoder, c.control, c.stop, nil)
+	go c.run(encoder.stdin, c.stop)
+	go playlist.watch(c.composed.Load, newWallClock(90000), nil, c.stop)
+	return nil
+}
+
+// Compose a frame of the latest frame of every source each tick, sources
+// without a frame yet stay black
+func (c *videoCompositor) run(encoder io.WriteCloser, stop <-chan struct{}) {
+	defer encoder.Close()
+
+	ticker := time.NewTicker(time.Second / compositeFrameRate)
+	defer ticker.Stop()
+
+	canvas := make([]byte, c.frameSize())
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		luma := c.width * c.height
+		fillBytes(canvas[:luma], 16)  // Black
+		fillBytes(canvas[luma:], 128) // No chroma
+
+		c.mu.Lock()
+		tiles := layoutTiles(c.layout, len(c.sources), c.width, c.height)
+		for i, source := range c.sources {
+			if source.frame != nil {
+				c.blit(canvas, source.frame, tiles[i])
+			}
+		}
+		c.mu.Unlock()
+
+		if _, err := encoder.Write(canvas); err != nil {
+			fmt.Println("Error writing to compositor:", err)
+			return
+		}
+		c.composed.Add(90000 / compositeFrameRate)
+	}
+}
+
+func fillBytes(b []byte, value byte) {
+	for i := range b {
+		b[i] = value
+	}
+}
+
+// Tiles of n sources in a layout, in source order
+func layoutTiles(layout string, n, width, height int) []compositeTile {
+	tiles := make([]compositeTile, 0, n)
+	if n == 0 {
+		return tiles
+	}
+
+	if layout == layoutPiP {
+		tiles = append(tiles, compositeTile{0, 0, width, height})
+
+		// Insets of a quarter of the frame, right to left from the bottom
+		w, h := even(width/4), even(height/4)
+		margin := even(height / 40)
+		perRow := max(1, (width-margin)/(w+margin))
+		for i := 0; i < n-1; i++ {
+			col, row := i%perRow, i/perRow%max(1, (height-margin)/(h+margin))
+			tiles = append(tiles, compositeTile{width - (col+1)*(w+margin), height - (row+1)*(h+margin), w, h})
+		}
+		return tiles
+	}
+
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := (n + cols - 1) / cols
+	w, h := even(width/cols), even(height/rows)
+	for i := 0; i < n; i++ {
+		tiles = append(tiles, compositeTile{(i % cols) * w, (i / cols) * h, w, h})
+	}
+	return tiles
+}
+
+func even(n int) int {
+	return n &^ 1
+}
+
+// Scale a full size yuv420p frame into a tile of the canvas, nearest
+// neighbour is plenty for call recordings
+func (c *videoCompositor) blit(canvas, frame []byte, tile compositeTile) {
+	luma, chroma := c.width*c.height, c.width*c.height/4
+
+	planes := []struct {
+		offset, width, height, scale int
+	}{
+		{0, c.width, c.height, 1},
+		{luma, c.width / 2, c.height / 2, 2},
+		{luma + chroma, c.width / 2, c.height / 2, 2},
+	}
+	for _, p := range planes {
+		x, y := tile.x/p.scale, tile.y/p.scale
+		w, h := tile.width/p.scale, tile.height/p.scale
+		for ty := 0; ty < h; ty++ {
+			src := frame[p.offset+ty*p.height/h*p.width:]
+			dst := canvas[p.offset+(y+ty)*p.width+x:]
+			for tx := 0; tx < w; tx++ {
+				dst[tx] = src[tx*p.width/w]
+			}
+		}
+	}
+}
+
+// Keep the latest decoded frame of a source
+func (s *compositeSource) read(stdout io.Reader) {
+	defer close(s.decoded)
+
+	c := s.compositor
+	buf := make([]byte, c.frameSize())
+	for {
+		if _, err := io.ReadFull(stdout, buf); err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		s.frame, buf = buf, s.frame
+		c.mu.Unlock()
+		if buf == nil {
+			buf = make([]byte, c.frameSize())
+		}
+	}
+}
+
+func (s *compositeSource) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+// Close removes the source from the layout, stopping the encoder after the
+// last one
+func (s *compositeSource) Close() error {
+	err := s.stdin.Close()
+	<-s.decoded
+	s.decoder.Wait() //nolint:errcheck
+
+	c := s.compositor
+	c.mu.Lock()
+	if i := slices.Index(c.sources, s); i >= 0 {
+		c.sources = slices.Delete(c.sources, i, i+1)
+	}
+	if len(c.sources) == 0 && c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+type compositeStatus struct {
+	Layout  string   `json:"layout"`
+	Sources []string `json:"sources"` // Session IDs in layout order
+}
+
+func (c *videoCompositor) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	c.mu.Lock()
+	status := compositeStatus{Layout: c.layout, Sources: []string{}}
+	for _, source := range c.sources {
+		status.Sources = append(status.Sources, source.session)
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status) //nolint:errcheck
+}
+
+// Switch the layout with {"layout": "pip"}, and with "sources" move the
+// given sessions to the front in that order, e.g. to pick the main picture
+func (c *videoCompositor) serveLayout(w http.ResponseWriter, r *http.Request) {
+	var update struct {
+		Layout  string   `json:"layout"`
+		Sources []string `json:"sources"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "invalid layout", http.StatusBadRequest)
+		return
+	}
+	if update.Layout != "" && update.Layout != layoutGrid && update.Layout != layoutPiP {
+		http.Error(w, fmt.Sprintf("unknown layout %q", update.Layout), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	if update.Layout != "" {
+		c.layout = update.Layout
+	}
+	for i := len(update.Sources) - 1; i >= 0; i-- {
+		for j, source := range c.sources {
+			if source.session == update.Sources[i] {
+				c.sources = slices.Insert(slices.Delete(c.sources, j, j+1), 0, source)
+				break
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	c.serveStatus(w, r)
+}
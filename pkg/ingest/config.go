@@ -0,0 +1,217 @@
+package ingest
+
+import (
+	"time"
+)
+
+// Config holds the runtime options of the ingest pipeline
+type Config struct {
+	TrimSilence      bool          // Pause audio segment output during long silences
+	SilenceTimeout   time.Duration // How long audio must stay silent before it is recorded as a silence interval
+	SilenceLevel     uint          // Audio level in -dBov (0-127, larger is quieter) from which a packet counts as silence
+	LegacyCodecs     bool          // Accept G.722, G.711 and iLBC audio from telephony gateways
+	DTMF             bool          // Negotiate telephone-event and report the DTMF digits received
+	OpusFEC          bool          // Negotiate Opus inband FEC and conceal lost packets with it
+	OpusDTX          bool          // Ask publishers to stop sending during silence
+	OpusStereo       bool          // Accept stereo Opus, publishers send mono otherwise
+	AudioRED         bool          // Negotiate redundant audio (RFC 2198) and recover lost Opus packets from it
+	VideoFEC         bool          // Negotiate ULPFEC for video and recover lost VP8 packets from it
+	RotateRecordings bool          // Turn WebM recordings of video sent rotated (CVO) upright
+	H264             bool          // Accept H.264 video besides VP8, for the cmaf sink to package
+	ResumeWindow     time.Duration // How long after a crash a publisher reconnecting continues its recording, zero disables
+
+	MaxSessionDuration time.Duration // Sessions are ended after this long, zero for no limit
+	MaxSessionSize     string        // e.g. "2GB", sessions are ended once their outputs take up this much, empty for no limit
+	OutputTemplate     string        // e.g. "archive/{{.Tenant}}/{{.SessionID}}/{{.Rendition}}", paths recordings are linked to once finalized
+
+	STTCommand      string // Speech-to-text command reading a WAV chunk on stdin and printing the transcript
+	STTURL          string // Speech-to-text HTTP endpoint accepting a WAV chunk and answering with the transcript
+	CaptionInterval time.Duration
+	CaptionLanguage string
+
+	HTTPAddr     string
+	TLSCert      string // Certificate and key files of the HTTPS listener
+	TLSKey       string
+	ACMEDomains  string // Domains certificates are obtained from Let's Encrypt for, instead of the files
+	ACMEEmail    string
+	ACMECacheDir string
+	ACMEHTTPAddr string // Answers HTTP-01 challenges
+
+	AllowedOrigins  string // e.g. "https://app.example.com,https://*.example.com", empty allows any
+	CORSCredentials bool
+	SegmentBaseURL  string // CDN or bucket URL segments are rewritten to in served playlists
+	SegmentSigner   string // "token" (HMAC) or "s3" (SigV4 pre-signed)
+	SegmentSignKey  string
+	SegmentURLTTL   time.Duration
+
+	ScreenFrameRate int    // Frame rate screen shares are encoded at
+	ScreenSize      string // Frame size screen shares are decoded at
+
+	ThumbnailInterval time.Duration // 0 disables thumbnails
+	ThumbnailSprites  bool
+	PreviewInterval   time.Duration // 0 disables the data channel preview feed
+
+	DriftCorrection bool
+	DriftThreshold  time.Duration
+
+	GapFill      bool
+	MaxGapFill   time.Duration
+	MaxGapBridge time.Duration // Longest outage bridged, beyond MaxGapFill gaps also start a discontinuity
+
+	WebhookURL     string // Receives session lifecycle events, empty disables webhooks
+	WebhookSecret  string // HMAC-SHA256 key of the X-Ingest-Signature header
+	WebhookEvents  string // e.g. "session.started,ffmpeg.crashed", empty for all
+	WebhookRetries int
+	EventBusURL    string        // "nats://host:4222" or "redis://:password@host:6379", empty disables the event bus
+	EventBusPrefix string        // Subjects are "<prefix>.<type>"
+	NodeID         string        // Identifies this node in events, the hostname by default
+	PublicURL      string        // Base URL viewers reach this node's HTTP API at
+	ClusterURL     string        // "redis://:password@host:6379" sessions are registered in, empty runs standalone
+	DrainTimeout   time.Duration // How long draining waits for sessions to end before closing them
+
+	PublishKey     string // HS256 secret publish tokens are signed with, empty leaves publishing open
+	PublishKeyFile string // PEM public key of RS256/ES256 publish tokens
+	PolicyFile     string // "<publisher> bitrate=2500000 height=720 fps=30" lines, "*" for everyone else
+	TenantsFile    string // "<tenant> sessions=10 storage=50GB" lines, "*" for tenants not listed
+
+	DTLSCertFile       string // PEM DTLS certificate, generated if missing, empty for a new one every start
+	PinnedFingerprints string // e.g. "sha-256 AB:CD:...", empty accepts any publisher certificate
+	DTLSKeyLogFile     string // NSS key log DTLS secrets are appended to for decrypting captures, never in production
+	RTPDumpDir         string // Directory incoming RTP and RTCP is dumped to as pcap files per track, for debugging
+
+	PlaybackKey     string // HMAC key of playback tokens, empty leaves playback to -auth
+	EncryptSegments bool   // AES-128 encrypt live HLS segments at rest, keys served at /keys/<session>
+
+	CatalogDB        string // SQLite database of finalized sessions and recordings, empty disables the catalog
+	CatalogDriver    string // database/sql driver the catalog is opened with
+	Retention        string // Rules like "age=168h,count=100,size=500GB" finished sessions are deleted by
+	PlaybackTokenTTL time.Duration
+
+	Auth             string // "none", "static", "jwt", "introspection" or "http"
+	AuthTokensFile   string
+	AuthJWKSURL      string
+	AuthIssuer       string
+	AuthURL          string
+	AuthClientID     string
+	AuthClientSecret string
+
+	FFmpegShutdownTimeout time.Duration // How long FFmpegs get to exit once their session ended, before SIGTERM and then SIGKILL
+	Encoder               string        // "ffmpeg" or "gstreamer", the backend of the hls and rtmp sinks
+	RTPListen             string        // UDP address plain RTP publishers send to, empty for WebRTC publishers only
+	RTPPayloadTypes       string        // e.g. "111=opus,96=vp8", codecs of the dynamic payload types of plain RTP
+	RTPIdleTimeout        time.Duration // How long plain RTP may stop before its session ends
+	RTSPURLs              string        // Comma separated cameras to pull
+	MoQ                   bool          // Accept Media over QUIC style object streams on POST /moq, experimental
+	FFmpegCPULimit        float64       // CPUs the FFmpegs of a session may use together, 0 for no limit
+	FFmpegMemoryLimit     string        // e.g. "1GB", memory the FFmpegs of a session may use together, empty for no limit
+	SignalSocket          string        // Unix socket serving the signaling endpoints to local processes, empty for none
+	GRPCAddr              string        // Address of the gRPC control plane, empty for none
+	TrackEndTimeout       time.Duration // How long a track may stop sending before it counts as ended, 0 to wait for BYE or its transceiver to stop
+	RTPStallTimeout       time.Duration // How long a track may stop sending before recovery is requested, and twice that before the stall is reported, 0 disables
+	RTPStallTeardown      time.Duration // How long every track of a session may stop sending before the session is closed, 0 keeps it
+
+	FFmpegSpares       int
+	DefaultPriority    string  // Priority class of sessions not given one
+	CPUWatermark       float64 // CPU usage (0-1) from which best-effort sessions are degraded, 0 disables
+	ICEUDPPort         int     // Single UDP port shared by all sessions, 0 for a port per session
+	ICETCPPort         int     // TCP port ICE candidates are also gathered on, 0 for UDP only
+	ICEInterfaces      string  // e.g. "eth1,eth2", network interfaces ICE gathers candidates on, empty for all
+	ICEIPFamily        string  // "ipv4" or "ipv6" to gather candidates of one IP family only, empty for both
+	STUNServer         string  // Server reflexive candidates are gathered with, empty for none
+	LANMode            bool    // Gather host candidates only, for networks without internet access
+	MDNS               string  // "query" resolves publishers' .local candidates, "gather" also hides ours behind one, "off" ignores them
+	TURNServers        string  // e.g. "turn:turn.example.com:3478?transport=tcp,turns:turn.example.com:5349"
+	TURNUsername       string
+	TURNCredential     string
+	AudioBandwidth     int // Bits per second publishers are asked to send at most, 0 for no cap
+	VideoBandwidth     int
+	RTCPXRInterval     time.Duration // How often publishers get RTCP Extended Reports, 0 disables them
+	RTCPRRInterval     time.Duration // How often publishers get RTCP Receiver Reports, and the round trip is measured
+	ReplayWindow       int           // Sequence numbers behind the newest packet of a track still accepted once, 0 lets duplicates through
+	Routes             string        // e.g. "audio=hls+webm,video=hls+rtmp,pcmu=discard"
+	SegmentFormats     string        // e.g. "video=ts,mix=ts", HLS segment containers by output
+	PlaylistWindow     int           // Segments listed in the live playlists of tracks
+	PlaylistTags       string        // e.g. "#EXT-X-INDEPENDENT-SEGMENTS", added to the live playlists of tracks
+	AudioFilters       string        // e.g. "audio=highpass+loudnorm,mix=loudnorm:-23", see parseAudioFilters
+	RTMPURL            string
+	SinkDurability     string // e.g. "webm=fsync,hls=buffered", sinks left out are buffered
+	AudioWriteThrough  bool
+	AudioBuffer        time.Duration // Audio queued between the RTP reader and the FFmpeg writer
+	AudioBatchSize     int           // Audio payloads written to FFmpeg at once
+	AudioFlushInterval time.Duration // Longest a partial batch waits
+	AudioLatencyTarget time.Duration // Ingest-to-write latency batching adapts to, 0 keeps it fixed
+	WritePolicy        string        // "drop-oldest", "drop-newest" or "block"
+	WriteQueue         int           // Payloads queued per track ahead of its sinks
+	WriteTimeout       time.Duration // How long a write may block before FFmpeg counts as stalled
+	Features           string        // Experimental subsystems enabled by default, e.g. "ll-hls,sfu"
+	Pacing             float64       // Multiple of the average bitrate video is forwarded to WebRTC viewers at, 0 sends bursts as they come
+
+	CompositeLayout string // "grid" or "pip"
+	CompositeSize   string
+
+	VODRenditions  string // e.g. "720p:720:2800k,360p:360:800k:libx265", empty disables VOD transcodes
+	VODConcurrency int
+
+	// Sinks added to the built-in ones, by the name routes refer to them with
+	Sinks map[string]Sink
+
+	// Stages every audio packet runs through before entering the pipeline
+	AudioProcessors []PacketProcessor
+}
+
+// DefaultConfig returns the options the ingest binary runs with by default
+func DefaultConfig() *Config {
+	return &Config{
+		SilenceTimeout:     2 * time.Second,
+		SilenceLevel:       60,
+		OpusFEC:            true,
+		RotateRecordings:   true,
+		ResumeWindow:       10 * time.Minute,
+		CaptionInterval:    5 * time.Second,
+		CaptionLanguage:    "en",
+		HTTPAddr:           ":8080",
+		ACMECacheDir:       "acme",
+		ACMEHTTPAddr:       ":80",
+		SegmentURLTTL:      5 * time.Minute,
+		ScreenFrameRate:    5,
+		ScreenSize:         "1920x1080",
+		ThumbnailInterval:  5 * time.Second,
+		PreviewInterval:    500 * time.Millisecond,
+		DriftCorrection:    true,
+		DriftThreshold:     100 * time.Millisecond,
+		GapFill:            true,
+		MaxGapFill:         2 * time.Second,
+		MaxGapBridge:       time.Minute,
+		WebhookRetries:     5,
+		PlaybackTokenTTL:   time.Hour,
+		DrainTimeout:       5 * time.Minute,
+		CatalogDriver:      "sqlite",
+		EventBusPrefix:     "ingest",
+		Auth:               "none",
+		DefaultPriority:    PriorityBroadcast,
+		AuthTokensFile:     "tokens.txt",
+		Routes:             "audio=hls,video=hls",
+		PlaylistWindow:     2,
+		AudioBuffer:        500 * time.Millisecond,
+		AudioBatchSize:     5,
+		AudioFlushInterval: 5 * time.Millisecond,
+		WritePolicy:        writePolicyBlock,
+		WriteQueue:         64,
+		WriteTimeout:       time.Second,
+		Pacing:             2.5,
+		STUNServer:         "stun:stun.l.google.com:19302",
+		MDNS:               "query",
+		RTCPRRInterval:     time.Second,
+		ReplayWindow:       1024,
+		CompositeLayout:    "grid",
+		CompositeSize:      "1280x720",
+		VODConcurrency:     1,
+
+		FFmpegShutdownTimeout: 10 * time.Second,
+		Encoder:               "ffmpeg",
+		RTPPayloadTypes:       "111=opus,96=vp8",
+		RTPIdleTimeout:        10 * time.Second,
+		TrackEndTimeout:       30 * time.Second,
+		RTPStallTimeout:       5 * time.Second,
+	}
+}
@@ -0,0 +1,104 @@
+package ingest
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// How long browsers may cache a preflight answer, in seconds
+const corsMaxAge = 600
+
+// originPolicy decides which web origins may call the HTTP endpoints, and
+// answers CORS preflights for them. Patterns are exact origins, or
+// "https://*.example.com" for any subdomain, or "*" for any origin.
+type originPolicy struct {
+	patterns    []string
+	credentials bool // Let pages send cookies along
+}
+
+// newOriginPolicy parses the allowed origins, nil when origins aren't checked
+func newOriginPolicy(cfg *Config) (*originPolicy, error) {
+	p := &originPolicy{credentials: cfg.CORSCredentials}
+	for _, origin := range strings.Split(cfg.AllowedOrigins, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			p.patterns = append(p.patterns, strings.ToLower(origin))
+		}
+	}
+
+	if len(p.patterns) == 0 {
+		return nil, nil
+	}
+	if p.credentials && containsAny(p.patterns) {
+		return nil, errors.New("-cors-credentials can't be combined with allowing any origin")
+	}
+	return p, nil
+}
+
+func containsAny(patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *originPolicy) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.patterns {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		if scheme, domain, ok := strings.Cut(pattern, "://*."); ok {
+			if rest, ok := strings.CutPrefix(origin, scheme+"://"); ok && strings.HasSuffix(rest, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reject requests from other origins, and add the CORS headers allowed ones
+// need. Requests without an Origin header, like players outside a browser,
+// pass as before.
+func (p *originPolicy) wrap(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !p.allowed(origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if p.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			headers := r.Header.Get("Access-Control-Request-Headers")
+			if headers == "" {
+				headers = "Authorization, Content-Type"
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// WHIP and WHEP clients need the session resource
+		w.Header().Set("Access-Control-Expose-Headers", "Location")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var errDraining = errors.New("node is draining")
+
+// Drain stops accepting new sessions and asks publishers to move to another
+// node. Live sessions get -drain-timeout to end on their own before they
+// are closed, and Drain returns once all of their recordings were
+// finalized. Drained is closed then.
+func (s *Server) Drain() {
+	if !s.draining.CompareAndSwap(false, true) {
+		<-s.drained
+		return
+	}
+
+	sessions := s.sessions.list()
+	fmt.Printf("Draining %d sessions, new sessions are refused\n", len(sessions))
+	s.metrics.set("ingest_draining", 1)
+	s.cluster.drain()
+	deadline := time.Now().Add(s.cfg.DrainTimeout)
+	for _, session := range sessions {
+		session.control.notifyDrain(deadline)
+	}
+
+	timer := time.NewTimer(s.cfg.DrainTimeout)
+	defer timer.Stop()
+	expired := false
+	for _, session := range sessions {
+		if !expired {
+			select {
+			case <-session.done:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+		fmt.Printf("Drain timeout passed, closing session %s\n", session.id)
+		if err := session.Close(); err != nil {
+			fmt.Println("Error closing peer connection:", err)
+		}
+	}
+
+	for _, session := range sessions {
+		session.Wait()
+	}
+	fmt.Println("Drained, every recording was finalized")
+	close(s.drained)
+}
+
+// Drained is closed once Drain finished, the process may exit then
+func (s *Server) Drained() <-chan struct{} {
+	return s.drained
+}
+
+// Start draining in the background, answering with the sessions left
+func (s *httpServer) serveDrain(w http.ResponseWriter, _ *http.Request) {
+	go s.drain()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"draining": true, "sessions": len(s.sessions.list())}) //nolint:errcheck
+}
+
+// Load balancers take a draining node out of rotation
+func (s *httpServer) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	if s.draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n")) //nolint:errcheck
+}
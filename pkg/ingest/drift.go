@@ -0,0 +1,152 @@
+package ingest
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Frame rate FFmpeg assumes for the video it is fed
+const videoFrameRate = 30
+
+const videoFrameDuration = time.Second / videoFrameRate
+
+// 20ms of Opus silence (CELT fullband, one frame)
+var opusSilenceFrame = []byte{0xf8, 0xff, 0xfe}
+
+const opusSilenceDuration = 20 * time.Millisecond
+
+// Cap on the frames inserted at once, so a broken clock can't flood the output
+const maxDriftFill = 50
+
+// avDrift exports how far the audio and video outputs drifted apart
+type avDrift struct {
+	metrics *metricRegistry
+	audio   atomic.Int64
+	video   atomic.Int64
+}
+
+func newAVDrift(metrics *metricRegistry) *avDrift {
+	return &avDrift{metrics: metrics}
+}
+
+func (a *avDrift) update() {
+	a.metrics.set("ingest_av_drift_seconds", time.Duration(a.audio.Load()-a.video.Load()).Seconds())
+}
+
+// driftTracker compares the media duration a track wrote to its output
+// with the wall-clock time the publisher sent, as mapped by RTCP Sender
+// Reports. FFmpeg derives output timestamps from what it is fed, so any
+// difference shows up as A/V desync in long sessions.
+type driftTracker struct {
+	track     string
+	clock     *wallClock
+	threshold time.Duration // Drift that triggers a correction, 0 to only measure
+	metrics   *metricRegistry
+	report    *atomic.Int64
+	av        *avDrift
+
+	start   time.Time
+	written time.Duration
+}
+
+func newDriftTracker(track string, clock *wallClock, cfg *Config, av *avDrift) *driftTracker {
+	d := &driftTracker{
+		track:   track,
+		clock:   clock,
+		metrics: av.metrics,
+		av:      av,
+		report:  &av.video,
+	}
+	switch track {
+	case "audio":
+		d.report = &av.audio
+	case "video":
+	default:
+		// A/V drift is between the camera and the first audio track
+		d.report = &atomic.Int64{}
+	}
+	if cfg.DriftCorrection {
+		d.threshold = cfg.DriftThreshold
+	}
+
+	return d
+}
+
+// observe returns how far the output is behind the publisher's clock at the
+// given RTP timestamp, negative when it is ahead
+func (d *driftTracker) observe(timestamp uint32) time.Duration {
+	now, ok := d.clock.at(timestamp)
+	if !ok {
+		return 0
+	}
+	if d.start.IsZero() {
+		d.start = now
+		d.written = 0
+	}
+
+	drift := now.Sub(d.start) - d.written
+	d.metrics.set(fmt.Sprintf("ingest_drift_seconds{track=%q}", d.track), drift.Seconds())
+	d.report.Store(int64(drift))
+	d.av.update()
+
+	return drift
+}
+
+// wrote accounts for media written to the output, or deliberately left out
+// of it (pauses, trimmed silence) so those gaps aren't corrected
+func (d *driftTracker) wrote(duration time.Duration) {
+	d.written += duration
+}
+
+// fill returns how many frames of the given duration should be inserted to
+// catch up with the drift, 0 when no correction is needed
+func (d *driftTracker) fill(drift, frame time.Duration) int {
+	if d.threshold == 0 || drift < d.threshold {
+		return 0
+	}
+
+	n := min(int(drift/frame), maxDriftFill)
+	d.metrics.add(fmt.Sprintf("ingest_drift_corrections_total{track=%q,action=\"insert\"}", d.track), float64(n))
+	return n
+}
+
+// drop reports whether the output is far enough ahead for the next frame to
+// be dropped
+func (d *driftTracker) drop(drift time.Duration) bool {
+	if d.threshold == 0 || drift > -d.threshold {
+		return false
+	}
+
+	d.metrics.add(fmt.Sprintf("ingest_drift_corrections_total{track=%q,action=\"drop\"}", d.track), 1)
+	return true
+}
+
+// Duration of an Opus packet from its TOC byte (RFC 6716 section 3.1)
+func opusDuration(payload []byte) time.Duration {
+	if len(payload) < 1 {
+		return 0
+	}
+
+	var frame time.Duration
+	switch config := payload[0] >> 3; {
+	case config < 12: // SILK
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16: // Hybrid
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default: // CELT
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	switch payload[0] & 0x3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(payload) < 2 {
+			return 0
+		}
+		return time.Duration(payload[1]&0x3f) * frame
+	}
+}
@@ -0,0 +1,138 @@
+package ingest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	dtlsCertLifetime = 365 * 24 * time.Hour
+	dtlsCertRenew    = 7 * 24 * time.Hour // Left before expiry when a new certificate is generated
+)
+
+// loadDTLSCertificate loads the DTLS certificate peers see the fingerprint
+// of, generating and saving one when the file is missing or the certificate
+// is about to expire. Browsers accept any self-signed certificate, but a
+// stable one lets reconnecting publishers keep their pinned fingerprint.
+func loadDTLSCertificate(path string) (*webrtc.Certificate, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		cert, err := webrtc.CertificateFromPEM(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DTLS certificate %s: %v", path, err)
+		}
+		if time.Until(cert.Expires()) > dtlsCertRenew {
+			return cert, nil
+		}
+		fmt.Println("DTLS certificate expires soon, generating a new one with a new fingerprint")
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := webrtc.NewCertificate(key, x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ingest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(dtlsCertLifetime),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := cert.PEM()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, []byte(data)); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// fingerprintPins are the DTLS fingerprints publishers of a closed
+// deployment may connect with, as "<algorithm> <hex>" or just the SHA-256
+// hex, e.g. "sha-256 AB:CD:..."
+type fingerprintPins map[string]bool
+
+func parseFingerprintPins(spec string) fingerprintPins {
+	pins := fingerprintPins{}
+	for _, pin := range strings.Split(spec, ",") {
+		fields := strings.Fields(strings.ToLower(pin))
+		switch len(fields) {
+		case 1:
+			pins["sha-256 "+fields[0]] = true
+		case 2:
+			pins[fields[0]+" "+fields[1]] = true
+		}
+	}
+
+	if len(pins) == 0 {
+		return nil
+	}
+	return pins
+}
+
+// check that an offer only carries pinned fingerprints. Pion verifies the
+// certificate of the DTLS handshake against these, so a peer can't present
+// another one.
+func (p fingerprintPins) check(offer webrtc.SessionDescription) error {
+	if p == nil {
+		return nil
+	}
+
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return err
+	}
+
+	var fingerprints []string
+	if value, ok := parsed.Attribute("fingerprint"); ok {
+		fingerprints = append(fingerprints, value)
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if value, ok := media.Attribute("fingerprint"); ok {
+			fingerprints = append(fingerprints, value)
+		}
+	}
+
+	if len(fingerprints) == 0 {
+		return errors.New("offer carries no DTLS fingerprint")
+	}
+	for _, fingerprint := range fingerprints {
+		if !p[strings.Join(strings.Fields(strings.ToLower(fingerprint)), " ")] {
+			return fmt.Errorf("DTLS fingerprint %s is not pinned", fingerprint)
+		}
+	}
+	return nil
+}
+
+// openDTLSKeyLog opens the file the secrets of every DTLS handshake are
+// appended to, in the NSS key log format Wireshark reads. Anyone holding it
+// can decrypt the captured sessions, so it's for debugging only.
+func openDTLSKeyLog(path string) (io.Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DTLS key log: %v", err)
+	}
+	fmt.Println("WARNING: exporting DTLS secrets to", path, "- captured media can be decrypted with it")
+	return f, nil
+}
@@ -0,0 +1,130 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const mimeTypeTelephoneEvent = "audio/telephone-event"
+
+// Digits of the RFC 4733 DTMF events 0-16
+const dtmfDigits = "0123456789*#ABCD!"
+
+// Telephone events are offered at the clock rate of Opus and at the 8kHz of
+// the telephony codecs, whichever a gateway sends
+var telephoneEventCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeTelephoneEvent, ClockRate: 48000, SDPFmtpLine: "0-15"},
+		PayloadType:        110,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeTelephoneEvent, ClockRate: 8000, SDPFmtpLine: "0-15"},
+		PayloadType:        126,
+	},
+}
+
+func registerTelephoneEvents(m *webrtc.MediaEngine) error {
+	for _, codec := range telephoneEventCodecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dtmfDigit is a digit a publisher sent, as recorded in the session metadata
+type dtmfDigit struct {
+	Time     time.Time `json:"time"`
+	Track    string    `json:"track"` // Rendition of the audio track it was sent on
+	Digit    string    `json:"digit"` // 0-9, *, #, A-D or ! for a hook flash
+	Duration int       `json:"durationMs"`
+}
+
+// dtmfReceiver takes the telephone-event packets out of an audio track,
+// which share its SSRC, and reports each digit once its event ended
+type dtmfReceiver struct {
+	track      string
+	clockRates map[uint8]uint32 // Of the negotiated telephone-event payload types
+	report     func(dtmfDigit)
+
+	ended     bool
+	timestamp uint32 // Of the latest event reported
+}
+
+// The DTMF receiver of a track, nil when telephone events weren't negotiated
+func (s *Session) newDTMFReceiver(t *Track, receiver *webrtc.RTPReceiver) *dtmfReceiver {
+	clockRates := map[uint8]uint32{}
+	for _, codec := range receiver.GetParameters().Codecs {
+		if strings.EqualFold(codec.MimeType, mimeTypeTelephoneEvent) {
+			clockRates[uint8(codec.PayloadType)] = codec.ClockRate
+		}
+	}
+	if len(clockRates) == 0 {
+		return nil
+	}
+
+	return &dtmfReceiver{track: t.rendition(), clockRates: clockRates, report: s.reportDTMF}
+}
+
+// receive reports whether a packet was a telephone event, which mustn't
+// reach the audio pipeline
+func (d *dtmfReceiver) receive(packet *rtp.Packet) bool {
+	if d == nil {
+		return false
+	}
+	clockRate, ok := d.clockRates[packet.PayloadType]
+	if !ok {
+		return false
+	}
+
+	// Event, end bit, volume and duration; the end packet is sent three times
+	if len(packet.Payload) < 4 || packet.Payload[1]&0x80 == 0 || (d.ended && packet.Timestamp == d.timestamp) {
+		return true
+	}
+	d.ended, d.timestamp = true, packet.Timestamp
+
+	event := int(packet.Payload[0])
+	if event >= len(dtmfDigits) {
+		return true
+	}
+	duration := binary.BigEndian.Uint16(packet.Payload[2:])
+	d.report(dtmfDigit{
+		Time:     time.Now(),
+		Track:    d.track,
+		Digit:    dtmfDigits[event : event+1],
+		Duration: int(uint64(duration) * 1000 / uint64(clockRate)),
+	})
+	return true
+}
+
+func (s *Session) reportDTMF(digit dtmfDigit) {
+	fmt.Printf("Session %s received DTMF %s on %s\n", s.id, digit.Digit, digit.Track)
+	s.mu.Lock()
+	s.dtmf = append(s.dtmf, digit)
+	s.mu.Unlock()
+
+	s.server.metrics.add("ingest_dtmf_digits_total", 1)
+	s.server.events.emit(eventDTMFReceived, s.id, map[string]any{"digit": digit.Digit, "track": digit.Track, "durationMs": digit.Duration})
+}
+
+func (r *sessionRegistry) serveDTMF(w http.ResponseWriter, req *http.Request) {
+	session := r.get(req.PathValue("id"))
+	if session == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	session.mu.Lock()
+	digits := append([]dtmfDigit{}, session.dtmf...)
+	session.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(digits) //nolint:errcheck
+}
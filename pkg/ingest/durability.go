@@ -0,0 +1,143 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How a sink's files reach the disk
+const (
+	durabilityBuffered = "buffered" // Left to the page cache, for latency-critical live output
+	durabilityFsync    = "fsync"    // Synced as each segment is finished, for archival output
+)
+
+// fileSink is a sink whose output are files FFmpeg writes, which can be
+// synced to disk as they are finished
+type fileSink interface {
+	Sink
+
+	// files returns the directory and printf style pattern of the numbered
+	// files written for a track, or the name of a single file
+	files(t *Track) (dir, pattern string)
+}
+
+// Parse a durability table like "webm=fsync,hls=buffered", by sink name
+func parseDurability(spec string) (map[string]string, error) {
+	modes := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		name, mode, _ := strings.Cut(entry, "=")
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		if mode != durabilityBuffered && mode != durabilityFsync {
+			return nil, fmt.Errorf("invalid sink durability %q", entry)
+		}
+		modes[strings.TrimSpace(name)] = mode
+	}
+
+	return modes, nil
+}
+
+// finishedOutput hands each file of a track's sink to finished once FFmpeg
+// moved on to the next one, and the last one when the writer is closed
+type finishedOutput struct {
+	io.WriteCloser
+	dir      string
+	pattern  string
+	finished func(path string)
+	stop     chan struct{}
+	stopped  chan struct{}
+	next     int // Number of the first segment not finished yet
+}
+
+func newFinishedOutput(w io.WriteCloser, dir, pattern string, finished func(path string)) *finishedOutput {
+	o := &finishedOutput{WriteCloser: w, dir: dir, pattern: pattern, finished: finished, stop: make(chan struct{}), stopped: make(chan struct{})}
+	if !strings.Contains(pattern, "%") {
+		close(o.stopped)
+		return o
+	}
+
+	go o.run()
+	return o
+}
+
+func (o *finishedOutput) run() {
+	defer close(o.stopped)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-ticker.C:
+		}
+
+		// A segment is finished once the next one exists
+		for o.exists(o.next + 1) {
+			o.finished(o.path(o.next))
+			o.next++
+		}
+	}
+}
+
+// Close closes the writer, then finishes what is left. For sinks whose
+// writer doesn't wait for FFmpeg, the last segment is finished as far as it
+// got.
+func (o *finishedOutput) Close() error {
+	err := o.WriteCloser.Close()
+	close(o.stop)
+	<-o.stopped
+
+	if !strings.Contains(o.pattern, "%") {
+		o.finished(filepath.Join(o.dir, o.pattern))
+	} else if o.exists(o.next) {
+		o.finished(o.path(o.next))
+	}
+	return err
+}
+
+func (o *finishedOutput) path(n int) string {
+	return filepath.Join(o.dir, fmt.Sprintf(o.pattern, n))
+}
+
+func (o *finishedOutput) exists(n int) bool {
+	_, err := os.Stat(o.path(n))
+	return err == nil
+}
+
+// syncedOutput fsyncs the files of a track's sink as they are finished, and
+// their directory once the writer is closed
+type syncedOutput struct {
+	*finishedOutput
+}
+
+func newSyncedOutput(w io.WriteCloser, dir, pattern string) syncedOutput {
+	return syncedOutput{newFinishedOutput(w, dir, pattern, syncFile)}
+}
+
+func (o syncedOutput) Close() error {
+	err := o.finishedOutput.Close()
+	syncFile(o.dir)
+	return err
+}
+
+func syncFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Failed to sync output:", err)
+		return
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		fmt.Println("Failed to sync output:", err)
+	}
+}
@@ -0,0 +1,165 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// Encoder runs the external processes of the hls and rtmp sinks, which read
+// a track's payloads in the format of its InputArgs
+type Encoder interface {
+	// HLS starts encoding a track to HLS segments in its Dir, named as the
+	// hls sink's files, which the session lists in the track's playlist.
+	// Closing the returned input waits until the outputs are complete.
+	HLS(t *Track) (io.WriteCloser, error)
+
+	// RTMP starts encoding a track and pushing it to an RTMP URL
+	RTMP(t *Track, url string) (io.WriteCloser, error)
+}
+
+// Backends of -encoder
+func newEncoder(cfg *Config, pool *ffmpegPool) (Encoder, error) {
+	switch cfg.Encoder {
+	case "", "ffmpeg":
+		e := &ffmpegEncoder{pool: pool}
+		e.cfg.Store(cfg)
+		return e, nil
+	case "gstreamer":
+		return &gstreamerEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown encoder %q", cfg.Encoder)
+	}
+}
+
+// ffmpegEncoder runs an FFmpeg per track, the HLS ones from the spares of
+// -ffmpeg-spares
+type ffmpegEncoder struct {
+	cfg  atomic.Pointer[Config] // Replaced by Reload, FFmpegs already started keep theirs
+	pool *ffmpegPool
+}
+
+func (e *ffmpegEncoder) HLS(t *Track) (io.WriteCloser, error) {
+	t.hlsArgs = hlsFFmpegArgs(e.cfg.Load(), t)
+	process, err := e.pool.start(t.hlsArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	t.processes.add(process)
+	go watchFFmpeg(process, t.control, t.Done, t.crashed)
+	return ffmpegInput{process}, nil
+}
+
+func (e *ffmpegEncoder) RTMP(t *Track, url string) (io.WriteCloser, error) {
+	return (&ffmpegSink{output: rtmpOutput(url)}).Open(t)
+}
+
+// gstreamerEncoder runs a gst-launch-1.0 pipeline per track reading it from
+// stdin. HLS segments are MPEG-TS written by hlssink2, and Opus is framed as
+// Ogg on the way in since GStreamer can't delimit raw Opus packets.
+type gstreamerEncoder struct{}
+
+func (e *gstreamerEncoder) HLS(t *Track) (io.WriteCloser, error) {
+	dir, pattern := (&hlsSink{}).files(t)
+	return e.start(t, "hlssink2",
+		"location="+filepath.Join(dir, pattern),
+		// hlssink2 always writes a playlist, the served one is ours
+		"playlist-location="+filepath.Join(dir, t.hlsName()+"_gst.m3u8"),
+		"target-duration=1",
+		"playlist-length=2",
+		"max-files=10",
+	)
+}
+
+func (e *gstreamerEncoder) RTMP(t *Track, url string) (io.WriteCloser, error) {
+	return e.start(t, "flvmux", "streamable=true", "!", "rtmpsink", "location="+url)
+}
+
+// Start a pipeline from stdin through the encoder of the track's kind into
+// the given elements
+func (e *gstreamerEncoder) start(t *Track, sink ...string) (io.WriteCloser, error) {
+	source, err := gstreamerSource(t)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"-q", "-e"}, source...)
+	process, err := startProcess("gst-launch-1.0", append(append(args, "!"), sink...))
+	if err != nil {
+		return nil, err
+	}
+
+	t.processes.add(process)
+	go watchFFmpeg(process, t.control, t.Done, t.crashed)
+	if t.Kind == "audio" {
+		return newOggOpusInput(ffmpegInput{process}, max(t.Channels, 1))
+	}
+	return ffmpegInput{process}, nil
+}
+
+// Elements reading a track from stdin and encoding it to AAC or H.264
+func gstreamerSource(t *Track) ([]string, error) {
+	if t.Kind == "audio" {
+		if !strings.EqualFold(t.Codec.MimeType, webrtc.MimeTypeOpus) {
+			return nil, fmt.Errorf("the gstreamer encoder only takes Opus audio, not %s", t.Codec.MimeType)
+		}
+		return strings.Fields("fdsrc fd=0 ! oggdemux ! opusdec ! audioconvert ! audioresample ! avenc_aac ! aacparse"), nil
+	}
+
+	// Raw I420 frames of the size and rate the FFmpeg input arguments name
+	arg := func(name string) string {
+		if i := slices.Index(t.InputArgs, name); i >= 0 && i+1 < len(t.InputArgs) {
+			return t.InputArgs[i+1]
+		}
+		return ""
+	}
+	width, height, ok := strings.Cut(arg("-s"), "x")
+	fps, err := strconv.Atoi(arg("-r"))
+	if !ok || err != nil || arg("-pix_fmt") != "yuv420p" {
+		return nil, fmt.Errorf("the gstreamer encoder can't read video input %q", strings.Join(t.InputArgs, " "))
+	}
+	return []string{
+		"fdsrc", "fd=0", "!",
+		"rawvideoparse", "width=" + width, "height=" + height, "format=i420", "framerate=" + strconv.Itoa(fps) + "/1", "!",
+		"x264enc", "tune=zerolatency", "speed-preset=veryfast", "key-int-max=" + strconv.Itoa(fps), "!",
+		"h264parse",
+	}, nil
+}
+
+// oggOpusInput frames the raw Opus payloads written to it as an Ogg stream
+type oggOpusInput struct {
+	ogg       *oggwriter.OggWriter
+	timestamp uint32 // In 48kHz samples, advanced by each packet's duration
+}
+
+func newOggOpusInput(w io.WriteCloser, channels int) (*oggOpusInput, error) {
+	ogg, err := oggwriter.NewWith(w, 48000, uint16(channels))
+	if err != nil {
+		return nil, err
+	}
+	return &oggOpusInput{ogg: ogg}, nil
+}
+
+func (i *oggOpusInput) Write(payload []byte) (int, error) {
+	packet := &rtp.Packet{Header: rtp.Header{Timestamp: i.timestamp}, Payload: payload}
+	if err := i.ogg.WriteRTP(packet); err != nil {
+		return 0, err
+	}
+	i.timestamp += uint32(opusDuration(payload) * 48000 / time.Second)
+	return len(payload), nil
+}
+
+// Close closes the underlying input
+func (i *oggOpusInput) Close() error {
+	return i.ogg.Close()
+}
@@ -0,0 +1,173 @@
+package ingest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// segmentEncryption encrypts the live HLS segments of sessions at rest with a
+// random AES-128 key per session. Served playlists only list the segments
+// already encrypted, each behind an #EXT-X-KEY tag pointing players at
+// /keys/<session> and carrying the segment's IV. HLS players only decrypt
+// whole segments encrypted with AES-128-CBC, so that is the mode used.
+type segmentEncryption struct {
+	mu   sync.Mutex
+	keys map[string][]byte // By session
+	ivs  map[string][]byte // Of encrypted segments, by path
+}
+
+// newSegmentEncryption is nil unless segments are encrypted
+func newSegmentEncryption(cfg *Config) *segmentEncryption {
+	if !cfg.EncryptSegments {
+		return nil
+	}
+	return &segmentEncryption{keys: map[string][]byte{}, ivs: map[string][]byte{}}
+}
+
+// key of a session, generated on first use
+func (e *segmentEncryption) key(session string) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if key, ok := e.keys[session]; ok {
+		return key, nil
+	}
+	key := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	e.keys[session] = key
+	return key, nil
+}
+
+// Drop the key of a session and the IVs of its segments once they're gone
+func (e *segmentEncryption) forget(session, dir string) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.keys, session)
+	for path := range e.ivs {
+		if filepath.Dir(path) == dir {
+			delete(e.ivs, path)
+		}
+	}
+}
+
+// Encrypt a finished segment in place, PKCS#7 padded as HLS expects
+func (e *segmentEncryption) encrypt(session, path string) error {
+	key, err := e.key(session)
+	if err != nil {
+		return err
+	}
+	plain, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(plain, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	// Not named like a segment, so nothing picks up the partial file
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".enc")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.ivs[path] = iv
+	e.mu.Unlock()
+	return nil
+}
+
+// Encrypt a track's segments as its FFmpeg finishes them. Closing waits for
+// FFmpeg, so the last segment is complete when it's encrypted.
+func (e *segmentEncryption) output(input io.WriteCloser, t *Track, dir, pattern string) (io.WriteCloser, error) {
+	// Playlists of the session are filtered from now on
+	if _, err := e.key(t.Session); err != nil {
+		return nil, err
+	}
+
+	return newFinishedOutput(input, dir, pattern, func(path string) {
+		if err := e.encrypt(t.Session, path); err != nil {
+			fmt.Println("Failed to encrypt segment:", err)
+		}
+	}), nil
+}
+
+// playlist keeps the segments of a session's playlist in dir that are
+// encrypted, each preceded by the key tag to decrypt it
+func (e *segmentEncryption) playlist(session, dir, playlist string) string {
+	if e == nil {
+		return playlist
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.keys[session]; !ok {
+		return playlist
+	}
+
+	lines := strings.Split(playlist, "\n")
+	out := make([]string, 0, len(lines)*2)
+	var segmentTags []string // Of the next segment, dropped along with it
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXTINF"), line == "#EXT-X-DISCONTINUITY", strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME"):
+			segmentTags = append(segmentTags, line)
+		case line == "" || strings.HasPrefix(line, "#"):
+			out = append(out, line)
+		default:
+			iv, ok := e.ivs[filepath.Join(dir, strings.TrimSpace(line))]
+			if ok {
+				out = append(out, fmt.Sprintf(`#EXT-X-KEY:METHOD=AES-128,URI="/keys/%s",IV=0x%s`, session, hex.EncodeToString(iv)))
+				out = append(append(out, segmentTags...), line)
+			}
+			segmentTags = nil
+		}
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// Deliver the key of a session to players
+func (s *httpServer) serveKey(w http.ResponseWriter, r *http.Request) {
+	session := r.PathValue("session")
+	s.encryption.mu.Lock()
+	key, ok := s.encryption.keys[session]
+	s.encryption.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(key) //nolint:errcheck
+}
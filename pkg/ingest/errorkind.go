@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorKind classifies errors, so the HTTP API, logs and the binary's exit
+// code can tell a malformed offer from a broken pipeline
+type ErrorKind string
+
+const (
+	ErrorSignaling   ErrorKind = "signaling"   // Malformed offers and tokens
+	ErrorNegotiation ErrorKind = "negotiation" // Offers without anything both sides support
+	ErrorPipeline    ErrorKind = "pipeline"    // FFmpeg, sinks and the disk
+	ErrorConfig      ErrorKind = "config"      // Flags, files and the host
+)
+
+// Error is an error of a kind, which prefixes its message
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return string(e.Kind) + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// WithKind classifies an error, unless it already is. A nil error stays nil.
+func WithKind(kind ErrorKind, err error) error {
+	if err == nil || KindOf(err) != "" {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf is the kind of an error, empty if it wasn't classified
+func KindOf(err error) ErrorKind {
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Kind
+	}
+	return ""
+}
+
+// ExitCode is what the binary exits with on an error
+func ExitCode(err error) int {
+	switch KindOf(err) {
+	case ErrorConfig:
+		return 2
+	case ErrorSignaling:
+		return 3
+	case ErrorNegotiation:
+		return 4
+	case ErrorPipeline:
+		return 5
+	default:
+		return 1
+	}
+}
+
+// Status answering a request whose offer failed with an error
+func offerStatus(err error) int {
+	switch KindOf(err) {
+	case ErrorNegotiation:
+		return http.StatusUnprocessableEntity
+	case ErrorPipeline, ErrorConfig:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,185 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// busPublisher publishes events to NATS or Redis pub/sub, on the subject
+// (channel) "<prefix>.<type>", e.g. "ingest.session.started". Both speak a
+// line protocol simple enough that no client library is needed. Events are
+// published in order, and held while the connection is reestablished.
+type busPublisher struct {
+	scheme  string // "nats" or "redis"
+	addr    string
+	user    *url.Userinfo
+	prefix  string
+	metrics *metricRegistry
+	queue   chan event
+
+	mu sync.Mutex // Serializes writes, the reader answers pings too
+}
+
+func newBusPublisher(rawURL, prefix string, metrics *metricRegistry) (*busPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "redis") || u.Host == "" {
+		return nil, fmt.Errorf("invalid event bus URL %q, expected nats:// or redis://", rawURL)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := "4222"
+		if u.Scheme == "redis" {
+			port = "6379"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	p := &busPublisher{
+		scheme:  u.Scheme,
+		addr:    addr,
+		user:    u.User,
+		prefix:  prefix,
+		metrics: metrics,
+		queue:   make(chan event, webhookQueue),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *busPublisher) publish(e event) {
+	select {
+	case p.queue <- e:
+	default:
+		fmt.Println("Event bus queue full, dropping event", e.Type)
+		p.metrics.add(`ingest_bus_events_total{result="dropped"}`, 1)
+	}
+}
+
+func (p *busPublisher) run() {
+	var conn net.Conn
+	backoff := time.Second
+
+	for e := range p.queue {
+		body, err := json.Marshal(e)
+		if err != nil {
+			fmt.Println("Failed to encode event:", err)
+			continue
+		}
+		frame := p.frame(p.prefix+"."+e.Type, body)
+
+		for {
+			if conn == nil {
+				if conn, err = p.connect(); err != nil {
+					fmt.Println("Failed to connect to event bus:", err)
+					time.Sleep(backoff)
+					backoff = min(backoff*2, time.Minute)
+					continue
+				}
+				backoff = time.Second
+			}
+
+			if err = p.write(conn, frame); err != nil {
+				fmt.Println("Failed to publish event:", err)
+				conn.Close()
+				conn = nil
+				continue
+			}
+
+			p.metrics.add(`ingest_bus_events_total{result="published"}`, 1)
+			break
+		}
+	}
+}
+
+func (p *busPublisher) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+
+	var hello []byte
+	switch p.scheme {
+	case "nats":
+		// The server introduces itself with an INFO line first
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+		if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+			conn.Close()
+			return nil, fmt.Errorf("no NATS INFO from %s: %v", p.addr, err)
+		}
+		conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+		options := map[string]any{"verbose": false, "pedantic": false, "name": "ingest"}
+		if p.user != nil {
+			options["user"] = p.user.Username()
+			options["pass"], _ = p.user.Password()
+		}
+		data, _ := json.Marshal(options)
+		hello = append(append([]byte("CONNECT "), data...), "\r\n"...)
+	case "redis":
+		if password, ok := p.user.Password(); ok {
+			hello = respCommand("AUTH", password)
+		}
+	}
+
+	if len(hello) > 0 {
+		if err := p.write(conn, hello); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	go p.read(conn, r)
+	return conn, nil
+}
+
+// Read what the server sends until the connection closes, answering NATS
+// pings and reporting errors. Redis replies to PUBLISH are dropped.
+func (p *busPublisher) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch line = strings.TrimSpace(line); {
+		case line == "PING" && p.scheme == "nats":
+			p.write(conn, []byte("PONG\r\n")) //nolint:errcheck
+		case strings.HasPrefix(line, "-"):
+			fmt.Println("Event bus error:", line)
+		}
+	}
+}
+
+func (p *busPublisher) write(conn net.Conn, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+	_, err := conn.Write(data)
+	return err
+}
+
+func (p *busPublisher) frame(subject string, body []byte) []byte {
+	if p.scheme == "redis" {
+		return respCommand("PUBLISH", subject, string(body))
+	}
+	return []byte(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(body), body))
+}
+
+// Encode a Redis command as a RESP array of bulk strings
+func respCommand(args ...string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,182 @@
+package ingest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Types of session lifecycle events
+const (
+	eventSessionStarted        = "session.started"
+	eventFirstSegment          = "segment.first"
+	eventPublisherDisconnected = "publisher.disconnected"
+	eventRecordingFinalized    = "recording.finalized"
+	eventFFmpegCrashed         = "ffmpeg.crashed"
+	eventRecordingDeleted      = "recording.deleted"
+	eventSessionLimitReached   = "session.limit_reached"
+	eventDTMFReceived          = "dtmf.received"
+	eventTrackEnded            = "track.ended"
+	eventTrackStalled          = "track.stalled"
+)
+
+type event struct {
+	Type    string         `json:"type"`
+	Node    string         `json:"node"`
+	URL     string         `json:"url,omitempty"` // Where the node's HTTP API is reached, for routing viewers
+	Session string         `json:"session"`
+	Time    time.Time      `json:"time"`
+	Data    map[string]any `json:"data,omitempty"`
+}
+
+// eventPublisher delivers events to a system outside the process. publish
+// must not block the session emitting the event.
+type eventPublisher interface {
+	publish(e event)
+}
+
+// eventBus hands session lifecycle events to every configured publisher
+type eventBus struct {
+	node       string
+	url        string
+	publishers []eventPublisher
+}
+
+func newEventBus(cfg *Config, metrics *metricRegistry) (*eventBus, error) {
+	bus := &eventBus{node: cfg.NodeID, url: cfg.PublicURL}
+	if bus.node == "" {
+		bus.node, _ = os.Hostname()
+	}
+
+	if cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid webhook URL %q", cfg.WebhookURL)
+		}
+		bus.publishers = append(bus.publishers, newWebhookPublisher(cfg, metrics))
+	}
+	if cfg.EventBusURL != "" {
+		publisher, err := newBusPublisher(cfg.EventBusURL, cfg.EventBusPrefix, metrics)
+		if err != nil {
+			return nil, err
+		}
+		bus.publishers = append(bus.publishers, publisher)
+	}
+
+	return bus, nil
+}
+
+func (b *eventBus) emit(typ, session string, data map[string]any) {
+	e := event{Type: typ, Node: b.node, URL: b.url, Session: session, Time: time.Now(), Data: data}
+	for _, p := range b.publishers {
+		p.publish(e)
+	}
+}
+
+// Events queued per webhook before new ones are dropped
+const webhookQueue = 256
+
+// webhookPublisher POSTs events as JSON to a URL, signed with an HMAC-SHA256
+// of the body in X-Ingest-Signature. Failed deliveries are retried with
+// exponential backoff, in order, so a slow receiver delays later events
+// rather than reordering them.
+type webhookPublisher struct {
+	url     string
+	secret  []byte
+	events  map[string]bool // Types delivered, all when empty
+	retries int
+	client  *http.Client
+	metrics *metricRegistry
+	queue   chan event
+}
+
+func newWebhookPublisher(cfg *Config, metrics *metricRegistry) *webhookPublisher {
+	w := &webhookPublisher{
+		url:     cfg.WebhookURL,
+		secret:  []byte(cfg.WebhookSecret),
+		events:  map[string]bool{},
+		retries: cfg.WebhookRetries,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		metrics: metrics,
+		queue:   make(chan event, webhookQueue),
+	}
+	for _, typ := range strings.Split(cfg.WebhookEvents, ",") {
+		if typ = strings.TrimSpace(typ); typ != "" {
+			w.events[typ] = true
+		}
+	}
+
+	go w.run()
+	return w
+}
+
+func (w *webhookPublisher) publish(e event) {
+	if len(w.events) > 0 && !w.events[e.Type] {
+		return
+	}
+
+	select {
+	case w.queue <- e:
+	default:
+		fmt.Println("Webhook queue full, dropping event", e.Type)
+		w.metrics.add(`ingest_webhooks_total{result="dropped"}`, 1)
+	}
+}
+
+func (w *webhookPublisher) run() {
+	for e := range w.queue {
+		body, err := json.Marshal(e)
+		if err != nil {
+			fmt.Println("Failed to encode event:", err)
+			continue
+		}
+
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			if err = w.deliver(e.Type, body); err == nil {
+				w.metrics.add(`ingest_webhooks_total{result="delivered"}`, 1)
+				break
+			}
+			if attempt >= w.retries {
+				fmt.Printf("Giving up on webhook %s: %v\n", e.Type, err)
+				w.metrics.add(`ingest_webhooks_total{result="failed"}`, 1)
+				break
+			}
+
+			time.Sleep(backoff)
+			backoff = min(backoff*2, time.Minute)
+		}
+	}
+}
+
+func (w *webhookPublisher) deliver(typ string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Ingest-Event", typ)
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set("X-Ingest-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
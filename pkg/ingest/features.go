@@ -0,0 +1,112 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Experimental subsystems that can be toggled at runtime, per deployment
+// and per session, without a rebuild
+const (
+	featureLLHLS = "ll-hls"
+	featureMoQ   = "moq"
+	featureSFU   = "sfu"
+)
+
+var knownFeatures = []string{featureLLHLS, featureMoQ, featureSFU}
+
+// featureFlags is a set of toggles for the experimental subsystems
+type featureFlags struct {
+	mu       sync.Mutex
+	flags    map[string]bool
+	onChange func() // Called after the flags were changed
+}
+
+// Parse a comma separated list of enabled features, like "ll-hls,sfu"
+func newFeatureFlags(spec string) (*featureFlags, error) {
+	f := &featureFlags{flags: map[string]bool{}}
+	for _, name := range knownFeatures {
+		f.flags[name] = false
+	}
+
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !slices.Contains(knownFeatures, name) {
+			return nil, fmt.Errorf("unknown feature %q", name)
+		}
+		f.flags[name] = true
+	}
+
+	return f, nil
+}
+
+func (f *featureFlags) enabled(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.flags[name]
+}
+
+func (f *featureFlags) snapshot() map[string]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	flags := make(map[string]bool, len(f.flags))
+	for name, on := range f.flags {
+		flags[name] = on
+	}
+	return flags
+}
+
+// Copy of the flags, sessions start with the deployment's flags at the
+// time they connect and are toggled separately afterwards
+func (f *featureFlags) clone() *featureFlags {
+	return &featureFlags{flags: f.snapshot()}
+}
+
+// set applies updates, all or nothing
+func (f *featureFlags) set(updates map[string]bool) error {
+	for name := range updates {
+		if !slices.Contains(knownFeatures, name) {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+	}
+
+	f.mu.Lock()
+	for name, on := range updates {
+		f.flags[name] = on
+	}
+	onChange := f.onChange
+	f.mu.Unlock()
+
+	if onChange != nil {
+		onChange()
+	}
+	return nil
+}
+
+func (f *featureFlags) serveGet(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.snapshot()) //nolint:errcheck
+}
+
+// Toggle flags from a JSON object like {"ll-hls": true}
+func (f *featureFlags) servePatch(w http.ResponseWriter, r *http.Request) {
+	updates := map[string]bool{}
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		http.Error(w, "invalid feature flags", http.StatusBadRequest)
+		return
+	}
+	if err := f.set(updates); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.serveGet(w, r)
+}
@@ -0,0 +1,254 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Video FEC, as Chrome sends it: ULPFEC (RFC 5109) packets wrapped in RED
+// next to the RED wrapped media packets, all on the media's SSRC
+const (
+	mimeTypeVideoRED = "video/red"
+	mimeTypeULPFEC   = "video/ulpfec"
+)
+
+const (
+	fecHeldPackets  = 64  // Packets held back waiting for a lost one to be recovered
+	fecKeptPackets  = 512 // Media packets kept to recover others from
+	fecKeptRepairs  = 32  // FEC packets kept
+	ulpfecHeaderLen = 10
+)
+
+func registerVideoFEC(m *webrtc.MediaEngine) error {
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeVideoRED, ClockRate: 90000}, PayloadType: 116},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeULPFEC, ClockRate: 90000}, PayloadType: 127},
+	} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fecDecoder unwraps the media packets of a RED video track and recovers the
+// lost ones from the ULPFEC packets protecting them. Packets after a gap are
+// held back until the lost one was recovered, or given up on once
+// fecHeldPackets piled up, so the frames are assembled from repaired
+// packets rather than broken ones that need a keyframe to recover from.
+type fecDecoder struct {
+	ulpfec  uint8 // Payload type of the FEC packets inside RED
+	track   string
+	metrics *metricRegistry
+
+	started bool
+	next    uint16                 // Sequence number of the next packet to hand out
+	latest  uint16                 // Highest sequence number of the media kept
+	held    map[uint16]*rtp.Packet // Nil for the sequence numbers of FEC packets
+	media   map[uint16]*rtp.Packet
+	repairs [][]byte
+	ready   []*rtp.Packet
+	err     error // Of the track, once the held packets were handed out
+}
+
+// newFECDecoder decodes a RED track, nil when the publisher doesn't send one
+func newFECDecoder(receiver *webrtc.RTPReceiver, track string, metrics *metricRegistry) *fecDecoder {
+	ulpfec, ok := negotiatedCodec(receiver, mimeTypeULPFEC)
+	if !ok {
+		return nil
+	}
+	return &fecDecoder{
+		ulpfec:  uint8(ulpfec.PayloadType),
+		track:   track,
+		metrics: metrics,
+		held:    map[uint16]*rtp.Packet{},
+		media:   map[uint16]*rtp.Packet{},
+	}
+}
+
+// nextPacket returns the next media packet of the track in order, read with read
+func (d *fecDecoder) nextPacket(read func() (*rtp.Packet, error)) (*rtp.Packet, error) {
+	for d != nil && len(d.ready) == 0 {
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		packet, err := read()
+		if err != nil {
+			// Hand out what is held before the error
+			d.err = err
+			d.release(true)
+			continue
+		}
+		d.push(packet)
+	}
+	if d == nil {
+		return read()
+	}
+
+	packet := d.ready[0]
+	d.ready = d.ready[1:]
+	return packet, nil
+}
+
+func (d *fecDecoder) push(packet *rtp.Packet) {
+	blocks, err := parseRED(packet.Payload)
+	if err != nil {
+		fmt.Println("Error parsing RED packet:", err)
+		return
+	}
+
+	// Video RED only carries its primary block
+	block := blocks[len(blocks)-1]
+	if block.payloadType == d.ulpfec {
+		d.repairs = append(d.repairs, block.payload)
+		if len(d.repairs) > fecKeptRepairs {
+			d.repairs = d.repairs[1:]
+		}
+		// FEC packets take sequence numbers of the media's, which aren't lost
+		if d.started && int16(packet.SequenceNumber-d.next) >= 0 {
+			d.held[packet.SequenceNumber] = nil
+		}
+	} else {
+		d.add(redBlockPacket(packet, packet.SequenceNumber, block))
+	}
+	d.recover(packet.SSRC)
+	d.release(false)
+}
+
+// Keep a media packet to hand out and recover others from
+func (d *fecDecoder) add(packet *rtp.Packet) {
+	seq := packet.SequenceNumber
+	if !d.started {
+		d.started = true
+		d.next, d.latest = seq, seq
+	}
+
+	// Only the last fecKeptPackets sequence numbers are kept, lost ones
+	// included, so no packet outlives a wrap of the sequence numbers
+	if ahead := int(int16(seq - d.latest)); ahead >= fecKeptPackets {
+		clear(d.media)
+		d.latest = seq
+	} else if ahead > 0 {
+		for i := range ahead {
+			delete(d.media, d.latest-fecKeptPackets+1+uint16(i))
+		}
+		d.latest = seq
+	} else if -ahead >= fecKeptPackets {
+		return
+	}
+
+	d.media[seq] = packet
+	// Packets already given up on are only kept for recovery
+	if int16(seq-d.next) >= 0 {
+		d.held[seq] = packet
+	}
+}
+
+// Hand out the held packets that are in order, skipping lost ones once too
+// many are held, or all of them
+func (d *fecDecoder) release(all bool) {
+	for len(d.held) > 0 {
+		if packet, ok := d.held[d.next]; ok {
+			if packet != nil {
+				d.ready = append(d.ready, packet)
+			}
+			delete(d.held, d.next)
+		} else if !all && len(d.held) < fecHeldPackets {
+			return
+		}
+		d.next++
+	}
+}
+
+// Recover the lost packets FEC packets protect all but one of
+func (d *fecDecoder) recover(ssrc uint32) {
+	for recovered := true; recovered; {
+		recovered = false
+		for _, repair := range d.repairs {
+			if packet := d.recoverFrom(repair, ssrc); packet != nil {
+				d.metrics.add(fmt.Sprintf("ingest_fec_recovered_total{track=%q}", d.track), 1)
+				d.add(packet)
+				recovered = true
+			}
+		}
+	}
+}
+
+// The packet an ULPFEC packet recovers, if it protects exactly one lost packet
+// still waited for
+func (d *fecDecoder) recoverFrom(repair []byte, ssrc uint32) *rtp.Packet {
+	if len(repair) < ulpfecHeaderLen+4 {
+		return nil
+	}
+	maskLen := 2
+	if repair[0]&0x40 != 0 {
+		maskLen = 6
+	}
+	levelStart := ulpfecHeaderLen + 2 + maskLen
+	if len(repair) < levelStart {
+		return nil
+	}
+	base := binary.BigEndian.Uint16(repair[2:])
+	protection := int(binary.BigEndian.Uint16(repair[ulpfecHeaderLen:]))
+	mask := repair[ulpfecHeaderLen+2 : levelStart]
+	payload := repair[levelStart:]
+	if len(payload) < protection {
+		return nil
+	}
+
+	var protected []*rtp.Packet
+	lost, missing := uint16(0), 0
+	for bit := 0; bit < maskLen*8; bit++ {
+		if mask[bit/8]&(0x80>>(bit%8)) == 0 {
+			continue
+		}
+		seq := base + uint16(bit)
+		if packet, ok := d.media[seq]; ok {
+			protected = append(protected, packet)
+		} else {
+			lost = seq
+			missing++
+		}
+	}
+	if missing != 1 || int16(lost-d.next) < 0 {
+		return nil
+	}
+
+	// XOR the protected packets out of the FEC packet's recovery fields
+	first, second := repair[0], repair[1]
+	timestamp := binary.BigEndian.Uint32(repair[4:])
+	length := binary.BigEndian.Uint16(repair[8:])
+	recovered := append([]byte(nil), payload[:protection]...)
+	for _, packet := range protected {
+		raw, err := packet.Marshal()
+		if err != nil {
+			return nil
+		}
+		first ^= raw[0]
+		second ^= raw[1]
+		timestamp ^= packet.Timestamp
+		length ^= uint16(len(raw) - 12)
+		for i := 0; i < protection && 12+i < len(raw); i++ {
+			recovered[i] ^= raw[12+i]
+		}
+	}
+	if int(length) > protection {
+		return nil
+	}
+
+	raw := make([]byte, 12, 12+int(length))
+	raw[0] = 0x80 | first&0x3f
+	raw[1] = second
+	binary.BigEndian.PutUint16(raw[2:], lost)
+	binary.BigEndian.PutUint32(raw[4:], timestamp)
+	binary.BigEndian.PutUint32(raw[8:], ssrc)
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(append(raw, recovered[:length]...)); err != nil {
+		return nil
+	}
+	return packet
+}
@@ -0,0 +1,176 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+const testSSRC = 0x1234
+
+// VP8 packet as a publisher sends it, before RED wrapping
+func testMediaPacket(seq uint16, marker bool, payload []byte) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{Version: 2, Marker: marker, PayloadType: 96, SequenceNumber: seq, Timestamp: 3000 * uint32(seq/2), SSRC: testSSRC}, Payload: payload}
+}
+
+// ULPFEC payload protecting the media packets, of consecutive sequence
+// numbers from the first
+func testULPFEC(t *testing.T, protected []*rtp.Packet) []byte {
+	t.Helper()
+	header := make([]byte, ulpfecHeaderLen)
+	binary.BigEndian.PutUint16(header[2:], protected[0].SequenceNumber)
+	var mask uint16
+	protection := 0
+	var raws [][]byte
+	for _, packet := range protected {
+		raw, err := packet.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raws = append(raws, raw)
+		header[0] ^= raw[0]
+		header[1] ^= raw[1]
+		timestamp := binary.BigEndian.Uint32(header[4:]) ^ packet.Timestamp
+		binary.BigEndian.PutUint32(header[4:], timestamp)
+		length := binary.BigEndian.Uint16(header[8:]) ^ uint16(len(raw)-12)
+		binary.BigEndian.PutUint16(header[8:], length)
+		mask |= 0x8000 >> (packet.SequenceNumber - protected[0].SequenceNumber)
+		protection = max(protection, len(raw)-12)
+	}
+	header[0] &= 0x3f // Neither the E nor the long mask flag
+
+	payload := make([]byte, protection)
+	for _, raw := range raws {
+		for i, b := range raw[12:] {
+			payload[i] ^= b
+		}
+	}
+	level := binary.BigEndian.AppendUint16(nil, uint16(protection))
+	level = binary.BigEndian.AppendUint16(level, mask)
+	return append(append(header, level...), payload...)
+}
+
+func TestFECDecoder(t *testing.T) {
+	media := []*rtp.Packet{
+		testMediaPacket(100, false, []byte{1, 2, 3}),
+		testMediaPacket(101, true, []byte{4, 5}),
+		testMediaPacket(103, false, []byte{6, 7, 8, 9}),
+		testMediaPacket(104, true, []byte{10}),
+		testMediaPacket(106, true, []byte{11, 12}),
+	}
+	red := func(packet *rtp.Packet) *rtp.Packet {
+		header := packet.Header.Clone()
+		header.PayloadType = 116
+		return &rtp.Packet{Header: header, Payload: append([]byte{packet.PayloadType}, packet.Payload...)}
+	}
+	fec := func(seq uint16, protected ...*rtp.Packet) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 116, SequenceNumber: seq, SSRC: testSSRC}, Payload: append([]byte{127}, testULPFEC(t, protected)...)}
+	}
+
+	for name, tc := range map[string]struct {
+		sent []*rtp.Packet
+		want []*rtp.Packet
+	}{
+		"in order": {
+			sent: []*rtp.Packet{red(media[0]), red(media[1]), fec(102, media[0], media[1]), red(media[2]), red(media[3]), fec(105, media[2], media[3]), red(media[4])},
+			want: media,
+		},
+		"recovered": {
+			sent: []*rtp.Packet{red(media[0]), fec(102, media[0], media[1]), red(media[2]), red(media[3]), fec(105, media[2], media[3]), red(media[4])},
+			want: media,
+		},
+		"recovered late": {
+			sent: []*rtp.Packet{red(media[0]), red(media[1]), fec(102, media[0], media[1]), red(media[3]), red(media[4]), fec(105, media[2], media[3])},
+			want: media,
+		},
+		"lost": {
+			sent: []*rtp.Packet{red(media[0]), red(media[1]), red(media[3]), red(media[4])},
+			want: []*rtp.Packet{media[0], media[1], media[3], media[4]},
+		},
+	} {
+		d := &fecDecoder{ulpfec: 127, track: "video", metrics: newMetricRegistry(), held: map[uint16]*rtp.Packet{}, media: map[uint16]*rtp.Packet{}}
+		sent := tc.sent
+		read := func() (*rtp.Packet, error) {
+			if len(sent) == 0 {
+				return nil, io.EOF
+			}
+			packet := sent[0]
+			sent = sent[1:]
+			return packet, nil
+		}
+
+		var got []*rtp.Packet
+		for {
+			packet, err := d.nextPacket(read)
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: nextPacket: %v", name, err)
+			}
+			got = append(got, packet)
+		}
+
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %d packets, want %d", name, len(got), len(tc.want))
+			continue
+		}
+		for i, packet := range got {
+			want := tc.want[i]
+			if packet.SequenceNumber != want.SequenceNumber || packet.Timestamp != want.Timestamp || packet.Marker != want.Marker ||
+				packet.PayloadType != want.PayloadType || !bytes.Equal(packet.Payload, want.Payload) {
+				t.Errorf("%s: packet %d = %v, want %v", name, i, packet, want)
+			}
+		}
+	}
+}
+
+// FEC packets don't hold back the media packets after them
+func TestFECDecoderSkipsRepairSequenceNumbers(t *testing.T) {
+	d := &fecDecoder{ulpfec: 127, held: map[uint16]*rtp.Packet{}, media: map[uint16]*rtp.Packet{}, metrics: newMetricRegistry()}
+	first, second := testMediaPacket(1, true, []byte{1}), testMediaPacket(3, true, []byte{2})
+	wrap := func(p *rtp.Packet) *rtp.Packet {
+		return &rtp.Packet{Header: p.Header, Payload: append([]byte{p.PayloadType}, p.Payload...)}
+	}
+
+	d.push(wrap(first))
+	d.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2, SSRC: testSSRC}, Payload: append([]byte{127}, testULPFEC(t, []*rtp.Packet{first})...)})
+	d.push(wrap(second))
+	if len(d.ready) != 2 || d.ready[1].SequenceNumber != 3 {
+		t.Errorf("ready = %v, want both media packets", d.ready)
+	}
+}
+
+// Packets from before a wrap of the sequence numbers don't stand in for
+// the ones after it, even when the packet that would evict them was lost
+func TestFECDecoderWrap(t *testing.T) {
+	d := &fecDecoder{ulpfec: 127, track: "video", held: map[uint16]*rtp.Packet{}, media: map[uint16]*rtp.Packet{}, metrics: newMetricRegistry()}
+	wrap := func(p *rtp.Packet) *rtp.Packet {
+		return &rtp.Packet{Header: p.Header, Payload: append([]byte{p.PayloadType}, p.Payload...)}
+	}
+
+	d.push(wrap(testMediaPacket(0, true, []byte{0xaa})))
+	for seq := 1; seq <= 0xffff; seq++ {
+		if seq != fecKeptPackets {
+			d.push(wrap(testMediaPacket(uint16(seq), true, []byte{byte(seq)})))
+		}
+		d.ready = nil
+	}
+
+	first, lost := testMediaPacket(0, false, []byte{0xbb, 1}), testMediaPacket(1, true, []byte{2, 3})
+	d.push(wrap(first))
+	d.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2, SSRC: testSSRC}, Payload: append([]byte{127}, testULPFEC(t, []*rtp.Packet{first, lost})...)})
+	d.push(wrap(testMediaPacket(3, true, []byte{4})))
+
+	if len(d.ready) != 3 {
+		t.Fatalf("ready = %v, want 3 packets", d.ready)
+	}
+	for i, want := range []*rtp.Packet{first, lost} {
+		if got := d.ready[i]; got.SequenceNumber != want.SequenceNumber || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("packet %d = %v, want %v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ffmpegProcess is a started FFmpeg waiting for media on its stdin
+type ffmpegProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *stderrTail
+
+	exited  chan struct{}
+	waitErr error
+}
+
+func startFFmpegProcess(args []string) (*ffmpegProcess, error) {
+	return startProcess("ffmpeg", args)
+}
+
+// Start an encoder process of another backend, like gst-launch-1.0, managed
+// as FFmpegs are
+func startProcess(name string, args []string) (*ffmpegProcess, error) {
+	cmd := exec.Command(name, args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+	}
+
+	stderr := &stderrTail{}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = stderr
+	isolateProcess(cmd)
+
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	process := &ffmpegProcess{cmd: cmd, stdin: stdin, stderr: stderr, exited: make(chan struct{})}
+	go func() {
+		process.waitErr = cmd.Wait()
+		close(process.exited)
+	}()
+
+	return process, nil
+}
+
+// wait blocks until FFmpeg exited and returns its exit error
+func (p *ffmpegProcess) wait() error {
+	<-p.exited
+	return p.waitErr
+}
+
+// stop ends an FFmpeg still running timeout after its session ended, which
+// normally finalized its outputs once its input closed: its process group
+// gets SIGTERM, and SIGKILL if it still runs another timeout later
+func (p *ffmpegProcess) stop(timeout time.Duration) {
+	for i, signal := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		select {
+		case <-p.exited:
+			return
+		case <-time.After(timeout):
+		}
+
+		fmt.Printf("FFmpeg %d still runs after its session ended, sending %s\n", p.cmd.Process.Pid, []string{"SIGTERM", "SIGKILL"}[i])
+		if err := signalProcessGroup(p.cmd, signal); err != nil {
+			fmt.Println("Failed to signal FFmpeg:", err)
+		}
+	}
+}
+
+// cpuTime is the CPU time the process used so far
+func (p *ffmpegProcess) cpuTime() time.Duration {
+	if p.hasExited() {
+		return p.cmd.ProcessState.UserTime() + p.cmd.ProcessState.SystemTime()
+	}
+	return processCPUTime(p.cmd.Process.Pid)
+}
+
+func (p *ffmpegProcess) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// ffmpegPool keeps idle FFmpeg processes started ahead of time, so the first
+// packets of a new track reach an encoder without paying process startup.
+// FFmpeg only opens its outputs once input arrives, so spares are harmless.
+type ffmpegPool struct {
+	spares int
+
+	mu   sync.Mutex
+	idle map[string][]*ffmpegProcess
+}
+
+func newFFmpegPool(spares int) *ffmpegPool {
+	return &ffmpegPool{spares: spares, idle: map[string][]*ffmpegProcess{}}
+}
+
+func poolKey(args []string) string {
+	return strings.Join(args, "\x00")
+}
+
+// warm tops up the spare processes for an argument list
+func (p *ffmpegPool) warm(args []string) {
+	key := poolKey(args)
+
+	p.mu.Lock()
+	missing := p.spares - len(p.idle[key])
+	p.mu.Unlock()
+
+	for ; missing > 0; missing-- {
+		process, err := startFFmpegProcess(args)
+		if err != nil {
+			fmt.Println("Failed to pre-warm FFmpeg:", err)
+			return
+		}
+
+		p.mu.Lock()
+		p.idle[key] = append(p.idle[key], process)
+		p.mu.Unlock()
+	}
+}
+
+// release stops the spare processes for an argument list
+func (p *ffmpegPool) release(args []string) {
+	key := poolKey(args)
+
+	p.mu.Lock()
+	idle := p.idle[key]
+	delete(p.idle, key)
+	p.mu.Unlock()
+
+	// Without input FFmpeg exits without writing anything
+	for _, process := range idle {
+		process.stdin.Close()
+		go process.wait() //nolint:errcheck
+	}
+}
+
+// start hands out a spare process for the arguments if there is one, or
+// starts a new one. Spares are replaced in the background.
+func (p *ffmpegPool) start(args []string) (*ffmpegProcess, error) {
+	if p.spares <= 0 {
+		return startFFmpegProcess(args)
+	}
+
+	key := poolKey(args)
+
+	p.mu.Lock()
+	var process *ffmpegProcess
+	for len(p.idle[key]) > 0 && process == nil {
+		process = p.idle[key][0]
+		p.idle[key] = p.idle[key][1:]
+
+		// A spare that died while idle is of no use
+		if process.hasExited() {
+			process = nil
+		}
+	}
+	p.mu.Unlock()
+
+	go p.warm(args)
+
+	if process != nil {
+		return process, nil
+	}
+	return startFFmpegProcess(args)
+}
@@ -0,0 +1,9 @@
+package ingest
+
+import "syscall"
+
+// Have the kernel send SIGTERM if the server dies, on which FFmpeg
+// finalizes its outputs and exits, so a crash never leaves FFmpegs running
+func setParentDeathSignal(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGTERM
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package ingest
+
+import "syscall"
+
+// Only Linux kills children with their parent, elsewhere FFmpegs exit on
+// the EOF of their stdin once the server died
+func setParentDeathSignal(*syscall.SysProcAttr) {}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package ingest
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start a process in a process group of its own, so signals reach whatever
+// it spawned and a terminal's Ctrl-C reaches only the server, which ends
+// its sessions
+func isolateProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	setParentDeathSignal(cmd.SysProcAttr)
+}
+
+// Signal the process group of a process started by isolateProcess
+func signalProcessGroup(cmd *exec.Cmd, signal syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, signal)
+}
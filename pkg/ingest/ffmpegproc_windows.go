@@ -0,0 +1,17 @@
+package ingest
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start a process in a process group of its own, so a console's Ctrl-C
+// reaches only the server, which ends its sessions
+func isolateProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// Windows has no signals to end a process with, it is killed either way
+func signalProcessGroup(cmd *exec.Cmd, _ syscall.Signal) error {
+	return cmd.Process.Kill()
+}
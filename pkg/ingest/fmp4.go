@@ -0,0 +1,500 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	cmafSegmentDuration = time.Second // Segments are cut at the first keyframe after this much media
+	cmafPlaylistSize    = 6
+
+	opusPreSkip = 312 // Samples decoders drop at the start, what libopus encoders use
+)
+
+// H.264 NAL unit types the muxer looks at
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+	h264NALAUD = 9
+)
+
+// cmafSink packages H.264 and Opus tracks into fragmented MP4 (CMAF)
+// segments and an HLS playlist in Go, without an FFmpeg process. Each write
+// is one sample: an Opus packet, or an H.264 access unit in Annex B.
+type cmafSink struct {
+	metrics *metricRegistry
+}
+
+func (s *cmafSink) Open(t *Track) (io.WriteCloser, error) {
+	w := &fmp4Writer{dir: t.Dir, name: t.hlsName() + "_cmaf", kind: t.Kind, channels: max(t.Channels, 1), metrics: s.metrics}
+	switch t.codecName() {
+	case "h264":
+		w.timescale, w.duration = 90000, 90000/videoFrameRate
+	case "opus":
+		w.timescale, w.duration = 48000, uint32(48000*opusSilenceDuration/time.Second)
+	default:
+		return nil, fmt.Errorf("cmaf sink only packages H.264 and Opus, not %s", t.Codec.MimeType)
+	}
+
+	// A resumed session continues after the segments of the previous run
+	_, pattern := s.files(t)
+	w.index = t.resumeSegments[pattern]
+	w.first = w.index
+	return w, nil
+}
+
+func (s *cmafSink) files(t *Track) (string, string) {
+	return t.Dir, t.hlsName() + "_cmaf_%d.m4s"
+}
+
+// fmp4Writer writes the init segment once the codec configuration is known,
+// then a media segment of about cmafSegmentDuration at a time
+type fmp4Writer struct {
+	dir       string
+	name      string // Of the playlist, the init segment and segments are named after it
+	kind      string
+	channels  int // Of an Opus track
+	metrics   *metricRegistry
+	timescale uint32
+	duration  uint32 // Of every sample, the pipelines write at a constant rate
+
+	initialized bool
+	sps, pps    []byte
+	width       int // From the SPS
+	height      int
+	samples     []fmp4Sample
+	decodeTime  uint64 // Of the first pending sample
+	sequence    uint32
+	first       int // Index of the first segment in the playlist
+	index       int // Of the next segment
+	durations   []float64
+}
+
+type fmp4Sample struct {
+	data []byte
+	key  bool
+}
+
+func (w *fmp4Writer) Write(p []byte) (int, error) {
+	sample := fmp4Sample{key: true}
+	if w.kind == "video" {
+		var nalus [][]byte
+		for _, nalu := range splitAnnexB(p) {
+			switch nalu[0] & 0x1f {
+			case h264NALSPS:
+				w.sps = append([]byte{}, nalu...)
+			case h264NALPPS:
+				w.pps = append([]byte{}, nalu...)
+			case h264NALAUD:
+				continue
+			}
+			nalus = append(nalus, nalu)
+		}
+		sample.key = h264Keyframe(p)
+
+		// Decoding starts at a keyframe, with the parameter sets it needs
+		if !w.initialized && (!sample.key || w.sps == nil || w.pps == nil) {
+			return len(p), nil
+		}
+		for _, nalu := range nalus {
+			sample.data = binary.BigEndian.AppendUint32(sample.data, uint32(len(nalu)))
+			sample.data = append(sample.data, nalu...)
+		}
+	} else {
+		sample.data = append([]byte{}, p...)
+	}
+
+	if !w.initialized {
+		if err := w.writeInit(); err != nil {
+			return 0, err
+		}
+		w.initialized = true
+	}
+
+	if sample.key && time.Duration(len(w.samples))*time.Second*time.Duration(w.duration)/time.Duration(w.timescale) >= cmafSegmentDuration {
+		if err := w.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	w.samples = append(w.samples, sample)
+	return len(p), nil
+}
+
+// Close writes the last segment and ends the playlist
+func (w *fmp4Writer) Close() error {
+	if !w.initialized {
+		return nil
+	}
+	return w.flush(true)
+}
+
+func (w *fmp4Writer) writeInit() error {
+	entry, err := w.sampleEntry()
+	if err != nil {
+		return err
+	}
+
+	brands := []byte("iso6\x00\x00\x00\x00iso6cmfcmp41")
+	if w.kind == "video" {
+		brands = append(brands, "avc1"...)
+	}
+	init := append(mp4Box("ftyp", brands), w.moov(entry)...)
+	return writeFileAtomic(filepath.Join(w.dir, w.name+"_init.mp4"), init)
+}
+
+// Write the pending samples as a segment and update the playlist
+func (w *fmp4Writer) flush(end bool) error {
+	if len(w.samples) > 0 {
+		w.sequence++
+		segment := w.moof(0)
+		segment = w.moof(uint32(len(segment) + 8))
+		var mdat []byte
+		for _, s := range w.samples {
+			mdat = append(mdat, s.data...)
+		}
+		segment = append(segment, mp4Box("mdat", mdat)...)
+
+		if err := writeFileAtomic(filepath.Join(w.dir, fmt.Sprintf("%s_%d.m4s", w.name, w.index)), segment); err != nil {
+			return err
+		}
+		w.metrics.add(fmt.Sprintf("ingest_cmaf_segments_total{kind=%q}", w.kind), 1)
+
+		w.durations = append(w.durations, float64(len(w.samples))*float64(w.duration)/float64(w.timescale))
+		w.decodeTime += uint64(len(w.samples)) * uint64(w.duration)
+		w.samples = w.samples[:0]
+		w.index++
+	}
+	if len(w.durations) > cmafPlaylistSize {
+		w.first += len(w.durations) - cmafPlaylistSize
+		w.durations = w.durations[len(w.durations)-cmafPlaylistSize:]
+	}
+
+	return writeFileAtomic(filepath.Join(w.dir, w.name+".m3u8"), []byte(w.playlist(end)))
+}
+
+func (w *fmp4Writer) playlist(end bool) string {
+	target := 1.0
+	for _, d := range w.durations {
+		target = max(target, math.Ceil(d))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n", int(target), w.first)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s_init.mp4\"\n", w.name)
+	for i, d := range w.durations {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s_%d.m4s\n", d, w.name, w.first+i)
+	}
+	if end {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+// Sample entry of the track's codec, avc1 or Opus
+func (w *fmp4Writer) sampleEntry() ([]byte, error) {
+	if w.kind != "video" {
+		entry := make([]byte, 28)
+		binary.BigEndian.PutUint16(entry[6:], 1) // Data reference index
+		binary.BigEndian.PutUint16(entry[16:], uint16(w.channels))
+		binary.BigEndian.PutUint16(entry[18:], 16)
+		binary.BigEndian.PutUint32(entry[24:], 48000<<16)
+
+		dOps := []byte{0, byte(w.channels)}
+		dOps = binary.BigEndian.AppendUint16(dOps, opusPreSkip)
+		dOps = binary.BigEndian.AppendUint32(dOps, 48000)
+		dOps = append(dOps, 0, 0, 0) // Output gain, channel mapping family
+		return mp4Box("Opus", entry, mp4Box("dOps", dOps)), nil
+	}
+
+	width, height, err := h264Size(w.sps)
+	if err != nil {
+		return nil, err
+	}
+	entry := make([]byte, 78)
+	binary.BigEndian.PutUint16(entry[6:], 1)
+	binary.BigEndian.PutUint16(entry[24:], uint16(width))
+	binary.BigEndian.PutUint16(entry[26:], uint16(height))
+	binary.BigEndian.PutUint32(entry[28:], 0x00480000) // 72 dpi
+	binary.BigEndian.PutUint32(entry[32:], 0x00480000)
+	binary.BigEndian.PutUint16(entry[40:], 1) // Frame count
+	binary.BigEndian.PutUint16(entry[74:], 0x18)
+	binary.BigEndian.PutUint16(entry[76:], 0xffff)
+
+	avcC := []byte{1, w.sps[1], w.sps[2], w.sps[3], 0xff, 0xe1}
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(w.sps)))
+	avcC = append(avcC, w.sps...)
+	avcC = append(avcC, 1)
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(w.pps)))
+	avcC = append(avcC, w.pps...)
+	w.width, w.height = width, height
+	return mp4Box("avc1", entry, mp4Box("avcC", avcC)), nil
+}
+
+func (w *fmp4Writer) moov(entry []byte) []byte {
+	matrix := []byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0}
+
+	mvhd := make([]byte, 96)
+	binary.BigEndian.PutUint32(mvhd[8:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 0x00010000) // Rate
+	binary.BigEndian.PutUint16(mvhd[20:], 0x0100)     // Volume
+	copy(mvhd[32:], matrix)
+	binary.BigEndian.PutUint32(mvhd[92:], 2) // Next track ID
+
+	tkhd := make([]byte, 80)
+	binary.BigEndian.PutUint32(tkhd[8:], 1) // Track ID
+	copy(tkhd[36:], matrix)
+	handler, header := "soun", mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	if w.kind == "video" {
+		binary.BigEndian.PutUint32(tkhd[72:], uint32(w.width)<<16)
+		binary.BigEndian.PutUint32(tkhd[76:], uint32(w.height)<<16)
+		handler, header = "vide", mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	} else {
+		binary.BigEndian.PutUint16(tkhd[32:], 0x0100)
+	}
+
+	mdhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mdhd[8:], w.timescale)
+	binary.BigEndian.PutUint16(mdhd[16:], 0x55c4) // "und"
+
+	hdlr := append(make([]byte, 4), handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, "ingest\x00"...)
+
+	dref := mp4FullBox("dref", 0, 0, []byte{0, 0, 0, 1}, mp4FullBox("url ", 0, 1))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, []byte{0, 0, 0, 1}, entry),
+		mp4FullBox("stts", 0, 0, make([]byte, 4)),
+		mp4FullBox("stsc", 0, 0, make([]byte, 4)),
+		mp4FullBox("stsz", 0, 0, make([]byte, 8)),
+		mp4FullBox("stco", 0, 0, make([]byte, 4)),
+	)
+
+	trex := []byte{0, 0, 0, 1, 0, 0, 0, 1}
+	trex = append(trex, make([]byte, 12)...)
+
+	return mp4Box("moov",
+		mp4FullBox("mvhd", 0, 0, mvhd),
+		mp4Box("trak",
+			mp4FullBox("tkhd", 0, 3, tkhd),
+			mp4Box("mdia",
+				mp4FullBox("mdhd", 0, 0, mdhd),
+				mp4FullBox("hdlr", 0, 0, hdlr),
+				mp4Box("minf", header, mp4Box("dinf", dref), stbl),
+			),
+		),
+		mp4Box("mvex", mp4FullBox("trex", 0, 0, trex)),
+	)
+}
+
+// Fragment header of the pending samples, whose data starts dataOffset
+// bytes after the start of the fragment
+func (w *fmp4Writer) moof(dataOffset uint32) []byte {
+	tfdt := binary.BigEndian.AppendUint64(nil, w.decodeTime)
+
+	trun := binary.BigEndian.AppendUint32(nil, uint32(len(w.samples)))
+	trun = binary.BigEndian.AppendUint32(trun, dataOffset)
+	for _, s := range w.samples {
+		flags := uint32(0x01010000) // Depends on others, not a sync sample
+		if s.key {
+			flags = 0x02000000
+		}
+		trun = binary.BigEndian.AppendUint32(trun, w.duration)
+		trun = binary.BigEndian.AppendUint32(trun, uint32(len(s.data)))
+		trun = binary.BigEndian.AppendUint32(trun, flags)
+	}
+
+	return mp4Box("moof",
+		mp4FullBox("mfhd", 0, 0, binary.BigEndian.AppendUint32(nil, w.sequence)),
+		mp4Box("traf",
+			mp4FullBox("tfhd", 0, 0x020000, []byte{0, 0, 0, 1}), // Base data offset is the moof
+			mp4FullBox("tfdt", 1, 0, tfdt),
+			mp4FullBox("trun", 0, 0x000701, trun), // Data offset, sample durations, sizes and flags
+		),
+	)
+}
+
+func mp4Box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	box := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+	box = append(box, typ...)
+	for _, p := range payloads {
+		box = append(box, p...)
+	}
+	return box
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// NAL units of an Annex B byte stream, without their start codes
+func splitAnnexB(stream []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(stream); i++ {
+		if stream[i] != 0 || stream[i+1] != 0 || stream[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalus = append(nalus, bytes.TrimRight(stream[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(stream) {
+		nalus = append(nalus, stream[start:])
+	}
+
+	out := nalus[:0]
+	for _, nalu := range nalus {
+		if len(nalu) > 0 {
+			out = append(out, nalu)
+		}
+	}
+	return out
+}
+
+// Whether an H.264 access unit in Annex B holds an IDR picture
+func h264Keyframe(au []byte) bool {
+	for _, nalu := range splitAnnexB(au) {
+		if nalu[0]&0x1f == h264NALIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// Picture size an H.264 SPS NAL unit announces, for 4:2:0 video
+func h264Size(sps []byte) (int, int, error) {
+	if len(sps) < 4 {
+		return 0, 0, errors.New("short H.264 SPS")
+	}
+
+	// Emulation prevention bytes aren't part of the RBSP
+	rbsp := make([]byte, 0, len(sps))
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	r := &bitReader{data: rbsp[3:]}
+	profile := rbsp[0]
+
+	r.ue() // seq_parameter_set_id
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma := r.ue()
+		if chroma == 3 {
+			r.bits(1)
+		}
+		r.ue() // Bit depths
+		r.ue()
+		r.bits(1)
+		if r.bits(1) == 1 { // Scaling matrices
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				for last, next, j := 8, 8, 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue()
+	case 1:
+		r.bits(1)
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue() // max_num_ref_frames
+	r.bits(1)
+	widthMBs, heightUnits := r.ue()+1, r.ue()+1
+	frameMBsOnly := r.bits(1)
+	if frameMBsOnly == 0 {
+		r.bits(1)
+	}
+	r.bits(1)
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bits(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return 0, 0, fmt.Errorf("invalid H.264 SPS: %v", r.err)
+	}
+
+	width := widthMBs*16 - (cropLeft+cropRight)*2
+	height := (2-frameMBsOnly)*heightUnits*16 - (cropTop+cropBottom)*2*(2-frameMBsOnly)
+	return width, height, nil
+}
+
+// bitReader reads the Exp-Golomb coded fields of H.264 parameter sets
+type bitReader struct {
+	data []byte
+	pos  int // In bits
+	err  error
+}
+
+func (r *bitReader) bits(n int) int {
+	v := 0
+	for ; n > 0; n-- {
+		if r.pos >= len(r.data)*8 {
+			r.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		v = v<<1 | int(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.bits(1) == 0 && r.err == nil && zeros < 32 {
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 0 {
+		return -v / 2
+	}
+	return (v + 1) / 2
+}
@@ -0,0 +1,219 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// bitWriter writes the Exp-Golomb coded fields bitReader reads
+type bitWriter struct {
+	data []byte
+	n    int // Bits written
+}
+
+func (w *bitWriter) bits(n, v int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(v>>i&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v int) {
+	length := bits.Len(uint(v + 1))
+	w.bits(length-1, 0)
+	w.bits(length, v+1)
+}
+
+// H.264 SPS NAL unit of a picture size in macroblocks, cropped by the
+// given left, right, top and bottom offsets
+func testSPS(profile byte, widthMBs, heightUnits, frameMBsOnly int, crop ...int) []byte {
+	w := &bitWriter{}
+	w.ue(0) // seq_parameter_set_id
+	if profile == 100 {
+		w.ue(1) // 4:2:0
+		w.ue(0)
+		w.ue(0)
+		w.bits(2, 0)
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(0) // pic_order_cnt_type
+	w.ue(0)
+	w.ue(1) // max_num_ref_frames
+	w.bits(1, 0)
+	w.ue(widthMBs - 1)
+	w.ue(heightUnits - 1)
+	w.bits(1, frameMBsOnly)
+	if frameMBsOnly == 0 {
+		w.bits(1, 0)
+	}
+	w.bits(1, 1)
+	w.bits(1, len(crop)/4)
+	for _, c := range crop {
+		w.ue(c)
+	}
+	w.bits(1, 0) // vui_parameters_present_flag
+	w.bits(1, 1) // rbsp_stop_one_bit
+	return append([]byte{0x67, profile, 0, 40}, w.data...)
+}
+
+func TestH264Size(t *testing.T) {
+	for name, tc := range map[string]struct {
+		sps           []byte
+		width, height int
+		fails         bool
+	}{
+		"baseline 720p":   {sps: testSPS(66, 80, 45, 1), width: 1280, height: 720},
+		"high 1080p":      {sps: testSPS(100, 120, 68, 1, 0, 0, 0, 4), width: 1920, height: 1080},
+		"interlaced 1080": {sps: testSPS(100, 120, 34, 0, 0, 0, 0, 2), width: 1920, height: 1080},
+		"cropped width":   {sps: testSPS(66, 40, 30, 1, 2, 2, 0, 0), width: 632, height: 480},
+		"short":           {sps: []byte{0x67, 66, 0}, fails: true},
+		"truncated":       {sps: testSPS(66, 80, 45, 1)[:5], fails: true},
+	} {
+		width, height, err := h264Size(tc.sps)
+		if (err != nil) != tc.fails || width != tc.width || height != tc.height {
+			t.Errorf("%s: h264Size = %dx%d, %v", name, width, height, err)
+		}
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	for name, tc := range map[string]struct {
+		stream []byte
+		nalus  [][]byte
+	}{
+		"three byte start codes": {stream: []byte{0, 0, 1, 0x67, 1, 0, 0, 1, 0x68, 2}, nalus: [][]byte{{0x67, 1}, {0x68, 2}}},
+		"four byte start codes":  {stream: []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x65, 3}, nalus: [][]byte{{0x09, 0xf0}, {0x65, 3}}},
+		"empty NAL units":        {stream: []byte{0, 0, 1, 0, 0, 1, 0x41, 4}, nalus: [][]byte{{0x41, 4}}},
+		"no start code":          {stream: []byte{0x65, 1, 2}},
+	} {
+		nalus := splitAnnexB(tc.stream)
+		if !slices.EqualFunc(nalus, tc.nalus, bytes.Equal) {
+			t.Errorf("%s: splitAnnexB = % x, want % x", name, nalus, tc.nalus)
+		}
+	}
+}
+
+// Payload of the first box along a path of nested box types
+func mp4Payload(data []byte, path ...string) []byte {
+	for len(data) >= 8 {
+		size := binary.BigEndian.Uint32(data)
+		if size < 8 || int(size) > len(data) {
+			return nil
+		}
+		if string(data[4:8]) == path[0] {
+			if len(path) == 1 {
+				return data[8:size]
+			}
+			return mp4Payload(data[8:size], path[1:]...)
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func TestFMP4WriterOpus(t *testing.T) {
+	dir := t.TempDir()
+	w := &fmp4Writer{dir: dir, name: "a_cmaf", kind: "audio", channels: 2, metrics: newMetricRegistry(), timescale: 48000, duration: uint32(48000 * opusSilenceDuration / time.Second)}
+	var packets [][]byte
+	for i := range 60 {
+		packet := []byte{0xfc, byte(i)}
+		packets = append(packets, packet)
+		if _, err := w.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	playlist, _ := os.ReadFile(filepath.Join(dir, "a_cmaf.m3u8"))
+	want := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-MAP:URI=\"a_cmaf_init.mp4\"\n" +
+		"#EXTINF:1.000,\na_cmaf_0.m4s\n#EXTINF:0.200,\na_cmaf_1.m4s\n#EXT-X-ENDLIST\n"
+	if string(playlist) != want {
+		t.Errorf("playlist = %q, want %q", playlist, want)
+	}
+
+	init, _ := os.ReadFile(filepath.Join(dir, "a_cmaf_init.mp4"))
+	dOps := mp4Payload(init, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	if !bytes.Contains(dOps, []byte("dOps\x00\x02\x01\x38\x00\x00\xbb\x80")) {
+		t.Errorf("init segment lacks the Opus header of 2 channels: % x", dOps)
+	}
+
+	for i, samples := range [][][]byte{packets[:50], packets[50:]} {
+		segment, _ := os.ReadFile(filepath.Join(dir, fmt.Sprintf("a_cmaf_%d.m4s", i)))
+		if mdat := mp4Payload(segment, "mdat"); !bytes.Equal(mdat, bytes.Join(samples, nil)) {
+			t.Errorf("segment %d: mdat = % x", i, mdat)
+		}
+		tfdt := mp4Payload(segment, "moof", "traf", "tfdt")
+		if len(tfdt) != 12 || binary.BigEndian.Uint64(tfdt[4:]) != uint64(i*50*960) {
+			t.Errorf("segment %d: tfdt = % x", i, tfdt)
+		}
+		trun := mp4Payload(segment, "moof", "traf", "trun")
+		if len(trun) < 12 || binary.BigEndian.Uint32(trun[4:]) != uint32(len(samples)) || !bytes.HasSuffix(segment, bytes.Join(samples, nil)) ||
+			int(binary.BigEndian.Uint32(trun[8:])) != len(segment)-len(bytes.Join(samples, nil)) {
+			t.Errorf("segment %d: trun doesn't point at the samples", i)
+		}
+	}
+}
+
+func TestFMP4WriterH264(t *testing.T) {
+	dir := t.TempDir()
+	w := &fmp4Writer{dir: dir, name: "v_cmaf", kind: "video", metrics: newMetricRegistry(), timescale: 90000, duration: 90000 / videoFrameRate}
+	sps, pps := testSPS(66, 80, 45, 1), []byte{0x68, 0xce, 0x3c, 0x80}
+	aud := []byte{0, 0, 0, 1, 0x09, 0xf0}
+	idr := []byte{0x65, 0x88, 0x84}
+	nonIDR := []byte{0x41, 0x9a}
+	annexB := func(nalus ...[]byte) []byte {
+		au := append([]byte{}, aud...)
+		for _, nalu := range nalus {
+			au = append(append(au, 0, 0, 0, 1), nalu...)
+		}
+		return au
+	}
+
+	// Frames before the first keyframe can't be decoded
+	w.Write(annexB(nonIDR)) //nolint:errcheck
+	if w.initialized {
+		t.Fatal("initialized before a keyframe")
+	}
+	for _, au := range [][]byte{annexB(sps, pps, idr), annexB(nonIDR)} {
+		if _, err := w.Write(au); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	init, _ := os.ReadFile(filepath.Join(dir, "v_cmaf_init.mp4"))
+	tkhd := mp4Payload(init, "moov", "trak", "tkhd")
+	if len(tkhd) != 84 || binary.BigEndian.Uint32(tkhd[76:]) != 1280<<16 || binary.BigEndian.Uint32(tkhd[80:]) != 720<<16 {
+		t.Errorf("tkhd = % x, want 1280x720", tkhd)
+	}
+	if stsd := mp4Payload(init, "moov", "trak", "mdia", "minf", "stbl", "stsd"); !bytes.Contains(stsd, append([]byte("avcC\x01"), sps[1:4]...)) {
+		t.Errorf("stsd = % x, want an avcC of the SPS", stsd)
+	}
+
+	// Samples are length prefixed, without the access unit delimiters
+	var want []byte
+	for _, nalus := range [][][]byte{{sps, pps, idr}, {nonIDR}} {
+		for _, nalu := range nalus {
+			want = binary.BigEndian.AppendUint32(want, uint32(len(nalu)))
+			want = append(want, nalu...)
+		}
+	}
+	segment, _ := os.ReadFile(filepath.Join(dir, "v_cmaf_0.m4s"))
+	if mdat := mp4Payload(segment, "mdat"); !bytes.Equal(mdat, want) {
+		t.Errorf("mdat = % x, want % x", mdat, want)
+	}
+}
@@ -0,0 +1,80 @@
+package ingest
+
+import (
+	"fmt"
+	"time"
+)
+
+// gapDetector finds the media lost between consecutive packets of a track
+// from their RTP timestamps. Lost packets would otherwise compress the
+// output timeline, since FFmpeg timestamps what it is fed back to back.
+//
+// Gaps longer than maxGap are outages rather than loss, e.g. a browser tab
+// that was throttled in the background or a network change. Those are
+// bridged up to maxBridge as well, so durations keep matching the wall
+// clock, and start a discontinuity in the playlists.
+type gapDetector struct {
+	track     string
+	clockRate uint32
+	maxGap    time.Duration
+	maxBridge time.Duration // Longest outage bridged, 0 leaves outages alone
+	metrics   *metricRegistry
+	control   *recordingControl
+
+	started  bool
+	expected uint32 // RTP timestamp the next packet should carry
+}
+
+func newGapDetector(track string, clockRate uint32, cfg *Config, metrics *metricRegistry, control *recordingControl) *gapDetector {
+	if !cfg.GapFill {
+		return nil
+	}
+
+	return &gapDetector{
+		track:     track,
+		clockRate: clockRate,
+		maxGap:    cfg.MaxGapFill,
+		maxBridge: cfg.MaxGapBridge,
+		metrics:   metrics,
+		control:   control,
+	}
+}
+
+// missing returns how many frames of the given length are needed to fill
+// the gap before a packet with the given timestamp and duration. Late and
+// duplicate packets never count as gaps.
+func (g *gapDetector) missing(timestamp uint32, duration, frame time.Duration) int {
+	if g == nil {
+		return 0
+	}
+
+	next := timestamp + uint32(duration*time.Duration(g.clockRate)/time.Second)
+	if !g.started {
+		g.started = true
+		g.expected = next
+		return 0
+	}
+
+	gap := int32(timestamp - g.expected)
+	if gap < 0 {
+		return 0
+	}
+	g.expected = next
+
+	lost := time.Duration(gap) * time.Second / time.Duration(g.clockRate)
+	if lost > g.maxGap {
+		if g.maxBridge <= 0 {
+			return 0
+		}
+		fmt.Printf("Bridging %s outage of the %s track\n", lost, g.track)
+		g.metrics.add(fmt.Sprintf("ingest_outages_total{track=%q}", g.track), 1)
+		g.control.markNextSegments()
+		lost = min(lost, g.maxBridge)
+	}
+
+	n := int(lost / frame)
+	if n > 0 {
+		g.metrics.add(fmt.Sprintf("ingest_gap_filled_seconds_total{track=%q}", g.track), (time.Duration(n) * frame).Seconds())
+	}
+	return n
+}
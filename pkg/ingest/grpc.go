@@ -0,0 +1,426 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Service path of control.proto
+const grpcService = "/ingest.v1.Control/"
+
+// Largest request message accepted, an offer with many candidates
+const grpcMaxMessage = 1 << 20
+
+// gRPC status codes the control plane answers with
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// grpcControl serves the Control service of control.proto, a typed
+// counterpart of the REST API for backend services. Messages are encoded by
+// hand in the Protocol Buffers wire format, so no generated code is needed.
+type grpcControl struct {
+	server *Server
+}
+
+// ListenGRPC serves the control plane on -grpc-addr over HTTP/2, with TLS if
+// the HTTPS listener has certificate files and in cleartext (h2c) otherwise,
+// and returns right away without it
+func (s *Server) ListenGRPC() error {
+	if s.cfg.GRPCAddr == "" {
+		return nil
+	}
+
+	server := &http.Server{Addr: s.cfg.GRPCAddr, Handler: &grpcControl{server: s}}
+	if s.cfg.TLSCert != "" {
+		fmt.Println("Serving the gRPC control plane over TLS on", s.cfg.GRPCAddr)
+		return server.ListenAndServeTLS(s.cfg.TLSCert, s.cfg.TLSKey)
+	}
+	server.Handler = h2c.NewHandler(server.Handler, &http2.Server{})
+	fmt.Println("Serving the gRPC control plane on", s.cfg.GRPCAddr)
+	return server.ListenAndServe()
+}
+
+func (c *grpcControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	err := c.call(w, r)
+	code, message := grpcStatus(err)
+	if code != grpcOK && code != grpcNotFound && code != grpcUnauthenticated {
+		fmt.Printf("Error in gRPC call %s: %v\n", r.URL.Path, err)
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(message))
+	}
+}
+
+func (c *grpcControl) call(w http.ResponseWriter, r *http.Request) error {
+	method := strings.TrimPrefix(r.URL.Path, grpcService)
+	switch method {
+	case "CreateSession", "Signal":
+		// Publish tokens are checked by publishAs, as for WHIP
+		if c.server.publishAuth == nil {
+			if err := c.authorize(r, scopeSignal); err != nil {
+				return err
+			}
+		}
+	case "ListSessions", "StopSession", "StreamStats":
+		if err := c.authorize(r, scopeAdmin); err != nil {
+			return err
+		}
+	default:
+		return &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+
+	request, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	switch method {
+	case "CreateSession":
+		return c.createSession(w, r, request)
+	case "Signal":
+		return c.signal(w, r, request)
+	case "ListSessions":
+		return c.listSessions(w)
+	case "StopSession":
+		return c.stopSession(w, request)
+	default:
+		return c.streamStats(w, r, request)
+	}
+}
+
+func (c *grpcControl) authorize(r *http.Request, scope string) error {
+	if c.server.http.auth == nil {
+		return nil
+	}
+	if _, err := c.server.http.auth.Authorize(r, scope); err != nil {
+		return fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+	return nil
+}
+
+// Start a session for an offer, which is closed if it can't be answered
+func (c *grpcControl) publish(r *http.Request, offer string) (*Session, *webrtc.SessionDescription, error) {
+	if offer == "" {
+		return nil, nil, WithKind(ErrorSignaling, errors.New("the request has no offer"))
+	}
+	session, err := c.server.publishAs(requestToken(r), requestIdentity(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	session.mu.Lock()
+	session.userAgent = r.UserAgent()
+	session.mu.Unlock()
+
+	answer, err := session.Answer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		session.Close() //nolint:errcheck
+		return nil, nil, err
+	}
+	return session, answer, nil
+}
+
+func (c *grpcControl) createSession(w http.ResponseWriter, r *http.Request, request []byte) error {
+	var offer string
+	err := decodeProto(request, func(number int, value protoField) error {
+		if number == 1 {
+			offer = value.string()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	session, answer, err := c.publish(r, offer)
+	if err != nil {
+		return err
+	}
+	response := &protoEncoder{}
+	response.string(1, session.ID())
+	response.string(2, answer.SDP)
+	return writeGRPCMessage(w, response.buf)
+}
+
+func (c *grpcControl) signal(w http.ResponseWriter, r *http.Request, request []byte) error {
+	var offer string
+	err := decodeProto(request, func(number int, value protoField) error {
+		if number == 1 {
+			offer = value.string()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	session, answer, err := c.publish(r, offer)
+	if err != nil {
+		return err
+	}
+	response := &protoEncoder{}
+	response.string(1, session.ID())
+	response.string(2, answer.SDP)
+	if err := writeGRPCMessage(w, response.buf); err != nil {
+		session.Close() //nolint:errcheck
+		return err
+	}
+
+	// Trickled candidates arrive until the client half-closes the stream
+	go func() {
+		for {
+			request, err := readGRPCMessage(r.Body)
+			if err != nil {
+				return
+			}
+			decodeProto(request, func(number int, value protoField) error { //nolint:errcheck
+				if number == 2 && value.string() != "" {
+					candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(value.string(), "a=")}
+					if err := session.peerConnection.AddICECandidate(candidate); err != nil {
+						fmt.Println("Error adding trickled ICE candidate:", err)
+					}
+				}
+				return nil
+			})
+		}
+	}()
+
+	select {
+	case <-session.Done():
+	case <-r.Context().Done():
+		// The client hung up
+		if err := session.Close(); err != nil {
+			fmt.Println("Error closing peer connection:", err)
+		}
+		return nil
+	}
+	ended := &protoEncoder{}
+	ended.string(1, session.ID())
+	ended.bool(3, true)
+	return writeGRPCMessage(w, ended.buf)
+}
+
+func (c *grpcControl) listSessions(w http.ResponseWriter) error {
+	response := &protoEncoder{}
+	for _, session := range c.server.sessions.list() {
+		metadata := session.metadata()
+		response.message(1, func(info *protoEncoder) {
+			info.string(1, metadata.ID)
+			info.string(2, metadata.Tenant)
+			info.int(3, metadata.Started.UnixMilli())
+			if metadata.Publisher != nil {
+				info.string(4, metadata.Publisher.UserID)
+			}
+			info.string(5, metadata.UserAgent)
+			info.int(6, int64(len(metadata.Tracks)))
+			info.string(7, metadata.Transport)
+			info.string(8, metadata.Priority)
+		})
+	}
+	return writeGRPCMessage(w, response.buf)
+}
+
+// Session named by the first field of a request
+func (c *grpcControl) session(request []byte) (*Session, error) {
+	var id string
+	err := decodeProto(request, func(number int, value protoField) error {
+		if number == 1 {
+			id = value.string()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	session := c.server.sessions.get(id)
+	if session == nil {
+		return nil, &grpcError{grpcNotFound, fmt.Sprintf("unknown session %q", id)}
+	}
+	return session, nil
+}
+
+func (c *grpcControl) stopSession(w http.ResponseWriter, request []byte) error {
+	session, err := c.session(request)
+	if err != nil {
+		return err
+	}
+	if err := session.Close(); err != nil {
+		fmt.Println("Error closing peer connection:", err)
+	}
+	return writeGRPCMessage(w, nil)
+}
+
+func (c *grpcControl) streamStats(w http.ResponseWriter, r *http.Request, request []byte) error {
+	session, err := c.session(request)
+	if err != nil {
+		return err
+	}
+	interval := time.Second
+	decodeProto(request, func(number int, value protoField) error { //nolint:errcheck
+		if number == 2 && value.number > 0 {
+			interval = max(time.Duration(value.number)*time.Millisecond, 100*time.Millisecond)
+		}
+		return nil
+	})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ended := false
+		select {
+		case <-session.Done():
+			ended = true
+		default:
+		}
+		if err := writeGRPCMessage(w, sessionStats(session, ended)); err != nil || ended {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-session.Done():
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+// SessionStats message of a session
+func sessionStats(session *Session, ended bool) []byte {
+	usage := session.resourceUsage()
+	stats := &protoEncoder{}
+	stats.string(1, session.ID())
+	stats.int(2, time.Now().UnixMilli())
+	stats.double(3, usage.CPUSeconds)
+	stats.int(4, int64(usage.FFmpegs))
+	stats.int(5, usage.BufferedBytes)
+	stats.uint(6, usage.BytesReceived)
+	stats.int(7, int64(usage.Bitrate))
+
+	var received, lost uint64
+	for _, track := range session.metadata().Tracks {
+		received += track.Received
+		lost += track.Lost
+	}
+	stats.uint(8, received)
+	stats.uint(9, lost)
+	stats.bool(10, ended)
+	if link := session.link.summary(false); link != nil {
+		stats.double(11, link.RTT)
+		stats.double(12, link.FractionLost)
+		stats.double(13, link.Jitter)
+		stats.int(14, int64(link.Score))
+	}
+	return stats.buf
+}
+
+// Read a length-prefixed message of a gRPC stream
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages aren't supported"}
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessage {
+		return nil, &grpcError{grpcResourceExhausted, "request message too large"}
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, message []byte) error {
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message)))
+	if _, err := w.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// Status code and message of the error a call ended with
+func grpcStatus(err error) (int, string) {
+	var status *grpcError
+	var elsewhere *elsewhereError
+	switch {
+	case err == nil:
+		return grpcOK, ""
+	case errors.As(err, &status):
+		return status.code, status.message
+	case errors.Is(err, errInvalidProto):
+		return grpcInvalidArgument, err.Error()
+	case errors.Is(err, errUnauthorized):
+		return grpcUnauthenticated, "unauthorized"
+	case errors.Is(err, errDraining):
+		return grpcUnavailable, err.Error()
+	case errors.Is(err, errQuotaExceeded):
+		return grpcResourceExhausted, err.Error()
+	case errors.Is(err, errOutsideSchedule), errors.As(err, &elsewhere):
+		return grpcFailedPrecondition, err.Error()
+	}
+
+	switch KindOf(err) {
+	case ErrorSignaling:
+		return grpcInvalidArgument, err.Error()
+	case ErrorNegotiation:
+		return grpcFailedPrecondition, err.Error()
+	case ErrorPipeline, ErrorConfig:
+		return grpcInternal, err.Error()
+	}
+	return grpcUnknown, err.Error()
+}
+
+// Percent-encode a status message as the gRPC protocol asks
+func grpcEscape(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
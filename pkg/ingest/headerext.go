@@ -0,0 +1,260 @@
+package ingest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Coordination of Video Orientation (3GPP TS 26.114), mobile browsers send
+// their frames as captured and tell the rotation to display them with
+const videoOrientationURI = "urn:3gpp:video-orientation"
+
+// Window the receive bitrate and transport loss are measured over
+const networkWindow = time.Second
+
+// Register the header extensions read by headerReader. transport-cc is
+// already registered along with the TWCC feedback interceptor.
+func registerHeaderExtensions(m *webrtc.MediaEngine) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.ABSSendTimeURI}, kind); err != nil {
+			return err
+		}
+	}
+	return m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: videoOrientationURI}, webrtc.RTPCodecTypeVideo)
+}
+
+// headerReader reads the header extensions of a track's packets as they
+// arrive, before RED or FEC are unwrapped: abs-send-time and transport-cc
+// feed the session's network estimate, video orientation the rotation the
+// track is recorded with
+type headerReader struct {
+	absSendTime uint8 // Negotiated IDs, 0 if not negotiated
+	transportCC uint8
+	orientation uint8
+	network     *networkEstimator
+	rotations   *videoOrientation
+}
+
+func (s *Session) newHeaderReader(t *Track, receiver *webrtc.RTPReceiver) *headerReader {
+	r := &headerReader{
+		absSendTime: headerExtensionID(receiver, sdp.ABSSendTimeURI),
+		transportCC: headerExtensionID(receiver, sdp.TransportCCURI),
+		network:     s.network,
+	}
+	if t.Kind == "video" {
+		r.orientation = headerExtensionID(receiver, videoOrientationURI)
+		t.orientation = &videoOrientation{}
+		r.rotations = t.orientation
+	}
+	return r
+}
+
+func (r *headerReader) observe(packet *rtp.Packet) {
+	if r == nil {
+		return
+	}
+
+	var sendTime uint32
+	sent := false
+	if ext := packet.GetExtension(r.absSendTime); r.absSendTime != 0 && len(ext) >= 3 {
+		sendTime, sent = uint32(ext[0])<<16|uint32(ext[1])<<8|uint32(ext[2]), true
+	}
+	transportSeq, sequenced := uint16(0), false
+	if ext := packet.GetExtension(r.transportCC); r.transportCC != 0 && len(ext) >= 2 {
+		transportSeq, sequenced = uint16(ext[0])<<8|uint16(ext[1]), true
+	}
+	r.network.observe(time.Now(), packet.MarshalSize(), sendTime, sent, transportSeq, sequenced)
+
+	// Chrome sends the orientation on the last packet of every frame
+	if ext := packet.GetExtension(r.orientation); r.orientation != 0 && len(ext) >= 1 && packet.Marker {
+		r.rotations.frames[ext[0]&0x7].Add(1)
+	}
+}
+
+// networkEstimator estimates the network path from a publisher over all of
+// its tracks: the queuing delay from the abs-send-time of the packets, and
+// the receive bitrate and loss from their transport-wide sequence numbers
+type networkEstimator struct {
+	metrics *metricRegistry
+
+	mu           sync.Mutex
+	sendStarted  bool
+	lastSend     uint32 // abs-send-time, 6.18 fixed point seconds wrapping every 64
+	send         int64  // In 2^-18 seconds since the first packet, unwrapped
+	firstArrival time.Time
+	baseline     time.Duration // Lowest one-way delay relative to the first packet
+	delay        time.Duration // Highest queuing delay in the window
+
+	windowStart time.Time
+	bytes       int
+	seqStarted  bool
+	highest     int64 // Transport-wide sequence numbers, extended
+	lastHighest int64 // At the end of the previous window
+	windowSeqs  map[int64]bool
+	summary     networkSummary
+}
+
+// networkSummary is how the network estimate is recorded in the session
+// metadata, as of the latest window
+type networkSummary struct {
+	ReceiveBitrate int     `json:"receiveBitrate"` // Bits per second
+	QueuingDelay   float64 `json:"queuingDelay"`   // Seconds above the lowest one-way delay seen
+	LossRatio      float64 `json:"transportLossRatio"`
+}
+
+func newNetworkEstimator(metrics *metricRegistry) *networkEstimator {
+	return &networkEstimator{metrics: metrics, windowSeqs: map[int64]bool{}}
+}
+
+func (e *networkEstimator) observe(now time.Time, size int, sendTime uint32, sent bool, transportSeq uint16, sequenced bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.windowStart.IsZero() {
+		e.windowStart = now
+	}
+
+	if sequenced {
+		seq := int64(transportSeq)
+		if e.seqStarted {
+			// Extended by the closest wrap to the highest so far
+			seq = e.highest + int64(int16(transportSeq-uint16(e.highest)))
+		} else {
+			e.seqStarted = true
+			e.highest, e.lastHighest = seq, seq-1
+		}
+		// Duplicates were counted already
+		if e.windowSeqs[seq] {
+			return
+		}
+		e.windowSeqs[seq] = true
+		e.highest = max(e.highest, seq)
+	}
+	e.bytes += size
+
+	if sent {
+		if !e.sendStarted {
+			e.sendStarted = true
+			e.lastSend, e.firstArrival = sendTime, now
+		}
+		// Sign extend the 24 bit difference
+		e.send += int64(int32((sendTime-e.lastSend)<<8) >> 8)
+		e.lastSend = sendTime
+
+		relative := now.Sub(e.firstArrival) - time.Duration(e.send*int64(time.Second)>>18)
+		e.baseline = min(e.baseline, relative)
+		e.delay = max(e.delay, relative-e.baseline)
+	}
+
+	if elapsed := now.Sub(e.windowStart); elapsed >= networkWindow {
+		e.closeWindow(now, elapsed)
+	}
+}
+
+func (e *networkEstimator) closeWindow(now time.Time, elapsed time.Duration) {
+	e.summary.ReceiveBitrate = int(float64(e.bytes*8) / elapsed.Seconds())
+	if e.sendStarted {
+		e.summary.QueuingDelay = e.delay.Seconds()
+		e.metrics.observe("ingest_queuing_delay_seconds", e.summary.QueuingDelay)
+	}
+	if expected := e.highest - e.lastHighest; e.seqStarted && expected > 0 {
+		e.summary.LossRatio = max(0, 1-float64(len(e.windowSeqs))/float64(expected))
+	}
+
+	e.windowStart, e.bytes, e.delay = now, 0, 0
+	e.lastHighest = e.highest
+	clear(e.windowSeqs)
+}
+
+func (e *networkEstimator) snapshot() *networkSummary {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.windowStart.IsZero() {
+		return nil
+	}
+	summary := e.summary
+	return &summary
+}
+
+// videoOrientation counts the frames of a video track by the CVO byte they
+// were sent with: the rotation in its low two bits, in steps of 90 degrees
+// clockwise, and a horizontal flip in the third
+type videoOrientation struct {
+	frames [8]atomic.Uint64
+}
+
+// The orientation most frames were sent with, recordings are turned upright
+// by it as a whole. Returns 0 for a track without CVO.
+func (o *videoOrientation) dominant() byte {
+	if o == nil {
+		return 0
+	}
+
+	var best byte
+	for cvo := range o.frames {
+		if o.frames[cvo].Load() > o.frames[best].Load() {
+			best = byte(cvo)
+		}
+	}
+	return best
+}
+
+// FFmpeg filter turning frames sent with a CVO byte upright, empty if they are
+func orientationFilter(cvo byte) string {
+	var filters []string
+	if cvo&0x4 != 0 {
+		filters = append(filters, "hflip")
+	}
+	switch cvo & 0x3 {
+	case 1:
+		filters = append(filters, "transpose=clock")
+	case 2:
+		filters = append(filters, "hflip", "vflip")
+	case 3:
+		filters = append(filters, "transpose=cclock")
+	}
+	return strings.Join(filters, ",")
+}
+
+// Re-encode the WebM recordings of the session's video tracks that were sent
+// rotated, so they play upright without the orientation the publisher sent
+func (s *Session) rotateRecordings(tracks []*Track) {
+	if !s.server.cfg.RotateRecordings {
+		return
+	}
+
+	for _, t := range tracks {
+		filter := orientationFilter(t.orientation.dominant())
+		name := recordingName(s.id, t.rendition())
+		if filter == "" || !fileExists(name) {
+			continue
+		}
+
+		rotated := name + ".rotated"
+		process, err := startFFmpegProcess([]string{"-i", name, "-vf", filter, "-c:v", "libvpx", "-deadline", "good", "-b:v", "0", "-crf", "10", "-f", "webm", "-y", rotated})
+		if err == nil {
+			process.stdin.Close()
+			if err = process.wait(); err != nil {
+				err = fmt.Errorf("%v: %s", err, process.stderr.String())
+			}
+		}
+		if err == nil {
+			err = os.Rename(rotated, name)
+		}
+		if err != nil {
+			fmt.Printf("Error rotating recording %s: %v\n", name, err)
+			os.Remove(rotated)
+			continue
+		}
+		s.server.metrics.add("ingest_recordings_rotated_total", 1)
+	}
+}
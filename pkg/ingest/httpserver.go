@@ -0,0 +1,205 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files produced by the pipeline that may be served to players
+var servedExtensions = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ogg":  "audio/ogg",
+	".mp4":  "video/mp4",
+	".m4s":  "video/iso.segment",
+	".webm": "video/webm",
+	".vtt":  "text/vtt",
+	".jpg":  "image/jpeg",
+	".ts":   "video/mp2t",
+}
+
+type httpServer struct {
+	signer     urlSigner
+	preview    *previewFeed
+	relay      *whepRelay
+	mixer      *audioMixer
+	compositor *videoCompositor
+	sfu        *sfuRelay
+	metrics    *metricRegistry
+	features   *featureFlags
+	sessions   *sessionRegistry
+	auth       authProvider
+
+	// Publishers present a publish token, or a signal scoped credential
+	// without a publish key
+	publish     func(token string, identity publisherIdentity) (*Session, error)
+	publishAuth *publishAuth
+	playback    *playbackTokens // Viewers present playback tokens instead of playback scoped credentials, if set
+	origins     *originPolicy   // Web origins allowed to call the endpoints, nil for any
+	encryption  *segmentEncryption
+	catalog     *recordingCatalog
+	cluster     *cluster // Redirects requests for sessions of other nodes, nil when standalone
+	drain       func()
+	draining    func() bool
+	iceLinks    []string // Link headers announcing the ICE servers to WHIP clients
+	schedule    *sessionSchedule
+	moq         http.HandlerFunc // Accepts Media over QUIC style publishers, nil unless enabled
+}
+
+func (s *httpServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{session}/{file}", s.requirePlayback(pathSession, s.cluster.redirect(pathSession, s.serveSessionOutput)))
+	mux.HandleFunc("GET /{file}", s.requirePlayback(recordingSession, s.cluster.redirect(recordingSession, s.serveOutput)))
+	mux.HandleFunc("GET /vod/{session}/{file}", s.requirePlayback(pathSession, serveVOD))
+	if s.encryption != nil {
+		mux.HandleFunc("GET /keys/{session}", s.requirePlayback(pathSession, s.serveKey))
+	}
+	if s.catalog != nil {
+		mux.HandleFunc("GET /recordings", s.require(scopeAdmin, s.serveRecordings))
+		mux.HandleFunc("DELETE /recordings/{file}", s.require(scopeAdmin, s.serveDeleteRecording))
+		mux.HandleFunc("POST /recordings/{file}/restore", s.require(scopeAdmin, s.serveRestoreRecording))
+	}
+	if s.publishAuth != nil {
+		mux.HandleFunc("POST /whip", s.serveWHIP)
+		mux.HandleFunc("DELETE /whip/{id}", s.cluster.redirect(idSession, s.serveWHIPDelete))
+	} else {
+		mux.HandleFunc("POST /whip", s.require(scopeSignal, s.serveWHIP))
+		mux.HandleFunc("DELETE /whip/{id}", s.require(scopeSignal, s.cluster.redirect(idSession, s.serveWHIPDelete)))
+	}
+	if s.moq != nil && s.publishAuth != nil {
+		mux.HandleFunc("POST /moq", s.moq)
+	} else if s.moq != nil {
+		mux.HandleFunc("POST /moq", s.require(scopeSignal, s.moq))
+	}
+	mux.HandleFunc("GET /publish", servePage(publishPage))
+	mux.HandleFunc("GET /play/{session}", servePage(playPage))
+	mux.HandleFunc("POST /preview", s.require(scopeSignal, s.preview.serveOffer))
+	if s.playback != nil {
+		mux.HandleFunc("POST /whep", s.requirePlayback(querySession, s.cluster.redirect(querySession, s.relay.serveOffer)))
+		mux.HandleFunc("DELETE /whep/{id}", s.requirePlayback(s.relay.viewerSession, s.relay.serveDelete))
+	} else {
+		mux.HandleFunc("POST /whep", s.require(scopeSignal, s.cluster.redirect(querySession, s.relay.serveOffer)))
+		mux.HandleFunc("DELETE /whep/{id}", s.require(scopeSignal, s.relay.serveDelete))
+	}
+	mux.HandleFunc("POST /sfu", s.require(scopeSignal, s.sfu.serveOffer))
+	mux.HandleFunc("DELETE /sfu/{id}", s.require(scopeSignal, s.sfu.serveDelete))
+	mux.HandleFunc("GET /mix", s.require(scopeAdmin, s.mixer.serveStatus))
+	mux.HandleFunc("PATCH /mix", s.require(scopeAdmin, s.mixer.serveGains))
+	mux.HandleFunc("GET /composite", s.require(scopeAdmin, s.compositor.serveStatus))
+	mux.HandleFunc("PATCH /composite", s.require(scopeAdmin, s.compositor.serveLayout))
+	mux.HandleFunc("GET /metrics", s.require(scopeAdmin, s.metrics.ServeHTTP))
+	mux.HandleFunc("POST /drain", s.require(scopeAdmin, s.serveDrain))
+	mux.HandleFunc("GET /healthz", s.serveHealth)
+	mux.HandleFunc("GET /features", s.require(scopeAdmin, s.features.serveGet))
+	mux.HandleFunc("PATCH /features", s.require(scopeAdmin, s.features.servePatch))
+	mux.HandleFunc("GET /sessions/{id}/features", s.require(scopeAdmin, s.cluster.redirect(idSession, s.sessions.serveFeatures)))
+	mux.HandleFunc("PATCH /sessions/{id}/features", s.require(scopeAdmin, s.cluster.redirect(idSession, s.sessions.serveFeatures)))
+	mux.HandleFunc("GET /sessions/{id}/tracks", s.require(scopeAdmin, s.cluster.redirect(idSession, s.sessions.serveTracks)))
+	mux.HandleFunc("GET /sessions/{id}/dtmf", s.require(scopeAdmin, s.cluster.redirect(idSession, s.sessions.serveDTMF)))
+	mux.HandleFunc("GET /sessions/{id}/resources", s.require(scopeAdmin, s.cluster.redirect(idSession, s.sessions.serveResources)))
+	mux.HandleFunc("GET /sessions/{id}/link", s.require(scopeAdmin, s.cluster.redirect(idSession, s.sessions.serveLink)))
+	mux.HandleFunc("GET /sessions/{id}/recording", s.require(scopeAdmin, s.cluster.redirect(idSession, s.sessions.serveRecording)))
+	mux.HandleFunc("POST /sessions/{id}/recording/{action}", s.require(scopeAdmin, s.cluster.redirect(idSession, s.sessions.serveRecording)))
+	if s.cluster != nil {
+		mux.HandleFunc("GET /cluster/nodes", s.require(scopeAdmin, s.cluster.serveNodes))
+	}
+	mux.HandleFunc("GET /schedule", s.require(scopeAdmin, s.schedule.serveList))
+	mux.HandleFunc("POST /schedule", s.require(scopeAdmin, s.schedule.serveCreate))
+	mux.HandleFunc("DELETE /schedule/{id}", s.require(scopeAdmin, s.schedule.serveDelete))
+	mux.HandleFunc("POST /sessions/{id}/playback-tokens", s.require(scopeAdmin, s.serveIssuePlayback))
+	mux.HandleFunc("DELETE /sessions/{id}/playback-tokens", s.require(scopeAdmin, s.serveRevokePlayback))
+
+	return s.origins.wrap(mux)
+}
+
+// Only let requests through that the auth provider grants the scope
+func (s *httpServer) require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	if s.auth == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.auth.Authorize(r, scope); err != nil {
+			if !errors.Is(err, errUnauthorized) {
+				fmt.Println("Error authorizing request:", err)
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Serve a live output from the directory of the session in the request path
+func (s *httpServer) serveSessionOutput(w http.ResponseWriter, r *http.Request) {
+	session := s.sessions.get(pathSession(r))
+	if session == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveFile(w, r, session.id, session.dir)
+}
+
+// Serve a recording or another output of the working directory
+func (s *httpServer) serveOutput(w http.ResponseWriter, r *http.Request) {
+	if s.catalog.isDeleted(r.PathValue("file")) {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveFile(w, r, "", ".")
+}
+
+// Serve the file in the request path from dir, the playlists of a session
+// signed and listing its segment keys
+func (s *httpServer) serveFile(w http.ResponseWriter, r *http.Request, session, dir string) {
+	name := r.PathValue("file")
+	contentType, ok := servedExtensions[filepath.Ext(name)]
+	if !ok || name == ".." {
+		http.NotFound(w, r)
+		return
+	}
+	path := filepath.Join(dir, name)
+	w.Header().Set("Content-Type", contentType)
+
+	switch filepath.Ext(name) {
+	case ".ogg", ".mp4", ".m4s", ".ts":
+		// Segments never change once listed in a playlist
+		w.Header().Set("Cache-Control", "max-age=3600")
+		http.ServeFile(w, r, path)
+		return
+	case ".vtt", ".jpg":
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, path)
+		return
+	}
+
+	playlist, err := os.ReadFile(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	body := string(playlist)
+	if s.signer != nil {
+		now := time.Now()
+		body, err = rewritePlaylist(body, func(uri string) (string, error) {
+			return s.signer.SignURL(uri, now)
+		})
+		if err != nil {
+			fmt.Println("Error signing playlist:", err)
+			http.Error(w, "failed to sign playlist", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// After signing, the key is fetched from us rather than a CDN
+	body = s.encryption.playlist(session, dir, body)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, body)
+}
@@ -0,0 +1,277 @@
+package ingest
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// How publishers' and our own host candidates are handled with mDNS, by
+// -mdns value
+var mdnsModes = map[string]ice.MulticastDNSMode{
+	"off":    ice.MulticastDNSModeDisabled,
+	"query":  ice.MulticastDNSModeQueryOnly,
+	"gather": ice.MulticastDNSModeQueryAndGather,
+	"":       ice.MulticastDNSModeQueryOnly, // pion's default
+}
+
+// How long a learned server reflexive address is trusted, so a network
+// change is picked up by the next session after it
+const iceCacheTTL = 10 * time.Minute
+
+// iceAgents hands out the API and configuration publisher peer connections
+// are created with. With a UDP port configured, every session shares one
+// socket, so the address a NAT maps it to is the same for all of them. Once a
+// session learned that address over STUN, and the NAT keeps the port, the
+// following sessions announce it as a host candidate right away instead of
+// waiting on a STUN round trip.
+type iceAgents struct {
+	api      *webrtc.API
+	config   webrtc.Configuration
+	settings webrtc.SettingEngine
+	newAPI   func(webrtc.SettingEngine) *webrtc.API
+	port     int // Of the shared socket, 0 without one
+
+	mu      sync.Mutex
+	cached  *webrtc.API // Announces the learned addresses, nil until learned
+	learned time.Time
+}
+
+func newICEAgents(cfg *Config, config webrtc.Configuration, newAPI func(webrtc.SettingEngine) *webrtc.API) (*iceAgents, error) {
+	a := &iceAgents{config: config, newAPI: newAPI}
+
+	mode, ok := mdnsModes[cfg.MDNS]
+	if !ok {
+		return nil, fmt.Errorf("invalid mDNS mode %q", cfg.MDNS)
+	}
+	a.settings.SetICEMulticastDNSMode(mode)
+
+	// Multi-homed servers pick the interfaces and IP families ICE uses
+	network, types, err := iceNetwork(cfg.ICEIPFamily, cfg.ICETCPPort > 0)
+	if err != nil {
+		return nil, err
+	}
+	a.settings.SetNetworkTypes(types)
+	var interfaces []string
+	for _, name := range strings.Split(cfg.ICEInterfaces, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			interfaces = append(interfaces, name)
+		}
+	}
+	if len(interfaces) > 0 {
+		a.settings.SetInterfaceFilter(func(name string) bool { return slices.Contains(interfaces, name) })
+	}
+
+	if cfg.ICEUDPPort > 0 {
+		conn, err := net.ListenUDP("udp"+network, &net.UDPAddr{Port: cfg.ICEUDPPort})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for ICE: %v", err)
+		}
+		a.settings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+		a.port = cfg.ICEUDPPort
+	}
+	if cfg.ICETCPPort > 0 {
+		// Publishers on networks blocking UDP connect over TCP instead
+		listener, err := net.ListenTCP("tcp"+network, &net.TCPAddr{Port: cfg.ICETCPPort})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for ICE-TCP: %v", err)
+		}
+		a.settings.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, 8))
+	}
+	if cfg.DTLSKeyLogFile != "" {
+		keyLog, err := openDTLSKeyLog(cfg.DTLSKeyLogFile)
+		if err != nil {
+			return nil, err
+		}
+		a.settings.SetDTLSKeyLogWriter(keyLog)
+	}
+	a.api = newAPI(a.settings)
+
+	return a, nil
+}
+
+// Network types ICE gathers candidates of for an IP family ("ipv4", "ipv6"
+// or empty for both), and the suffix of the shared sockets' network
+func iceNetwork(family string, tcp bool) (string, []webrtc.NetworkType, error) {
+	network := map[string]string{"": "", "ipv4": "4", "ipv6": "6"}
+	suffix, ok := network[strings.ToLower(family)]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid IP family %q", family)
+	}
+
+	var types []webrtc.NetworkType
+	if suffix != "6" {
+		types = append(types, webrtc.NetworkTypeUDP4)
+		if tcp {
+			types = append(types, webrtc.NetworkTypeTCP4)
+		}
+	}
+	if suffix != "4" {
+		types = append(types, webrtc.NetworkTypeUDP6)
+		if tcp {
+			types = append(types, webrtc.NetworkTypeTCP6)
+		}
+	}
+	return suffix, types, nil
+}
+
+// The API and configuration of a new publisher
+func (a *iceAgents) publisher() (*webrtc.API, webrtc.Configuration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cached == nil || time.Since(a.learned) > iceCacheTTL {
+		return a.api, a.config
+	}
+
+	// STUN is skipped, TURN servers are still needed to relay
+	config := a.config
+	config.ICEServers = nil
+	for _, server := range a.config.ICEServers {
+		if !slices.ContainsFunc(server.URLs, func(url string) bool { return strings.HasPrefix(url, "stun") }) {
+			config.ICEServers = append(config.ICEServers, server)
+		}
+	}
+	return a.cached, config
+}
+
+// learn keeps the server reflexive addresses of a gathered local description
+// that map the shared socket without changing its port
+func (a *iceAgents) learn(local *webrtc.SessionDescription) {
+	if a.port == 0 || local == nil {
+		return
+	}
+
+	var mappings []string
+	for _, line := range strings.Split(local.SDP, "\n") {
+		// candidate:<foundation> <component> <transport> <priority> <address> <port> typ srflx raddr <address> rport <port>
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 12 || fields[7] != "srflx" || fields[8] != "raddr" || fields[5] != fmt.Sprint(a.port) {
+			continue
+		}
+
+		external, internal := net.ParseIP(fields[4]), net.ParseIP(fields[9])
+		if external == nil || internal == nil || internal.IsUnspecified() {
+			continue
+		}
+		if mapping := external.String() + "/" + internal.String(); !slices.Contains(mappings, mapping) {
+			mappings = append(mappings, mapping)
+		}
+	}
+	if len(mappings) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cached != nil && time.Since(a.learned) <= iceCacheTTL {
+		return
+	}
+
+	settings := a.settings
+	settings.SetNAT1To1IPs(mappings, webrtc.ICECandidateTypeHost)
+	a.cached = a.newAPI(settings)
+	a.learned = time.Now()
+	fmt.Println("Caching NAT mappings of the ICE socket:", strings.Join(mappings, ", "))
+}
+
+// ICE servers of the configuration: STUN, and the TURN servers publishers
+// behind UDP-blocking firewalls relay through, over TCP or TLS. There are
+// none in LAN mode, where only host candidates are gathered.
+func iceServers(cfg *Config) ([]webrtc.ICEServer, error) {
+	var servers []webrtc.ICEServer
+	if cfg.LANMode {
+		return servers, nil
+	}
+
+	if stun := strings.TrimSpace(cfg.STUNServer); stun != "" {
+		if !strings.HasPrefix(stun, "stun:") && !strings.HasPrefix(stun, "stuns:") {
+			return nil, fmt.Errorf("invalid STUN server %q", stun)
+		}
+		servers = append(servers, webrtc.ICEServer{URLs: []string{stun}})
+	}
+
+	var turn []string
+	for _, url := range strings.Split(cfg.TURNServers, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		if !strings.HasPrefix(url, "turn:") && !strings.HasPrefix(url, "turns:") {
+			return nil, fmt.Errorf("invalid TURN server %q", url)
+		}
+		turn = append(turn, url)
+	}
+	if len(turn) > 0 {
+		servers = append(servers, webrtc.ICEServer{URLs: turn, Username: cfg.TURNUsername, Credential: cfg.TURNCredential})
+	}
+
+	return servers, nil
+}
+
+// Link headers announcing ICE servers to WHIP clients
+func iceServerLinks(servers []webrtc.ICEServer) []string {
+	var links []string
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", url)
+			if credential, ok := server.Credential.(string); ok && server.Username != "" {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", server.Username, credential)
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// Transport the ICE connection of a peer connection ended up on: udp, tcp,
+// or turn-udp, turn-tcp and turn-tls when relayed through one of our TURN
+// servers, turn when the publisher relays through its own
+func selectedTransport(peerConnection *webrtc.PeerConnection) string {
+	ice := peerConnection.SCTP().Transport().ICETransport()
+	pair, err := ice.GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return ""
+	}
+
+	switch {
+	case pair.Local.Typ == webrtc.ICECandidateTypeRelay:
+		stats, ok := ice.GetSelectedCandidatePairStats()
+		if !ok {
+			return "turn"
+		}
+		candidate, ok := peerConnection.GetStats()[stats.LocalCandidateID].(webrtc.ICECandidateStats)
+		if !ok || candidate.RelayProtocol == "" {
+			return "turn"
+		}
+		return "turn-" + candidate.RelayProtocol
+	case pair.Remote.Typ == webrtc.ICECandidateTypeRelay:
+		return "turn"
+	}
+	return pair.Local.Protocol.String()
+}
+
+// Note the transport the publisher connected over, counted per transport
+func (s *Session) recordTransport() {
+	transport := selectedTransport(s.peerConnection)
+	if transport == "" {
+		return
+	}
+
+	s.mu.Lock()
+	s.transport = transport
+	s.mu.Unlock()
+	s.server.metrics.add(fmt.Sprintf("ingest_ice_transport_total{transport=%q}", transport), 1)
+	fmt.Printf("Session %s connected over %s\n", s.id, transport)
+}
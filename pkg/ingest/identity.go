@@ -0,0 +1,48 @@
+package ingest
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Longest user ID and display name kept of a publisher
+const maxIdentityLength = 128
+
+// publisherIdentity is who publishes a session, as told at signaling time
+type publisherIdentity struct {
+	UserID   string `json:"userId,omitempty"`
+	Name     string `json:"name,omitempty"`     // Display name
+	Verified bool   `json:"verified,omitempty"` // The user ID is the subject of a verified publish token
+}
+
+// Identity a WHIP request announces, in the X-Publisher-Id and
+// X-Publisher-Name headers or the user and name query parameters
+func requestIdentity(r *http.Request) publisherIdentity {
+	value := func(header, query string) string {
+		v := r.Header.Get(header)
+		if v == "" {
+			v = r.URL.Query().Get(query)
+		}
+		v = strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r < ' ' || r == 0x7f {
+				return -1
+			}
+			return r
+		}, v))
+		if len(v) > maxIdentityLength {
+			v = v[:maxIdentityLength]
+		}
+		return strings.ToValidUTF8(v, "")
+	}
+	return publisherIdentity{UserID: value("X-Publisher-Id", "user"), Name: value("X-Publisher-Name", "name")}
+}
+
+// Directory of a verified user's archived recordings, so they show whose
+// they are, empty if nothing of the user ID can name files
+func userSlug(userID string) string {
+	slug := strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(userID), "-"), "-")
+	if len(slug) > 32 {
+		slug = strings.TrimRight(slug[:32], "-")
+	}
+	return slug
+}
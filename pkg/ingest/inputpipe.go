@@ -0,0 +1,84 @@
+package ingest
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// inputPipe is an FFmpeg input besides stdin, for processes reading several
+// streams: a FIFO, or a named pipe on Windows. Writes are dropped until
+// FFmpeg opened it, so a writer never waits for FFmpeg to get to its input.
+type inputPipe struct {
+	pipe *namedPipe
+
+	mu      sync.Mutex
+	file    *os.File
+	closed  bool
+	dropped int // Writes before FFmpeg opened the pipe
+}
+
+// Create a pipe named after name in dir, which FFmpeg opens as path()
+func newInputPipe(dir, name string) (*inputPipe, error) {
+	pipe, err := newNamedPipe(dir, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create input pipe: %v", err)
+	}
+	return &inputPipe{pipe: pipe}, nil
+}
+
+func (p *inputPipe) path() string {
+	return p.pipe.path
+}
+
+// connect waits for FFmpeg to open the pipe, until remove is called
+func (p *inputPipe) connect() {
+	file, err := p.pipe.connect()
+	if err != nil {
+		fmt.Println("Error opening FFmpeg input pipe:", err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		file.Close()
+		return
+	}
+	p.file = file
+	if p.dropped > 0 {
+		fmt.Printf("Dropped %d writes to %s before FFmpeg opened it\n", p.dropped, p.path())
+	}
+}
+
+func (p *inputPipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	file := p.file
+	if file == nil {
+		p.dropped++
+	}
+	p.mu.Unlock()
+
+	if file == nil {
+		return len(b), nil
+	}
+	return file.Write(b)
+}
+
+// Close ends the input, FFmpeg reads EOF
+func (p *inputPipe) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
+
+// remove gives up on FFmpeg opening the pipe and deletes it, once FFmpeg
+// exited
+func (p *inputPipe) remove() {
+	p.pipe.remove()
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package ingest
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// namedPipe is a FIFO in the session directory
+type namedPipe struct {
+	path string
+}
+
+func newNamedPipe(dir, name string) (*namedPipe, error) {
+	path := filepath.Join(dir, name+".fifo")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		return nil, err
+	}
+	return &namedPipe{path: path}, nil
+}
+
+// Opening a FIFO for writing blocks until a reader opened it
+func (p *namedPipe) connect() (*os.File, error) {
+	return os.OpenFile(p.path, os.O_WRONLY, 0)
+}
+
+func (p *namedPipe) remove() {
+	// Stand in for the reader, so a connect still waiting returns; its
+	// writes fail once this end is closed
+	if reader, err := os.OpenFile(p.path, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+		reader.Close()
+	}
+	os.Remove(p.path) //nolint:errcheck
+}
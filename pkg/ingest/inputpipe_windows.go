@@ -0,0 +1,69 @@
+package ingest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+// namedPipe is a Windows named pipe, \\.\pipe\ingest-<session dir>-<name>
+type namedPipe struct {
+	path string
+
+	mu        sync.Mutex
+	handle    windows.Handle
+	connected bool // The handle belongs to the file connect returned
+	removed   bool
+}
+
+func newNamedPipe(dir, name string) (*namedPipe, error) {
+	path := `\\.\pipe\ingest-` + filepath.Base(dir) + "-" + name
+	path16, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := windows.CreateNamedPipe(path16,
+		windows.PIPE_ACCESS_OUTBOUND,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		1, 1<<20, 0, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &namedPipe{path: path, handle: handle}, nil
+}
+
+// ConnectNamedPipe blocks until a client opened the pipe
+func (p *namedPipe) connect() (*os.File, error) {
+	err := windows.ConnectNamedPipe(p.handle, nil)
+	if err != nil && !errors.Is(err, windows.ERROR_PIPE_CONNECTED) {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.removed {
+		return nil, errors.New("input pipe removed")
+	}
+	p.connected = true
+	return os.NewFile(uintptr(p.handle), p.path), nil
+}
+
+func (p *namedPipe) remove() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.removed || p.connected {
+		p.removed = true
+		return
+	}
+	p.removed = true
+
+	// Stand in for the client, so a connect still waiting returns
+	if client, err := os.Open(p.path); err == nil {
+		client.Close()
+	}
+	windows.CloseHandle(p.handle) //nolint:errcheck
+}
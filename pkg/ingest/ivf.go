@@ -0,0 +1,104 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FourCCs of the codecs IVF files can hold, by codec name
+var ivfFourCCs = map[string]string{
+	"vp8": "VP80",
+	"vp9": "VP90",
+	"av1": "AV01",
+}
+
+// ivfSink stores the frames of a video track in an IVF file as they were
+// sent, without transcoding, for debugging encoders and for re-encoding
+// offline at a higher quality than the live pass
+type ivfSink struct{}
+
+func (ivfSink) Open(t *Track) (io.WriteCloser, error) {
+	fourCC, ok := ivfFourCCs[t.codecName()]
+	if !ok || t.Kind != "video" {
+		return nil, fmt.Errorf("ivf sink only stores VP8, VP9 and AV1 video, not %s", t.Codec.MimeType)
+	}
+
+	f, err := os.Create(ivfName(t.Session, t.rendition()))
+	if err != nil {
+		return nil, err
+	}
+	w := &ivfWriter{f: f, fourCC: fourCC, vp8: fourCC == "VP80"}
+	if err = w.writeHeader(); err == nil {
+		_, err = f.Seek(32, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (ivfSink) files(t *Track) (string, string) {
+	return ".", ivfName(t.Session, t.rendition())
+}
+
+// IVF dump of a rendition of a session
+func ivfName(session, rendition string) string {
+	return fmt.Sprintf("recording_%s_%s.ivf", session, rendition)
+}
+
+// ivfWriter writes each frame with its index as the timestamp, in the
+// constant frame rate the pipelines write at. The header's frame count and
+// size are filled in once the writer is closed.
+type ivfWriter struct {
+	f             *os.File
+	fourCC        string
+	vp8           bool
+	frames        uint32
+	width, height int // Of the first keyframe of VP8, zero for other codecs
+}
+
+func (w *ivfWriter) writeHeader() error {
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], w.fourCC)
+	binary.LittleEndian.PutUint16(header[12:], uint16(w.width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(w.height))
+	binary.LittleEndian.PutUint32(header[16:], videoFrameRate)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], w.frames)
+
+	_, err := w.f.WriteAt(header, 0)
+	return err
+}
+
+func (w *ivfWriter) Write(p []byte) (int, error) {
+	if w.vp8 && w.frames == 0 {
+		// Decoders start at a keyframe, which also tells the size
+		width, height, ok := vp8FrameSize(p)
+		if !ok {
+			return len(p), nil
+		}
+		w.width, w.height = width, height
+	}
+
+	header := make([]byte, 12, 12+len(p))
+	binary.LittleEndian.PutUint32(header, uint32(len(p)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(w.frames))
+	if _, err := w.f.Write(append(header, p...)); err != nil {
+		return 0, err
+	}
+	w.frames++
+	return len(p), nil
+}
+
+func (w *ivfWriter) Close() error {
+	err := w.writeHeader()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
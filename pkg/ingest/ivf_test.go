@@ -0,0 +1,69 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIVFWriter(t *testing.T) {
+	// A VP8 keyframe of 320x240 and an interframe
+	keyframe := []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x40, 0x01, 0xf0, 0x00, 0xaa}
+	interframe := []byte{0x11, 0x02, 0x00, 0xbb}
+
+	for name, tc := range map[string]struct {
+		fourCC        string
+		frames        [][]byte
+		written       [][]byte // Frames in the file
+		width, height uint16
+	}{
+		"vp8":                 {fourCC: "VP80", frames: [][]byte{keyframe, interframe}, written: [][]byte{keyframe, interframe}, width: 320, height: 240},
+		"vp8 from a keyframe": {fourCC: "VP80", frames: [][]byte{interframe, keyframe, interframe}, written: [][]byte{keyframe, interframe}, width: 320, height: 240},
+		"vp9":                 {fourCC: "VP90", frames: [][]byte{interframe}, written: [][]byte{interframe}},
+		"no frames":           {fourCC: "AV01"},
+	} {
+		path := filepath.Join(t.TempDir(), "recording.ivf")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &ivfWriter{f: f, fourCC: tc.fourCC, vp8: tc.fourCC == "VP80"}
+		if err := w.writeHeader(); err != nil {
+			t.Fatal(err)
+		}
+		f.Seek(32, 0) //nolint:errcheck
+		for _, frame := range tc.frames {
+			if n, err := w.Write(frame); err != nil || n != len(frame) {
+				t.Fatalf("%s: Write = %d, %v", name, n, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var want bytes.Buffer
+		header := make([]byte, 32)
+		copy(header, "DKIF")
+		binary.LittleEndian.PutUint16(header[6:], 32)
+		copy(header[8:], tc.fourCC)
+		binary.LittleEndian.PutUint16(header[12:], tc.width)
+		binary.LittleEndian.PutUint16(header[14:], tc.height)
+		binary.LittleEndian.PutUint32(header[16:], videoFrameRate)
+		binary.LittleEndian.PutUint32(header[20:], 1)
+		binary.LittleEndian.PutUint32(header[24:], uint32(len(tc.written)))
+		want.Write(header)
+		for i, frame := range tc.written {
+			frameHeader := make([]byte, 12)
+			binary.LittleEndian.PutUint32(frameHeader, uint32(len(frame)))
+			binary.LittleEndian.PutUint64(frameHeader[4:], uint64(i))
+			want.Write(frameHeader)
+			want.Write(frame)
+		}
+
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("%s: wrote % x, want % x", name, got, want.Bytes())
+		}
+	}
+}
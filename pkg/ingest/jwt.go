@@ -0,0 +1,220 @@
+package ingest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token expired")
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims map[string]any
+
+// Look up the key verifying a token, by algorithm and key ID. HS256 expects
+// a []byte, RS256 an *rsa.PublicKey and ES256 an *ecdsa.PublicKey.
+type jwtKeyFunc func(header jwtHeader) (any, error)
+
+// parseJWT verifies a compact JWS token and its exp/nbf claims
+func parseJWT(token string, keyFunc jwtKeyFunc, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	header := jwtHeader{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	claims := jwtClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	key, err := keyFunc(header)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case []byte:
+		if header.Alg != "HS256" {
+			return nil, fmt.Errorf("unexpected algorithm %s", header.Alg)
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errTokenSignature
+		}
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected algorithm %s", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errTokenSignature
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("unexpected algorithm %s", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errTokenSignature
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+		return nil, errTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errTokenMalformed
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return errTokenMalformed
+	}
+
+	return nil
+}
+
+// String claim of a token, empty if it is missing
+func (c jwtClaims) str(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// hasScope checks the space separated "scope" claim
+func (c jwtClaims) hasScope(scope string) bool {
+	for _, s := range strings.Fields(c.str("scope")) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jwks fetches and caches the signing keys published at a JWKS URL
+type jwks struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+	failed  time.Time // Of the last refresh that failed
+}
+
+func newJWKS(url string) *jwks {
+	return &jwks{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (j *jwks) key(header jwtHeader) (any, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Refresh hourly, or on an unknown key ID at most once a minute to
+	// pick up rotations without letting bad tokens hammer the issuer. The
+	// cached keys stay in use while the issuer fails, retried once a minute.
+	key, ok := j.keys[header.Kid]
+	if age := time.Since(j.fetched); (age > time.Hour || (!ok && age > time.Minute)) && time.Since(j.failed) > time.Minute {
+		if err := j.refresh(); err != nil {
+			j.failed = time.Now()
+			fmt.Println("Error refreshing JWKS:", err)
+			if !ok {
+				return nil, err
+			}
+		}
+		key, ok = j.keys[header.Kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+
+	return key, nil
+}
+
+func (j *jwks) refresh() error {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+
+	keys := map[string]any{}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	j.keys = keys
+	j.fetched = time.Now()
+	return nil
+}
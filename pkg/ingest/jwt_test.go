@@ -0,0 +1,158 @@
+package ingest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT signs claims as a compact JWS with the given algorithm and key
+func signJWT(t *testing.T, alg string, key any, claims jwtClaims) string {
+	t.Helper()
+	encode := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(jwtHeader{Alg: alg, Kid: "test"}) + "." + encode(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestParseJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	now := time.Unix(1_700_000_000, 0)
+	claims := jwtClaims{"sid": "abc", "scope": "signal playback", "exp": float64(now.Unix() + 60)}
+	keyOf := func(key any) jwtKeyFunc {
+		return func(jwtHeader) (any, error) { return key, nil }
+	}
+
+	valid := signJWT(t, "HS256", secret, claims)
+	parts := strings.Split(valid, ".")
+	forged, _ := json.Marshal(jwtClaims{"sid": "other", "exp": claims["exp"]})
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+
+	for name, tc := range map[string]struct {
+		token string
+		key   any
+		fails bool
+		err   error // Of a failing token, if named
+	}{
+		"HS256": {token: valid, key: secret},
+		"RS256": {token: signJWT(t, "RS256", rsaKey, claims), key: &rsaKey.PublicKey},
+		"ES256": {token: signJWT(t, "ES256", ecKey, claims), key: &ecKey.PublicKey},
+
+		"wrong secret":    {token: valid, key: []byte("other"), fails: true, err: errTokenSignature},
+		"tampered claims": {token: tampered, key: secret, fails: true, err: errTokenSignature},
+		"key of another":  {token: signJWT(t, "RS256", rsaKey, claims), key: &ecKey.PublicKey, fails: true},
+		"algorithm swap":  {token: valid, key: &rsaKey.PublicKey, fails: true},
+		"two parts":       {token: parts[0] + "." + parts[1], key: secret, fails: true, err: errTokenMalformed},
+		"bad encoding":    {token: parts[0] + ".!." + parts[2], key: secret, fails: true, err: errTokenMalformed},
+		"expired": {
+			token: signJWT(t, "HS256", secret, jwtClaims{"exp": float64(now.Unix())}),
+			key:   secret,
+			fails: true,
+			err:   errTokenExpired,
+		},
+		"not valid yet": {
+			token: signJWT(t, "HS256", secret, jwtClaims{"nbf": float64(now.Unix() + 1)}),
+			key:   secret,
+			fails: true,
+		},
+	} {
+		got, err := parseJWT(tc.token, keyOf(tc.key), now)
+		switch {
+		case !tc.fails && err != nil:
+			t.Errorf("%s: parseJWT: %v", name, err)
+		case !tc.fails && (got.str("sid") != "abc" || !got.hasScope("playback") || got.hasScope("admin")):
+			t.Errorf("%s: parseJWT = %v", name, got)
+		case tc.fails && err == nil:
+			t.Errorf("%s: parseJWT accepted the token", name)
+		case tc.err != nil && !errors.Is(err, tc.err):
+			t.Errorf("%s: parseJWT = %v, want %v", name, err, tc.err)
+		}
+	}
+}
+
+// Keys stay cached while the issuer fails, which isn't asked again at once
+func TestJWKSRefreshFailure(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"keys":[{"kty":"EC","kid":"a","crv":"P-256","x":%q,"y":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))), base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))))
+	failing, requests := false, 0
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(body)) //nolint:errcheck
+	}))
+	defer issuer.Close()
+
+	j := newJWKS(issuer.URL)
+	if got, err := j.key(jwtHeader{Kid: "a"}); err != nil || !key.PublicKey.Equal(got) {
+		t.Fatalf("key = %v, %v", got, err)
+	}
+
+	failing = true
+	j.fetched = time.Now().Add(-2 * time.Hour)
+	for range 3 {
+		if got, err := j.key(jwtHeader{Kid: "a"}); err != nil || !key.PublicKey.Equal(got) {
+			t.Errorf("key after a failed refresh = %v, %v", got, err)
+		}
+	}
+	if _, err := j.key(jwtHeader{Kid: "b"}); err == nil {
+		t.Error("unknown key found")
+	}
+	if requests != 2 {
+		t.Errorf("issuer asked %d times, want 2", requests)
+	}
+}
@@ -0,0 +1,93 @@
+package ingest
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pipeline stages latency is measured at, from the time the publisher
+// captured the media as told by its Sender Reports
+const (
+	latencyReceived = "received" // Read from the network
+	latencyBuffered = "buffered" // Out of the jitter buffer, or assembled into a frame
+	latencyWritten  = "written"  // Written to the sinks
+)
+
+// Stages are sampled at most this often per track, not every packet
+const latencySampleInterval = 100 * time.Millisecond
+
+// latencyTracker measures how long after capture a track's media reaches each
+// stage of the pipeline, and how long after capture its segments become
+// available in the playlist. The capture time is the publisher's clock, so
+// the figures are estimates as good as the publisher's clock sync.
+type latencyTracker struct {
+	session string
+	track   string // Rendition
+	clock   *wallClock
+	metrics *metricRegistry
+
+	received atomic.Int64 // Latest latency of the received stage, in nanoseconds
+
+	mu      sync.Mutex
+	sampled map[string]time.Time
+}
+
+func newLatencyTracker(session string, t *Track, clock *wallClock, metrics *metricRegistry) *latencyTracker {
+	return &latencyTracker{session: session, track: t.rendition(), clock: clock, metrics: metrics, sampled: map[string]time.Time{}}
+}
+
+// Record a stage reached by the media of an RTP timestamp
+func (l *latencyTracker) at(stage string, timestamp uint32) {
+	if l == nil || !l.due(stage) {
+		return
+	}
+
+	captured, ok := l.clock.at(timestamp)
+	if !ok {
+		return
+	}
+	latency := time.Since(captured)
+	if stage == latencyReceived {
+		l.received.Store(int64(latency))
+	}
+	l.observe(stage, latency)
+}
+
+// Record a stage reached some time after the media was received, for the
+// stages that don't know the RTP timestamps anymore
+func (l *latencyTracker) after(stage string, since time.Duration) {
+	if l == nil || !l.due(stage) {
+		return
+	}
+
+	if received := l.received.Load(); received != 0 {
+		l.observe(stage, time.Duration(received)+since)
+	}
+}
+
+// Record a segment becoming available whose media starts at a capture time
+func (l *latencyTracker) segment(start time.Time) {
+	if l == nil {
+		return
+	}
+	l.metrics.observe(fmt.Sprintf("ingest_glass_to_playlist_seconds{session=%q,track=%q}", l.session, l.track), max(time.Since(start), 0).Seconds())
+}
+
+func (l *latencyTracker) due(stage string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.sampled[stage]) < latencySampleInterval {
+		return false
+	}
+	l.sampled[stage] = now
+	return true
+}
+
+func (l *latencyTracker) observe(stage string, latency time.Duration) {
+	// A publisher clock ahead of ours can't make the latency negative
+	l.metrics.observe(fmt.Sprintf("ingest_pipeline_latency_seconds{stage=%q,track=%q}", stage, l.track), max(latency, 0).Seconds())
+}
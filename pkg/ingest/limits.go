@@ -0,0 +1,65 @@
+package ingest
+
+import (
+	"fmt"
+	"time"
+)
+
+// How often a session is measured against -max-session-duration and
+// -max-session-size
+const sessionLimitInterval = time.Second
+
+// Ends the session once it ran for -max-session-duration, its outputs took
+// up -max-session-size, or at its scheduled end, so a tab left open doesn't
+// record forever. The publisher is told first, then the session is closed
+// and its recording finalized as if the publisher had hung up.
+func (s *Session) enforceLimits() {
+	// The scheduled end is only known once the session was admitted
+	duration, size := s.server.cfg.MaxSessionDuration, s.server.maxSessionSize
+
+	ticker := time.NewTicker(sessionLimitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		ends := s.ends
+		s.mu.Unlock()
+
+		limit, message := "", ""
+		if !ends.IsZero() && !time.Now().Before(ends) {
+			limit, message = "schedule", fmt.Sprintf("the session reached its scheduled end at %s", ends.Format(time.RFC3339))
+		} else if duration > 0 && time.Since(s.started) >= duration {
+			limit, message = "duration", fmt.Sprintf("the session reached its maximum duration of %s", duration)
+		} else if size > 0 && s.outputBytes() >= size {
+			limit, message = "size", fmt.Sprintf("the session reached its maximum size of %d bytes", size)
+		}
+		if limit == "" {
+			continue
+		}
+
+		fmt.Printf("Closing session %s: %s\n", s.id, message)
+		s.control.reportError(errCodeSessionLimit, message)
+		s.server.events.emit(eventSessionLimitReached, s.id, map[string]any{"limit": limit})
+		s.server.metrics.add(fmt.Sprintf("ingest_session_limit_closed_total{limit=%q}", limit), 1)
+		if err := s.Close(); err != nil {
+			fmt.Println("Error closing peer connection:", err)
+		}
+		return
+	}
+}
+
+// Bytes the live outputs and recordings of the session take up so far
+func (s *Session) outputBytes() int64 {
+	used, _ := diskUsage(s.dir)
+	for _, name := range s.recordings() {
+		if size, ok := diskUsage(name); ok {
+			used += size
+		}
+	}
+	return used
+}
@@ -0,0 +1,194 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// Samples of a session's link kept as its trend, a minute at the default
+// Receiver Report interval
+const linkTrendSize = 60
+
+// Round trips above this are stale answers rather than measurements
+const maxRTT = 10 * time.Second
+
+// linkMonitor measures the path from a publisher every Receiver Report
+// interval: the round trip from the DLRR blocks answering the server's
+// Receiver Reference Time reports (RFC 3611), which the receiving end of a
+// stream can't get from Sender and Receiver Reports alone, and the fraction
+// of packets lost since the previous sample, as the Receiver Reports do
+type linkMonitor struct {
+	ssrc uint32 // Sender of the server's reports
+
+	mu       sync.Mutex
+	rtt      time.Duration // Latest, 0 before the publisher answered
+	samples  []linkSample  // Oldest first
+	expected map[*trackReport][2]uint64
+}
+
+// linkSample is the state of a link at one Receiver Report interval
+type linkSample struct {
+	Time         time.Time `json:"time"`
+	RTT          float64   `json:"rtt,omitempty"` // Seconds, left out before the first measurement
+	FractionLost float64   `json:"fractionLost"`  // Of the packets expected since the previous sample
+	Jitter       float64   `json:"jitter"`        // Seconds, of the track with the most
+	Bitrate      int       `json:"bitrate"`       // Bits per second received over the tracks still sending
+	Score        int       `json:"score"`         // Quality of the link from 0 to 100, see qualityScore
+}
+
+// linkSummary is the latest state of a link and its trend
+type linkSummary struct {
+	RTT          float64      `json:"rtt,omitempty"`
+	FractionLost float64      `json:"fractionLost"`
+	Jitter       float64      `json:"jitter"`
+	Bitrate      int          `json:"bitrate"`
+	Score        int          `json:"score"`
+	Trend        []linkSample `json:"trend,omitempty"`
+}
+
+func newLinkMonitor() *linkMonitor {
+	return &linkMonitor{ssrc: rand.Uint32(), expected: map[*trackReport][2]uint64{}}
+}
+
+// Take the round trip from the DLRR blocks of an RTCP packet answering the
+// server's reports
+func (l *linkMonitor) receive(packet rtcp.Packet) {
+	xr, ok := packet.(*rtcp.ExtendedReport)
+	if !ok {
+		return
+	}
+
+	now := uint32(ntpTimestamp(time.Now()) >> 16)
+	for _, block := range xr.Reports {
+		dlrr, ok := block.(*rtcp.DLRRReportBlock)
+		if !ok {
+			continue
+		}
+		for _, report := range dlrr.Reports {
+			if report.SSRC != l.ssrc || report.LastRR == 0 {
+				continue
+			}
+			// Compact NTP time, in 1/65536 seconds
+			rtt := time.Duration(now-report.LastRR-report.DLRR) * time.Second / 65536
+			if rtt > maxRTT {
+				continue
+			}
+			l.mu.Lock()
+			l.rtt = rtt
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Sample the link: the latest round trip, the packets lost by the tracks
+// since the previous sample, and the jitter and bitrate of those still
+// sending, scored against the bitrates they need at the session's caps
+func (l *linkMonitor) sample(now time.Time, tracks []*trackReport, caps map[string]int) linkSample {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expected, received uint64
+	sample, needed := linkSample{Time: now, RTT: l.rtt.Seconds()}, 0
+	for _, track := range tracks {
+		e, r := track.counts()
+		previous := l.expected[track]
+		l.expected[track] = [2]uint64{e, r}
+		expected += e - previous[0]
+		received += r - previous[1]
+
+		if _, ended := track.activity(); ended != "" {
+			continue
+		}
+		_, bitrate := track.bandwidth()
+		jitter, measured := track.conditions()
+		sample.Bitrate += bitrate
+		sample.Jitter = max(sample.Jitter, jitter)
+		if measured {
+			needed += qualityBitrate(track.track.Kind, caps)
+		}
+	}
+
+	if expected > received {
+		sample.FractionLost = float64(expected-received) / float64(expected)
+	}
+	sample.Score = qualityScore(sample, needed)
+	if len(l.samples) == linkTrendSize {
+		l.samples = append(l.samples[:0], l.samples[1:]...)
+	}
+	l.samples = append(l.samples, sample)
+	return sample
+}
+
+// summary returns nil before the first sample
+func (l *linkMonitor) summary(trend bool) *linkSummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) == 0 {
+		return nil
+	}
+	latest := l.samples[len(l.samples)-1]
+	summary := &linkSummary{RTT: latest.RTT, FractionLost: latest.FractionLost, Jitter: latest.Jitter, Bitrate: latest.Bitrate, Score: latest.Score}
+	if trend {
+		summary.Trend = append([]linkSample(nil), l.samples...)
+	}
+	return summary
+}
+
+// Every Receiver Report interval, send the publisher a Receiver Reference
+// Time report for it to answer with a DLRR block, sample the link into the
+// session's metrics, and tell the publisher its quality
+func (s *Session) monitorLink() {
+	ticker := time.NewTicker(s.server.cfg.RTCPRRInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			tracks := s.tracks
+			s.mu.Unlock()
+			if len(tracks) == 0 {
+				continue
+			}
+
+			rrtr := &rtcp.ExtendedReport{SenderSSRC: s.link.ssrc, Reports: []rtcp.ReportBlock{&rtcp.ReceiverReferenceTimeReportBlock{NTPTimestamp: ntpTimestamp(now)}}}
+			if err := s.peerConnection.WriteRTCP([]rtcp.Packet{rrtr}); err != nil {
+				fmt.Println("Failed to send RTCP XR:", err)
+			}
+
+			sample := s.link.sample(now, tracks, s.bandwidth)
+			s.notifyQuality(sample)
+			s.server.metrics.set(fmt.Sprintf("ingest_session_quality_score{session=%q}", s.id), float64(sample.Score))
+			s.server.metrics.set(fmt.Sprintf("ingest_session_fraction_lost{session=%q}", s.id), sample.FractionLost)
+			if sample.RTT > 0 {
+				s.server.metrics.set(fmt.Sprintf("ingest_session_rtt_seconds{session=%q}", s.id), sample.RTT)
+				s.server.metrics.observe("ingest_rtt_seconds", sample.RTT)
+			}
+		}
+	}
+}
+
+// Round trip, packet loss, jitter, bitrate and quality score of the
+// session in the request path, with their trend
+func (r *sessionRegistry) serveLink(w http.ResponseWriter, req *http.Request) {
+	session := r.get(req.PathValue("id"))
+	if session == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	summary := session.link.summary(true)
+	if summary == nil {
+		summary = &linkSummary{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary) //nolint:errcheck
+}
@@ -0,0 +1,148 @@
+package ingest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricRegistry is a minimal registry of gauges and counters served in the
+// Prometheus text format. Names may carry labels, e.g. `drift{track="audio"}`.
+type metricRegistry struct {
+	mu         sync.Mutex
+	gauges     map[string]float64
+	counters   map[string]float64
+	histograms map[string]*histogram
+}
+
+// Upper bounds of the histogram buckets, in seconds
+var histogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64 // Per bucket, plus +Inf
+	sum    float64
+	count  uint64
+}
+
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{
+		gauges:     map[string]float64{},
+		counters:   map[string]float64{},
+		histograms: map[string]*histogram{},
+	}
+}
+
+func (m *metricRegistry) set(name string, value float64) {
+	m.mu.Lock()
+	m.gauges[name] = value
+	m.mu.Unlock()
+}
+
+func (m *metricRegistry) add(name string, value float64) {
+	m.mu.Lock()
+	m.counters[name] += value
+	m.mu.Unlock()
+}
+
+func (m *metricRegistry) observe(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.histograms[name]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(histogramBuckets)+1)}
+		m.histograms[name] = h
+	}
+
+	h.counts[sort.SearchFloat64s(histogramBuckets, value)]++
+	h.sum += value
+	h.count++
+}
+
+// Drop the series carrying a label, e.g. `session="abc"`, once what they
+// describe is gone
+func (m *metricRegistry) forget(label string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, values := range []map[string]float64{m.gauges, m.counters} {
+		for name := range values {
+			if strings.Contains(name, label) {
+				delete(values, name)
+			}
+		}
+	}
+	for name := range m.histograms {
+		if strings.Contains(name, label) {
+			delete(m.histograms, name)
+		}
+	}
+}
+
+func (m *metricRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetricFamily(w, "gauge", m.gauges)
+	writeMetricFamily(w, "counter", m.counters)
+	writeHistograms(w, m.histograms)
+}
+
+func writeMetricFamily(w http.ResponseWriter, kind string, values map[string]float64) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lastBase := ""
+	for _, name := range names {
+		base, _, _ := strings.Cut(name, "{")
+		if base != lastBase {
+			fmt.Fprintf(w, "# TYPE %s %s\n", base, kind)
+			lastBase = base
+		}
+		fmt.Fprintf(w, "%s %g\n", name, values[name])
+	}
+}
+
+// Histograms are written cumulatively, with the le label added to the
+// labels embedded in their name
+func writeHistograms(w http.ResponseWriter, histograms map[string]*histogram) {
+	names := make([]string, 0, len(histograms))
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lastBase := ""
+	for _, name := range names {
+		base, labels, _ := strings.Cut(name, "{")
+		labels = strings.TrimSuffix(labels, "}")
+		if labels != "" {
+			labels += ","
+		}
+		if base != lastBase {
+			fmt.Fprintf(w, "# TYPE %s histogram\n", base)
+			lastBase = base
+		}
+
+		h := histograms[name]
+		cumulative := uint64(0)
+		for i, bound := range histogramBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", base, labels, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", base, labels, h.count)
+
+		suffix := ""
+		if labels != "" {
+			suffix = "{" + strings.TrimSuffix(labels, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", base, suffix, h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", base, suffix, h.count)
+	}
+}
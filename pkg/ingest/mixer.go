@@ -0,0 +1,245 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mixSampleRate  = 48000
+	mixFrame       = mixSampleRate / 50 // Samples mixed per 20ms tick
+	mixMaxBuffered = mixSampleRate / 5  // Older audio of a source is dropped beyond 200ms
+)
+
+// audioMixer is the sink mixing the audio of every track routed to it, from
+// any number of sessions, into a single recording for meeting capture.
+// Sources are decoded to PCM, natively or by FFmpeg, mixed with a gain per session, and
+// re-encoded to mix.m3u8, whose playlist is written by hlsPlaylist.
+type audioMixer struct {
+	control *recordingControl
+	format  string // Container of the mix's segments, empty for Ogg
+	filter  string // FFmpeg audio filter chain of the mix, see parseAudioFilters
+	window  int    // Segments listed in mix.m3u8
+	tags    []string
+	mixed   atomic.Uint32 // Samples written to the encoder, the playlist's clock
+
+	mu      sync.Mutex
+	sources map[*mixSource]struct{}
+	gains   map[string]float64 // By session ID, 1 when unset
+	stop    chan struct{}      // Stops the encoder, nil while nothing is mixed
+}
+
+type mixSource struct {
+	mixer   *audioMixer
+	session string
+	decoder *pcmDecoder
+	decoded chan struct{} // Closed once the decoder output was read
+	samples []int16       // Decoded and not mixed yet, guarded by the mixer
+}
+
+func newAudioMixer(control *recordingControl, format, filter string, window int, tags []string) *audioMixer {
+	return &audioMixer{
+		control: control,
+		format:  format,
+		filter:  filter,
+		window:  window,
+		tags:    tags,
+		sources: map[*mixSource]struct{}{},
+		gains:   map[string]float64{},
+	}
+}
+
+func (m *audioMixer) Open(t *Track) (io.WriteCloser, error) {
+	if t.Kind != "audio" {
+		return nil, fmt.Errorf("can't mix %s tracks", t.Kind)
+	}
+
+	decoder, err := newPCMDecoder(t.InputArgs, mixSampleRate)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &mixSource{mixer: m, session: t.Session, decoder: decoder, decoded: make(chan struct{})}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.sources) == 0 {
+		if err = m.startEncoder(); err != nil {
+			decoder.discard()
+			return nil, err
+		}
+	}
+	m.sources[source] = struct{}{}
+
+	go source.read(decoder)
+	return source, nil
+}
+
+// Called with the lock held
+func (m *audioMixer) startEncoder() error {
+	playlist := newSinkPlaylist("mix", segmentFilePattern("mix_%d.ogg", m.format, true), m.window, m.tags, m.control)
+	encoder, err := startFFmpegProcess(continueSegments(withSegmentFormat(withAudioFilter([]string{
+		"-f", "s16le",
+		"-ar", fmt.Sprint(mixSampleRate),
+		"-ac", "1",
+		"-i", "pipe:0",
+		"-c:a", "libopus",
+		"-f", "segment",
+		"-segment_time", "2",
+		"-segment_format", "ogg",
+		"-segment_filename", "mix_%d.ogg",
+	}, m.filter), m.format), map[string]int{playlist.pattern: playlist.first}))
+	if err != nil {
+		return err
+	}
+
+	m.stop = make(chan struct{})
+	go watchFFmpeg(encoder, m.control, m.stop, nil)
+	go m.run(encoder.stdin, m.stop)
+	go playlist.watch(m.mixed.Load, newWallClock(mixSampleRate), nil, m.stop)
+	return nil
+}
+
+// Mix a frame of every source each tick, sources that fell behind
+// contribute silence
+func (m *audioMixer) run(encoder io.WriteCloser, stop <-chan struct{}) {
+	defer encoder.Close()
+
+	ticker := time.NewTicker(mixFrame * time.Second / mixSampleRate)
+	defer ticker.Stop()
+
+	mixed := make([]float64, mixFrame)
+	out := make([]byte, 0, mixFrame*2)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		clear(mixed)
+		m.mu.Lock()
+		for source := range m.sources {
+			gain, ok := m.gains[source.session]
+			if !ok {
+				gain = 1
+			}
+
+			n := min(len(source.samples), mixFrame)
+			for i, sample := range source.samples[:n] {
+				mixed[i] += float64(sample) * gain
+			}
+			source.samples = source.samples[n:]
+		}
+		m.mu.Unlock()
+
+		out = out[:0]
+		for _, sample := range mixed {
+			clipped := max(math.MinInt16, min(math.MaxInt16, sample))
+			out = binary.LittleEndian.AppendUint16(out, uint16(int16(clipped)))
+		}
+		if _, err := encoder.Write(out); err != nil {
+			fmt.Println("Error writing to mixer:", err)
+			return
+		}
+		m.mixed.Add(mixFrame)
+	}
+}
+
+// Collect the decoded samples of a source
+func (s *mixSource) read(stdout io.Reader) {
+	defer close(s.decoded)
+
+	buf := make([]byte, mixFrame*2)
+	for {
+		n, err := io.ReadFull(stdout, buf)
+		if n >= 2 {
+			s.mixer.mu.Lock()
+			for i := 0; i+1 < n; i += 2 {
+				s.samples = append(s.samples, int16(binary.LittleEndian.Uint16(buf[i:])))
+			}
+			if excess := len(s.samples) - mixMaxBuffered; excess > 0 {
+				s.samples = s.samples[excess:]
+			}
+			s.mixer.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *mixSource) Write(p []byte) (int, error) {
+	return s.decoder.Write(p)
+}
+
+// Close removes the source from the mix, stopping the encoder after the
+// last one
+func (s *mixSource) Close() error {
+	err := s.decoder.Close()
+	<-s.decoded
+	s.decoder.wait()
+
+	m := s.mixer
+	m.mu.Lock()
+	delete(m.sources, s)
+	if len(m.sources) == 0 && m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	m.mu.Unlock()
+
+	return err
+}
+
+type mixStatus struct {
+	Sources []string           `json:"sources"` // Session IDs being mixed
+	Gains   map[string]float64 `json:"gains"`
+}
+
+func (m *audioMixer) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	status := mixStatus{Sources: []string{}, Gains: map[string]float64{}}
+	for source := range m.sources {
+		status.Sources = append(status.Sources, source.session)
+	}
+	for session, gain := range m.gains {
+		status.Gains[session] = gain
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status) //nolint:errcheck
+}
+
+// Set the gains of sessions from a JSON object like {"<session>": 0.5}
+func (m *audioMixer) serveGains(w http.ResponseWriter, r *http.Request) {
+	gains := map[string]float64{}
+	if err := json.NewDecoder(r.Body).Decode(&gains); err != nil {
+		http.Error(w, "invalid gains", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	for session, gain := range gains {
+		if gain < 0 || math.IsNaN(gain) || math.IsInf(gain, 0) {
+			m.mu.Unlock()
+			http.Error(w, fmt.Sprintf("invalid gain for %s", session), http.StatusBadRequest)
+			return
+		}
+	}
+	for session, gain := range gains {
+		m.gains[session] = gain
+	}
+	m.mu.Unlock()
+
+	m.serveStatus(w, r)
+}
@@ -0,0 +1,166 @@
+package ingest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// Largest object payload accepted, a keyframe of high bitrate video
+const moqMaxObject = 4 << 20
+
+var errMoQObjectTooLarge = errors.New("object too large")
+
+// moqTrack is a track announced by a MoQ publisher, whose objects are
+// written to an in-process peer connection
+type moqTrack struct {
+	track    *webrtc.TrackLocalStaticSample
+	last     time.Time // Capture time of the previous object
+	duration time.Duration
+}
+
+// serveMoQ publishes the objects a Media over QUIC style publisher streams in
+// the request body, through an in-process peer connection like plain RTP, so
+// QUIC based contribution can be compared with WebRTC on the same pipeline.
+// The tracks are announced as ?tracks=opus,vp8, their index being the track
+// alias of the objects. Each object is a sequence of QUIC variable-length
+// integers, track alias, group, object ID, capture time in microseconds since
+// the Unix epoch and payload length, followed by the payload: an Opus packet
+// or a whole video frame, H.264 in Annex B.
+func (s *Server) serveMoQ(w http.ResponseWriter, r *http.Request) {
+	var tracks []*moqTrack
+	var locals []webrtc.TrackLocal
+	for i, name := range strings.Split(r.URL.Query().Get("tracks"), ",") {
+		codec, ok := rtpBridgeCodecs[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown codec %q", name), http.StatusBadRequest)
+			return
+		}
+		track, err := webrtc.NewTrackLocalStaticSample(codec, fmt.Sprintf("moq-%d", i), "moq")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tracks = append(tracks, &moqTrack{track: track, duration: 20 * time.Millisecond})
+		locals = append(locals, track)
+	}
+
+	session, err := s.publishAs(requestToken(r), requestIdentity(r))
+	if err != nil {
+		s.http.publishError(w, r, err)
+		return
+	}
+	session.mu.Lock()
+	session.userAgent = r.UserAgent()
+	session.mu.Unlock()
+
+	publisher, err := s.connectPublisherTo(session, locals...)
+	if err != nil {
+		http.Error(w, err.Error(), offerStatus(err))
+		return
+	}
+	defer func() {
+		if err := publisher.Close(); err != nil {
+			fmt.Println("Error closing MoQ peer connection:", err)
+		}
+		if err := session.Close(); err != nil {
+			fmt.Println("Error closing peer connection:", err)
+		}
+	}()
+
+	// The session is announced before the objects were all read, which
+	// HTTP/1.1 needs full duplex for
+	http.NewResponseController(w).EnableFullDuplex() //nolint:errcheck
+	w.Header().Set("Location", "/whip/"+session.ID())
+	w.WriteHeader(http.StatusCreated)
+	http.NewResponseController(w).Flush() //nolint:errcheck
+
+	// A session ended by the server stops reading the publisher
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-session.Done():
+			r.Body.Close()
+		case <-stopped:
+		}
+	}()
+
+	body := bufio.NewReader(r.Body)
+	latency := fmt.Sprintf("ingest_moq_object_latency_seconds{session=%q}", session.ID())
+	for {
+		alias, captured, payload, err := readMoQObject(body)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Printf("Error reading MoQ objects of session %s: %v\n", session.ID(), err)
+			}
+			return
+		}
+		if alias >= uint64(len(tracks)) {
+			s.metrics.add(`ingest_moq_objects_total{result="unknown_track"}`, 1)
+			continue
+		}
+		s.metrics.add(`ingest_moq_objects_total{result="received"}`, 1)
+		// How long after capture objects arrive, to hold against the
+		// received stage of ingest_pipeline_latency_seconds
+		s.metrics.observe(latency, max(time.Since(captured), 0).Seconds())
+
+		t := tracks[alias]
+		if delta := captured.Sub(t.last); !t.last.IsZero() && delta > 0 && delta < time.Second {
+			t.duration = delta
+		}
+		t.last = captured
+		if err := t.track.WriteSample(media.Sample{Data: payload, Duration: t.duration}); err != nil {
+			fmt.Println("Error writing MoQ object:", err)
+		}
+	}
+}
+
+// Read an object, returning its track alias, capture time and payload
+func readMoQObject(r *bufio.Reader) (uint64, time.Time, []byte, error) {
+	var fields [5]uint64
+	for i := range fields {
+		v, err := readVarint(r)
+		if err != nil {
+			if i > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, time.Time{}, nil, err
+		}
+		fields[i] = v
+	}
+	if fields[4] > moqMaxObject {
+		return 0, time.Time{}, nil, errMoQObjectTooLarge
+	}
+
+	payload := make([]byte, fields[4])
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, time.Time{}, nil, io.ErrUnexpectedEOF
+	}
+	return fields[0], time.UnixMicro(int64(fields[3])), payload, nil
+}
+
+// Read a QUIC variable-length integer (RFC 9000 section 16), whose two most
+// significant bits give its length
+func readVarint(r *bufio.Reader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(first & 0x3f)
+	for range 1<<(first>>6) - 1 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
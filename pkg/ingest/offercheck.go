@@ -0,0 +1,117 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Codecs of the static payload types, which offers may leave without rtpmap
+var staticPayloadTypes = map[string]string{"0": "PCMU", "8": "PCMA", "9": "G722"}
+
+// Media codecs the server accepts by kind, as registered in NewServer. RED,
+// FEC and telephone events only come along with them.
+func acceptedCodecs(cfg *Config) map[string][]string {
+	accepted := map[string][]string{"audio": {"opus"}, "video": {"VP8"}}
+	if cfg.H264 {
+		accepted["video"] = append(accepted["video"], "H264")
+	}
+	if cfg.LegacyCodecs {
+		for _, codec := range legacyCodecs {
+			_, name, _ := strings.Cut(codec.params.MimeType, "/")
+			accepted["audio"] = append(accepted["audio"], name)
+		}
+	}
+	return accepted
+}
+
+// validateOffer checks an offer before it is applied, so a publisher is told
+// why it can't publish instead of getting a session without tracks: the
+// offer must hold audio or video, send at least one of them, in a codec the
+// server accepts
+func validateOffer(offer webrtc.SessionDescription, accepted map[string][]string) error {
+	if offer.Type != webrtc.SDPTypeOffer {
+		return WithKind(ErrorSignaling, fmt.Errorf("expected an offer, got %s", offer.Type))
+	}
+	if strings.TrimSpace(offer.SDP) == "" {
+		return WithKind(ErrorSignaling, errors.New("offer has no SDP"))
+	}
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return WithKind(ErrorSignaling, fmt.Errorf("offer isn't valid SDP: %v", err))
+	}
+
+	sessionDirection := sdpDirection(parsed.Attributes, "sendrecv")
+	var media, sending, offered []string
+	for _, m := range parsed.MediaDescriptions {
+		kind := m.MediaName.Media
+		if kind != "audio" && kind != "video" {
+			continue
+		}
+		media = append(media, kind)
+		if m.MediaName.Port.Value == 0 {
+			continue // Rejected by the publisher itself
+		}
+		if direction := sdpDirection(m.Attributes, sessionDirection); direction != "sendrecv" && direction != "sendonly" {
+			continue
+		}
+		sending = append(sending, kind)
+
+		codecs := offeredCodecs(m)
+		for _, codec := range codecs {
+			if slices.ContainsFunc(accepted[kind], func(name string) bool { return strings.EqualFold(name, codec) }) {
+				return nil
+			}
+		}
+		offered = append(offered, kind+" "+strings.Join(codecs, "/"))
+	}
+
+	switch {
+	case len(media) == 0:
+		return WithKind(ErrorNegotiation, errors.New("missing media sections: the offer has no audio or video, add a track before creating it"))
+	case len(sending) == 0:
+		return WithKind(ErrorNegotiation, errors.New("unsupported direction: the offer doesn't send any audio or video, its media sections must be sendonly or sendrecv"))
+	}
+	return WithKind(ErrorNegotiation, fmt.Errorf("no compatible codec: the offer sends %s, the server accepts audio %s and video %s",
+		strings.Join(offered, ", "), strings.Join(accepted["audio"], "/"), strings.Join(accepted["video"], "/")))
+}
+
+// Direction attribute among the attributes of a description, or the default
+func sdpDirection(attributes []sdp.Attribute, fallback string) string {
+	for _, a := range attributes {
+		switch a.Key {
+		case "sendrecv", "sendonly", "recvonly", "inactive":
+			return a.Key
+		}
+	}
+	return fallback
+}
+
+// Encoding names of the payload types of a media section
+func offeredCodecs(m *sdp.MediaDescription) []string {
+	names := map[string]string{}
+	for _, a := range m.Attributes {
+		if a.Key != "rtpmap" {
+			continue
+		}
+		payloadType, encoding, _ := strings.Cut(a.Value, " ")
+		name, _, _ := strings.Cut(encoding, "/")
+		names[payloadType] = name
+	}
+
+	var codecs []string
+	for _, payloadType := range m.MediaName.Formats {
+		name, ok := names[payloadType]
+		if !ok {
+			name, ok = staticPayloadTypes[payloadType]
+		}
+		if ok && !slices.Contains(codecs, name) {
+			codecs = append(codecs, name)
+		}
+	}
+	return codecs
+}
@@ -0,0 +1,63 @@
+//go:build opus && cgo
+
+package ingest
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// nativeOpus is whether this build decodes Opus itself, with libopus
+const nativeOpus = true
+
+// opusDecoder decodes Opus packets to interleaved 16-bit PCM
+type opusDecoder struct {
+	decoder  *C.OpusDecoder
+	channels int
+}
+
+func newOpusDecoder(rate, channels int) (*opusDecoder, error) {
+	var status C.int
+	decoder := C.opus_decoder_create(C.opus_int32(rate), C.int(channels), &status)
+	if status != C.OPUS_OK {
+		return nil, fmt.Errorf("opus_decoder_create: %s", C.GoString(C.opus_strerror(status)))
+	}
+
+	d := &opusDecoder{decoder: decoder, channels: channels}
+	runtime.SetFinalizer(d, (*opusDecoder).close)
+	return d, nil
+}
+
+// decode decodes a packet into pcm, which must hold 120ms at the decoder's
+// rate, and returns the number of samples per channel. An empty packet is
+// concealed as lost.
+func (d *opusDecoder) decode(packet []byte, pcm []int16) (int, error) {
+	if d.decoder == nil {
+		return 0, fmt.Errorf("opus decoder closed")
+	}
+
+	var data *C.uchar
+	if len(packet) > 0 {
+		data = (*C.uchar)(unsafe.Pointer(&packet[0]))
+	}
+	n := C.opus_decode(d.decoder, data, C.opus_int32(len(packet)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/d.channels), 0)
+	if n < 0 {
+		return 0, fmt.Errorf("opus_decode: %s", C.GoString(C.opus_strerror(n)))
+	}
+	return int(n), nil
+}
+
+func (d *opusDecoder) close() {
+	if d.decoder != nil {
+		C.opus_decoder_destroy(d.decoder)
+		d.decoder = nil
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !opus || !cgo
+
+package ingest
+
+import "errors"
+
+// nativeOpus is whether this build decodes Opus itself, with libopus
+const nativeOpus = false
+
+var errNoNativeOpus = errors.New("built without libopus, rebuild with -tags opus")
+
+// opusDecoder is unavailable without the opus build tag, callers decode
+// through FFmpeg instead
+type opusDecoder struct{}
+
+func newOpusDecoder(rate, channels int) (*opusDecoder, error) {
+	return nil, errNoNativeOpus
+}
+
+func (d *opusDecoder) decode(packet []byte, pcm []int16) (int, error) {
+	return 0, errNoNativeOpus
+}
+
+func (d *opusDecoder) close() {}
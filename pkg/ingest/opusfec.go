@@ -0,0 +1,132 @@
+package ingest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Opus fmtp parameters offered to publishers
+func opusFmtp(cfg *Config) string {
+	fmtp := "minptime=10"
+	if cfg.OpusFEC {
+		fmtp += ";useinbandfec=1"
+	}
+	if cfg.OpusDTX {
+		fmtp += ";usedtx=1"
+	}
+	if cfg.OpusStereo {
+		fmtp += ";stereo=1"
+	}
+	return fmtp
+}
+
+// Channels a publisher sends on an Opus track: two when its fmtp line has
+// sprop-stereo=1 and -opus-stereo accepts them
+func opusChannels(cfg *Config, codec webrtc.RTPCodecParameters) int {
+	if !cfg.OpusStereo || codec.Channels == 1 {
+		return 1
+	}
+	for _, param := range strings.Split(codec.SDPFmtpLine, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "sprop-stereo") && value == "1" {
+			return 2
+		}
+	}
+	return 1
+}
+
+// opusConcealer tells the gaps of an Opus track apart by their sequence
+// numbers. Publishers using DTX stop sending during silence without skipping
+// sequence numbers, those gaps are filled with silence even without
+// -gap-fill. A packet lost right before one carrying inband FEC (LBRR) data
+// is replaced with that packet rather than silence: without decoding, the
+// redundant copy can't be cut out of it, but the neighbouring frame conceals
+// the loss far better than a dropout.
+type opusConcealer struct {
+	track     string
+	clockRate uint32
+	fec       bool
+	metrics   *metricRegistry
+
+	started  bool
+	seq      uint16 // Of the latest packet
+	expected uint32 // RTP timestamp the next packet should carry
+}
+
+func newOpusConcealer(track string, clockRate uint32, cfg *Config, metrics *metricRegistry) *opusConcealer {
+	return &opusConcealer{track: track, clockRate: clockRate, fec: cfg.OpusFEC, metrics: metrics}
+}
+
+// conceal returns how many silence frames a DTX gap before a packet needs,
+// and the payload standing in for a lost frame if the packet carries FEC for
+// it. lost is how many frames the gap detector found missing.
+func (c *opusConcealer) conceal(packet *rtp.Packet, lost int) (int, []byte) {
+	if c == nil {
+		return 0, nil
+	}
+
+	duration := opusDuration(packet.Payload)
+	next := packet.Timestamp + uint32(duration*time.Duration(c.clockRate)/time.Second)
+	if !c.started {
+		c.started = true
+		c.seq, c.expected = packet.SequenceNumber, next
+		return 0, nil
+	}
+
+	skipped := int16(packet.SequenceNumber - c.seq - 1)
+	gap := int32(packet.Timestamp - c.expected)
+	if skipped < 0 || gap < 0 {
+		// Late or duplicate
+		return 0, nil
+	}
+	c.seq, c.expected = packet.SequenceNumber, next
+
+	if skipped == 0 {
+		dtx := int(time.Duration(gap) * time.Second / time.Duration(c.clockRate) / opusSilenceDuration)
+		if dtx > 0 {
+			c.metrics.add(fmt.Sprintf("ingest_opus_dtx_seconds_total{track=%q}", c.track), (time.Duration(dtx) * opusSilenceDuration).Seconds())
+		}
+		return dtx, nil
+	}
+
+	if c.fec && lost > 0 && duration == opusSilenceDuration && opusHasLBRR(packet.Payload) {
+		c.metrics.add(fmt.Sprintf("ingest_opus_fec_recovered_total{track=%q}", c.track), 1)
+		return 0, packet.Payload
+	}
+	return 0, nil
+}
+
+// Whether an Opus packet carries LBRR (inband FEC) data for the previous
+// frame. The flag follows the VAD flags of the SILK frames at the start of
+// the range coded data, which code to plain bits (as opus_packet_has_lbrr).
+func opusHasLBRR(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+
+	// CELT only packets carry no SILK layer
+	config := payload[0] >> 3
+	if config >= 16 {
+		return false
+	}
+
+	// Only single frame packets, the first frame starts after the TOC byte
+	if payload[0]&0x3 != 0 {
+		return false
+	}
+	silkFrames := 1
+	if config < 12 {
+		silkFrames = max(1, int(opusDuration(payload)/(20*time.Millisecond)))
+	}
+
+	frame := payload[1]
+	lbrr := frame>>(7-silkFrames)&1 == 1
+	if stereo := payload[0]&0x4 != 0; stereo {
+		lbrr = lbrr || frame>>(6-2*silkFrames)&1 == 1
+	}
+	return lbrr
+}
@@ -0,0 +1,81 @@
+package ingest
+
+import (
+	"time"
+)
+
+// Pacing never goes slower than this, in bytes per second, so nearly idle
+// streams aren't held back
+const pacerMinRate = 64 * 1024
+
+// Bytes sent back to back before pacing kicks in
+const pacerBurst = 8 * 1200
+
+// Longest a packet is held, beyond it a burst is let through faster than the
+// pace rather than queueing ever more
+const pacerMaxDelay = 250 * time.Millisecond
+
+// pacer spreads the packets forwarded to a WebRTC viewer at a multiple of the
+// stream's average bitrate. Keyframes and frames sent late arrive in bursts,
+// which would overflow the jitter buffers of viewers and make their
+// congestion control back off.
+type pacer struct {
+	multiplier float64
+	rate       float64 // Average bitrate of the stream, in bytes per second
+	budget     float64 // Bytes that can be sent right away, negative while behind
+	last       time.Time
+
+	window      time.Time // Start of the current measurement window
+	windowBytes int
+}
+
+// A pacer for a multiple of the average bitrate, nil if multiplier disables pacing
+func newPacer(multiplier float64) *pacer {
+	if multiplier <= 0 {
+		return nil
+	}
+	return &pacer{multiplier: multiplier, budget: pacerBurst}
+}
+
+// How long to hold a packet of n bytes before sending it
+func (p *pacer) delay(n int, now time.Time) time.Duration {
+	if p == nil {
+		return 0
+	}
+	// Nothing is held until the bitrate was measured, not to skew it
+	if p.measure(n, now); p.rate == 0 {
+		return 0
+	}
+
+	rate := max(p.rate*p.multiplier, pacerMinRate)
+	if !p.last.IsZero() {
+		p.budget = min(p.budget+now.Sub(p.last).Seconds()*rate, pacerBurst)
+	}
+	p.last = now
+
+	p.budget = max(p.budget-float64(n), -rate*pacerMaxDelay.Seconds())
+	if p.budget >= 0 {
+		return 0
+	}
+	return time.Duration(-p.budget / rate * float64(time.Second))
+}
+
+// Average the bitrate over windows of a second
+func (p *pacer) measure(n int, now time.Time) {
+	if p.window.IsZero() {
+		p.window = now
+	}
+	p.windowBytes += n
+
+	elapsed := now.Sub(p.window)
+	if elapsed < time.Second {
+		return
+	}
+	rate := float64(p.windowBytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = rate
+	} else {
+		p.rate = 0.8*p.rate + 0.2*rate
+	}
+	p.window, p.windowBytes = now, 0
+}
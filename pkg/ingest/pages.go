@@ -0,0 +1,25 @@
+package ingest
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// Page capturing the microphone and camera and publishing them over WHIP
+//
+//go:embed web/publish.html
+var publishPage []byte
+
+// Page playing a session's live HLS, VOD renditions or the WHEP relay, with
+// latency and segment stats
+//
+//go:embed web/play.html
+var playPage []byte
+
+func servePage(page []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(page) //nolint:errcheck
+	}
+}
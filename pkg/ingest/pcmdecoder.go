@@ -0,0 +1,100 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+)
+
+// pcmDecoder decodes the payloads written to it, in the format of their
+// FFmpeg input arguments, to 16-bit little-endian mono PCM read from it.
+// Opus is decoded in process by builds with the opus tag, anything else by
+// an FFmpeg.
+type pcmDecoder struct {
+	io.WriteCloser
+	io.Reader // Until EOF once the input was closed
+	wait      func()
+}
+
+func newPCMDecoder(inputArgs []string, rate int) (*pcmDecoder, error) {
+	if isOpusInput(inputArgs) {
+		if decoder, err := newOpusDecoder(rate, 1); err == nil {
+			pcm, input := io.Pipe()
+			return &pcmDecoder{
+				WriteCloser: &opusPCMInput{decoder: decoder, pcm: input, samples: make([]int16, rate*120/1000)},
+				Reader:      pcm,
+				wait:        func() {},
+			}, nil
+		}
+	}
+
+	decoder := exec.Command("ffmpeg", append(slices.Clone(inputArgs),
+		"-i", "pipe:0",
+		"-f", "s16le",
+		"-ar", fmt.Sprint(rate),
+		"-ac", "1",
+		"pipe:1",
+	)...)
+	decoder.Stderr = os.Stderr
+	isolateProcess(decoder)
+
+	stdin, err := decoder.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+	}
+	stdout, err := decoder.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	if err = decoder.Start(); err != nil {
+		return nil, err
+	}
+
+	return &pcmDecoder{
+		WriteCloser: stdin,
+		Reader:      stdout,
+		wait:        func() { decoder.Wait() }, //nolint:errcheck
+	}, nil
+}
+
+// discard closes the input and waits for the decoder without reading its
+// output
+func (d *pcmDecoder) discard() {
+	d.Close()
+	io.Copy(io.Discard, d) //nolint:errcheck
+	d.wait()
+}
+
+// opusPCMInput decodes each payload written to it with libopus
+type opusPCMInput struct {
+	decoder *opusDecoder
+	pcm     *io.PipeWriter
+	samples []int16
+	out     []byte
+}
+
+func (i *opusPCMInput) Write(payload []byte) (int, error) {
+	n, err := i.decoder.decode(payload, i.samples)
+	if err != nil {
+		// Skipped like FFmpeg skips a corrupt packet
+		fmt.Println("Error decoding Opus:", err)
+		return len(payload), nil
+	}
+
+	i.out = i.out[:0]
+	for _, sample := range i.samples[:n] {
+		i.out = binary.LittleEndian.AppendUint16(i.out, uint16(sample))
+	}
+	if _, err := i.pcm.Write(i.out); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+func (i *opusPCMInput) Close() error {
+	i.decoder.close()
+	return i.pcm.Close()
+}
@@ -0,0 +1,479 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// Raw Opus payloads are fed to FFmpeg as they arrive
+var opusInputArgs = []string{"-f", "opus"}
+
+// FFmpeg input arguments of an Opus track with the given channels
+func opusTrackInputArgs(channels int) []string {
+	if channels == 2 {
+		return append(slices.Clone(opusInputArgs), "-ac", "2")
+	}
+	return opusInputArgs
+}
+
+// Whether FFmpeg input arguments describe Opus payloads
+func isOpusInput(inputArgs []string) bool {
+	return len(inputArgs) >= 2 && slices.Equal(inputArgs[:2], opusInputArgs)
+}
+
+// Video frames are fed to FFmpeg as they are assembled
+var videoInputArgs = []string{"-f", "rawvideo", "-pix_fmt", "yuv420p", "-s", "640x480", "-r", "30"}
+
+type streamHandler struct {
+	ring           *payloadRing // Payloads ready for FFmpeg
+	done           chan struct{}
+	finishOnce     sync.Once
+	end            *trackEnd
+	link           *linkMonitor
+	ffmpegStdin    io.WriteCloser
+	metricsEnabled bool
+	metrics        *metricRegistry
+	vad            *voiceDetector
+	silences       func(intervals []silenceInterval) // Records the long silences once the track ended
+	control        *recordingControl
+	lastTimestamp  atomic.Uint32 // RTP timestamp of the latest packet read
+	clock          *wallClock
+	latency        *latencyTracker
+	drift          *driftTracker
+	gaps           *gapDetector
+	opus           *opusConcealer // Fills DTX gaps and recovers lost packets through FEC, nil for other codecs
+	red            *redDecoder    // Unwraps RED packets, nil for plain Opus
+	dtmf           *dtmfReceiver  // Takes out telephone events, nil unless negotiated
+	headers        *headerReader
+	taps           []io.WriteCloser // Extra consumers of the payloads written to FFmpeg
+	writeThrough   bool             // Write every payload as it arrives instead of batching
+	batchSize      int              // Payloads written to FFmpeg at once
+	flushInterval  time.Duration    // Longest a partial batch waits
+	batcher        *adaptiveBatcher // Tunes batchSize and flushInterval to a latency target, nil to keep them
+	processors     []PacketProcessor
+}
+
+// newStreamHandler buffers up to the given duration of audio ahead of FFmpeg
+func newStreamHandler(buffer time.Duration, control *recordingControl, metrics *metricRegistry) *streamHandler {
+	return &streamHandler{
+		ring:           newPayloadRing(max(1, int(buffer/opusSilenceDuration))),
+		done:           make(chan struct{}),
+		metricsEnabled: true,
+		batchSize:      5,
+		flushInterval:  5 * time.Millisecond,
+		metrics:        metrics,
+		control:        control,
+	}
+}
+
+func (h *streamHandler) processRTPPackets() {
+	defer h.ring.close()
+	defer h.reportSilence()
+
+	packetCounter := uint64(0)
+	lastMetricTime := time.Now()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		default:
+			rtpPacket, err := h.end.read()
+			if err != nil {
+				return
+			}
+
+			h.headers.observe(rtpPacket)
+			h.latency.at(latencyReceived, rtpPacket.Timestamp)
+			if h.dtmf.receive(rtpPacket) {
+				continue
+			}
+			queued := 0
+			for _, packet := range h.red.unwrap(rtpPacket) {
+				if h.handlePacket(packet) {
+					queued++
+				}
+			}
+			if queued == 0 {
+				continue
+			}
+
+			if h.metricsEnabled {
+				packetCounter += uint64(queued)
+				if time.Since(lastMetricTime) >= time.Second {
+					fmt.Printf("Processed %d packets/sec\n", packetCounter)
+					packetCounter = 0
+					lastMetricTime = time.Now()
+				}
+			}
+		}
+	}
+}
+
+// Run a packet through the processors and queue its payload, reporting
+// whether it was queued
+func (h *streamHandler) handlePacket(rtpPacket *rtp.Packet) bool {
+	// Dropped packets are treated like lost ones
+	rtpPacket, err := processPacket(h.processors, rtpPacket)
+	if err != nil {
+		fmt.Println("Error processing packet:", err)
+		return false
+	} else if rtpPacket == nil {
+		return false
+	}
+
+	h.lastTimestamp.Store(rtpPacket.Timestamp)
+
+	if h.vad != nil && !h.vad.observe(rtpPacket, time.Now()) {
+		h.fillTimeline(rtpPacket, true)
+		return false
+	}
+	if h.control.isPaused() {
+		h.fillTimeline(rtpPacket, true)
+		return false
+	}
+	h.fillTimeline(rtpPacket, false)
+
+	// The copy is released once written
+	payload := copyPayload(rtpPacket.Payload)
+	if !h.ring.push(payload) {
+		releasePayload(payload)
+		h.metrics.add(`ingest_pipeline_dropped_total{track="audio"}`, 1)
+		if h.metricsEnabled {
+			fmt.Println("Packet dropped: buffer full")
+		}
+		return false
+	}
+	return true
+}
+
+// Keep the output timeline continuous ahead of a packet: silence replaces
+// media lost to packet loss, then output that fell behind the publisher's
+// clock is filled as well. Skipped packets are left out of the output on
+// purpose and must not be compensated for.
+func (h *streamHandler) fillTimeline(packet *rtp.Packet, skipped bool) {
+	duration := opusDuration(packet.Payload)
+	lost := h.gaps.missing(packet.Timestamp, duration, opusSilenceDuration)
+	dtx, recovered := h.opus.conceal(packet, lost)
+	lost = max(lost, dtx)
+	switch {
+	case skipped:
+		duration += time.Duration(lost) * opusSilenceDuration
+	case recovered != nil:
+		h.insertSilence(lost - 1)
+		h.insertFrame(recovered)
+	default:
+		h.insertSilence(lost)
+	}
+
+	if h.drift == nil {
+		return
+	}
+
+	drift := h.drift.observe(packet.Timestamp)
+	if !skipped {
+		h.insertSilence(h.drift.fill(drift, opusSilenceDuration))
+	}
+
+	h.drift.wrote(duration)
+}
+
+func (h *streamHandler) insertSilence(frames int) {
+	// Long outages need more silence than the ring holds, wait for FFmpeg
+	// to catch up
+	for ; frames > 0; frames-- {
+		if !h.ring.pushWait(opusSilenceFrame, h.done) {
+			return
+		}
+		if h.drift != nil {
+			h.drift.wrote(opusSilenceDuration)
+		}
+	}
+}
+
+// Insert a copy of an Opus frame standing in for a lost one
+func (h *streamHandler) insertFrame(payload []byte) {
+	if h.ring.pushWait(copyPayload(payload), h.done) && h.drift != nil {
+		h.drift.wrote(opusSilenceDuration)
+	}
+}
+
+func (h *streamHandler) reportSilence() {
+	if h.vad == nil {
+		return
+	}
+
+	intervals := h.vad.silenceIntervals(time.Now())
+	for _, interval := range intervals {
+		fmt.Printf("Silence from %s to %s\n", interval.Start.Format(time.RFC3339Nano), interval.End.Format(time.RFC3339Nano))
+	}
+	if h.silences != nil && len(intervals) > 0 {
+		h.silences(intervals)
+	}
+}
+
+func (h *streamHandler) writeToFFmpeg() {
+	defer h.finish()
+	defer func() {
+		for _, tap := range h.taps {
+			tap.Close()
+		}
+	}()
+
+	// Process packets in small batches for efficiency
+	batchSize, flushInterval := max(1, h.batchSize), h.flushInterval
+	batch := make([][]byte, 0, batchSize)
+	var queued time.Time // When the oldest payload of the batch was queued
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	flushBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		start := time.Now()
+		for _, payload := range batch {
+			if _, err := h.ffmpegStdin.Write(payload); err != nil {
+				fmt.Println("Error writing to FFmpeg:", err)
+				batch = batch[:0] // Some payloads were released already
+				return
+			}
+			for _, tap := range h.taps {
+				if _, err := tap.Write(payload); err != nil {
+					fmt.Println("Error writing to tap:", err)
+				}
+			}
+			releasePayload(payload)
+		}
+		batch = batch[:0]
+
+		end := time.Now()
+		h.metrics.observe(`ingest_pipeline_write_latency_seconds{track="audio"}`, end.Sub(queued).Seconds())
+		h.latency.after(latencyWritten, end.Sub(queued))
+		if h.batcher != nil && h.batcher.observe(queued, start, end) {
+			batchSize, flushInterval = h.batcher.size, h.batcher.flush
+			ticker.Reset(flushInterval)
+			h.metrics.set(`ingest_pipeline_batch_size{track="audio"}`, float64(batchSize))
+		}
+	}
+
+	for {
+		// Whatever was queued before the ring closed is still written
+		closed := h.ring.closed.Load()
+		for payload, at, ok := h.ring.pop(); ok; payload, at, ok = h.ring.pop() {
+			if len(batch) == 0 {
+				queued = at
+			}
+			h.latency.after(latencyBuffered, time.Since(at))
+			batch = append(batch, payload)
+			if h.writeThrough || len(batch) >= batchSize {
+				flushBatch()
+			}
+		}
+		if closed {
+			flushBatch()
+			return
+		}
+
+		select {
+		case <-h.ring.readable:
+		case <-ticker.C:
+			h.metrics.set(`ingest_pipeline_buffer_occupancy{track="audio"}`, h.ring.occupancy())
+			flushBatch()
+		}
+	}
+}
+
+// End the track and close its FFmpeg input, whether the track or the
+// session ended first
+func (h *streamHandler) finish() {
+	h.finishOnce.Do(func() {
+		close(h.done)
+		h.ffmpegStdin.Close()
+	})
+}
+
+// FFmpeg arguments reading payloads in the given input format and writing
+// them with the given audio encoder to the HLS segments <name>_N.ogg in dir,
+// whose playlist is written by hlsPlaylist
+func audioFFmpegArgs(inputArgs []string, encoder, dir, name string) []string {
+	args := []string{
+		"-fflags", "+nobuffer+fastseek+flush_packets+discardcorrupt",
+		"-flags", "low_delay",
+	}
+	args = append(args, inputArgs...)
+	return append(args,
+		"-i", "pipe:0",
+		"-c:a", encoder,
+		"-f", "segment",
+		"-segment_time", "0.025",
+		"-segment_format", "ogg",
+		"-segment_format_options", "flush_packets=1",
+		"-max_delay", "0",
+		"-avoid_negative_ts", "make_zero",
+		"-thread_queue_size", "512",
+		"-segment_filename", filepath.Join(dir, name+"_%d.ogg"),
+	)
+}
+
+// FFmpeg arguments transcoding the VP8 track to the HLS segments
+// <name>_N.mp4 in dir, plus the image outputs
+func videoFFmpegArgs(cfg *Config, dir, name string) []string {
+	args := append([]string{}, videoInputArgs...)
+	args = append(args,
+		"-i", "pipe:0",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-f", "segment",
+		"-segment_time", "0.05",
+		"-segment_format", "mp4",
+		"-segment_format_options", "movflags=+frag_keyframe+empty_moov",
+		"-max_delay", "0",
+		"-avoid_negative_ts", "make_zero",
+		"-segment_filename", filepath.Join(dir, name+"_%d.mp4"),
+	)
+	args = append(args, thumbnailArgs(cfg, dir)...)
+	return append(args, previewArgs(cfg)...)
+}
+
+// Run the processing pipeline of an audio track until it or the session
+// ends
+func startAudioPipeline(sessionDone <-chan struct{}, receiver *webrtc.RTPReceiver, handler *streamHandler, playlist *hlsPlaylist, t *Track, guard *sessionGuard) {
+	// Start parallel processing pipeline
+	name := t.rendition()
+	guard.run(name+" reader", handler.processRTPPackets)
+	guard.run(name+" writer", handler.writeToFFmpeg)
+
+	// Stamp segments with the publisher's wall-clock time
+	guard.run(name+" RTCP reader", func() { readRTCP(receiver, handler.clock, handler.end.bye, handler.link.receive) })
+	guard.run(name+" playlist", func() {
+		playlist.watch(handler.lastTimestamp.Load, handler.clock, handler.latency.segment, handler.done)
+	})
+
+	// End the track along with the session
+	go func() {
+		select {
+		case <-sessionDone:
+			handler.finish()
+		case <-handler.done:
+		}
+	}()
+}
+
+// videoWriter assembles the frames of a video track and writes them to its
+// sinks at the constant frame rate FFmpeg expects
+type videoWriter struct {
+	writer        io.Writer
+	control       *recordingControl
+	lastTimestamp atomic.Uint32 // RTP timestamp of the latest packet read
+	drift         *driftTracker
+	gaps          *gapDetector
+	startup       *startupTimer
+	latency       *latencyTracker
+	fec           *fecDecoder      // Unwraps RED and recovers lost packets, nil for plain VP8
+	depacketizer  rtp.Depacketizer // Turns payloads into the codec's frames
+	headers       *headerReader
+	processors    []PacketProcessor
+}
+
+// Write the frames of the track until it ends, returning the write error if
+// the writer failed first. Frames are duplicated or dropped to keep the
+// constant frame rate output in sync with the publisher's clock.
+func (v *videoWriter) saveToDisk(end *trackEnd) error {
+	writer, control, drift, gaps := v.writer, v.control, v.drift, v.gaps
+
+	frame, last := []byte{}, []byte{}
+	read := func() (*rtp.Packet, error) {
+		packet, err := end.read()
+		if err == nil {
+			v.headers.observe(packet)
+			v.latency.at(latencyReceived, packet.Timestamp)
+		}
+		return packet, err
+	}
+	for {
+		rtpPacket, err := v.fec.nextPacket(read)
+		if err != nil {
+			return nil
+		}
+
+		if rtpPacket, err = processPacket(v.processors, rtpPacket); err != nil {
+			fmt.Println("Error processing packet:", err)
+			continue
+		} else if rtpPacket == nil {
+			continue
+		}
+
+		v.lastTimestamp.Store(rtpPacket.Timestamp)
+		payload, err := v.depacketizer.Unmarshal(rtpPacket.Payload)
+		if err != nil {
+			fmt.Println("Error depacketizing video:", err)
+			continue
+		}
+		if _, h264 := v.depacketizer.(*codecs.H264Packet); (h264 && h264Keyframe(payload)) || (!h264 && isVP8Keyframe(rtpPacket.Payload)) {
+			v.startup.mark(stageFirstKeyframe)
+		}
+
+		// The marker bit is set on the last packet of a frame
+		frame = append(frame, payload...)
+		if !rtpPacket.Marker {
+			continue
+		}
+		v.latency.at(latencyBuffered, rtpPacket.Timestamp)
+
+		// Repeat the last frame over frames lost to packet loss
+		lost := gaps.missing(rtpPacket.Timestamp, videoFrameDuration, videoFrameDuration)
+		if control.isPaused() || len(last) == 0 {
+			drift.wrote(time.Duration(lost) * videoFrameDuration)
+			lost = 0
+		}
+		for ; lost > 0; lost-- {
+			if _, err := writer.Write(last); err != nil {
+				fmt.Println("Error writing payload:", err)
+				return err
+			}
+			drift.wrote(videoFrameDuration)
+		}
+
+		offset := drift.observe(rtpPacket.Timestamp)
+		switch {
+		case control.isPaused():
+			drift.wrote(videoFrameDuration)
+		case drift.drop(offset):
+		default:
+			for n := drift.fill(offset, videoFrameDuration) + 1; n > 0; n-- {
+				if _, err := writer.Write(frame); err != nil {
+					fmt.Println("Error writing payload:", err)
+					return err
+				}
+				drift.wrote(videoFrameDuration)
+			}
+			v.latency.at(latencyWritten, rtpPacket.Timestamp)
+			last = append(last[:0], frame...)
+		}
+		frame = frame[:0]
+	}
+}
+
+// Find the ID negotiated for a header extension, 0 if it wasn't negotiated
+func headerExtensionID(receiver *webrtc.RTPReceiver, uri string) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == uri {
+			return uint8(ext.ID)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,125 @@
+package ingest
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Codes of the errors reported to the publisher
+const (
+	errCodeFFmpegExited = "ffmpeg_exited"
+	errCodeFFmpegStart  = "ffmpeg_start_failed"
+	errCodeDiskFull     = "disk_full"
+	errCodePanic        = "panic"
+	errCodePolicy       = "policy_violation"
+	errCodeSinkFailed   = "sink_failed"
+	errCodeSessionLimit = "session_limit"
+)
+
+type pipelineError struct {
+	Type    string    `json:"type"`
+	Code    string    `json:"code"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+const stderrTailLines = 5
+
+// stderrTail forwards FFmpeg's stderr to ours while keeping its last lines
+// around, so a crash can be reported with the reason FFmpeg gave
+type stderrTail struct {
+	mu      sync.Mutex
+	lines   []string
+	partial string
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	os.Stderr.Write(p) //nolint:errcheck
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// FFmpeg rewrites its progress line with \r, treat it as a line break
+	lines := strings.FieldsFunc(t.partial+string(p), func(r rune) bool { return r == '\n' || r == '\r' })
+	t.partial = ""
+	if len(p) > 0 && p[len(p)-1] != '\n' && p[len(p)-1] != '\r' && len(lines) > 0 {
+		t.partial = lines[len(lines)-1]
+		lines = lines[:len(lines)-1]
+	}
+
+	t.lines = append(t.lines, lines...)
+	if len(t.lines) > stderrTailLines {
+		t.lines = t.lines[len(t.lines)-stderrTailLines:]
+	}
+
+	return len(p), nil
+}
+
+func (t *stderrTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]string{}, t.lines...)
+	if t.partial != "" {
+		lines = append(lines, t.partial)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Wait for FFmpeg to exit and report it as a pipeline error, unless it exited
+// because the pipeline was stopped
+func watchFFmpeg(process *ffmpegProcess, control *recordingControl, done <-chan struct{}, crashed func(message string)) {
+	err := process.wait()
+
+	select {
+	case <-done:
+		return
+	default:
+	}
+
+	output := strings.TrimSpace(process.stderr.String())
+	code := errCodeFFmpegExited
+	if strings.Contains(output, "No space left on device") {
+		code = errCodeDiskFull
+	}
+
+	message := fmt.Sprintf("FFmpeg exited (%v): %s", err, output)
+	control.reportError(code, message)
+	if crashed != nil {
+		crashed(message)
+	}
+}
+
+// sessionGuard keeps a panic in one stage of a session from crashing the
+// whole process: the panic is reported to the publisher and only the
+// session it happened in is closed
+type sessionGuard struct {
+	control *recordingControl
+	close   func()
+}
+
+// Run a stage of the session in its own goroutine
+func (g *sessionGuard) run(stage string, fn func()) {
+	go func() {
+		defer g.recover(stage)
+		fn()
+	}()
+}
+
+// Deferred by stages running on goroutines the session doesn't start itself,
+// like Pion callbacks
+func (g *sessionGuard) recover(stage string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	fmt.Printf("Panic in %s: %v\n%s", stage, r, debug.Stack())
+	g.control.reportError(errCodePanic, fmt.Sprintf("%s panicked: %v", stage, r))
+	g.close()
+}
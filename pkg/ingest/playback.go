@@ -0,0 +1,219 @@
+package ingest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookie playback tokens are kept in once a player presented one, so the
+// segments a playlist lists are fetched with it too
+const playbackCookie = "ingest_playback"
+
+// Where revocations are kept across restarts
+const playbackRevocationsFile = "playback_revocations.json"
+
+var errPlaybackToken = errors.New("invalid playback token")
+
+// playbackTokens issues and verifies the tokens viewers present to play a
+// session's live playlists, recordings and VOD renditions. A token is
+// "<session>.<issued>.<expires>.<signature>", times in Unix milliseconds and
+// the signature an HMAC-SHA256 of the rest. Revoking a session's tokens
+// rejects every token of it issued until then.
+type playbackTokens struct {
+	key []byte
+	ttl time.Duration
+
+	mu      sync.Mutex
+	revoked map[string]int64 // Unix milliseconds, by session
+}
+
+// newPlaybackTokens loads the revocations, nil without a key
+func newPlaybackTokens(cfg *Config) (*playbackTokens, error) {
+	if cfg.PlaybackKey == "" {
+		return nil, nil
+	}
+
+	p := &playbackTokens{key: []byte(cfg.PlaybackKey), ttl: cfg.PlaybackTokenTTL, revoked: map[string]int64{}}
+	data, err := os.ReadFile(playbackRevocationsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.revoked); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", playbackRevocationsFile, err)
+	}
+
+	return p, nil
+}
+
+func (p *playbackTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (p *playbackTokens) issue(session string, ttl time.Duration, now time.Time) (string, time.Time) {
+	expires := now.Add(ttl)
+	payload := fmt.Sprintf("%s.%d.%d", session, now.UnixMilli(), expires.UnixMilli())
+	return payload + "." + p.sign(payload), expires
+}
+
+// verify returns the session a token grants playback of
+func (p *playbackTokens) verify(token string, now time.Time) (string, error) {
+	// Tenant session IDs hold a dot of their own, so the fields are taken
+	// from the right and the session is whatever precedes them
+	parts := strings.Split(token, ".")
+	if len(parts) < 4 {
+		return "", errPlaybackToken
+	}
+	n := len(parts)
+	session := strings.Join(parts[:n-3], ".")
+	payload := strings.Join(parts[:n-1], ".")
+	if !validSessionID(session) || !hmac.Equal([]byte(p.sign(payload)), []byte(parts[n-1])) {
+		return "", errPlaybackToken
+	}
+
+	issued, err := strconv.ParseInt(parts[n-3], 10, 64)
+	if err != nil {
+		return "", errPlaybackToken
+	}
+	expires, err := strconv.ParseInt(parts[n-2], 10, 64)
+	if err != nil || now.UnixMilli() >= expires {
+		return "", errTokenExpired
+	}
+
+	p.mu.Lock()
+	revoked, ok := p.revoked[session]
+	p.mu.Unlock()
+	if ok && issued <= revoked {
+		return "", errors.New("playback token revoked")
+	}
+
+	return session, nil
+}
+
+func (p *playbackTokens) revoke(session string, now time.Time) error {
+	p.mu.Lock()
+	p.revoked[session] = now.UnixMilli()
+	data, err := json.MarshalIndent(p.revoked, "", "  ")
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(playbackRevocationsFile, data)
+}
+
+// Playback token of a request: bearer, query parameter or cookie
+func playbackToken(r *http.Request) string {
+	if token := requestToken(r); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(playbackCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Only let playback requests through with a token for the session the
+// request is for, an empty session accepting a token of any. Without a
+// playback key, the auth provider's playback scope applies as before.
+func (s *httpServer) requirePlayback(session func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	if s.playback == nil {
+		return s.require(scopePlayback, next)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := playbackToken(r)
+		granted, err := s.playback.verify(token, time.Now())
+		if want := session(r); err == nil && want != "" && granted != want {
+			err = errors.New("playback token of another session")
+		}
+		if err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		// Players don't carry query parameters over to segment URLs
+		if r.URL.Query().Get("token") == token {
+			http.SetCookie(w, &http.Cookie{Name: playbackCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		}
+		next(w, r)
+	}
+}
+
+// Session named in the request path, of live outputs, VOD renditions and
+// segment keys
+func pathSession(r *http.Request) string {
+	return r.PathValue("session")
+}
+
+// Session a recording in the working directory belongs to, empty when it
+// belongs to none in particular
+func recordingSession(r *http.Request) string {
+	name := r.PathValue("file")
+	if rest, ok := strings.CutPrefix(name, "recording_"); ok {
+		if i := strings.LastIndex(rest, "_"); i > 0 {
+			return rest[:i]
+		}
+	}
+	return ""
+}
+
+// Issue a playback token of a session, valid for the ttl query parameter or
+// -playback-token-ttl
+func (s *httpServer) serveIssuePlayback(w http.ResponseWriter, r *http.Request) {
+	if s.playback == nil {
+		http.Error(w, "playback tokens are disabled", http.StatusNotFound)
+		return
+	}
+
+	id := r.PathValue("id")
+	if !validSessionID(id) {
+		http.Error(w, "invalid session", http.StatusBadRequest)
+		return
+	}
+	ttl := s.playback.ttl
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		var err error
+		if ttl, err = time.ParseDuration(raw); err != nil || ttl <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, expires := s.playback.issue(id, ttl, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"token": token, "expires": expires}) //nolint:errcheck
+}
+
+// Revoke every playback token issued for a session so far
+func (s *httpServer) serveRevokePlayback(w http.ResponseWriter, r *http.Request) {
+	if s.playback == nil {
+		http.Error(w, "playback tokens are disabled", http.StatusNotFound)
+		return
+	}
+
+	id := r.PathValue("id")
+	if !validSessionID(id) {
+		http.Error(w, "invalid session", http.StatusBadRequest)
+		return
+	}
+	if err := s.playback.revoke(id, time.Now()); err != nil {
+		fmt.Println("Error saving playback revocations:", err)
+		http.Error(w, "failed to save revocation", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,45 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlaybackTokens(t *testing.T) {
+	p := &playbackTokens{key: []byte("secret"), revoked: map[string]int64{}}
+	now := time.UnixMilli(1_700_000_000_000)
+
+	for _, session := range []string{"abc", "acme.abc", "a-b_c"} {
+		token, _ := p.issue(session, time.Minute, now)
+		got, err := p.verify(token, now.Add(time.Second))
+		if err != nil || got != session {
+			t.Errorf("verify(issue(%q)) = %q, %v", session, got, err)
+		}
+	}
+
+	token, _ := p.issue("acme.abc", time.Minute, now)
+	for name, tc := range map[string]struct {
+		token string
+		now   time.Time
+		err   error
+	}{
+		"expired":   {token, now.Add(time.Minute), errTokenExpired},
+		"tampered":  {"other" + token[4:], now, errPlaybackToken},
+		"truncated": {token[:len(token)-1], now, errPlaybackToken},
+		"too short": {"abc.1.2", now, errPlaybackToken},
+		"empty":     {"", now, errPlaybackToken},
+	} {
+		if _, err := p.verify(tc.token, tc.now); err != tc.err {
+			t.Errorf("%s: verify = %v, want %v", name, err, tc.err)
+		}
+	}
+
+	p.revoked["acme.abc"] = now.UnixMilli()
+	if _, err := p.verify(token, now); err == nil {
+		t.Error("verify accepted a revoked token")
+	}
+	later, _ := p.issue("acme.abc", time.Minute, now.Add(time.Second))
+	if _, err := p.verify(later, now.Add(time.Second)); err != nil {
+		t.Errorf("verify rejected a token issued after the revocation: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package ingest
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewritePlaylist passes every media URI of an m3u8 playlist through
+// rewrite. URIs of other playlists are left alone since those are served
+// by us and rewritten when they are fetched.
+func rewritePlaylist(playlist string, rewrite func(uri string) (string, error)) (string, error) {
+	var rewriteErr error
+	rewriteURI := func(uri string) string {
+		if strings.HasSuffix(uri, ".m3u8") {
+			return uri
+		}
+
+		out, err := rewrite(uri)
+		if err != nil {
+			rewriteErr = err
+			return uri
+		}
+		return out
+	}
+
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			lines[i] = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + rewriteURI(uriAttribute.FindStringSubmatch(attr)[1]) + `"`
+			})
+		default:
+			lines[i] = rewriteURI(strings.TrimSpace(line))
+		}
+	}
+
+	return strings.Join(lines, "\n"), rewriteErr
+}
+
+// Tags the playlists of tracks are made of, which -playlist-tags can't add
+var playlistManagedTags = []string{"#EXTM3U", "#EXT-X-VERSION", "#EXT-X-TARGETDURATION", "#EXT-X-MEDIA-SEQUENCE", "#EXT-X-DISCONTINUITY-SEQUENCE", "#EXT-X-DISCONTINUITY", "#EXT-X-PROGRAM-DATE-TIME", "#EXTINF", "#EXT-X-ENDLIST"}
+
+// Parse the tags of -playlist-tags, like "#EXT-X-INDEPENDENT-SEGMENTS,
+// #EXT-X-START:TIME-OFFSET=-1,PRECISE=YES". Every tag starts with #EXT, so
+// commas between the attributes of one stay with it.
+func parsePlaylistTags(spec string) ([]string, error) {
+	var tags []string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case strings.ContainsAny(entry, "\r\n"):
+			return nil, fmt.Errorf("invalid playlist tag %q", entry)
+		case strings.HasPrefix(entry, "#EXT"):
+			tags = append(tags, entry)
+		case len(tags) > 0:
+			tags[len(tags)-1] += "," + entry
+		default:
+			return nil, fmt.Errorf("invalid playlist tag %q", entry)
+		}
+	}
+
+	for _, tag := range tags {
+		if name, _, _ := strings.Cut(tag, ":"); slices.Contains(playlistManagedTags, name) {
+			return nil, fmt.Errorf("playlist tag %s is written by the server", name)
+		}
+	}
+	return tags, nil
+}
+
+// hlsPlaylist writes the live HLS playlist of a track, whose FFmpeg only
+// writes the segments. Segment durations are the media between the RTP
+// timestamps the track's pipeline was at when FFmpeg opened each segment,
+// rather than what the muxer makes of its input, and every segment is
+// stamped with the publisher's wall-clock time once Sender Reports arrived.
+type hlsPlaylist struct {
+	path    string
+	dir     string
+	pattern string // Printf style name of the segments in dir
+	first   int    // Number of the first segment, past those of a resumed session
+	window  int    // Segments listed
+	tags    []string
+	control *recordingControl // Of the session, pauses it and marks the segments starting a discontinuity
+
+	segments        []playlistSegment
+	sequence        int // Media sequence number of the first listed segment
+	discontinuities int // That slid out of the window
+	target          int // Target duration in seconds, which never goes down
+	ended           bool
+}
+
+type playlistSegment struct {
+	uri           string
+	duration      time.Duration
+	start         time.Time // Wall-clock time of its first media, zero before the first Sender Report
+	discontinuity bool
+}
+
+// Playlist of a track's hls sink, once its sinks are open
+func (s *Session) newPlaylist(t *Track) *hlsPlaylist {
+	dir, pattern := (&hlsSink{}).files(t)
+	first := s.resumeSegments[pattern]
+	return &hlsPlaylist{
+		path:     filepath.Join(dir, t.hlsName()+".m3u8"),
+		dir:      dir,
+		pattern:  pattern,
+		first:    first,
+		window:   s.server.cfg.PlaylistWindow,
+		tags:     s.server.playlistTags,
+		control:  s.control,
+		sequence: first,
+		target:   1,
+
+		discontinuities: s.control.discontinuitiesBefore(pattern, first),
+	}
+}
+
+// Playlist of the segments a node-wide sink's FFmpeg writes to the working
+// directory, numbered after the ones an earlier encoder left there
+func newSinkPlaylist(name, pattern string, window int, tags []string, control *recordingControl) *hlsPlaylist {
+	first := 0
+	for fileExists(fmt.Sprintf(pattern, first)) {
+		first++
+	}
+	return &hlsPlaylist{path: name + ".m3u8", dir: ".", pattern: pattern, first: first, window: window, tags: tags, control: control, sequence: first, target: 1}
+}
+
+// watch polls for the next segment FFmpeg opens and notes the RTP timestamp
+// the track's pipeline is at, a segment being complete once the next one
+// appeared. Complete segments are listed with the media between the two
+// timestamps as their duration, less what the recording was paused for, and
+// their start time is reported to available. Segments FFmpeg moved past
+// within one poll share that media evenly. Once stop is closed, the segment
+// FFmpeg was writing is listed last and the playlist ended.
+func (p *hlsPlaylist) watch(position func() uint32, clock *wallClock, available func(start time.Time), stop <-chan struct{}) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	var open *playlistSegment // Being written by FFmpeg
+	var opened, pausedAt uint32
+	var openedAt time.Time
+	var paused time.Duration // Of the open segment
+	pausing := false
+	complete := func(timestamp uint32, now time.Time, more []string) []playlistSegment {
+		if pausing {
+			paused += clock.elapsed(pausedAt, timestamp)
+			pausedAt = timestamp
+		}
+		// The RTP timestamps jump when a publisher restarts its stream
+		duration, wall := clock.elapsed(opened, timestamp)-paused, now.Sub(openedAt)-paused
+		if duration <= 0 || duration > wall+time.Second {
+			duration = wall
+		}
+
+		share := max(0, duration) / time.Duration(1+len(more))
+		segments := []playlistSegment{*open}
+		for _, uri := range more {
+			segment := playlistSegment{uri: uri}
+			if previous := segments[len(segments)-1]; !previous.start.IsZero() {
+				segment.start = previous.start.Add(share)
+			}
+			segments = append(segments, segment)
+		}
+		for i := range segments {
+			segments[i].duration = share
+			p.add(segments[i])
+		}
+		return segments
+	}
+
+	next := p.first
+	for {
+		select {
+		case <-stop:
+			if open != nil {
+				complete(position(), time.Now(), nil)
+				p.ended = true
+				p.write()
+			}
+			return
+		case <-ticker.C:
+		}
+
+		// Nothing is written while the recording is paused
+		timestamp, now := position(), time.Now()
+		switch isPaused := p.control.isPaused(); {
+		case isPaused && !pausing:
+			pausing, pausedAt = true, timestamp
+		case !isPaused && pausing:
+			pausing = false
+			paused += clock.elapsed(pausedAt, timestamp)
+		}
+
+		var found []string // Opened since the last poll
+		for {
+			name := fmt.Sprintf(p.pattern, next)
+			if _, err := os.Stat(filepath.Join(p.dir, name)); err != nil {
+				break
+			}
+			found = append(found, name)
+			next++
+		}
+		if len(found) == 0 {
+			continue
+		}
+
+		if open == nil {
+			start, _ := clock.at(timestamp)
+			open = &playlistSegment{uri: found[0], start: start}
+			opened, openedAt, paused = timestamp, now, 0
+			found = found[1:]
+			if len(found) == 0 {
+				continue
+			}
+		}
+
+		// All but the last segment found are complete along with the open one
+		for _, segment := range complete(timestamp, now, found[:len(found)-1]) {
+			if !segment.start.IsZero() && available != nil {
+				available(segment.start)
+			}
+		}
+		p.write()
+		start, _ := clock.at(timestamp)
+		open = &playlistSegment{uri: found[len(found)-1], start: start}
+		opened, openedAt, paused = timestamp, now, 0
+	}
+}
+
+// List a complete segment, sliding the oldest out of the window
+func (p *hlsPlaylist) add(segment playlistSegment) {
+	segment.discontinuity = p.control.discontinuity(segment.uri)
+	p.segments = append(p.segments, segment)
+	p.target = max(p.target, int(math.Round(segment.duration.Seconds())))
+	if len(p.segments) > p.window {
+		if p.segments[0].discontinuity {
+			p.discontinuities++
+		}
+		p.segments = p.segments[1:]
+		p.sequence++
+	}
+}
+
+func (p *hlsPlaylist) write() {
+	if err := writeFileAtomic(p.path, []byte(p.String())); err != nil {
+		fmt.Println("Error writing playlist:", err)
+	}
+}
+
+func (p *hlsPlaylist) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n", p.target, p.sequence)
+	if p.discontinuities > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.discontinuities)
+	}
+	for _, tag := range p.tags {
+		b.WriteString(tag + "\n")
+	}
+
+	for _, segment := range p.segments {
+		if segment.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if !segment.start.IsZero() {
+			b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + segment.start.UTC().Format("2006-01-02T15:04:05.000Z") + "\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", segment.duration.Seconds(), segment.uri)
+	}
+	if p.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+package ingest
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePlaylistTags(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		tags []string
+		err  bool
+	}{
+		{spec: "", tags: nil},
+		{spec: "#EXT-X-INDEPENDENT-SEGMENTS", tags: []string{"#EXT-X-INDEPENDENT-SEGMENTS"}},
+		{
+			spec: "#EXT-X-INDEPENDENT-SEGMENTS, #EXT-X-START:TIME-OFFSET=-1,PRECISE=YES",
+			tags: []string{"#EXT-X-INDEPENDENT-SEGMENTS", "#EXT-X-START:TIME-OFFSET=-1,PRECISE=YES"},
+		},
+		{spec: " , #EXT-X-INDEPENDENT-SEGMENTS ,", tags: []string{"#EXT-X-INDEPENDENT-SEGMENTS"}},
+		{spec: "TIME-OFFSET=-1", err: true},
+		{spec: "#EXT-X-START:TIME-OFFSET=-1\n#EXT-X-ENDLIST", err: true},
+		{spec: "#EXT-X-TARGETDURATION:4", err: true},
+		{spec: "#EXT-X-ENDLIST", err: true},
+	} {
+		tags, err := parsePlaylistTags(tc.spec)
+		if (err != nil) != tc.err || !slices.Equal(tags, tc.tags) {
+			t.Errorf("parsePlaylistTags(%q) = %q, %v", tc.spec, tags, err)
+		}
+	}
+}
+
+func TestHLSPlaylistString(t *testing.T) {
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	newPlaylist := func(discontinuities ...string) *hlsPlaylist {
+		control := newRecordingControl("")
+		for _, name := range discontinuities {
+			control.markSegment(name)
+		}
+		return &hlsPlaylist{window: 2, control: control}
+	}
+
+	for name, tc := range map[string]struct {
+		playlist *hlsPlaylist
+		segments []playlistSegment
+		ended    bool
+		want     string
+	}{
+		"empty": {
+			playlist: newPlaylist(),
+			want:     "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:0\n#EXT-X-MEDIA-SEQUENCE:0\n",
+		},
+		"program date time": {
+			playlist: newPlaylist(),
+			segments: []playlistSegment{
+				{uri: "s_0.ogg", duration: 1500 * time.Millisecond, start: start},
+				{uri: "s_1.ogg", duration: 2600 * time.Millisecond},
+			},
+			ended: true,
+			want: "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+				"#EXT-X-PROGRAM-DATE-TIME:2026-10-16T12:00:00.000Z\n#EXTINF:1.500,\ns_0.ogg\n" +
+				"#EXTINF:2.600,\ns_1.ogg\n#EXT-X-ENDLIST\n",
+		},
+		"sliding window": {
+			playlist: newPlaylist("s_1.ogg"),
+			segments: []playlistSegment{
+				{uri: "s_0.ogg", duration: time.Second},
+				{uri: "s_1.ogg", duration: time.Second},
+				{uri: "s_2.ogg", duration: time.Second},
+				{uri: "s_3.ogg", duration: time.Second},
+			},
+			want: "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:2\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n" +
+				"#EXTINF:1.000,\ns_2.ogg\n#EXTINF:1.000,\ns_3.ogg\n",
+		},
+		"discontinuity": {
+			playlist: newPlaylist("s_1.ogg"),
+			segments: []playlistSegment{
+				{uri: "s_0.ogg", duration: time.Second},
+				{uri: "s_1.ogg", duration: time.Second},
+			},
+			want: "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+				"#EXTINF:1.000,\ns_0.ogg\n#EXT-X-DISCONTINUITY\n#EXTINF:1.000,\ns_1.ogg\n",
+		},
+	} {
+		for _, segment := range tc.segments {
+			tc.playlist.add(segment)
+		}
+		tc.playlist.ended = tc.ended
+		if got := tc.playlist.String(); got != tc.want {
+			t.Errorf("%s: String() = %q, want %q", name, got, tc.want)
+		}
+	}
+
+	p := newPlaylist()
+	p.tags = []string{"#EXT-X-INDEPENDENT-SEGMENTS"}
+	if got := p.String(); !strings.HasSuffix(got, "#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-INDEPENDENT-SEGMENTS\n") {
+		t.Errorf("String() = %q, want the tags after the header", got)
+	}
+}
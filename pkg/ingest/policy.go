@@ -0,0 +1,259 @@
+package ingest
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	policyGrace = 10 * time.Second // How long a publisher may exceed its policy before the session is closed
+
+	// Measurements may exceed the limits by this much without a violation,
+	// encoders overshoot briefly
+	policyBitrateTolerance   = 1.25
+	policyFrameRateTolerance = 2
+)
+
+// Policy limits the video a session's publisher may send, zero leaving a
+// limit off
+type Policy struct {
+	MaxBitrate   int `json:"maxBitrate,omitempty"` // Bits per second
+	MaxHeight    int `json:"maxHeight,omitempty"`
+	MaxFrameRate int `json:"maxFrameRate,omitempty"`
+}
+
+func (p Policy) limited() bool {
+	return p.MaxBitrate > 0 || p.MaxHeight > 0 || p.MaxFrameRate > 0
+}
+
+// SetPolicy limits the video the publisher may send. It must be called
+// before Answer, and overrides the policy of -policy-file. The bitrate
+// also caps the video bandwidth.
+func (s *Session) SetPolicy(p Policy) {
+	s.mu.Lock()
+	s.policy = p
+	s.mu.Unlock()
+
+	if p.MaxBitrate > 0 && (s.bandwidth["video"] <= 0 || s.bandwidth["video"] > p.MaxBitrate) {
+		s.bandwidth["video"] = p.MaxBitrate
+	}
+}
+
+func (s *Session) currentPolicy() Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policy
+}
+
+// policyTable holds the policies of -policy-file by publisher, "*" for the
+// publishers not listed
+type policyTable map[string]Policy
+
+// Load a file of "<publisher> bitrate=2500000 height=720 fps=30" lines, nil
+// without a file
+func loadPolicies(path string) (policyTable, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy file: %v", err)
+	}
+	defer f.Close()
+
+	table := policyTable{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var p Policy
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid policy limit %q of %s", field, fields[0])
+			}
+			switch key {
+			case "bitrate":
+				p.MaxBitrate = n
+			case "height":
+				p.MaxHeight = n
+			case "fps":
+				p.MaxFrameRate = n
+			default:
+				return nil, fmt.Errorf("unknown policy limit %q of %s", key, fields[0])
+			}
+		}
+		table[fields[0]] = p
+	}
+
+	return table, scanner.Err()
+}
+
+// Policy of a publisher, the empty one with no policy file
+func (t policyTable) lookup(publisher string) Policy {
+	if p, ok := t[publisher]; ok && publisher != "" {
+		return p
+	}
+	return t["*"]
+}
+
+// Add max-fs and max-fr (RFC 7741) to the VP8 formats of an answer, so the
+// publisher's encoder keeps within the policy from the first frame. Frame
+// sizes are in macroblocks, for a 16:9 frame of the maximum height.
+func limitVideoFormat(answer *webrtc.SessionDescription, p Policy) (*webrtc.SessionDescription, error) {
+	if p.MaxHeight <= 0 && p.MaxFrameRate <= 0 {
+		return answer, nil
+	}
+
+	var limits []string
+	if p.MaxHeight > 0 {
+		width := (p.MaxHeight*16/9 + 1) &^ 1
+		limits = append(limits, fmt.Sprintf("max-fs=%d", ((width+15)/16)*((p.MaxHeight+15)/16)))
+	}
+	if p.MaxFrameRate > 0 {
+		limits = append(limits, fmt.Sprintf("max-fr=%d", p.MaxFrameRate))
+	}
+
+	parsed, err := answer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, attr := range media.Attributes {
+			payloadType, codec, _ := strings.Cut(attr.Value, " ")
+			if attr.Key != "rtpmap" || !strings.HasPrefix(strings.ToUpper(codec), "VP8/") {
+				continue
+			}
+			addFmtp(media, payloadType, strings.Join(limits, ";"))
+		}
+	}
+
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return &webrtc.SessionDescription{Type: answer.Type, SDP: string(raw)}, nil
+}
+
+// Append parameters to the fmtp line of a payload type, adding one if missing
+func addFmtp(media *sdp.MediaDescription, payloadType, params string) {
+	for i, attr := range media.Attributes {
+		if attr.Key == "fmtp" && strings.HasPrefix(attr.Value, payloadType+" ") {
+			media.Attributes[i].Value += ";" + params
+			return
+		}
+	}
+	media.Attributes = append(media.Attributes, sdp.NewAttribute("fmtp", payloadType+" "+params))
+}
+
+// policyEnforcer is the PacketProcessor measuring a video track against the
+// session's policy every second. The publisher is sent a REMB with the
+// bitrate limit each time, and the session is closed once it kept exceeding
+// a limit for policyGrace.
+type policyEnforcer struct {
+	session *Session
+	policy  Policy
+	track   string
+
+	windowStart time.Time
+	bytes       int
+	frames      int
+	height      int       // Of the latest keyframe
+	violating   time.Time // Since when a limit is exceeded, zero if none is
+	closed      bool
+}
+
+// Processors enforcing the session's policy on a video track, none without one
+func (s *Session) policyProcessors(t *Track) []PacketProcessor {
+	p := s.currentPolicy()
+	if !p.limited() {
+		return nil
+	}
+	return []PacketProcessor{&policyEnforcer{session: s, policy: p, track: t.rendition()}}
+}
+
+func (e *policyEnforcer) Process(packet *rtp.Packet) (*rtp.Packet, error) {
+	now := time.Now()
+	if e.windowStart.IsZero() {
+		e.windowStart = now
+	}
+
+	e.bytes += packet.MarshalSize()
+	if packet.Marker {
+		e.frames++
+	}
+	if _, height, ok := vp8KeyframeSize(packet.Payload); ok {
+		e.height = height
+	}
+
+	if elapsed := now.Sub(e.windowStart); elapsed >= time.Second {
+		e.measure(now, elapsed, packet.SSRC)
+	}
+	return packet, nil
+}
+
+func (e *policyEnforcer) measure(now time.Time, elapsed time.Duration, ssrc uint32) {
+	bitrate := float64(e.bytes*8) / elapsed.Seconds()
+	frameRate := float64(e.frames) / elapsed.Seconds()
+	e.windowStart, e.bytes, e.frames = now, 0, 0
+
+	p, s := e.policy, e.session
+	if p.MaxBitrate > 0 {
+		remb := &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: float32(p.MaxBitrate), SSRCs: []uint32{ssrc}}
+		if err := s.peerConnection.WriteRTCP([]rtcp.Packet{remb}); err != nil {
+			fmt.Println("Error sending REMB:", err)
+		}
+	}
+
+	limit := ""
+	switch {
+	case p.MaxBitrate > 0 && bitrate > float64(p.MaxBitrate)*policyBitrateTolerance:
+		limit = "bitrate"
+	case p.MaxHeight > 0 && e.height > p.MaxHeight:
+		limit = "height"
+	case p.MaxFrameRate > 0 && frameRate > float64(p.MaxFrameRate+policyFrameRateTolerance):
+		limit = "fps"
+	}
+	if limit == "" {
+		e.violating = time.Time{}
+		return
+	}
+
+	s.server.metrics.add(fmt.Sprintf("ingest_policy_violations_total{limit=%q}", limit), 1)
+	if e.violating.IsZero() {
+		e.violating = now
+	}
+	if now.Sub(e.violating) < policyGrace || e.closed {
+		return
+	}
+
+	e.closed = true
+	message := fmt.Sprintf("%s track exceeded the %s limit of the session's policy for %s", e.track, limit, policyGrace)
+	fmt.Printf("Closing session %s: %s\n", s.id, message)
+	s.control.reportError(errCodePolicy, message)
+	s.server.metrics.add("ingest_policy_closed_total", 1)
+	go func() {
+		if err := s.Close(); err != nil {
+			fmt.Println("Error closing peer connection:", err)
+		}
+	}()
+}
@@ -0,0 +1,218 @@
+package ingest
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+)
+
+// Outcomes of a preflight check
+const (
+	PreflightOK   = "ok"
+	PreflightWarn = "warn" // The server runs, with a feature missing or slower
+	PreflightFail = "fail" // Sessions would fail
+)
+
+// How long a STUN or TURN server gets to answer
+const preflightTimeout = 5 * time.Second
+
+// FFmpeg encoders the pipelines use, and the optional ones with what is
+// missing without them
+var (
+	requiredEncoders = []string{"libx264", "libopus", "libvpx", "aac"}
+	optionalEncoders = map[string]string{"h264_nvenc": "H.264 is encoded on the CPU"}
+)
+
+// PreflightCheck is the outcome of one check of Preflight
+type PreflightCheck struct {
+	Name   string
+	Status string // PreflightOK, PreflightWarn or PreflightFail
+	Detail string
+}
+
+// Preflight checks what the server needs from its host with cfg: FFmpeg and
+// its encoders, the reachability of the STUN and TURN servers, and that the
+// directories outputs are written to are writable
+func Preflight(cfg *Config) []PreflightCheck {
+	checks := preflightFFmpeg()
+	if cfg.Encoder == "gstreamer" {
+		checks = append(checks, preflightGStreamer())
+	}
+
+	servers, err := iceServers(cfg)
+	if err != nil {
+		checks = append(checks, PreflightCheck{"ICE servers", PreflightFail, err.Error()})
+	}
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			checks = append(checks, preflightICEServer(url, server.Username, fmt.Sprint(server.Credential)))
+		}
+	}
+
+	dirs := []string{".", os.TempDir()}
+	if cfg.RTPDumpDir != "" {
+		dirs = append(dirs, cfg.RTPDumpDir)
+	}
+	for _, dir := range dirs {
+		checks = append(checks, preflightWritable(dir))
+	}
+
+	return checks
+}
+
+func preflightGStreamer() PreflightCheck {
+	path, err := exec.LookPath("gst-launch-1.0")
+	if err != nil {
+		return PreflightCheck{"gst-launch-1.0", PreflightFail, "not found in PATH, needed by -encoder gstreamer"}
+	}
+	return PreflightCheck{"gst-launch-1.0", PreflightOK, path}
+}
+
+func preflightFFmpeg() []PreflightCheck {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return []PreflightCheck{{"ffmpeg", PreflightFail, "not found in PATH"}}
+	}
+	version, err := exec.Command(path, "-hide_banner", "-version").Output()
+	if err != nil {
+		return []PreflightCheck{{"ffmpeg", PreflightFail, fmt.Sprintf("%s -version failed: %v", path, err)}}
+	}
+	checks := []PreflightCheck{{"ffmpeg", PreflightOK, strings.SplitN(string(version), "\n", 2)[0] + " at " + path}}
+
+	out, err := exec.Command(path, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return append(checks, PreflightCheck{"ffmpeg encoders", PreflightFail, fmt.Sprintf("listing encoders failed: %v", err)})
+	}
+	available := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// " V....D libx264  libx264 H.264 / AVC ..."
+		if fields := strings.Fields(line); len(fields) > 1 {
+			available[fields[1]] = true
+		}
+	}
+	for _, encoder := range requiredEncoders {
+		if available[encoder] {
+			checks = append(checks, PreflightCheck{"encoder " + encoder, PreflightOK, ""})
+		} else {
+			checks = append(checks, PreflightCheck{"encoder " + encoder, PreflightFail, "FFmpeg was built without it"})
+		}
+	}
+	for encoder, missing := range optionalEncoders {
+		if available[encoder] {
+			checks = append(checks, PreflightCheck{"encoder " + encoder, PreflightOK, ""})
+		} else {
+			checks = append(checks, PreflightCheck{"encoder " + encoder, PreflightWarn, "not available, " + missing})
+		}
+	}
+
+	return checks
+}
+
+// Ask a STUN server for our reflexive address, or allocate a relay on a TURN
+// server with the configured credentials
+func preflightICEServer(url, username, credential string) PreflightCheck {
+	check := PreflightCheck{Name: url, Status: PreflightFail}
+	uri, err := stun.ParseURI(url)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	addr := net.JoinHostPort(uri.Host, fmt.Sprint(uri.Port))
+	turnServer := uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS
+
+	var conn net.PacketConn
+	switch {
+	case uri.Scheme == stun.SchemeTypeTURNS || uri.Scheme == stun.SchemeTypeSTUNS:
+		tlsConn, err := tls.DialWithDialer(&net.Dialer{Timeout: preflightTimeout}, "tcp", addr, &tls.Config{ServerName: uri.Host})
+		if err != nil {
+			check.Detail = err.Error()
+			return check
+		}
+		conn = turn.NewSTUNConn(tlsConn)
+	case uri.Proto == stun.ProtoTypeTCP:
+		tcpConn, err := net.DialTimeout("tcp", addr, preflightTimeout)
+		if err != nil {
+			check.Detail = err.Error()
+			return check
+		}
+		conn = turn.NewSTUNConn(tcpConn)
+	default:
+		if conn, err = net.ListenPacket("udp4", "0.0.0.0:0"); err != nil {
+			check.Detail = err.Error()
+			return check
+		}
+	}
+	defer conn.Close()
+
+	config := &turn.ClientConfig{STUNServerAddr: addr, Conn: conn, RTO: preflightTimeout / 8}
+	if turnServer {
+		config.TURNServerAddr, config.Username, config.Password = addr, username, credential
+	}
+	client, err := turn.NewClient(config)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	defer client.Close()
+	if err = client.Listen(); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+
+	if !turnServer {
+		mapped, err := client.SendBindingRequest()
+		if err != nil {
+			check.Detail = err.Error()
+			return check
+		}
+		check.Status, check.Detail = PreflightOK, "reflexive address "+mapped.String()
+		return check
+	}
+
+	if username == "" {
+		check.Detail = "no -turn-username and -turn-credential"
+		return check
+	}
+	relay, err := client.Allocate()
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	defer relay.Close()
+	check.Status, check.Detail = PreflightOK, "relay address "+relay.LocalAddr().String()
+	return check
+}
+
+// Write and remove a file in a directory outputs go to
+func preflightWritable(dir string) PreflightCheck {
+	check := PreflightCheck{Name: "writable " + dir, Status: PreflightFail}
+	if abs, err := filepath.Abs(dir); err == nil {
+		check.Name = "writable " + abs
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	_, err = f.WriteString("preflight")
+	err = errors.Join(err, f.Close(), os.Remove(f.Name()))
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.Status = PreflightOK
+	return check
+}
@@ -0,0 +1,145 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// previewFeed pushes the latest downscaled frame of the ingest as a JPEG
+// over data channels, for monitoring clients that only need a cheap
+// sub-second preview instead of a full media subscription
+type previewFeed struct {
+	api      *webrtc.API
+	config   webrtc.Configuration
+	interval time.Duration
+
+	mu       sync.Mutex
+	channels map[*webrtc.DataChannel]struct{}
+}
+
+func newPreviewFeed(api *webrtc.API, config webrtc.Configuration, interval time.Duration) *previewFeed {
+	return &previewFeed{
+		api:      api,
+		config:   config,
+		interval: interval,
+		channels: map[*webrtc.DataChannel]struct{}{},
+	}
+}
+
+// Extra FFmpeg output refreshing preview.jpg at the preview rate
+func previewArgs(cfg *Config) []string {
+	if cfg.PreviewInterval <= 0 {
+		return nil
+	}
+
+	return []string{
+		"-map", "0:v",
+		"-vf", fmt.Sprintf("fps=1/%g,scale=160:-2", cfg.PreviewInterval.Seconds()),
+		"-q:v", "8",
+		"-update", "1",
+		"-atomic_writing", "1",
+		"-f", "image2",
+		"preview.jpg",
+	}
+}
+
+// Answer the offer of a monitoring client. The client is expected to open a
+// data channel labelled "preview" on which every new frame is sent.
+func (p *previewFeed) serveOffer(w http.ResponseWriter, r *http.Request) {
+	if p.interval <= 0 {
+		http.Error(w, "preview feed is disabled", http.StatusNotFound)
+		return
+	}
+
+	offer := webrtc.SessionDescription{}
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	peerConnection, err := p.api.NewPeerConnection(p.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
+		if d.Label() != "preview" {
+			return
+		}
+
+		d.OnOpen(func() {
+			p.mu.Lock()
+			p.channels[d] = struct{}{}
+			p.mu.Unlock()
+		})
+		d.OnClose(func() {
+			p.mu.Lock()
+			delete(p.channels, d)
+			p.mu.Unlock()
+		})
+	})
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateDisconnected {
+			peerConnection.Close()
+		}
+	})
+
+	if err = peerConnection.SetRemoteDescription(offer); err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	<-gatherComplete
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peerConnection.LocalDescription()) //nolint:errcheck
+}
+
+// Send preview.jpg to every open channel whenever FFmpeg refreshes it
+func (p *previewFeed) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	var lastModified time.Time
+	for range ticker.C {
+		info, err := os.Stat("preview.jpg")
+		if err != nil || !info.ModTime().After(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+
+		frame, err := os.ReadFile("preview.jpg")
+		if err != nil {
+			continue
+		}
+
+		p.mu.Lock()
+		for d := range p.channels {
+			if err := d.Send(frame); err != nil {
+				fmt.Println("Error sending preview frame:", err)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
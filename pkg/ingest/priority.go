@@ -0,0 +1,263 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority classes of sessions
+const (
+	PriorityBroadcast  = "broadcast"   // Flagship streams, never degraded or preempted
+	PriorityBestEffort = "best-effort" // Degraded, then preempted first under CPU pressure
+)
+
+// Niceness of the FFmpeg processes of degraded sessions
+const degradedNice = 19
+
+const (
+	cpuSampleInterval = 5 * time.Second
+	preemptAfter      = 3 // Samples over the watermark after degrading before a session is preempted
+)
+
+func validPriority(class string) bool {
+	return class == PriorityBroadcast || class == PriorityBestEffort
+}
+
+// SetPriority puts the session in a priority class, PriorityBroadcast or
+// PriorityBestEffort, overriding -default-priority
+func (s *Session) SetPriority(class string) error {
+	if !validPriority(class) {
+		return fmt.Errorf("unknown priority class %q", class)
+	}
+
+	s.mu.Lock()
+	s.priority = class
+	s.mu.Unlock()
+	s.writeMetadata()
+	return nil
+}
+
+func (s *Session) priorityClass() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.priority
+}
+
+// processGroup is the FFmpeg processes started for a session's tracks, so
+// they can be reniced, accounted and limited together
+type processGroup struct {
+	mu        sync.Mutex
+	processes []*ffmpegProcess
+	degraded  bool
+	exitedCPU time.Duration // Of the processes that exited and left the group
+	cgroup    *ffmpegCgroup // Holds the processes to the session's limits, nil without
+}
+
+// add joins a process to the group, degraded right away if the group is.
+// Tracks of custom sinks have no group.
+func (g *processGroup) add(p *ffmpegProcess) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.processes = slices.DeleteFunc(g.processes, func(p *ffmpegProcess) bool {
+		if !p.hasExited() {
+			return false
+		}
+		g.exitedCPU += p.cpuTime()
+		return true
+	})
+	g.processes = append(g.processes, p)
+	g.cgroup.add(p)
+	if g.degraded {
+		renice(p, degradedNice)
+	}
+}
+
+// usage is the CPU time of the processes so far and how many still run
+func (g *processGroup) usage() (time.Duration, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cpu, running := g.exitedCPU, 0
+	for _, p := range g.processes {
+		cpu += p.cpuTime()
+		if !p.hasExited() {
+			running++
+		}
+	}
+	return cpu, running
+}
+
+// shutdown stops the processes that don't exit on their own once the
+// session ended
+func (g *processGroup) shutdown(timeout time.Duration) {
+	g.mu.Lock()
+	processes := slices.DeleteFunc(slices.Clone(g.processes), (*ffmpegProcess).hasExited)
+	g.mu.Unlock()
+
+	for _, p := range processes {
+		go p.stop(timeout)
+	}
+}
+
+func (g *processGroup) degrade(on bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.degraded == on {
+		return
+	}
+	g.degraded = on
+
+	nice := 0
+	if on {
+		nice = degradedNice
+	}
+	for _, p := range g.processes {
+		renice(p, nice)
+	}
+}
+
+// priorityScheduler keeps broadcast sessions healthy under CPU pressure.
+// Once CPU usage crosses the watermark, the FFmpeg processes of best-effort
+// sessions are reniced so the kernel favours everyone else's transcodes. If
+// that isn't enough, the newest best-effort session is closed every few
+// samples until usage drops again.
+type priorityScheduler struct {
+	watermark float64
+	sessions  *sessionRegistry
+	metrics   *metricRegistry
+
+	previous cpuTimes
+	pressure int // Consecutive samples over the watermark
+}
+
+func newPriorityScheduler(watermark float64, sessions *sessionRegistry, metrics *metricRegistry) *priorityScheduler {
+	return &priorityScheduler{watermark: watermark, sessions: sessions, metrics: metrics}
+}
+
+func (p *priorityScheduler) run() {
+	var err error
+	if p.previous, err = readCPUTimes(); err != nil {
+		fmt.Println("CPU usage unavailable, priority classes have no effect:", err)
+		return
+	}
+
+	ticker := time.NewTicker(cpuSampleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		current, err := readCPUTimes()
+		if err != nil {
+			fmt.Println("Failed to read CPU usage:", err)
+			continue
+		}
+
+		busy := current.busySince(p.previous)
+		p.previous = current
+		p.metrics.set("ingest_cpu_busy_ratio", busy)
+		p.sample(busy)
+	}
+}
+
+func (p *priorityScheduler) sample(busy float64) {
+	bestEffort := p.bestEffort()
+
+	if busy < p.watermark {
+		p.pressure = 0
+		for _, s := range bestEffort {
+			s.processes.degrade(false)
+		}
+		p.metrics.set("ingest_sessions_degraded", 0)
+		return
+	}
+
+	p.pressure++
+	if p.pressure == 1 {
+		fmt.Printf("CPU usage at %.0f%%, degrading %d best-effort sessions\n", busy*100, len(bestEffort))
+	}
+	for _, s := range bestEffort {
+		s.processes.degrade(true)
+	}
+	p.metrics.set("ingest_sessions_degraded", float64(len(bestEffort)))
+
+	if p.pressure <= preemptAfter || len(bestEffort) == 0 {
+		return
+	}
+
+	// The newest session has the least to lose
+	newest := slices.MaxFunc(bestEffort, func(a, b *Session) int { return a.started.Compare(b.started) })
+	fmt.Printf("CPU usage at %.0f%%, preempting session %s\n", busy*100, newest.id)
+	p.metrics.add("ingest_sessions_preempted_total", 1)
+	if err := newest.Close(); err != nil {
+		fmt.Println("Error closing peer connection:", err)
+	}
+	p.pressure = 1
+}
+
+func (p *priorityScheduler) bestEffort() []*Session {
+	var sessions []*Session
+	for _, s := range p.sessions.list() {
+		select {
+		case <-s.done:
+			continue // Already ending
+		default:
+		}
+
+		if s.priorityClass() == PriorityBestEffort {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// cpuTimes are the cumulative jiffies of all CPUs from /proc/stat
+type cpuTimes struct {
+	idle, total uint64
+}
+
+func readCPUTimes() (cpuTimes, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return cpuTimes{}, errors.New("unexpected /proc/stat format")
+	}
+
+	var times cpuTimes
+	for i, field := range fields[1:] {
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return cpuTimes{}, err
+		}
+		times.total += n
+		if i == 3 || i == 4 { // idle and iowait
+			times.idle += n
+		}
+	}
+
+	return times, nil
+}
+
+// busySince is the share of CPU time spent busy between two samples
+func (t cpuTimes) busySince(previous cpuTimes) float64 {
+	total := t.total - previous.total
+	if total == 0 {
+		return 0
+	}
+	return 1 - float64(t.idle-previous.idle)/float64(total)
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package ingest
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Renice an FFmpeg, which needs CAP_SYS_NICE to give back the niceness of
+// a degraded one
+func renice(p *ffmpegProcess, nice int) {
+	if p.hasExited() {
+		return
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, p.cmd.Process.Pid, nice); err != nil {
+		fmt.Println("Failed to renice FFmpeg:", err)
+	}
+}
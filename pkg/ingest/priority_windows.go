@@ -0,0 +1,29 @@
+package ingest
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// Renice an FFmpeg, as the priority class closest to the niceness
+func renice(p *ffmpegProcess, nice int) {
+	if p.hasExited() {
+		return
+	}
+
+	class := uint32(windows.NORMAL_PRIORITY_CLASS)
+	if nice > 0 {
+		class = windows.BELOW_NORMAL_PRIORITY_CLASS
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_INFORMATION, false, uint32(p.cmd.Process.Pid))
+	if err != nil {
+		fmt.Println("Failed to renice FFmpeg:", err)
+		return
+	}
+	defer windows.CloseHandle(process) //nolint:errcheck
+
+	if err := windows.SetPriorityClass(process, class); err != nil {
+		fmt.Println("Failed to renice FFmpeg:", err)
+	}
+}
@@ -0,0 +1,32 @@
+package ingest
+
+import (
+	"github.com/pion/rtp"
+)
+
+// PacketProcessor is a stage run on every packet of an audio track before it
+// reaches the pipeline. It returns the packet to pass on, which may be
+// modified or replaced, or nil to drop it.
+type PacketProcessor interface {
+	Process(packet *rtp.Packet) (*rtp.Packet, error)
+}
+
+// PacketProcessorFunc lets an ordinary function be used as a PacketProcessor
+type PacketProcessorFunc func(packet *rtp.Packet) (*rtp.Packet, error)
+
+func (f PacketProcessorFunc) Process(packet *rtp.Packet) (*rtp.Packet, error) {
+	return f(packet)
+}
+
+// Run a packet through a chain of processors, stopping at the first one that
+// drops it or fails
+func processPacket(processors []PacketProcessor, packet *rtp.Packet) (*rtp.Packet, error) {
+	for _, processor := range processors {
+		var err error
+		if packet, err = processor.Process(packet); err != nil || packet == nil {
+			return nil, err
+		}
+	}
+
+	return packet, nil
+}
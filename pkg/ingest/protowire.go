@@ -0,0 +1,128 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Protocol Buffers wire types used by the control plane messages
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errInvalidProto = errors.New("invalid protobuf message")
+
+// protoEncoder appends the fields of a message in the Protocol Buffers wire
+// format, leaving out zero values as proto3 does
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(field, wireType int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (e *protoEncoder) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// int encodes int32 and int64 fields, negative ones in ten bytes
+func (e *protoEncoder) int(field int, v int64) {
+	e.uint(field, uint64(v))
+}
+
+func (e *protoEncoder) bool(field int, v bool) {
+	if v {
+		e.uint(field, 1)
+	}
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireFixed64)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+}
+
+func (e *protoEncoder) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// message encodes an embedded message, even an empty one, as repeated
+// fields need every element
+func (e *protoEncoder) message(field int, encode func(*protoEncoder)) {
+	embedded := &protoEncoder{}
+	encode(embedded)
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(embedded.buf)))
+	e.buf = append(e.buf, embedded.buf...)
+}
+
+// protoField is a decoded field: varints and fixed width numbers in number,
+// length-delimited fields in bytes
+type protoField struct {
+	number uint64
+	bytes  []byte
+}
+
+func (f protoField) string() string {
+	return string(f.bytes)
+}
+
+// decodeProto calls field for every field of a message, skipping none:
+// unknown fields are left to the callback to ignore
+func decodeProto(data []byte, field func(number int, value protoField) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag>>3 == 0 {
+			return errInvalidProto
+		}
+		data = data[n:]
+
+		var value protoField
+		switch tag & 7 {
+		case wireVarint:
+			if value.number, n = binary.Uvarint(data); n <= 0 {
+				return errInvalidProto
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errInvalidProto
+			}
+			value.number, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errInvalidProto
+			}
+			value.number, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errInvalidProto
+			}
+			value.bytes, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return errInvalidProto // Groups are long deprecated
+		}
+
+		if err := field(int(tag>>3), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package ingest
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestProtoEncoder(t *testing.T) {
+	for name, tc := range map[string]struct {
+		encode func(*protoEncoder)
+		want   []byte
+	}{
+		"zero values":  {encode: func(e *protoEncoder) { e.uint(1, 0); e.int(2, 0); e.bool(3, false); e.double(4, 0); e.string(5, "") }},
+		"varint":       {encode: func(e *protoEncoder) { e.uint(1, 150) }, want: []byte{0x08, 0x96, 0x01}},
+		"negative int": {encode: func(e *protoEncoder) { e.int(1, -1) }, want: []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		"bool":         {encode: func(e *protoEncoder) { e.bool(2, true) }, want: []byte{0x10, 0x01}},
+		"double":       {encode: func(e *protoEncoder) { e.double(3, 1) }, want: []byte{0x19, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		"string":       {encode: func(e *protoEncoder) { e.string(2, "testing") }, want: []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		"large field":  {encode: func(e *protoEncoder) { e.uint(16, 1) }, want: []byte{0x80, 0x01, 0x01}},
+		"message": {
+			encode: func(e *protoEncoder) { e.message(3, func(e *protoEncoder) { e.uint(1, 150) }) },
+			want:   []byte{0x1a, 0x03, 0x08, 0x96, 0x01},
+		},
+		"empty message": {encode: func(e *protoEncoder) { e.message(1, func(*protoEncoder) {}) }, want: []byte{0x0a, 0x00}},
+	} {
+		e := &protoEncoder{}
+		tc.encode(e)
+		if !bytes.Equal(e.buf, tc.want) {
+			t.Errorf("%s: encoded % x, want % x", name, e.buf, tc.want)
+		}
+	}
+}
+
+func TestDecodeProto(t *testing.T) {
+	e := &protoEncoder{}
+	e.uint(1, 150)
+	e.string(2, "session")
+	e.double(3, 2.5)
+	e.message(4, func(e *protoEncoder) { e.bool(1, true) })
+	data := append(e.buf, 0x2d, 1, 0, 0, 0) // Field 5, fixed32
+
+	type field struct {
+		number int
+		value  uint64
+		bytes  string
+	}
+	var got []field
+	err := decodeProto(data, func(number int, value protoField) error {
+		got = append(got, field{number, value.number, value.string()})
+		return nil
+	})
+	want := []field{{1, 150, ""}, {2, 0, "session"}, {3, math.Float64bits(2.5), ""}, {4, 0, "\x08\x01"}, {5, 1, ""}}
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("decodeProto = %v, %v", got, err)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("field %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"truncated varint": {0x08, 0x96},
+		"truncated bytes":  {0x12, 0x07, 't'},
+		"truncated fixed":  {0x19, 0, 0},
+		"field zero":       {0x00, 0x01},
+		"group":            {0x0b},
+	} {
+		if err := decodeProto(data, func(int, protoField) error { return nil }); err != errInvalidProto {
+			t.Errorf("%s: decodeProto = %v, want %v", name, err, errInvalidProto)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package ingest
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Session IDs tokens may name, they end up in file names
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Whether publishers can be granted a session ID. It names the session's
+// live outputs, so it can't be one of its other playlists.
+func publishableSessionID(id string) bool {
+	return sessionIDPattern.MatchString(id) && !slices.Contains(reservedRenditions, id)
+}
+
+// publishAuth verifies the tokens publishers present: JWTs signed with the
+// configured key, scoped to a session ID in their "sid" claim and carrying
+// an expiry
+type publishAuth struct {
+	mu  sync.RWMutex
+	key any // []byte for HS256, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// newPublishAuth loads the publish key, nil when publishing is open
+func newPublishAuth(cfg *Config) (*publishAuth, error) {
+	switch {
+	case cfg.PublishKey != "" && cfg.PublishKeyFile != "":
+		return nil, errors.New("-publish-key and -publish-key-file are exclusive")
+	case cfg.PublishKey != "":
+		return &publishAuth{key: []byte(cfg.PublishKey)}, nil
+	case cfg.PublishKeyFile == "":
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(cfg.PublishKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key in %s", cfg.PublishKeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return &publishAuth{key: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported publish key type %T", key)
+	}
+}
+
+// publishGrant is what a publish token grants
+type publishGrant struct {
+	session   string // ID of the session, prefixed with the tenant if any
+	publisher string // "sub" claim, if any
+	name      string // "name" claim, if any
+	tenant    string // "tenant" claim, if any
+}
+
+// verify returns what a token grants
+func (a *publishAuth) verify(token string, now time.Time) (publishGrant, error) {
+	a.mu.RLock()
+	key := a.key
+	a.mu.RUnlock()
+
+	claims, err := parseJWT(token, func(jwtHeader) (any, error) { return key, nil }, now)
+	if err != nil {
+		return publishGrant{}, err
+	}
+
+	if _, ok := claims["exp"].(float64); !ok {
+		return publishGrant{}, errors.New("publish token has no expiry")
+	}
+	id := claims.str("sid")
+	if !publishableSessionID(id) {
+		return publishGrant{}, errors.New("publish token has no valid session ID")
+	}
+	tenant := claims.str("tenant")
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		return publishGrant{}, errors.New("publish token has no valid tenant")
+	}
+
+	return publishGrant{session: tenantSessionID(tenant, id), publisher: claims.str("sub"), name: claims.str("name"), tenant: tenant}, nil
+}
+
+// Publish creates the session a publisher's token is scoped to. The token
+// must be a JWT signed with -publish-key (HS256) or the key in
+// -publish-key-file (RS256/ES256), carrying the session ID in "sid" and an
+// "exp" claim. A "tenant" claim prefixes the session ID with the tenant and
+// holds the session to the tenant's quotas. Without a publish key, tokens
+// aren't checked and the session gets a random ID as with NewSession.
+func (s *Server) Publish(token string) (*Session, error) {
+	return s.publishAs(token, publisherIdentity{})
+}
+
+// publishAs is Publish for a publisher announcing who they are. With a
+// publish key, the user ID is the token's "sub" claim and its "name" claim
+// takes precedence over the announced display name.
+func (s *Server) publishAs(token string, identity publisherIdentity) (*Session, error) {
+	if s.publishAuth == nil {
+		return s.newOpenSession(identity)
+	}
+
+	grant, err := s.publishAuth.verify(token, time.Now())
+	if err != nil {
+		return nil, WithKind(ErrorSignaling, fmt.Errorf("%w: %v", errUnauthorized, err))
+	}
+	identity.UserID = grant.publisher
+	if grant.name != "" {
+		identity.Name = grant.name
+	}
+
+	ends, err := s.schedule.admit(grant.session, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.tenants.admit(grant.tenant, grant.session, s.sessions); err != nil {
+		return nil, err
+	}
+	defer s.tenants.done(grant.session)
+
+	session, err := s.newSession(grant.session, grant.tenant)
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	session.publisher, session.verified = grant.publisher, grant.publisher != ""
+	session.publisherName = identity.Name
+	session.ends = ends
+	session.mu.Unlock()
+	session.SetPolicy(s.policy(grant.publisher))
+	s.schedule.connected(grant.session, time.Now())
+	s.tenants.count(grant.tenant, s.sessions)
+	return session, nil
+}
+
+// Answer the SDP offer of a WHIP publisher with a new session
+func (s *httpServer) serveWHIP(w http.ResponseWriter, r *http.Request) {
+	offer, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil || len(offer) == 0 {
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.publish(requestToken(r), requestIdentity(r))
+	if err != nil {
+		s.publishError(w, r, err)
+		return
+	}
+
+	session.mu.Lock()
+	session.userAgent = r.UserAgent()
+	session.mu.Unlock()
+
+	answer, err := session.Answer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)})
+	if err != nil {
+		session.Close() //nolint:errcheck
+		http.Error(w, err.Error(), offerStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+session.ID())
+	for _, link := range s.iceLinks {
+		w.Header().Add("Link", link)
+	}
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP) //nolint:errcheck
+}
+
+// Answer a publisher whose session couldn't be started
+func (s *httpServer) publishError(w http.ResponseWriter, r *http.Request, err error) {
+	var elsewhere *elsewhereError
+	switch {
+	case errors.Is(err, errUnauthorized):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	case errors.As(err, &elsewhere):
+		// The node publishing the session answers its publisher
+		http.Redirect(w, r, elsewhere.url+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	case errors.Is(err, errDraining):
+		// Publishers are sent to another node, or told to come back later
+		if node := s.cluster.alternative(); node != "" {
+			http.Redirect(w, r, node+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errOutsideSchedule):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// End the session of a WHIP publisher, who must present a token for it
+func (s *httpServer) serveWHIPDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if s.publishAuth != nil {
+		if grant, err := s.publishAuth.verify(requestToken(r), time.Now()); err != nil || grant.session != id {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	session := s.sessions.get(id)
+	if session == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	if err := session.Close(); err != nil {
+		fmt.Println("Error closing peer connection:", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
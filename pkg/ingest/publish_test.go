@@ -0,0 +1,39 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishAuthVerify(t *testing.T) {
+	key := []byte("secret")
+	a := &publishAuth{key: key}
+	now := time.Unix(1_700_000_000, 0)
+	exp := float64(now.Unix() + 60)
+
+	for name, tc := range map[string]struct {
+		claims jwtClaims
+		grant  publishGrant
+		fails  bool
+	}{
+		"session": {
+			claims: jwtClaims{"sid": "abc", "exp": exp},
+			grant:  publishGrant{session: "abc"},
+		},
+		"tenant and publisher": {
+			claims: jwtClaims{"sid": "abc", "tenant": "acme", "sub": "u1", "name": "Alice", "exp": exp},
+			grant:  publishGrant{session: "acme.abc", publisher: "u1", name: "Alice", tenant: "acme"},
+		},
+		"no expiry":       {claims: jwtClaims{"sid": "abc"}, fails: true},
+		"no session":      {claims: jwtClaims{"exp": exp}, fails: true},
+		"invalid session": {claims: jwtClaims{"sid": "a/b", "exp": exp}, fails: true},
+		"reserved name":   {claims: jwtClaims{"sid": "master", "exp": exp}, fails: true},
+		"route name":      {claims: jwtClaims{"sid": "play", "exp": exp}, fails: true},
+		"invalid tenant":  {claims: jwtClaims{"sid": "abc", "tenant": "Acme", "exp": exp}, fails: true},
+	} {
+		grant, err := a.verify(signJWT(t, "HS256", key, tc.claims), now)
+		if (err != nil) != tc.fails || grant != tc.grant {
+			t.Errorf("%s: verify = %+v, %v", name, grant, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package ingest
+
+import "encoding/json"
+
+// Bitrates below which a track of a kind can't sound or look right, lowered
+// to the session's caps
+var qualityBitrates = map[string]int{"audio": 16000, "video": 150000}
+
+// Most points each condition takes off the score
+const (
+	qualityLossPoints    = 50
+	qualityJitterPoints  = 15
+	qualityRTTPoints     = 15
+	qualityBitratePoints = 20
+)
+
+// Bitrate a track of a kind needs, at most what the publisher was capped to
+func qualityBitrate(kind string, caps map[string]int) int {
+	needed := qualityBitrates[kind]
+	if limit := caps[kind]; limit > 0 {
+		needed = min(needed, limit)
+	}
+	return needed
+}
+
+// qualityScore rates a link from 0 to 100 for publishing UIs to warn with:
+// 10% loss takes off 25 points and 20% all 50 loss can take, jitter above
+// 30ms and a round trip above 200ms take off up to 15 points each, all of
+// them once doubled, and up to 20 go with the share of the needed bitrate
+// missing
+func qualityScore(sample linkSample, needed int) int {
+	score := 100.0
+	score -= min(qualityLossPoints, sample.FractionLost*250)
+	score -= min(qualityJitterPoints, max(0, sample.Jitter-0.03)/0.03*qualityJitterPoints)
+	score -= min(qualityRTTPoints, max(0, sample.RTT-0.2)/0.2*qualityRTTPoints)
+	if needed > 0 && sample.Bitrate < needed {
+		score -= float64(needed-sample.Bitrate) / float64(needed) * qualityBitratePoints
+	}
+	return int(max(0, score) + 0.5)
+}
+
+// Send the publisher a {"type": "quality"} message with a link sample
+func (s *Session) notifyQuality(sample linkSample) {
+	msg, _ := json.Marshal(struct {
+		Type string `json:"type"`
+		linkSample
+	}{"quality", sample})
+	s.control.send(msg)
+}
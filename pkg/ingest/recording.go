@@ -0,0 +1,241 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var segmentName = regexp.MustCompile(`^(.*_)(\d+)(\.\w+)$`)
+
+// Pipeline errors kept of a session, the latest ones
+const pipelineErrorHistory = 20
+
+// recordingControl pauses and resumes writing a session's output while the
+// peer connection stays up. Every resume starts a discontinuity in the
+// session's playlists. The server has one of its own for the pipelines of
+// no session in particular, like the mix.
+type recordingControl struct {
+	paused atomic.Bool
+	dir    string // The HLS segments are written to, the working directory if empty
+
+	mu              sync.Mutex
+	discontinuities map[string]bool                  // First segment written after each resume, by name in dir
+	errors          []pipelineError                  // The last pipelineErrorHistory
+	channels        map[*webrtc.DataChannel]struct{} // Open "control" channels of the publisher
+}
+
+func newRecordingControl(dir string) *recordingControl {
+	return &recordingControl{
+		dir:             dir,
+		discontinuities: map[string]bool{},
+		channels:        map[*webrtc.DataChannel]struct{}{},
+	}
+}
+
+func (c *recordingControl) isPaused() bool {
+	return c.paused.Load()
+}
+
+func (c *recordingControl) pause() {
+	if c.paused.CompareAndSwap(false, true) {
+		fmt.Println("Recording paused")
+	}
+}
+
+func (c *recordingControl) resume() {
+	if !c.paused.Load() {
+		return
+	}
+
+	// Whatever segment FFmpeg opens next carries the first media after the pause
+	c.markNextSegments()
+
+	c.paused.Store(false)
+	fmt.Println("Recording resumed")
+}
+
+// Start a discontinuity at the segment FFmpeg opens next in every playlist
+// of the session
+func (c *recordingControl) markNextSegments() {
+	matches, _ := filepath.Glob(filepath.Join(c.dir, "*_*"))
+
+	c.mu.Lock()
+	for pattern, index := range nextSegments(matches) {
+		c.discontinuities[fmt.Sprintf(pattern, index)] = true
+	}
+	c.mu.Unlock()
+}
+
+// Start a discontinuity at a segment
+func (c *recordingControl) markSegment(name string) {
+	c.mu.Lock()
+	c.discontinuities[name] = true
+	c.mu.Unlock()
+}
+
+// Number of the segment after the last one of each file pattern among
+// segment files
+func nextSegments(files []string) map[string]int {
+	next := map[string]int{}
+	for _, file := range files {
+		if m := segmentName.FindStringSubmatch(filepath.Base(file)); m != nil {
+			index, _ := strconv.Atoi(m[2])
+			next[m[1]+"%d"+m[3]] = max(next[m[1]+"%d"+m[3]], index+1)
+		}
+	}
+	return next
+}
+
+// Whether a segment starts a discontinuity
+func (c *recordingControl) discontinuity(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.discontinuities[name]
+}
+
+// Discontinuities before a segment of a file pattern, so a playlist resumed
+// after a crash carries on their sequence
+func (c *recordingControl) discontinuitiesBefore(pattern string, index int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sequence := 0
+	for name := range c.discontinuities {
+		m := segmentName.FindStringSubmatch(name)
+		if n, _ := strconv.Atoi(m[2]); m[1]+"%d"+m[3] == pattern && n < index {
+			sequence++
+		}
+	}
+	return sequence
+}
+
+func (c *recordingControl) status() map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return map[string]any{
+		"paused": c.isPaused(),
+		"errors": append([]pipelineError{}, c.errors...),
+	}
+}
+
+// reportError records a pipeline failure and pushes it to the publisher on
+// every open control channel of the session, so the publishing app can
+// surface it
+func (c *recordingControl) reportError(code, message string) {
+	fmt.Printf("Pipeline error %s: %s\n", code, message)
+
+	report := pipelineError{Type: "error", Code: code, Message: message, Time: time.Now()}
+	msg, _ := json.Marshal(report)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.errors = append(c.errors, report)
+	if len(c.errors) > pipelineErrorHistory {
+		c.errors = c.errors[len(c.errors)-pipelineErrorHistory:]
+	}
+	c.broadcast(msg)
+}
+
+// notifyDrain tells the publisher on every open control channel that the
+// node is draining, so publishing apps can move to another node before the
+// deadline
+func (c *recordingControl) notifyDrain(deadline time.Time) {
+	msg, _ := json.Marshal(map[string]any{"type": "drain", "deadline": deadline})
+	c.send(msg)
+}
+
+// Send a message on every open control channel
+func (c *recordingControl) send(msg []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broadcast(msg)
+}
+
+// Send a message on every open control channel, c.mu must be held
+func (c *recordingControl) broadcast(msg []byte) {
+	for d := range c.channels {
+		if err := d.SendText(string(msg)); err != nil {
+			fmt.Println("Error sending on control channel:", err)
+		}
+	}
+}
+
+// Recording state of the session in the request path, after pausing or
+// resuming it for POST .../pause and .../resume
+func (r *sessionRegistry) serveRecording(w http.ResponseWriter, req *http.Request) {
+	session := r.get(req.PathValue("id"))
+	if session == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	switch req.PathValue("action") {
+	case "":
+	case "pause":
+		session.control.pause()
+	case "resume":
+		session.control.resume()
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session.control.status()) //nolint:errcheck
+}
+
+// Handle {"type": "pause"} and {"type": "resume"} messages sent by the
+// publisher on the "control" data channel, answering with the new status.
+// Pipeline errors are pushed on the same channel.
+func (c *recordingControl) handleDataChannel(d *webrtc.DataChannel) {
+	if d.Label() != "control" {
+		return
+	}
+
+	d.OnOpen(func() {
+		c.mu.Lock()
+		c.channels[d] = struct{}{}
+		c.mu.Unlock()
+	})
+	d.OnClose(func() {
+		c.mu.Lock()
+		delete(c.channels, d)
+		c.mu.Unlock()
+	})
+
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		command := struct {
+			Type string `json:"type"`
+		}{}
+		if err := json.Unmarshal(msg.Data, &command); err != nil {
+			fmt.Println("Invalid control message:", err)
+			return
+		}
+
+		switch command.Type {
+		case "pause":
+			c.pause()
+		case "resume":
+			c.resume()
+		}
+
+		status := c.status()
+		status["type"] = "status"
+		reply, _ := json.Marshal(status)
+		if err := d.SendText(string(reply)); err != nil {
+			fmt.Println("Error replying on control channel:", err)
+		}
+	})
+}
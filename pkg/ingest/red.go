@@ -0,0 +1,141 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Redundant audio (RFC 2198), as Chrome offers it for Opus
+const (
+	mimeTypeRED    = "audio/red"
+	redPayloadType = 63
+)
+
+// Register RED ahead of Opus, so publishers sending both prefer it
+func registerRED(m *webrtc.MediaEngine) error {
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRED, ClockRate: 48000, Channels: 2, SDPFmtpLine: "111/111"},
+		PayloadType:        redPayloadType,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+// A codec negotiated for a receiver, e.g. the one a RED track carries
+func negotiatedCodec(receiver *webrtc.RTPReceiver, mimeType string) (webrtc.RTPCodecParameters, bool) {
+	for _, codec := range receiver.GetParameters().Codecs {
+		if strings.EqualFold(codec.MimeType, mimeType) {
+			return codec, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// redDecoder unwraps the Opus packets of a RED track. The redundant copies
+// of earlier packets a RED packet carries replace those that were lost, so
+// they reach the pipeline ahead of the primary packet instead of being
+// concealed.
+type redDecoder struct {
+	track   string
+	metrics *metricRegistry
+
+	started bool
+	seq     uint16 // Of the latest primary packet
+}
+
+func newREDDecoder(track string, metrics *metricRegistry) *redDecoder {
+	return &redDecoder{track: track, metrics: metrics}
+}
+
+type redBlock struct {
+	payloadType uint8
+	offset      uint32 // Timestamp offset from the primary packet
+	payload     []byte
+}
+
+// unwrap returns the Opus packets of a RED packet: the lost ones it recovers,
+// oldest first, then its primary packet. Without a decoder the packet is
+// returned as it is.
+func (d *redDecoder) unwrap(packet *rtp.Packet) []*rtp.Packet {
+	if d == nil {
+		return []*rtp.Packet{packet}
+	}
+
+	blocks, err := parseRED(packet.Payload)
+	if err != nil {
+		fmt.Println("Error parsing RED packet:", err)
+		return nil
+	}
+	primary := blocks[len(blocks)-1]
+
+	// Redundant blocks are the packets right before the primary one
+	lost := 0
+	if d.started {
+		if gap := int16(packet.SequenceNumber - d.seq - 1); gap > 0 {
+			lost = int(gap)
+		} else if gap < 0 {
+			// Late packets are left to the gap detector
+			return []*rtp.Packet{redBlockPacket(packet, packet.SequenceNumber, primary)}
+		}
+	}
+	d.started = true
+	d.seq = packet.SequenceNumber
+
+	var packets []*rtp.Packet
+	redundant := blocks[:len(blocks)-1]
+	for i, block := range redundant {
+		distance := len(redundant) - i
+		if distance > lost || len(block.payload) == 0 {
+			continue
+		}
+		packets = append(packets, redBlockPacket(packet, packet.SequenceNumber-uint16(distance), block))
+		d.metrics.add(fmt.Sprintf("ingest_red_recovered_total{track=%q}", d.track), 1)
+	}
+	return append(packets, redBlockPacket(packet, packet.SequenceNumber, primary))
+}
+
+// The packet a block of a RED packet carries
+func redBlockPacket(red *rtp.Packet, seq uint16, block redBlock) *rtp.Packet {
+	header := red.Header.Clone()
+	header.PayloadType = block.payloadType
+	header.SequenceNumber = seq
+	header.Timestamp -= block.offset
+	return &rtp.Packet{Header: header, Payload: block.payload}
+}
+
+// Parse the blocks of a RED payload, the primary one last
+func parseRED(payload []byte) ([]redBlock, error) {
+	var blocks []redBlock
+	var lengths []int
+	i := 0
+	for {
+		if i >= len(payload) {
+			return nil, errors.New("truncated RED header")
+		}
+
+		// The last header is only the payload type
+		if payload[i]&0x80 == 0 {
+			blocks = append(blocks, redBlock{payloadType: payload[i] & 0x7f})
+			i++
+			break
+		}
+		if i+4 > len(payload) {
+			return nil, errors.New("truncated RED header")
+		}
+		blocks = append(blocks, redBlock{payloadType: payload[i] & 0x7f, offset: uint32(payload[i+1])<<6 | uint32(payload[i+2])>>2})
+		lengths = append(lengths, int(payload[i+2]&0x3)<<8|int(payload[i+3]))
+		i += 4
+	}
+
+	for n, length := range lengths {
+		if i+length > len(payload) {
+			return nil, errors.New("truncated RED block")
+		}
+		blocks[n].payload = payload[i : i+length]
+		i += length
+	}
+	blocks[len(blocks)-1].payload = payload[i:]
+	return blocks, nil
+}
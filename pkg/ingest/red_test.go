@@ -0,0 +1,87 @@
+package ingest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// RED payload of redundant blocks, 20 ms of Opus apart, and a primary one
+func testRED(payloadType uint8, redundant [][]byte, primary []byte) []byte {
+	var headers, blocks []byte
+	for i, block := range redundant {
+		offset := uint32(len(redundant)-i) * 960
+		headers = append(headers, 0x80|payloadType, byte(offset>>6), byte(offset<<2)|byte(len(block)>>8), byte(len(block)))
+		blocks = append(blocks, block...)
+	}
+	headers = append(headers, payloadType)
+	return append(append(headers, blocks...), primary...)
+}
+
+func TestParseRED(t *testing.T) {
+	for name, tc := range map[string]struct {
+		payload []byte
+		blocks  []redBlock
+		fails   bool
+	}{
+		"primary only": {payload: testRED(111, nil, []byte{1, 2}), blocks: []redBlock{{111, 0, []byte{1, 2}}}},
+		"redundant": {
+			payload: testRED(111, [][]byte{{1}, {2, 2}}, []byte{3}),
+			blocks:  []redBlock{{111, 1920, []byte{1}}, {111, 960, []byte{2, 2}}, {111, 0, []byte{3}}},
+		},
+		"empty redundant block": {payload: testRED(111, [][]byte{{}}, []byte{3}), blocks: []redBlock{{111, 960, []byte{}}, {111, 0, []byte{3}}}},
+		"empty":                 {payload: nil, fails: true},
+		"truncated header":      {payload: []byte{0x80 | 111, 0, 0}, fails: true},
+		"truncated block":       {payload: testRED(111, [][]byte{{1, 2}}, nil)[:6], fails: true},
+	} {
+		blocks, err := parseRED(tc.payload)
+		if (err != nil) != tc.fails || len(blocks) != len(tc.blocks) {
+			t.Errorf("%s: parseRED = %v, %v", name, blocks, err)
+			continue
+		}
+		for i, block := range blocks {
+			want := tc.blocks[i]
+			if block.payloadType != want.payloadType || block.offset != want.offset || !bytes.Equal(block.payload, want.payload) {
+				t.Errorf("%s: block %d = %+v, want %+v", name, i, block, want)
+			}
+		}
+	}
+}
+
+func TestREDDecoderUnwrap(t *testing.T) {
+	d := newREDDecoder("audio", newMetricRegistry())
+	packet := func(seq uint16) *rtp.Packet {
+		// Every packet carries the two before it
+		payload := testRED(111, [][]byte{{byte(seq - 2)}, {byte(seq - 1)}}, []byte{byte(seq)})
+		return &rtp.Packet{Header: rtp.Header{PayloadType: 63, SequenceNumber: seq, Timestamp: uint32(seq) * 960}, Payload: payload}
+	}
+
+	for _, tc := range []struct {
+		seq  uint16
+		want []uint16 // Sequence numbers unwrapped
+	}{
+		{10, []uint16{10}},
+		{11, []uint16{11}},
+		{13, []uint16{12, 13}},     // Recovers the lost packet
+		{17, []uint16{15, 16, 17}}, // Two packets back at most
+		{16, []uint16{16}},         // Late
+		{18, []uint16{18}},
+	} {
+		packets := d.unwrap(packet(tc.seq))
+		if len(packets) != len(tc.want) {
+			t.Fatalf("unwrap(%d) = %d packets, want %v", tc.seq, len(packets), tc.want)
+		}
+		for i, p := range packets {
+			seq := tc.want[i]
+			if p.SequenceNumber != seq || p.Timestamp != uint32(seq)*960 || p.PayloadType != 111 || !bytes.Equal(p.Payload, []byte{byte(seq)}) {
+				t.Errorf("unwrap(%d)[%d] = %d at %d, %v", tc.seq, i, p.SequenceNumber, p.Timestamp, p.Payload)
+			}
+		}
+	}
+
+	var none *redDecoder
+	if p := packet(1); len(none.unwrap(p)) != 1 || none.unwrap(p)[0] != p {
+		t.Error("unwrap without a decoder changed the packet")
+	}
+}
@@ -0,0 +1,99 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"text/template"
+)
+
+// Reload applies the settings of cfg that are safe to change while sessions
+// are live: the retention rules, the publish key, the static auth tokens,
+// the policy and tenants files, -output-template and the FFmpeg settings of
+// HLS outputs. Live sessions and their FFmpegs keep what they started with,
+// everything else in cfg needs a restart. Nothing is applied if any of it is
+// invalid.
+func (s *Server) Reload(cfg *Config) error {
+	err := s.reload(cfg)
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	s.metrics.add(fmt.Sprintf("ingest_config_reloads_total{result=%q}", result), 1)
+	return err
+}
+
+func (s *Server) reload(cfg *Config) error {
+	retention, err := parseRetention(cfg.Retention)
+	if err != nil {
+		return err
+	}
+	publishAuth, err := newPublishAuth(cfg)
+	if err != nil {
+		return err
+	}
+	if (publishAuth == nil) != (s.publishAuth == nil) {
+		return errors.New("enabling or disabling the publish key needs a restart")
+	}
+	if cfg.Auth != s.cfg.Auth {
+		return errors.New("changing -auth needs a restart")
+	}
+	var tokens *staticTokenAuth
+	if cfg.Auth == "static" {
+		if tokens, err = newStaticTokenAuth(cfg.AuthTokensFile); err != nil {
+			return err
+		}
+	}
+	policies, err := loadPolicies(cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+	tenants, err := loadTenants(cfg.TenantsFile)
+	if err != nil {
+		return err
+	}
+	outputTemplate, err := parseOutputTemplate(cfg.OutputTemplate)
+	if err != nil {
+		return err
+	}
+
+	s.retention.setPolicy(retention)
+	if cfg.Retention != "" {
+		s.retention.start()
+	}
+	if publishAuth != nil {
+		s.publishAuth.mu.Lock()
+		s.publishAuth.key = publishAuth.key
+		s.publishAuth.mu.Unlock()
+	}
+	if current, ok := s.http.auth.(*staticTokenAuth); ok {
+		current.mu.Lock()
+		current.tokens = tokens.tokens
+		current.mu.Unlock()
+	}
+	s.tenants.setTable(tenants)
+	if encoder, ok := s.encoder.(*ffmpegEncoder); ok {
+		encoder.cfg.Store(cfg)
+	}
+
+	s.reloadMu.Lock()
+	s.policies = policies
+	s.outputTemplate = outputTemplate
+	s.reloadMu.Unlock()
+
+	fmt.Println("Reloaded configuration")
+	return nil
+}
+
+// Policy of a publisher's new session
+func (s *Server) policy(publisher string) Policy {
+	s.reloadMu.RLock()
+	defer s.reloadMu.RUnlock()
+	return s.policies.lookup(publisher)
+}
+
+// Layout recordings are archived in, nil without -output-template
+func (s *Server) archiveTemplate() *template.Template {
+	s.reloadMu.RLock()
+	defer s.reloadMu.RUnlock()
+	return s.outputTemplate
+}
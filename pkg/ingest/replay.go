@@ -0,0 +1,174 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// How long an in-process publisher may take to connect
+const loopbackConnectTimeout = 15 * time.Second
+
+// Replay publishes RTP dumps written with -rtp-dump-dir as a new session,
+// sending their packets with the timing they were captured with, so what a
+// publisher sent can be run through the pipeline again offline. The RTCP in
+// the dumps is skipped, the replaying peer connection sends its own. It
+// returns once the session's outputs were finalized.
+func (s *Server) Replay(paths ...string) error {
+	if len(paths) == 0 {
+		return errors.New("no RTP dumps to replay")
+	}
+
+	type replayed struct {
+		dumpedPacket
+		track *webrtc.TrackLocalStaticRTP
+	}
+	var packets []replayed
+	var tracks []webrtc.TrackLocal
+	for i, path := range paths {
+		mimeType, clockRate, err := parseRTPDumpName(path)
+		if err != nil {
+			return err
+		}
+		dumped, err := readRTPDump(path)
+		if err != nil {
+			return err
+		}
+
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: clockRate}, fmt.Sprintf("replay-%d", i), "replay")
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, track)
+		for _, packet := range dumped {
+			if !packet.isRTCP() {
+				packets = append(packets, replayed{packet, track})
+			}
+		}
+	}
+	if len(packets) == 0 {
+		return errors.New("the RTP dumps hold no RTP packets")
+	}
+	slices.SortStableFunc(packets, func(a, b replayed) int { return a.at.Compare(b.at) })
+
+	publisher, session, err := s.connectPublisher(tracks...)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Replaying", len(packets), "packets as session", session.ID())
+
+	start := time.Now()
+	for _, packet := range packets {
+		time.Sleep(time.Until(start.Add(packet.at.Sub(packets[0].at))))
+		if _, err := packet.track.Write(packet.data); err != nil {
+			fmt.Println("Error replaying packet:", err)
+		}
+	}
+
+	// Let the last packets reach the pipeline before hanging up
+	time.Sleep(time.Second)
+	if err := publisher.Close(); err != nil {
+		fmt.Println("Error closing replaying peer connection:", err)
+	}
+	if err := session.Close(); err != nil {
+		fmt.Println("Error closing peer connection:", err)
+	}
+	session.Wait()
+	return nil
+}
+
+// connectPublisher negotiates a new session with an in-process publisher
+// sending the given tracks, and waits until it connected
+func (s *Server) connectPublisher(tracks ...webrtc.TrackLocal) (*webrtc.PeerConnection, *Session, error) {
+	session, err := s.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	publisher, err := s.connectPublisherTo(session, tracks...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return publisher, session, nil
+}
+
+// connectPublisherTo is connectPublisher for a session already started, which
+// is closed if the publisher fails to connect
+func (s *Server) connectPublisherTo(session *Session, tracks ...webrtc.TrackLocal) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		session.Close() //nolint:errcheck
+		return nil, err
+	}
+	publisher, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		session.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	connected := make(chan struct{})
+	failed := make(chan struct{})
+	publisher.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			close(connected)
+		case webrtc.PeerConnectionStateFailed:
+			close(failed)
+		}
+	})
+
+	if err := s.negotiatePublisher(publisher, session, tracks); err != nil {
+		publisher.Close() //nolint:errcheck
+		session.Close()   //nolint:errcheck
+		return nil, err
+	}
+
+	select {
+	case <-connected:
+		return publisher, nil
+	case <-failed:
+		err = errors.New("in-process publisher failed to connect")
+	case <-time.After(loopbackConnectTimeout):
+		err = errors.New("timed out connecting in-process publisher")
+	}
+	publisher.Close() //nolint:errcheck
+	session.Close()   //nolint:errcheck
+	return nil, err
+}
+
+func (s *Server) negotiatePublisher(publisher *webrtc.PeerConnection, session *Session, tracks []webrtc.TrackLocal) error {
+	for _, track := range tracks {
+		sender, err := publisher.AddTrack(track)
+		if err != nil {
+			return err
+		}
+
+		// Reading is what lets the interceptors process incoming RTCP
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	offer, err := publisher.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(publisher)
+	if err = publisher.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+
+	answer, err := session.Answer(*publisher.LocalDescription())
+	if err != nil {
+		return err
+	}
+	return publisher.SetRemoteDescription(*answer)
+}
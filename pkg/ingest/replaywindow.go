@@ -0,0 +1,105 @@
+package ingest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// SSRCs of a track whose windows are kept, older ones are forgotten
+const replayStreams = 4
+
+// replayFilter is the PacketProcessor dropping packets of a track that were
+// seen already, whether duplicated by the network, retransmitted after a
+// NACK that raced the original, or recovered through RED or FEC before the
+// original arrived, and packets older than the window that can no longer
+// be told apart from duplicates. Each SSRC has a window of its own, so a
+// publisher restarting its stream doesn't have its new packets dropped.
+type replayFilter struct {
+	track   string
+	size    int // Sequence numbers behind the newest one still accepted
+	metrics *metricRegistry
+
+	mu      sync.Mutex
+	streams map[uint32]*replayWindow
+	order   []uint32 // SSRCs by first packet, oldest first
+}
+
+// replayWindow is a bitmap of the sequence numbers seen of one SSRC
+type replayWindow struct {
+	highest int64 // Extended sequence number of the newest packet
+	seen    []uint64
+}
+
+// A filter keeping size sequence numbers, nil without one
+func newReplayFilter(track string, size int, metrics *metricRegistry) *replayFilter {
+	if size <= 0 {
+		return nil
+	}
+	return &replayFilter{track: track, size: (size + 63) / 64 * 64, metrics: metrics, streams: map[uint32]*replayWindow{}}
+}
+
+func (f *replayFilter) Process(packet *rtp.Packet) (*rtp.Packet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := f.streams[packet.SSRC]
+	if w == nil {
+		if len(f.order) == replayStreams {
+			delete(f.streams, f.order[0])
+			f.order = f.order[1:]
+		}
+		// Extended past the first wrap so older packets stay positive
+		w = &replayWindow{highest: 1<<16 + int64(packet.SequenceNumber), seen: make([]uint64, f.size/64)}
+		w.mark(w.highest)
+		f.streams[packet.SSRC] = w
+		f.order = append(f.order, packet.SSRC)
+		return packet, nil
+	}
+
+	// Extended by the closest wrap to the newest so far
+	seq := w.highest + int64(int16(packet.SequenceNumber-uint16(w.highest)))
+	switch behind := w.highest - seq; {
+	case behind < 0:
+		w.advance(seq)
+	case behind >= int64(f.size):
+		f.metrics.add(fmt.Sprintf("ingest_replayed_packets_total{track=%q,reason=\"late\"}", f.track), 1)
+		return nil, nil
+	case w.marked(seq):
+		f.metrics.add(fmt.Sprintf("ingest_replayed_packets_total{track=%q,reason=\"duplicate\"}", f.track), 1)
+		return nil, nil
+	}
+	w.mark(seq)
+	return packet, nil
+}
+
+// Move the window up to a newer sequence number, forgetting what slid out
+func (w *replayWindow) advance(seq int64) {
+	size := int64(len(w.seen) * 64)
+	for n := w.highest + 1; n < seq && n-w.highest <= size; n++ {
+		w.clear(n)
+	}
+	w.clear(seq)
+	w.highest = seq
+}
+
+func (w *replayWindow) bit(seq int64) (int, uint64) {
+	i := int(seq % int64(len(w.seen)*64))
+	return i / 64, 1 << (i % 64)
+}
+
+func (w *replayWindow) mark(seq int64) {
+	word, bit := w.bit(seq)
+	w.seen[word] |= bit
+}
+
+func (w *replayWindow) clear(seq int64) {
+	word, bit := w.bit(seq)
+	w.seen[word] &^= bit
+}
+
+func (w *replayWindow) marked(seq int64) bool {
+	word, bit := w.bit(seq)
+	return w.seen[word]&bit != 0
+}
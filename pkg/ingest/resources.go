@@ -0,0 +1,116 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// resourceUsage is what a session costs the server
+type resourceUsage struct {
+	CPUSeconds    float64 `json:"cpuSeconds"`    // Of its FFmpegs, exited ones included
+	FFmpegs       int     `json:"ffmpegs"`       // Running
+	BufferedBytes int64   `json:"bufferedBytes"` // Payloads queued ahead of its FFmpegs
+	BytesReceived uint64  `json:"bytesReceived"` // RTP from the publisher
+	Bitrate       int     `json:"bitrate"`       // Bits per second received lately
+	CPULimit      float64 `json:"cpuLimit,omitempty"`
+	MemoryLimit   int64   `json:"memoryLimit,omitempty"` // Bytes
+}
+
+// Count bytes buffered for a session, which may not account for them
+func addBuffered(buffered *atomic.Int64, n int) {
+	if buffered != nil {
+		buffered.Add(int64(n))
+	}
+}
+
+func (s *Session) resourceUsage() resourceUsage {
+	cpu, running := s.processes.usage()
+	usage := resourceUsage{
+		CPUSeconds:    cpu.Seconds(),
+		FFmpegs:       running,
+		BufferedBytes: s.buffered.Load(),
+	}
+	if limits := s.processes.cgroup; limits != nil {
+		usage.CPULimit, usage.MemoryLimit = limits.cpu, limits.memory
+	}
+
+	s.mu.Lock()
+	tracks := s.tracks
+	s.mu.Unlock()
+	for _, track := range tracks {
+		received, bitrate := track.bandwidth()
+		usage.BytesReceived += received
+		usage.Bitrate += bitrate
+	}
+	return usage
+}
+
+// Resources the session in the request path uses
+func (r *sessionRegistry) serveResources(w http.ResponseWriter, req *http.Request) {
+	session := r.get(req.PathValue("id"))
+	if session == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session.resourceUsage()) //nolint:errcheck
+}
+
+// ffmpegCgroups creates a cgroup v2 per session below the server's own, whose
+// FFmpegs are moved into it and held to its CPU and memory limits together,
+// so a runaway transcode can't starve co-located sessions
+type ffmpegCgroups struct {
+	root   string  // Cgroup directory the server started in
+	cpu    float64 // CPUs per session, 0 for no limit
+	memory int64   // Bytes per session, 0 for no limit
+}
+
+// ffmpegCgroup is the cgroup of a session's FFmpegs
+type ffmpegCgroup struct {
+	dir    string
+	cpu    float64
+	memory int64
+}
+
+// Cgroup for a session, named after its ID
+func (c *ffmpegCgroups) create(session string) (*ffmpegCgroup, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	cgroup := &ffmpegCgroup{dir: c.root + "/ingest-" + strings.ReplaceAll(session, "/", "_"), cpu: c.cpu, memory: c.memory}
+	if err := cgroup.create(); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %v", cgroup.dir, err)
+	}
+	return cgroup, nil
+}
+
+// Move a started FFmpeg into the cgroup
+func (c *ffmpegCgroup) add(p *ffmpegProcess) {
+	if c == nil || p.hasExited() {
+		return
+	}
+	if err := c.join(p.cmd.Process.Pid); err != nil {
+		fmt.Println("Failed to move FFmpeg into its session's cgroup:", err)
+	}
+}
+
+// Remove the cgroup once the session's FFmpegs exited
+func (c *ffmpegCgroup) remove() {
+	if c == nil {
+		return
+	}
+	// The kernel may still be reaping the last FFmpeg
+	for range 10 {
+		if c.destroy() == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Println("Failed to remove cgroup", c.dir)
+}
@@ -0,0 +1,108 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cgroupMount = "/sys/fs/cgroup"
+
+// The kernel reports process times in USER_HZ, 100 on every architecture
+// Go runs on
+const userHZ = 100
+
+// CPU time of a running process and the children it waited for, from
+// /proc/<pid>/stat
+func processCPUTime(pid int) time.Duration {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+
+	// The command may contain spaces and parentheses, the fields follow the
+	// last parenthesis: state is field 3, utime, stime, cutime and cstime
+	// fields 14 to 17
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	if len(fields) < 15 {
+		return 0
+	}
+	var ticks uint64
+	for _, field := range fields[11:15] {
+		n, _ := strconv.ParseUint(field, 10, 64)
+		ticks += n
+	}
+	return time.Duration(ticks) * time.Second / userHZ
+}
+
+// Prepare the cgroup the server runs in for session cgroups. Cgroup v2 only
+// delegates controllers to cgroups without processes of their own, so the
+// server first moves itself into a "server" leaf. The cgroup must be
+// delegated to the server's user, e.g. with systemd's Delegate=yes.
+func newFFmpegCgroups(cpu float64, memory int64) (*ffmpegCgroups, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	// Hybrid hierarchies list the v1 controllers besides the v2 line
+	var root string
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			root = filepath.Join(cgroupMount, path)
+		}
+	}
+	if root == "" {
+		return nil, errors.New("cgroup v2 isn't mounted")
+	}
+
+	controllers := ""
+	if cpu > 0 {
+		controllers += " +cpu"
+	}
+	if memory > 0 {
+		controllers += " +memory"
+	}
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(strings.TrimSpace(controllers)), 0); err != nil {
+		leaf := filepath.Join(root, "server")
+		if err := os.Mkdir(leaf, 0o755); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(strings.TrimSpace(controllers)), 0); err != nil {
+			return nil, err
+		}
+	}
+	return &ffmpegCgroups{root: root, cpu: cpu, memory: memory}, nil
+}
+
+func (c *ffmpegCgroup) create() error {
+	if err := os.Mkdir(c.dir, 0o755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if c.cpu > 0 {
+		// Quota per period of 100ms
+		if err := os.WriteFile(filepath.Join(c.dir, "cpu.max"), []byte(fmt.Sprintf("%d 100000", int(c.cpu*100000))), 0); err != nil {
+			return err
+		}
+	}
+	if c.memory > 0 {
+		if err := os.WriteFile(filepath.Join(c.dir, "memory.max"), []byte(strconv.FormatInt(c.memory, 10)), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ffmpegCgroup) join(pid int) error {
+	return os.WriteFile(filepath.Join(c.dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0)
+}
+
+func (c *ffmpegCgroup) destroy() error {
+	return os.Remove(c.dir)
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package ingest
+
+import (
+	"errors"
+	"time"
+)
+
+// Elsewhere the CPU time of an FFmpeg is only known once it exited
+func processCPUTime(int) time.Duration {
+	return 0
+}
+
+func newFFmpegCgroups(float64, int64) (*ffmpegCgroups, error) {
+	return nil, errors.New("cgroup limits need Linux")
+}
+
+func (c *ffmpegCgroup) create() error {
+	return errors.ErrUnsupported
+}
+
+func (c *ffmpegCgroup) join(int) error {
+	return errors.ErrUnsupported
+}
+
+func (c *ffmpegCgroup) destroy() error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,242 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionState is what a session persists in state_<id>.json while it is
+// live, so a publisher reconnecting after a crash continues its recording
+// instead of starting over. The file is removed once the session ended.
+type sessionState struct {
+	ID       string                   `json:"id"`
+	Tenant   string                   `json:"tenant,omitempty"`
+	PID      int                      `json:"pid"` // Of the process publishing the session
+	Dir      string                   `json:"dir"`
+	Started  time.Time                `json:"started"`
+	Updated  time.Time                `json:"updated"`
+	Segments map[string]int           `json:"segments"` // Number of the next HLS segment, by file pattern
+	Tracks   map[string]trackPosition `json:"tracks"`   // By rendition
+	Resumed  []time.Time              `json:"resumed,omitempty"`
+}
+
+// trackPosition is the last RTP packet received on a track
+type trackPosition struct {
+	SSRC      uint32 `json:"ssrc"`
+	Sequence  uint16 `json:"sequence"`
+	Timestamp uint32 `json:"timestamp"`
+}
+
+func stateName(session string) string {
+	return fmt.Sprintf("state_%s.json", session)
+}
+
+// State a crashed process left for a session, nil if there is none or it is
+// older than -resume-window
+func resumableState(session string, window time.Duration) *sessionState {
+	data, err := os.ReadFile(stateName(session))
+	if err != nil || window <= 0 {
+		return nil
+	}
+
+	var state sessionState
+	if err = json.Unmarshal(data, &state); err != nil {
+		fmt.Println("Error reading session state:", err)
+		return nil
+	}
+	if processAlive(state.PID) || time.Since(state.Updated) > window {
+		return nil
+	}
+	return &state
+}
+
+// Session directories of states that can still be resumed. States older
+// than the window are removed, their directories are swept as usual.
+func resumableDirs(window time.Duration) map[string]bool {
+	dirs := map[string]bool{}
+	names, _ := filepath.Glob("state_*.json")
+	for _, name := range names {
+		state := resumableState(strings.TrimSuffix(strings.TrimPrefix(name, "state_"), ".json"), window)
+		if state != nil {
+			dirs[state.Dir] = true
+		} else if data, err := os.ReadFile(name); err == nil {
+			var stale sessionState
+			if json.Unmarshal(data, &stale) == nil && !processAlive(stale.PID) {
+				os.Remove(name) //nolint:errcheck
+			}
+		}
+	}
+	return dirs
+}
+
+// Take over the directory of a crashed session, empty if it is gone
+func reclaimSessionDir(dir string) string {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() || !strings.HasPrefix(filepath.Base(dir), strings.TrimSuffix(sessionDirPattern, "*")) {
+		return ""
+	}
+	if err := os.WriteFile(filepath.Join(dir, sessionDirOwner), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		fmt.Println("Error reclaiming session directory:", err)
+		return ""
+	}
+	return dir
+}
+
+// Continue the numbering of an FFmpeg segment output where a crashed
+// process left it
+func continueSegments(args []string, next map[string]int) []string {
+	i := slices.Index(args, "-segment_filename")
+	if i < 0 || i+1 >= len(args) || next[filepath.Base(args[i+1])] == 0 {
+		return args
+	}
+
+	out := append([]string{}, args[:i]...)
+	out = append(out, "-segment_start_number", strconv.Itoa(next[filepath.Base(args[i+1])]))
+	return append(out, args[i:]...)
+}
+
+// Pick up a crashed session's state: its segments continue after the ones
+// written before the crash with a discontinuity, and its recordings so far
+// become parts joined with the new ones once the session ended
+func (s *Session) resumeFrom(state *sessionState) {
+	s.started = state.Started
+	s.resumeSegments = state.Segments
+	s.resumed = append(state.Resumed, time.Now())
+
+	for pattern, index := range state.Segments {
+		s.control.markSegment(fmt.Sprintf(pattern, index))
+	}
+
+	// Only the renditions of this session, whose IDs can prefix others'
+	for rendition := range state.Tracks {
+		for _, name := range []string{recordingName(s.id, rendition), ivfName(s.id, rendition), oggName(s.id, rendition)} {
+			if fileExists(name) {
+				if err := os.Rename(name, partName(name, len(recordingParts(name))+1)); err != nil {
+					fmt.Println("Error keeping recording part:", err)
+				}
+			}
+			if len(recordingParts(name)) > 0 {
+				s.parted = append(s.parted, name)
+			}
+		}
+	}
+
+	for rendition, position := range state.Tracks {
+		fmt.Printf("Resuming %s of session %s after sequence %d\n", rendition, s.id, position.Sequence)
+	}
+	s.server.metrics.add("ingest_sessions_resumed_total", 1)
+}
+
+// Persist the session's state every second until it ended
+func (s *Session) persistState() {
+	if s.server.cfg.ResumeWindow <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		s.writeState()
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Session) writeState() {
+	state := sessionState{ID: s.id, Tenant: s.tenant, PID: os.Getpid(), Dir: s.dir, Started: s.started, Updated: time.Now(), Segments: map[string]int{}, Tracks: map[string]trackPosition{}, Resumed: s.resumed}
+
+	// Numbering continues where the previous run left it, even if no segment
+	// was written since
+	for pattern, index := range s.resumeSegments {
+		state.Segments[pattern] = index
+	}
+	matches, _ := filepath.Glob(filepath.Join(s.dir, "*_*"))
+	for pattern, index := range nextSegments(matches) {
+		state.Segments[pattern] = max(state.Segments[pattern], index)
+	}
+
+	s.mu.Lock()
+	tracks := s.tracks
+	s.mu.Unlock()
+	for _, report := range tracks {
+		if position, ok := report.position(); ok {
+			state.Tracks[report.track.rendition()] = position
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(stateName(s.id), data)
+	}
+	if err != nil {
+		fmt.Println("Error writing session state:", err)
+	}
+}
+
+// Join the recording parts of a resumed session into one recording, IVF
+// dump and Ogg archive per rendition, in order
+func (s *Session) joinRecordings() {
+	for _, name := range s.parted {
+		parts := recordingParts(name)
+		if fileExists(name) {
+			parts = append(parts, name)
+		}
+
+		list := ""
+		for _, part := range parts {
+			abs, _ := filepath.Abs(part)
+			list += fmt.Sprintf("file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+		}
+		// The WebM, IVF and Ogg muxers are named after their extensions
+		format := strings.TrimPrefix(filepath.Ext(name), ".")
+		listFile := filepath.Join(s.dir, filepath.Base(name)+".parts")
+		joined := name + ".joined"
+		err := os.WriteFile(listFile, []byte(list), 0o644)
+		if err == nil {
+			var process *ffmpegProcess
+			if process, err = startFFmpegProcess([]string{"-f", "concat", "-safe", "0", "-i", listFile, "-c", "copy", "-f", format, "-y", joined}); err == nil {
+				process.stdin.Close()
+				if err = process.wait(); err != nil {
+					err = fmt.Errorf("%v: %s", err, process.stderr.String())
+				}
+			}
+		}
+		if err == nil {
+			err = os.Rename(joined, name)
+		}
+		if err != nil {
+			fmt.Printf("Error joining recording %s: %v\n", name, err)
+			os.Remove(joined)
+			continue
+		}
+
+		for _, part := range parts {
+			if part != name {
+				os.Remove(part)
+			}
+		}
+	}
+}
+
+// Parts a crashed run left of a recording, in order
+func recordingParts(name string) []string {
+	var parts []string
+	for n := 1; fileExists(partName(name, n)); n++ {
+		parts = append(parts, partName(name, n))
+	}
+	return parts
+}
+
+// Part n of a recording, "recording_<id>_<rendition>.part<n>.<ext>"
+func partName(name string, n int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.part%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
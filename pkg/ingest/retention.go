@@ -0,0 +1,243 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the retention rules are applied
+const retentionInterval = 10 * time.Minute
+
+// retentionPolicy limits which finished sessions keep their recordings: by
+// age, by how many of the newest are kept, and by the total size of the
+// newest that fit. Zero limits don't apply.
+type retentionPolicy struct {
+	maxAge   time.Duration
+	maxCount int
+	maxBytes int64
+}
+
+// Parse retention rules like "age=168h,count=100,size=500GB"
+func parseRetention(spec string) (retentionPolicy, error) {
+	var policy retentionPolicy
+	for _, rule := range strings.Split(spec, ",") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(rule, "=")
+		value = strings.TrimSpace(value)
+		var err error
+		switch strings.TrimSpace(name) {
+		case "age":
+			policy.maxAge, err = time.ParseDuration(value)
+		case "count":
+			policy.maxCount, err = strconv.Atoi(value)
+		case "size":
+			policy.maxBytes, err = parseByteSize(value)
+		default:
+			err = fmt.Errorf("unknown rule")
+		}
+		if err != nil {
+			return retentionPolicy{}, fmt.Errorf("invalid retention rule %q: %v", rule, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// Parse a size like "500GB" or "2TB", in powers of 1000 as disks are sold
+func parseByteSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		bytes  float64
+	}{{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1}}
+
+	value = strings.ToUpper(strings.TrimSpace(value))
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+			return int64(n * unit.bytes), err
+		}
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// retentionEngine applies the retention policy to the sessions whose
+// session_<id>.json says they finished, deleting their recordings, VOD
+// renditions and metadata together and emitting recording.deleted for the
+// audit trail. A session's own retention, set with SetRetention, replaces the
+// age rule for it.
+type retentionEngine struct {
+	mu      sync.Mutex
+	policy  retentionPolicy
+	events  *eventBus
+	catalog *recordingCatalog
+	started sync.Once
+}
+
+// A finished session as the engine sees it
+type retainedSession struct {
+	id        string
+	tenant    string
+	ended     time.Time
+	retention time.Duration // Of the session itself, 0 for the policy's
+	files     []string      // Metadata last
+	bytes     int64
+}
+
+func newRetentionEngine(cfg *Config, events *eventBus, catalog *recordingCatalog) (*retentionEngine, error) {
+	policy, err := parseRetention(cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+	return &retentionEngine{policy: policy, events: events, catalog: catalog}, nil
+}
+
+// start runs the engine, once
+func (e *retentionEngine) start() {
+	e.started.Do(func() {
+		go func() {
+			for {
+				e.sweep(time.Now())
+				time.Sleep(retentionInterval)
+			}
+		}()
+	})
+}
+
+// setPolicy replaces the policy from the next sweep on
+func (e *retentionEngine) setPolicy(policy retentionPolicy) {
+	e.mu.Lock()
+	e.policy = policy
+	e.mu.Unlock()
+}
+
+func (e *retentionEngine) sweep(now time.Time) {
+	e.mu.Lock()
+	policy := e.policy
+	e.mu.Unlock()
+	sessions := finishedSessions()
+
+	// Newest first, count and size keep the newest
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ended.After(sessions[j].ended) })
+
+	kept, bytes := 0, int64(0)
+	for _, session := range sessions {
+		maxAge := policy.maxAge
+		if session.retention > 0 {
+			maxAge = session.retention
+		}
+
+		reason := ""
+		switch {
+		case maxAge > 0 && now.Sub(session.ended) > maxAge:
+			reason = "age"
+		case policy.maxCount > 0 && kept >= policy.maxCount:
+			reason = "count"
+		case policy.maxBytes > 0 && bytes+session.bytes > policy.maxBytes:
+			reason = "size"
+		}
+		if reason == "" {
+			kept++
+			bytes += session.bytes
+			continue
+		}
+
+		e.delete(session, reason, now)
+	}
+}
+
+func (e *retentionEngine) delete(session *retainedSession, reason string, now time.Time) {
+	var deleted []string
+	for _, file := range session.files {
+		if err := os.RemoveAll(file); err != nil {
+			fmt.Println("Error deleting recording:", err)
+			return
+		}
+		deleted = append(deleted, file)
+		removeEmptyParents(file)
+		if err := e.catalog.purge(file, now); err != nil {
+			fmt.Println("Error updating recording catalog:", err)
+		}
+	}
+
+	fmt.Printf("Deleted session %s by the %s retention rule\n", session.id, reason)
+	e.events.emit(eventRecordingDeleted, session.id, map[string]any{"files": deleted, "reason": reason})
+}
+
+// The sessions the metadata in the working directory says finished, with
+// their files still on disk
+func finishedSessions() []*retainedSession {
+	names, _ := filepath.Glob("session_*.json")
+
+	var sessions []*retainedSession
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var metadata sessionMetadata
+		if err := json.Unmarshal(data, &metadata); err != nil || metadata.Ended == nil {
+			continue
+		}
+
+		session := &retainedSession{id: metadata.ID, tenant: metadata.Tenant, ended: *metadata.Ended}
+		if metadata.Retention != "" {
+			session.retention, _ = time.ParseDuration(metadata.Retention)
+		}
+		for _, file := range append(metadata.Outputs, vodDir(metadata.ID)) {
+			if size, ok := diskUsage(file); ok {
+				session.files = append(session.files, file)
+				session.bytes += size
+			}
+		}
+		// Archived links share the recordings' data, they take up no space
+		for _, file := range metadata.Archive {
+			if fileExists(file) {
+				session.files = append(session.files, file)
+			}
+		}
+		session.files = append(session.files, name)
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Size of a file, or of the files in a directory
+func diskUsage(path string) (int64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	if !info.IsDir() {
+		return info.Size(), true
+	}
+
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error { //nolint:errcheck
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, true
+}
+
+// SetRetention keeps the session's recordings for a duration after it
+// ended, instead of the age rule of -retention. The count and size rules
+// still apply.
+func (s *Session) SetRetention(retention time.Duration) {
+	s.mu.Lock()
+	s.retention = retention
+	s.mu.Unlock()
+
+	s.writeMetadata()
+}
@@ -0,0 +1,102 @@
+package ingest
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// payloadRing is a preallocated single-producer/single-consumer queue of
+// payloads. Neither side takes a lock or allocates: the producer only moves
+// tail and the consumer only moves head, so the latency of handing over a
+// packet doesn't depend on the scheduler's view of a channel.
+type payloadRing struct {
+	slots  [][]byte
+	queued []int64 // When each slot was pushed, in Unix nanoseconds
+	mask   uint64
+
+	head   atomic.Uint64 // Next slot to read, only moved by the consumer
+	tail   atomic.Uint64 // Next slot to write, only moved by the producer
+	closed atomic.Bool
+
+	buffered *atomic.Int64 // Bytes queued of the session, nil if not accounted
+
+	readable chan struct{} // Wakes the consumer
+	writable chan struct{} // Wakes a producer waiting for room
+}
+
+// newPayloadRing holds at least size payloads, rounded up to a power of two
+func newPayloadRing(size int) *payloadRing {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+
+	return &payloadRing{
+		slots:    make([][]byte, n),
+		queued:   make([]int64, n),
+		mask:     uint64(n - 1),
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+// push queues a payload, false when the ring is full
+func (r *payloadRing) push(p []byte) bool {
+	tail := r.tail.Load()
+	if tail-r.head.Load() == uint64(len(r.slots)) {
+		return false
+	}
+
+	r.slots[tail&r.mask] = p
+	r.queued[tail&r.mask] = time.Now().UnixNano()
+	addBuffered(r.buffered, len(p))
+	r.tail.Store(tail + 1)
+	wake(r.readable)
+	return true
+}
+
+// pushWait queues a payload once there is room, false if stopped first
+func (r *payloadRing) pushWait(p []byte, stop <-chan struct{}) bool {
+	for !r.push(p) {
+		select {
+		case <-r.writable:
+		case <-stop:
+			return false
+		}
+	}
+
+	return true
+}
+
+// pop takes the oldest payload and when it was pushed, false when the ring
+// is empty
+func (r *payloadRing) pop() ([]byte, time.Time, bool) {
+	head := r.head.Load()
+	if head == r.tail.Load() {
+		return nil, time.Time{}, false
+	}
+
+	p, queued := r.slots[head&r.mask], time.Unix(0, r.queued[head&r.mask])
+	r.slots[head&r.mask] = nil
+	addBuffered(r.buffered, -len(p))
+	r.head.Store(head + 1)
+	wake(r.writable)
+	return p, queued, true
+}
+
+// close tells the consumer nothing follows what is queued
+func (r *payloadRing) close() {
+	r.closed.Store(true)
+	wake(r.readable)
+}
+
+func (r *payloadRing) occupancy() float64 {
+	return float64(r.tail.Load()-r.head.Load()) / float64(len(r.slots))
+}
+
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
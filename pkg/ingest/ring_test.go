@@ -0,0 +1,64 @@
+package ingest
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPayloadRing(t *testing.T) {
+	for _, tc := range []struct {
+		size, slots int
+	}{{1, 1}, {3, 4}, {4, 4}, {5, 8}} {
+		ring := newPayloadRing(tc.size)
+		ring.buffered = &atomic.Int64{}
+		for i := range tc.slots {
+			if !ring.push([]byte{byte(i)}) {
+				t.Fatalf("size %d: push %d failed", tc.size, i)
+			}
+		}
+		if ring.push([]byte{0xff}) {
+			t.Errorf("size %d: push to a full ring succeeded", tc.size)
+		}
+		if ring.occupancy() != 1 || ring.buffered.Load() != int64(tc.slots) {
+			t.Errorf("size %d: occupancy %v, %d bytes buffered", tc.size, ring.occupancy(), ring.buffered.Load())
+		}
+
+		// Payloads come out in order, also once the ring wrapped around
+		for i := range 2 * tc.slots {
+			p, _, ok := ring.pop()
+			if !ok || p[0] != byte(i) {
+				t.Fatalf("size %d: pop %d = %v, %v", tc.size, i, p, ok)
+			}
+			ring.push([]byte{byte(i + tc.slots)})
+		}
+		for range tc.slots {
+			ring.pop()
+		}
+		if _, _, ok := ring.pop(); ok || ring.buffered.Load() != 0 {
+			t.Errorf("size %d: popped from an empty ring, %d bytes buffered", tc.size, ring.buffered.Load())
+		}
+	}
+}
+
+func TestPayloadRingPushWait(t *testing.T) {
+	ring := newPayloadRing(1)
+	ring.push([]byte{1})
+
+	stop := make(chan struct{})
+	pushed := make(chan bool)
+	go func() { pushed <- ring.pushWait([]byte{2}, stop) }()
+	time.Sleep(10 * time.Millisecond)
+	if p, _, _ := ring.pop(); p[0] != 1 {
+		t.Fatalf("pop = %v", p)
+	}
+	if !<-pushed {
+		t.Fatal("pushWait failed once there was room")
+	}
+
+	go func() { pushed <- ring.pushWait([]byte{3}, stop) }()
+	close(stop)
+	if <-pushed {
+		t.Error("pushWait succeeded on a full ring once stopped")
+	}
+}
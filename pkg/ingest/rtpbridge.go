@@ -0,0 +1,197 @@
+package ingest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Packets of a source queued for its publisher, while it connects
+const rtpBridgeQueue = 512
+
+// Codecs -rtp-payload-types maps payload types to
+var rtpBridgeCodecs = map[string]webrtc.RTPCodecCapability{
+	"opus": {MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+	"vp8":  {MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+	"h264": {MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+	"pcmu": {MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+	"pcma": {MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+	"g722": {MimeType: webrtc.MimeTypeG722, ClockRate: 8000},
+}
+
+// Parse a payload type table like "111=opus,96=vp8". The static payload
+// types of RFC 3551 a SIP trunk sends, PCMU, PCMA and G.722, are always
+// known.
+func parseRTPPayloadTypes(spec string) (map[uint8]webrtc.RTPCodecCapability, error) {
+	payloadTypes := map[uint8]webrtc.RTPCodecCapability{
+		0: rtpBridgeCodecs["pcmu"],
+		8: rtpBridgeCodecs["pcma"],
+		9: rtpBridgeCodecs["g722"],
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		pt, name, _ := strings.Cut(entry, "=")
+		payloadType, err := strconv.ParseUint(strings.TrimSpace(pt), 10, 7)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload type in %q", entry)
+		}
+		codec, ok := rtpBridgeCodecs[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown codec in %q", entry)
+		}
+		payloadTypes[uint8(payloadType)] = codec
+	}
+
+	return payloadTypes, nil
+}
+
+// rtpBridge publishes the plain RTP streams sent to -rtp-listen, from SIP
+// trunks or ffmpeg -f rtp, through an in-process peer connection each, so
+// they run through the same sessions and pipelines as WebRTC publishers.
+// Every source address and SSRC is a session of its own with one track,
+// ended once it stopped sending for -rtp-idle-timeout.
+type rtpBridge struct {
+	server       *Server
+	payloadTypes map[uint8]webrtc.RTPCodecCapability
+	idleTimeout  time.Duration
+
+	mu      sync.Mutex
+	sources map[string]chan []byte // Packets by source address and SSRC
+}
+
+// ListenRTP accepts plain RTP on -rtp-listen until the server was drained,
+// and returns right away without it
+func (s *Server) ListenRTP() error {
+	if s.cfg.RTPListen == "" {
+		return nil
+	}
+	payloadTypes, err := parseRTPPayloadTypes(s.cfg.RTPPayloadTypes)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", s.cfg.RTPListen)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-s.Drained()
+		conn.Close()
+	}()
+	fmt.Println("Accepting plain RTP on", conn.LocalAddr())
+
+	b := &rtpBridge{server: s, payloadTypes: payloadTypes, idleTimeout: s.cfg.RTPIdleTimeout, sources: map[string]chan []byte{}}
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		b.receive(addr, buf[:n])
+	}
+}
+
+func (b *rtpBridge) receive(addr net.Addr, data []byte) {
+	header := rtp.Header{}
+	if _, err := header.Unmarshal(data); err != nil || header.Version != 2 {
+		return
+	}
+	// RTCP multiplexed on the port (RFC 5761) is left out
+	if data[1] >= 192 && data[1] <= 223 {
+		return
+	}
+
+	key := fmt.Sprintf("%s/%d", addr, header.SSRC)
+	b.mu.Lock()
+	packets, ok := b.sources[key]
+	if !ok {
+		codec, known := b.payloadTypes[header.PayloadType]
+		if !known {
+			b.mu.Unlock()
+			b.server.metrics.add(`ingest_rtp_bridge_packets_total{result="unknown_payload_type"}`, 1)
+			return
+		}
+		packets = make(chan []byte, rtpBridgeQueue)
+		b.sources[key] = packets
+		go b.publish(key, codec, packets)
+	}
+	b.mu.Unlock()
+
+	select {
+	case packets <- append([]byte(nil), data...):
+	default:
+		b.server.metrics.add(`ingest_rtp_bridge_packets_total{result="dropped"}`, 1)
+	}
+}
+
+// Publish a source until it stopped sending. The packets of a source whose
+// session couldn't start or already ended are dropped rather than starting
+// another session.
+func (b *rtpBridge) publish(key string, codec webrtc.RTPCodecCapability, packets <-chan []byte) {
+	var publisher *webrtc.PeerConnection
+	var session *Session
+	var ended <-chan struct{}
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "rtp", "rtp-bridge")
+	if err == nil {
+		publisher, session, err = b.server.connectPublisher(track)
+	}
+	if err != nil {
+		fmt.Printf("Error publishing RTP from %s: %v\n", key, err)
+	} else {
+		fmt.Printf("Publishing %s RTP from %s as session %s\n", codec.MimeType, key, session.ID())
+		session.mu.Lock()
+		session.userAgent = "RTP from " + key
+		session.mu.Unlock()
+		ended = session.Done()
+	}
+
+	hangUp := func() {
+		if publisher == nil {
+			return
+		}
+		if err := publisher.Close(); err != nil {
+			fmt.Println("Error closing bridging peer connection:", err)
+		}
+		if err := session.Close(); err != nil {
+			fmt.Println("Error closing peer connection:", err)
+		}
+		publisher, ended = nil, nil
+	}
+	defer func() {
+		b.mu.Lock()
+		delete(b.sources, key)
+		b.mu.Unlock()
+		hangUp()
+	}()
+
+	idle := time.NewTimer(b.idleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case data := <-packets:
+			idle.Reset(b.idleTimeout)
+			if publisher == nil {
+				b.server.metrics.add(`ingest_rtp_bridge_packets_total{result="dropped"}`, 1)
+				continue
+			}
+			if _, err := track.Write(data); err != nil {
+				fmt.Println("Error bridging RTP packet:", err)
+			}
+			b.server.metrics.add(`ingest_rtp_bridge_packets_total{result="published"}`, 1)
+		case <-ended:
+			hangUp()
+		case <-idle.C:
+			fmt.Printf("RTP from %s stopped for %s, ending its session\n", key, b.idleTimeout)
+			return
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+)
+
+// Dumps are pcap files of raw IPv4 packets, the RTP and RTCP of a track
+// wrapped in made up UDP datagrams Wireshark decodes as RTP
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapLinkRaw    = 101
+	pcapSnapLen    = 65535
+	dumpHeaderSize = 20 + 8 // IPv4 and UDP
+	dumpPort       = 5004
+)
+
+// rtpDumpFactory makes interceptors writing the incoming RTP and RTCP of every
+// track of a peer connection to a pcap file of its own in dir, before any
+// other interceptor touched them
+type rtpDumpFactory struct {
+	dir string
+}
+
+func (f *rtpDumpFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &rtpDumpInterceptor{dir: f.dir, dumps: map[uint32]*rtpDump{}}, nil
+}
+
+type rtpDumpInterceptor struct {
+	interceptor.NoOp
+	dir string
+
+	mu    sync.Mutex
+	dumps map[uint32]*rtpDump // By SSRC
+}
+
+func (i *rtpDumpInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	dump, err := createRTPDump(filepath.Join(i.dir, rtpDumpName(info, time.Now())))
+	if err != nil {
+		fmt.Println("Failed to create RTP dump:", err)
+		return reader
+	}
+	i.mu.Lock()
+	i.dumps[info.SSRC] = dump
+	i.mu.Unlock()
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err == nil {
+			dump.write(b[:n], time.Now())
+		}
+		return n, a, err
+	})
+}
+
+func (i *rtpDumpInterceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	dump := i.dumps[info.SSRC]
+	delete(i.dumps, info.SSRC)
+	i.mu.Unlock()
+
+	if dump != nil {
+		dump.close()
+	}
+}
+
+// RTCP goes to the dumps of the tracks it is about
+func (i *rtpDumpInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err != nil {
+			return n, a, err
+		}
+
+		packets, parseErr := rtcp.Unmarshal(b[:n])
+		if parseErr != nil {
+			return n, a, err
+		}
+		written := map[*rtpDump]bool{}
+		now := time.Now()
+		i.mu.Lock()
+		for _, packet := range packets {
+			ssrcs := packet.DestinationSSRC()
+			if sr, ok := packet.(*rtcp.SenderReport); ok {
+				ssrcs = append(ssrcs, sr.SSRC)
+			}
+			for _, ssrc := range ssrcs {
+				if dump := i.dumps[ssrc]; dump != nil && !written[dump] {
+					written[dump] = true
+					dump.write(b[:n], now)
+				}
+			}
+		}
+		i.mu.Unlock()
+		return n, a, err
+	})
+}
+
+func (i *rtpDumpInterceptor) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for ssrc, dump := range i.dumps {
+		dump.close()
+		delete(i.dumps, ssrc)
+	}
+	return nil
+}
+
+// Name of the dump of a track, e.g. rtp_1700000000000_1234_audio_opus_48000.pcap.
+// It carries what replaying the dump needs to know about the codec.
+func rtpDumpName(info *interceptor.StreamInfo, now time.Time) string {
+	kind, codec, _ := strings.Cut(strings.ToLower(info.MimeType), "/")
+	return fmt.Sprintf("rtp_%d_%d_%s_%s_%d.pcap", now.UnixMilli(), info.SSRC, kind, codec, info.ClockRate)
+}
+
+// Parse the name of a dump into the MIME type and clock rate of its codec
+func parseRTPDumpName(path string) (string, uint32, error) {
+	fields := strings.Split(strings.TrimSuffix(filepath.Base(path), ".pcap"), "_")
+	if len(fields) != 6 || fields[0] != "rtp" {
+		return "", 0, fmt.Errorf("%s isn't named like an RTP dump", path)
+	}
+	clockRate, err := strconv.ParseUint(fields[5], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s isn't named like an RTP dump", path)
+	}
+	return fields[3] + "/" + fields[4], uint32(clockRate), nil
+}
+
+type rtpDump struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func createRTPDump(path string) (*rtpDump, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &rtpDump{f: f, w: w}, nil
+}
+
+// write a packet as a datagram received at a time
+func (d *rtpDump) write(payload []byte, at time.Time) {
+	record := make([]byte, 16+dumpHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:], uint32(at.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(at.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(dumpHeaderSize+len(payload)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(dumpHeaderSize+len(payload)))
+
+	ip := record[16:]
+	ip[0] = 0x45 // IPv4 without options
+	binary.BigEndian.PutUint16(ip[2:], uint16(dumpHeaderSize+len(payload)))
+	ip[8] = 64 // TTL
+	ip[9] = 17 // UDP
+	copy(ip[12:], []byte{10, 0, 0, 1})
+	copy(ip[16:], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:20]))
+
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:], dumpPort)
+	binary.BigEndian.PutUint16(udp[2:], dumpPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	copy(udp[8:], payload)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.w != nil {
+		d.w.Write(record) //nolint:errcheck
+	}
+}
+
+func (d *rtpDump) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.w == nil {
+		return
+	}
+	if err := d.w.Flush(); err != nil {
+		fmt.Println("Failed to write RTP dump:", err)
+	}
+	d.f.Close()
+	d.w = nil
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// dumpedPacket is an RTP or RTCP packet read back from a dump
+type dumpedPacket struct {
+	at   time.Time
+	data []byte
+}
+
+// RTCP packet types are 192 to 223, where RTP has a marker bit and payload type
+func (p dumpedPacket) isRTCP() bool {
+	return len(p.data) > 1 && p.data[1] >= 192 && p.data[1] <= 223
+}
+
+// Read the packets of a dump
+func readRTPDump(path string) ([]dumpedPacket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header) != pcapMagic || binary.LittleEndian.Uint32(header[20:]) != pcapLinkRaw {
+		return nil, fmt.Errorf("%s isn't an RTP dump", path)
+	}
+
+	var packets []dumpedPacket
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); errors.Is(err, io.EOF) {
+			return packets, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, binary.LittleEndian.Uint32(record[8:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if len(data) < dumpHeaderSize {
+			continue
+		}
+		at := time.Unix(int64(binary.LittleEndian.Uint32(record[0:])), int64(binary.LittleEndian.Uint32(record[4:]))*1000)
+		packets = append(packets, dumpedPacket{at: at, data: data[dumpHeaderSize:]})
+	}
+}
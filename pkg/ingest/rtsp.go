@@ -0,0 +1,384 @@
+package ingest
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// How long an RTSP server gets to answer, and how often a playing session is
+// kept alive
+const (
+	rtspTimeout   = 10 * time.Second
+	rtspKeepAlive = 30 * time.Second
+)
+
+// rtspClient plays an RTSP URL with its media interleaved on the TCP
+// connection (RFC 2326 section 10.12), which passes NATs and firewalls
+// cameras sit behind
+type rtspClient struct {
+	url      *url.URL // Without its credentials
+	user     *url.Userinfo
+	conn     net.Conn
+	reader   *bufio.Reader
+	mu       sync.Mutex // Serializes requests, the keepalives run alongside reading media
+	cseq     int
+	session  string
+	auth     func(method, uri string) string // Authorization header, nil until challenged
+	base     string                          // Of the media control URLs
+	interval time.Duration                   // Keepalive interval, from the session timeout
+}
+
+// rtspMedia is a media section of the presentation, played on the channel
+// pair from channel
+type rtspMedia struct {
+	kind    string // "audio" or "video"
+	codec   string // Encoding name of its rtpmap, upper case
+	rate    uint32
+	fmtp    map[string]string
+	control string // URL to SETUP
+	channel uint8  // Interleaved channel of its RTP, RTCP is on the next one
+}
+
+func dialRTSP(rawURL string) (*rtspClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported RTSP URL scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, rtspTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &rtspClient{user: u.User, conn: conn, reader: bufio.NewReader(conn), interval: rtspKeepAlive}
+	u.User = nil
+	c.url = u
+	return c, nil
+}
+
+// A URL without its password, for logs
+func redactURL(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Redacted()
+	}
+	return rawURL
+}
+
+// describe returns the media of the presentation
+func (c *rtspClient) describe() ([]rtspMedia, error) {
+	header, body, err := c.request("DESCRIBE", c.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+	c.base = c.url.String()
+	if base := header.Get("Content-Base"); base != "" {
+		c.base = base
+	}
+
+	description := sdp.SessionDescription{}
+	if err := description.UnmarshalString(string(body)); err != nil {
+		return nil, fmt.Errorf("invalid SDP from RTSP server: %v", err)
+	}
+
+	var media []rtspMedia
+	for _, m := range description.MediaDescriptions {
+		if len(m.MediaName.Formats) == 0 {
+			continue
+		}
+		entry := rtspMedia{kind: m.MediaName.Media, fmtp: map[string]string{}, control: c.base}
+		format := m.MediaName.Formats[0]
+		for _, attribute := range m.Attributes {
+			switch attribute.Key {
+			case "rtpmap":
+				// "96 H264/90000" or "97 MPEG4-GENERIC/44100/2"
+				pt, encoding, _ := strings.Cut(attribute.Value, " ")
+				if pt != format {
+					continue
+				}
+				parts := strings.Split(encoding, "/")
+				entry.codec = strings.ToUpper(parts[0])
+				if len(parts) > 1 {
+					rate, _ := strconv.ParseUint(parts[1], 10, 32)
+					entry.rate = uint32(rate)
+				}
+			case "fmtp":
+				pt, params, _ := strings.Cut(attribute.Value, " ")
+				if pt != format {
+					continue
+				}
+				for _, param := range strings.Split(params, ";") {
+					key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+					entry.fmtp[strings.ToLower(key)] = value
+				}
+			case "control":
+				entry.control = c.controlURL(attribute.Value)
+			}
+		}
+		media = append(media, entry)
+	}
+	return media, nil
+}
+
+// Resolve a control attribute against the base URL
+func (c *rtspClient) controlURL(control string) string {
+	switch {
+	case control == "*" || control == "":
+		return c.base
+	case strings.HasPrefix(strings.ToLower(control), "rtsp://"):
+		return control
+	default:
+		return strings.TrimSuffix(c.base, "/") + "/" + control
+	}
+}
+
+// setup asks for a media to be played interleaved on its channel pair
+func (c *rtspClient) setup(media *rtspMedia) error {
+	transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", media.channel, media.channel+1)
+	header, _, err := c.request("SETUP", media.control, map[string]string{"Transport": transport})
+	if err != nil {
+		return err
+	}
+
+	// "12345678;timeout=60"
+	session, params, _ := strings.Cut(header.Get("Session"), ";")
+	c.session = strings.TrimSpace(session)
+	if _, timeout, ok := strings.Cut(params, "timeout="); ok {
+		if seconds, err := strconv.Atoi(strings.TrimSpace(timeout)); err == nil && seconds > 2 {
+			c.interval = min(rtspKeepAlive, time.Duration(seconds)*time.Second/2)
+		}
+	}
+	return nil
+}
+
+// play starts the media and keeps the session alive until the connection
+// is closed. Media is then read with readPacket.
+func (c *rtspClient) play() error {
+	if _, _, err := c.request("PLAY", c.base, map[string]string{"Range": "npt=0.000-"}); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			// The answer is skipped by readPacket
+			if err := c.send("GET_PARAMETER", c.base, nil); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// readPacket returns the next interleaved packet and its channel, skipping
+// the answers to keepalives
+func (c *rtspClient) readPacket() (uint8, []byte, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(rtspTimeout + c.interval)) //nolint:errcheck
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if first[0] != '$' {
+			if _, _, _, err := c.readAnswer(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		frame := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, frame); err != nil {
+			return 0, nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint16(frame[2:]))
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return 0, nil, err
+		}
+		return frame[1], data, nil
+	}
+}
+
+func (c *rtspClient) close() error {
+	c.send("TEARDOWN", c.base, nil) //nolint:errcheck
+	return c.conn.Close()
+}
+
+// Send a request and read its answer, authenticating once challenged
+func (c *rtspClient) request(method, uri string, headers map[string]string) (textproto.MIMEHeader, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.send(method, uri, headers); err != nil {
+			return nil, nil, err
+		}
+		c.conn.SetReadDeadline(time.Now().Add(rtspTimeout)) //nolint:errcheck
+		status, header, body, err := c.readAnswer()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if status == 401 && attempt == 0 && c.user != nil {
+			// Digest is preferred when Basic is offered too
+			challenge := header.Get("WWW-Authenticate")
+			for _, offered := range header.Values("WWW-Authenticate") {
+				if strings.HasPrefix(strings.ToLower(offered), "digest") {
+					challenge = offered
+				}
+			}
+			if c.auth, err = rtspAuthorization(c.user, challenge); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if status != 200 {
+			return nil, nil, fmt.Errorf("RTSP %s answered %d", method, status)
+		}
+		return header, body, nil
+	}
+}
+
+func (c *rtspClient) send(method, uri string, headers map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: ingest\r\n", method, uri, c.cseq)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	if c.auth != nil {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", c.auth(method, uri))
+	}
+	for key, value := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	b.WriteString("\r\n")
+
+	c.conn.SetWriteDeadline(time.Now().Add(rtspTimeout)) //nolint:errcheck
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// Read the answer to a request, skipping media interleaved before it
+func (c *rtspClient) readAnswer() (int, textproto.MIMEHeader, []byte, error) {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if first[0] == '$' {
+			frame := make([]byte, 4)
+			if _, err := io.ReadFull(c.reader, frame); err != nil {
+				return 0, nil, nil, err
+			}
+			if _, err := c.reader.Discard(int(binary.BigEndian.Uint16(frame[2:]))); err != nil {
+				return 0, nil, nil, err
+			}
+			continue
+		}
+
+		status, header, err := c.readResponse()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		body := make([]byte, 0)
+		if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+			body = make([]byte, length)
+			if _, err := io.ReadFull(c.reader, body); err != nil {
+				return 0, nil, nil, err
+			}
+		}
+		return status, header, body, nil
+	}
+}
+
+// Read the status line and headers of a response
+func (c *rtspClient) readResponse() (int, textproto.MIMEHeader, error) {
+	reader := textproto.NewReader(c.reader)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+	// "RTSP/1.0 200 OK"
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return 0, nil, fmt.Errorf("invalid RTSP status line %q", line)
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid RTSP status line %q", line)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, nil, err
+	}
+	return status, header, nil
+}
+
+// Authorization of a Basic or Digest (RFC 2617) challenge
+func rtspAuthorization(user *url.Userinfo, challenge string) (func(method, uri string) string, error) {
+	password, _ := user.Password()
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		return func(string, string) string { return "Basic " + credentials }, nil
+	case "digest":
+	default:
+		return nil, fmt.Errorf("unsupported RTSP authentication %q", scheme)
+	}
+
+	values := map[string]string{}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		values[strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+	md5Hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := md5Hex(user.Username() + ":" + values["realm"] + ":" + password)
+	qop := ""
+	for _, option := range strings.Split(values["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			qop = "auth"
+		}
+	}
+
+	nc := 0
+	return func(method, uri string) string {
+		ha2 := md5Hex(method + ":" + uri)
+		header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, user.Username(), values["realm"], values["nonce"], uri)
+		if qop == "" {
+			return header + fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+values["nonce"]+":"+ha2))
+		}
+
+		nc++
+		random := make([]byte, 8)
+		rand.Read(random) //nolint:errcheck
+		cnonce := hex.EncodeToString(random)
+		response := md5Hex(fmt.Sprintf("%s:%s:%08x:%s:auth:%s", ha1, values["nonce"], nc, cnonce, ha2))
+		return header + fmt.Sprintf(`, qop=auth, nc=%08x, cnonce="%s", response="%s"`, nc, cnonce, response)
+	}, nil
+}
@@ -0,0 +1,374 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// How long a camera is left alone after its stream failed or ended
+const rtspRetry = 5 * time.Second
+
+var errRTSPSessionEnded = errors.New("session ended")
+
+// PullRTSP pulls every camera of -rtsp-url in the background, each stream
+// published as a session through an in-process peer connection like plain
+// RTP. H.264 video is depacketized and passed through, which needs -h264,
+// and AAC audio is transcoded to Opus by FFmpeg. A stream that fails or
+// ends is pulled again as a new session until the server drains.
+func (s *Server) PullRTSP() {
+	for _, rawURL := range strings.Split(s.cfg.RTSPURLs, ",") {
+		if rawURL = strings.TrimSpace(rawURL); rawURL == "" {
+			continue
+		}
+		go func() {
+			for !s.draining.Load() {
+				if err := s.pullRTSP(rawURL); err != nil {
+					fmt.Printf("Error pulling %s: %v\n", redactURL(rawURL), err)
+				}
+				time.Sleep(rtspRetry)
+			}
+		}()
+	}
+}
+
+// Pull a camera until its stream or session ends
+func (s *Server) pullRTSP(rawURL string) error {
+	client, err := dialRTSP(rawURL)
+	if err != nil {
+		return err
+	}
+	defer client.close() //nolint:errcheck
+
+	presentation, err := client.describe()
+	if err != nil {
+		return err
+	}
+
+	var video, audio *rtspMedia
+	for i := range presentation {
+		m := &presentation[i]
+		switch {
+		case m.kind == "video" && m.codec == "H264" && video == nil:
+			if !s.cfg.H264 {
+				fmt.Printf("Skipping the H.264 video of %s, it needs -h264\n", client.url)
+				continue
+			}
+			video = m
+		case m.kind == "audio" && m.codec == "MPEG4-GENERIC" && audio == nil:
+			audio = m
+		}
+	}
+	if video == nil && audio == nil {
+		return errors.New("no H.264 video or AAC audio to pull")
+	}
+
+	var tracks []webrtc.TrackLocal
+	var h264 *h264Assembler
+	var aac *aacTranscoder
+	if video != nil {
+		video.channel = 0
+		track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"}, "video", "rtsp")
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, track)
+		h264 = newH264Assembler(track, video.fmtp["sprop-parameter-sets"])
+	}
+	if audio != nil {
+		audio.channel = 2
+		track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "rtsp")
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, track)
+		if aac, err = newAACTranscoder(track, audio.fmtp); err != nil {
+			return err
+		}
+		defer aac.close()
+	}
+	for _, m := range []*rtspMedia{video, audio} {
+		if m == nil {
+			continue
+		}
+		if err := client.setup(m); err != nil {
+			return err
+		}
+	}
+
+	publisher, session, err := s.connectPublisher(tracks...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := publisher.Close(); err != nil {
+			fmt.Println("Error closing pulling peer connection:", err)
+		}
+		if err := session.Close(); err != nil {
+			fmt.Println("Error closing peer connection:", err)
+		}
+	}()
+	session.mu.Lock()
+	session.userAgent = "RTSP " + client.url.String()
+	session.mu.Unlock()
+	fmt.Printf("Pulling %s as session %s\n", client.url, session.ID())
+
+	if err := client.play(); err != nil {
+		return err
+	}
+	for {
+		channel, data, err := client.readPacket()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-session.Done():
+			return errRTSPSessionEnded
+		default:
+		}
+
+		switch {
+		case h264 != nil && channel == video.channel:
+			err = h264.write(data)
+		case aac != nil && channel == audio.channel:
+			err = aac.write(data)
+		}
+		if err != nil {
+			fmt.Printf("Error pulling %s: %v\n", client.url, err)
+		}
+	}
+}
+
+// h264Assembler depacketizes H.264 into access units written to a track,
+// with the parameter sets of the SDP ahead of IDR pictures the camera sends
+// without them
+type h264Assembler struct {
+	track         *webrtc.TrackLocalStaticSample
+	depacketizer  codecs.H264Packet
+	parameterSets []byte // Annex B
+	frame         []byte
+	timestamp     uint32 // Of the frame being assembled
+	last          uint32 // Of the latest frame written
+	duration      time.Duration
+}
+
+func newH264Assembler(track *webrtc.TrackLocalStaticSample, spropParameterSets string) *h264Assembler {
+	a := &h264Assembler{track: track, duration: time.Second / 30}
+	for _, set := range strings.Split(spropParameterSets, ",") {
+		if nalu, err := base64.StdEncoding.DecodeString(set); err == nil && len(nalu) > 0 {
+			a.parameterSets = append(append(a.parameterSets, 0, 0, 0, 1), nalu...)
+		}
+	}
+	return a
+}
+
+func (a *h264Assembler) write(data []byte) error {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(data); err != nil {
+		return err
+	}
+	if len(a.frame) > 0 && packet.Timestamp != a.timestamp {
+		// The marker of the previous frame was lost
+		if err := a.flush(); err != nil {
+			return err
+		}
+	}
+
+	nalus, err := a.depacketizer.Unmarshal(packet.Payload)
+	if err != nil {
+		return err
+	}
+	a.frame = append(a.frame, nalus...)
+	a.timestamp = packet.Timestamp
+	if packet.Marker {
+		return a.flush()
+	}
+	return nil
+}
+
+func (a *h264Assembler) flush() error {
+	frame := a.frame
+	a.frame = nil
+	if len(frame) == 0 {
+		return nil
+	}
+
+	// Frames last as long as the previous one did, the next isn't known yet
+	if a.last != 0 {
+		if delta := a.timestamp - a.last; delta > 0 && delta < 90000 {
+			a.duration = time.Duration(delta) * time.Second / 90000
+		}
+	}
+	a.last = a.timestamp
+
+	if h264Keyframe(frame) && !h264HasSPS(frame) {
+		frame = append(append([]byte{}, a.parameterSets...), frame...)
+	}
+	return a.track.WriteSample(media.Sample{Data: frame, Duration: a.duration})
+}
+
+// Whether an H.264 access unit in Annex B carries its SPS
+func h264HasSPS(au []byte) bool {
+	for _, nalu := range splitAnnexB(au) {
+		if nalu[0]&0x1f == h264NALSPS {
+			return true
+		}
+	}
+	return false
+}
+
+// aacTranscoder depacketizes AAC (RFC 3640 mpeg4-generic) into ADTS frames
+// for an FFmpeg encoding them to Opus, whose packets are written to a track
+type aacTranscoder struct {
+	track       *webrtc.TrackLocalStaticSample
+	sizeLength  int // Of the AU headers, in bits
+	indexLength int
+	adts        [4]byte // Fixed leading bytes of the ADTS header, without the frame length
+	encoder     *exec.Cmd
+	stdin       io.WriteCloser
+	done        chan struct{} // Closed once the encoder output was read
+}
+
+func newAACTranscoder(track *webrtc.TrackLocalStaticSample, fmtp map[string]string) (*aacTranscoder, error) {
+	// AudioSpecificConfig: object type, sampling frequency index and channels
+	config, err := hex.DecodeString(fmtp["config"])
+	if err != nil || len(config) < 2 {
+		return nil, fmt.Errorf("invalid AAC config %q", fmtp["config"])
+	}
+	objectType := config[0] >> 3
+	rateIndex := (config[0]&0x7)<<1 | config[1]>>7
+	channels := (config[1] >> 3) & 0xf
+
+	t := &aacTranscoder{track: track, sizeLength: 13, indexLength: 3, done: make(chan struct{})}
+	if n, err := strconv.Atoi(fmtp["sizelength"]); err == nil {
+		t.sizeLength = n
+	}
+	if n, err := strconv.Atoi(fmtp["indexlength"]); err == nil {
+		t.indexLength = n
+	}
+	t.adts = [4]byte{0xff, 0xf1, (objectType-1)<<6 | rateIndex<<2 | channels>>2, (channels & 0x3) << 6}
+
+	t.encoder = exec.Command("ffmpeg",
+		"-f", "aac",
+		"-i", "pipe:0",
+		"-c:a", "libopus",
+		"-ar", "48000",
+		"-f", "ogg",
+		"-page_duration", "20000",
+		"-flush_packets", "1",
+		"pipe:1",
+	)
+	t.encoder.Stderr = os.Stderr
+	isolateProcess(t.encoder)
+	if t.stdin, err = t.encoder.StdinPipe(); err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+	}
+	stdout, err := t.encoder.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	if err = t.encoder.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(t.done)
+		err := readOggPackets(bufio.NewReader(stdout), func(packet []byte) error {
+			if strings.HasPrefix(string(packet), "OpusHead") || strings.HasPrefix(string(packet), "OpusTags") {
+				return nil
+			}
+			return track.WriteSample(media.Sample{Data: packet, Duration: opusDuration(packet)})
+		})
+		if err != nil && !errors.Is(err, io.EOF) {
+			fmt.Println("Error reading AAC transcoder:", err)
+		}
+	}()
+	return t, nil
+}
+
+// Write the access units of an RTP packet to the encoder as ADTS frames
+func (t *aacTranscoder) write(data []byte) error {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(data); err != nil {
+		return err
+	}
+	payload := packet.Payload
+	if len(payload) < 2 {
+		return errors.New("short AAC payload")
+	}
+	headerBits := int(binary.BigEndian.Uint16(payload))
+	headerBytes := (headerBits + 7) / 8
+	if len(payload) < 2+headerBytes || t.sizeLength+t.indexLength == 0 {
+		return errors.New("short AAC payload")
+	}
+
+	headers := &bitReader{data: payload[2 : 2+headerBytes]}
+	units := payload[2+headerBytes:]
+	for i := 0; i < headerBits/(t.sizeLength+t.indexLength); i++ {
+		size := headers.bits(t.sizeLength)
+		headers.bits(t.indexLength)
+		if headers.err != nil || size > len(units) {
+			return errors.New("truncated AAC access unit")
+		}
+
+		length := size + 7
+		frame := append(t.adts[:3:3], t.adts[3]|byte(length>>11), byte(length>>3), byte(length&0x7)<<5|0x1f, 0xfc)
+		if _, err := t.stdin.Write(append(frame, units[:size]...)); err != nil {
+			return err
+		}
+		units = units[size:]
+	}
+	return nil
+}
+
+func (t *aacTranscoder) close() {
+	t.stdin.Close()
+	<-t.done
+	t.encoder.Wait() //nolint:errcheck
+}
+
+// Read the packets of an Ogg stream, joining the segments of each page
+// until one shorter than 255 bytes ends a packet
+func readOggPackets(r io.Reader, packet func([]byte) error) error {
+	header := make([]byte, 27)
+	var pending []byte
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		if string(header[:4]) != "OggS" {
+			return errors.New("invalid Ogg page")
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(r, segments); err != nil {
+			return err
+		}
+		for _, size := range segments {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			pending = append(pending, data...)
+			if size < 255 {
+				if err := packet(pending); err != nil {
+					return err
+				}
+				pending = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// File scheduled sessions are kept in across restarts
+const scheduleFile = "schedule.json"
+
+var errOutsideSchedule = errors.New("outside the session's schedule")
+
+// scheduledSession is a session created ahead of time. Its publisher may
+// first connect from the start until the window closes, and reconnect until
+// the end, when the session is ended and its recording finalized.
+type scheduledSession struct {
+	ID        string    `json:"id"` // Prefixed with the tenant if any
+	Start     time.Time `json:"start"`
+	Closes    time.Time `json:"closes"` // Of the window publishers may first connect in
+	End       time.Time `json:"end"`
+	Connected bool      `json:"connected"`
+}
+
+// sessionSchedule holds the scheduled sessions by ID. Sessions that aren't
+// scheduled can be published any time.
+type sessionSchedule struct {
+	mu       sync.Mutex
+	sessions map[string]*scheduledSession
+}
+
+func loadSchedule() (*sessionSchedule, error) {
+	s := &sessionSchedule{sessions: map[string]*scheduledSession{}}
+
+	data, err := os.ReadFile(scheduleFile)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sessions []*scheduledSession
+	if err = json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", scheduleFile, err)
+	}
+	for _, session := range sessions {
+		s.sessions[session.ID] = session
+	}
+	return s, nil
+}
+
+// admit checks a session may be published now, returning its scheduled end,
+// zero if it isn't scheduled
+func (s *sessionSchedule) admit(id string, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := s.sessions[id]
+	switch {
+	case session == nil:
+		return time.Time{}, nil
+	case now.Before(session.Start):
+		return time.Time{}, fmt.Errorf("%w: session %s starts at %s", errOutsideSchedule, id, session.Start.Format(time.RFC3339))
+	case !now.Before(session.End):
+		return time.Time{}, fmt.Errorf("%w: session %s ended at %s", errOutsideSchedule, id, session.End.Format(time.RFC3339))
+	case !session.Connected && now.After(session.Closes):
+		return time.Time{}, fmt.Errorf("%w: the window to start session %s closed at %s", errOutsideSchedule, id, session.Closes.Format(time.RFC3339))
+	}
+
+	return session.End, nil
+}
+
+// Note a scheduled session started, after which its start window no longer
+// applies
+func (s *sessionSchedule) connected(id string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session := s.sessions[id]; session != nil && !session.Connected {
+		session.Connected = true
+		s.save(now)
+	}
+}
+
+// Persist the sessions that haven't ended yet, called with the lock held
+func (s *sessionSchedule) save(now time.Time) {
+	sessions := []*scheduledSession{}
+	for id, session := range s.sessions {
+		if !now.Before(session.End) {
+			delete(s.sessions, id)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Start.Before(sessions[j].Start) })
+
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(scheduleFile, data)
+	}
+	if err != nil {
+		fmt.Println("Error saving session schedule:", err)
+	}
+}
+
+// List the scheduled sessions that haven't ended, by start
+func (s *sessionSchedule) serveList(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	now := time.Now()
+	sessions := []*scheduledSession{}
+	for _, session := range s.sessions {
+		if now.Before(session.End) {
+			sessions = append(sessions, session)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Start.Before(sessions[j].Start) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions) //nolint:errcheck
+}
+
+// Schedule a session from a JSON object like {"id": "webinar", "tenant":
+// "acme", "start": "2026-10-20T15:00:00Z", "window": "15m", "ttl": "2h"}.
+// The window defaults to the whole session.
+func (s *sessionSchedule) serveCreate(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ID     string    `json:"id"`
+		Tenant string    `json:"tenant"`
+		Start  time.Time `json:"start"`
+		Window string    `json:"window"`
+		TTL    string    `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid schedule", http.StatusBadRequest)
+		return
+	}
+	if !publishableSessionID(request.ID) || (request.Tenant != "" && !tenantPattern.MatchString(request.Tenant)) {
+		http.Error(w, "invalid session", http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(request.TTL)
+	if err != nil || ttl <= 0 || request.Start.IsZero() {
+		http.Error(w, "start and ttl are required", http.StatusBadRequest)
+		return
+	}
+	window := ttl
+	if request.Window != "" {
+		if window, err = time.ParseDuration(request.Window); err != nil || window <= 0 || window > ttl {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+	}
+
+	session := &scheduledSession{
+		ID:     tenantSessionID(request.Tenant, request.ID),
+		Start:  request.Start,
+		Closes: request.Start.Add(window),
+		End:    request.Start.Add(ttl),
+	}
+	now := time.Now()
+	if !now.Before(session.End) {
+		http.Error(w, "the session would have ended already", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	if existing := s.sessions[session.ID]; existing != nil && existing.Connected {
+		s.mu.Unlock()
+		http.Error(w, "session already started", http.StatusConflict)
+		return
+	}
+	s.sessions[session.ID] = session
+	s.save(now)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session) //nolint:errcheck
+}
+
+// Cancel a scheduled session, a live one keeps going until it ends
+func (s *sessionSchedule) serveDelete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("id")
+	if s.sessions[id] == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	delete(s.sessions, id)
+	s.save(time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
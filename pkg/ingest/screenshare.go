@@ -0,0 +1,60 @@
+package ingest
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// Content of a screen share's m-line (RFC 4796)
+const contentSlides = "slides"
+
+// Content the publisher labelled a video track's m-line with. A video track
+// arriving next to the camera without one is taken as a screen share too,
+// since browsers don't set a=content.
+func (s *Session) videoContent(mid string) string {
+	content := s.mediaAttribute(mid, "content")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if content != contentSlides && s.camera {
+		content = contentSlides
+	}
+	if content != contentSlides {
+		s.camera = true
+	}
+	return content
+}
+
+// FFmpeg input arguments of a screen share, decoded at the larger screen size
+func screenInputArgs(cfg *Config) []string {
+	return []string{"-f", "rawvideo", "-pix_fmt", "yuv420p", "-s", cfg.ScreenSize, "-r", strconv.Itoa(videoFrameRate)}
+}
+
+// FFmpeg arguments transcoding a screen share to the HLS segments
+// <name>_N.mp4, at a low frame rate tuned for still images and text
+func screenFFmpegArgs(cfg *Config, dir, name string) []string {
+	args := append([]string{}, screenInputArgs(cfg)...)
+	return append(args,
+		"-i", "pipe:0",
+		"-r", strconv.Itoa(cfg.ScreenFrameRate),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-tune", "stillimage",
+		"-f", "segment",
+		"-segment_time", "1",
+		"-segment_format", "mp4",
+		"-segment_format_options", "movflags=+frag_keyframe+empty_moov",
+		"-avoid_negative_ts", "make_zero",
+		"-segment_filename", filepath.Join(dir, name+"_%d.mp4"),
+	)
+}
+
+// Check the screen share options
+func validateScreen(cfg *Config) error {
+	if cfg.ScreenFrameRate <= 0 || cfg.ScreenFrameRate > videoFrameRate {
+		return fmt.Errorf("screen frame rate must be between 1 and %d", videoFrameRate)
+	}
+	_, _, err := parseFrameSize(cfg.ScreenSize)
+	return err
+}
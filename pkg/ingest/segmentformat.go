@@ -0,0 +1,92 @@
+package ingest
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Container of HLS segments written as MPEG-TS instead of fragmented MP4 or
+// Ogg, for legacy HLS players and broadcast contribution
+const segmentFormatTS = "ts"
+
+// Outputs whose segment container can be picked
+var segmentProfiles = []string{"audio", "video", "screen", "mix", "composite"}
+
+// Parse a segment container table like "video=ts,mix=ts", by output
+func parseSegmentFormats(spec string) (map[string]string, error) {
+	formats := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		profile, format, _ := strings.Cut(entry, "=")
+		profile, format = strings.TrimSpace(profile), strings.ToLower(strings.TrimSpace(format))
+		if !slices.Contains(segmentProfiles, profile) {
+			return nil, fmt.Errorf("unknown segment output %q", profile)
+		}
+		switch format {
+		case segmentFormatTS:
+			formats[profile] = format
+		case "mp4", "ogg", "":
+		default:
+			return nil, fmt.Errorf("invalid segment container %q", entry)
+		}
+	}
+
+	return formats, nil
+}
+
+// Output a track's segment container is picked by
+func (t *Track) segmentProfile() string {
+	if t.Content == contentSlides {
+		return "screen"
+	}
+	return t.Kind
+}
+
+// Rewrite the arguments of an FFmpeg segment output for a container, audio
+// is re-encoded to AAC for MPEG-TS since legacy players can't play Opus
+func withSegmentFormat(args []string, format string) []string {
+	if format != segmentFormatTS {
+		return args
+	}
+
+	audio := slices.Contains(args, "-c:a")
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-segment_format_options" && i+1 < len(args):
+			i++
+			continue
+		case i > 0 && args[i-1] == "-segment_format":
+			out = append(out, "mpegts")
+			continue
+		case i > 0 && args[i-1] == "-segment_filename":
+			out = append(out, segmentFilePattern(args[i], format, audio))
+			continue
+		case i > 0 && args[i-1] == "-c:a":
+			out = append(out, "aac")
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// Pattern of the segment files of a container, from the default one like
+// "<session>_%d.mp4". Audio MPEG-TS segments are named apart from the video
+// ones, as the primary tracks share the session's name.
+func segmentFilePattern(pattern, format string, audio bool) string {
+	if format != segmentFormatTS {
+		return pattern
+	}
+
+	base := strings.TrimSuffix(pattern, filepath.Ext(pattern))
+	if audio {
+		base = strings.TrimSuffix(base, "%d") + "audio_%d"
+	}
+	return base + ".ts"
+}
@@ -0,0 +1,439 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Server ingests the WebRTC sessions of publishers into HLS and the other
+// sinks tracks are routed to, and serves the output over HTTP
+type Server struct {
+	cfg    *Config
+	api    *webrtc.API
+	config webrtc.Configuration
+
+	control  *recordingControl
+	metrics  *metricRegistry
+	av       *avDrift
+	routes   *router
+	http     *httpServer
+	features *featureFlags
+	sessions *sessionRegistry
+	sfu      *sfuRelay
+	vod      *transcodeQueue
+	ice      *iceAgents
+	pool     *ffmpegPool
+	events   *eventBus
+
+	publishAuth *publishAuth
+	tenants     *tenants
+	cluster     *cluster           // Shared session registry, nil when running standalone
+	pins        fingerprintPins    // DTLS fingerprints publishers may use, nil for any
+	encryption  *segmentEncryption // Of live segments at rest, nil without
+	catalog     *recordingCatalog  // Of finalized sessions, nil without
+	schedule    *sessionSchedule
+
+	segmentFormats map[string]string   // Containers of HLS segments by output, see parseSegmentFormats
+	playlistTags   []string            // Of -playlist-tags, added to the playlists of tracks
+	audioFilters   map[string]string   // FFmpeg audio filter chains by output, see parseAudioFilters
+	maxSessionSize int64               // Of -max-session-size, 0 for no limit
+	cgroups        *ffmpegCgroups      // Limits the FFmpegs of each session, nil without
+	offerCodecs    map[string][]string // Media codecs offers must send one of, see acceptedCodecs
+
+	// Settings Reload replaces
+	reloadMu       sync.RWMutex
+	policies       policyTable        // By publisher, nil without -policy-file
+	outputTemplate *template.Template // Layout recordings are archived in, nil without -output-template
+	retention      *retentionEngine
+	encoder        Encoder
+
+	draining atomic.Bool   // New sessions are refused
+	drained  chan struct{} // Closed once draining finished
+}
+
+// NewServer sets up the WebRTC API and the pipeline shared by all sessions
+func NewServer(cfg *Config) (*Server, error) {
+	signer, err := newURLSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newAuthProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateTLS(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateScreen(cfg); err != nil {
+		return nil, err
+	}
+	if !validWritePolicy(cfg.WritePolicy) {
+		return nil, fmt.Errorf("unknown write policy %q", cfg.WritePolicy)
+	}
+	if cfg.WriteQueue <= 0 || cfg.WriteTimeout <= 0 {
+		return nil, errors.New("write queue and timeout must be positive")
+	}
+	if cfg.AudioBuffer <= 0 || cfg.AudioBatchSize <= 0 || cfg.AudioFlushInterval <= 0 {
+		return nil, errors.New("audio buffer, batch size and flush interval must be positive")
+	}
+	if cfg.RTCPRRInterval <= 0 {
+		return nil, errors.New("receiver report interval must be positive")
+	}
+	if cfg.PlaylistWindow <= 0 {
+		return nil, errors.New("playlist window must be positive")
+	}
+
+	if !validPriority(cfg.DefaultPriority) {
+		return nil, fmt.Errorf("unknown priority class %q", cfg.DefaultPriority)
+	}
+
+	features, err := newFeatureFlags(cfg.Features)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg:      cfg,
+		control:  newRecordingControl(""),
+		metrics:  newMetricRegistry(),
+		features: features,
+		sessions: newSessionRegistry(),
+		drained:  make(chan struct{}),
+	}
+	s.av = newAVDrift(s.metrics)
+	if s.events, err = newEventBus(cfg, s.metrics); err != nil {
+		return nil, err
+	}
+	if s.publishAuth, err = newPublishAuth(cfg); err != nil {
+		return nil, err
+	}
+	if s.policies, err = loadPolicies(cfg.PolicyFile); err != nil {
+		return nil, err
+	}
+	if s.cluster, err = newCluster(cfg, s.sessions); err != nil {
+		return nil, err
+	}
+	if s.outputTemplate, err = parseOutputTemplate(cfg.OutputTemplate); err != nil {
+		return nil, err
+	}
+	if s.schedule, err = loadSchedule(); err != nil {
+		return nil, err
+	}
+	s.tenants = &tenants{metrics: s.metrics}
+	if s.tenants.table, err = loadTenants(cfg.TenantsFile); err != nil {
+		return nil, err
+	}
+	playback, err := newPlaybackTokens(cfg)
+	if err != nil {
+		return nil, err
+	}
+	origins, err := newOriginPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Under CPU pressure best-effort sessions give way to broadcast ones
+	if cfg.CPUWatermark > 0 {
+		go newPriorityScheduler(cfg.CPUWatermark, s.sessions, s.metrics).run()
+	}
+
+	// Recordings of ended sessions are transcoded to VOD renditions
+	if s.vod, err = newTranscodeQueue(cfg, s.metrics); err != nil {
+		return nil, err
+	}
+
+	// Everything below is the Pion WebRTC API! Thanks for using it .
+
+	// FFmpeg processes of the Opus and VP8 pipelines are pre-started for
+	// every new session
+	s.pool = newFFmpegPool(cfg.FFmpegSpares)
+
+	// Intermediate files of sessions a crash ended are removed, once they
+	// can't be resumed anymore
+	sweepSessionDirs(resumableDirs(cfg.ResumeWindow))
+	if cfg.ResumeWindow > 0 {
+		time.AfterFunc(cfg.ResumeWindow, func() { sweepSessionDirs(resumableDirs(cfg.ResumeWindow)) })
+	}
+
+	// Create a MediaEngine object to configure the supported codec
+	m := &webrtc.MediaEngine{}
+	s.offerCodecs = acceptedCodecs(cfg)
+
+	// Setup the codecs you want to use.
+	// We'll use a VP8 and Opus but you can also define your own
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
+		PayloadType:        96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+	if cfg.H264 {
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+			PayloadType:        102,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.VideoFEC {
+		if err := registerVideoFEC(m); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AudioRED {
+		if err := registerRED(m); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: opusFmtp(cfg), RTCPFeedback: nil},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	// Telephony codecs are only offered when asked for, browsers never need them
+	if cfg.LegacyCodecs {
+		if err := registerLegacyCodecs(m); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DTMF {
+		if err := registerTelephoneEvents(m); err != nil {
+			return nil, err
+		}
+	}
+
+	// Audio levels drive the voice activity detection of the Opus pipeline
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	// Latency, bandwidth and orientation of the publisher's packets
+	if err := registerHeaderExtensions(m); err != nil {
+		return nil, err
+	}
+
+	// Policies cap the bitrate of publishers with REMB
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBGoogREMB}, webrtc.RTPCodecTypeVideo)
+
+	// Create a InterceptorRegistry. This is the user configurable RTP/RTCP Pipeline.
+	// This provides NACKs, RTCP Reports and other features. If you use `webrtc.NewPeerConnection`
+	// this is enabled by default. If you are manually managing You MUST create a InterceptorRegistry
+	// for each PeerConnection.
+	i := &interceptor.Registry{}
+
+	// Dumps see the packets as they arrived, ahead of the other interceptors
+	if cfg.RTPDumpDir != "" {
+		if err := os.MkdirAll(cfg.RTPDumpDir, 0o755); err != nil {
+			return nil, err
+		}
+		i.Add(&rtpDumpFactory{dir: cfg.RTPDumpDir})
+	}
+
+	// Register a intervalpli factory
+	// This interceptor sends a PLI every 3 seconds. A PLI causes a video keyframe to be generated by the sender.
+	// This makes our video seekable and more error resilent, but at a cost of lower picture quality and higher bitrates
+	// A real world application should process incoming RTCP packets from viewers and forward them to senders
+	intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	i.Add(intervalPliFactory)
+
+	// The default set of Interceptors, with Receiver Reports at
+	// -rtcp-rr instead of every second
+	if err = webrtc.ConfigureNack(m, i); err != nil {
+		return nil, err
+	}
+	receiverReports, err := report.NewReceiverInterceptor(report.ReceiverInterval(cfg.RTCPRRInterval))
+	if err != nil {
+		return nil, err
+	}
+	i.Add(receiverReports)
+	senderReports, err := report.NewSenderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	i.Add(senderReports)
+	if err = webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		return nil, err
+	}
+	if err = webrtc.ConfigureTWCCSender(m, i); err != nil {
+		return nil, err
+	}
+
+	// Prepare the configuration
+	servers, err := iceServers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.config = webrtc.Configuration{
+		ICEServers: servers,
+	}
+
+	// A persisted DTLS certificate keeps the fingerprint stable across restarts
+	if cfg.DTLSCertFile != "" {
+		cert, err := loadDTLSCertificate(cfg.DTLSCertFile)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprints, err := cert.GetFingerprints(); err == nil {
+			fmt.Println("DTLS fingerprint:", fingerprints[0].Algorithm, fingerprints[0].Value)
+		}
+		s.config.Certificates = []webrtc.Certificate{*cert}
+	}
+	s.pins = parseFingerprintPins(cfg.PinnedFingerprints)
+
+	// Create the API object with the MediaEngine, sharing one UDP socket
+	// between sessions when -ice-udp-port is set
+	if s.ice, err = newICEAgents(cfg, s.config, func(settings webrtc.SettingEngine) *webrtc.API {
+		return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settings))
+	}); err != nil {
+		return nil, err
+	}
+	s.api = s.ice.api
+
+	// Monitoring clients get a cheap preview over a data channel of their own
+	preview := newPreviewFeed(s.api, s.config, cfg.PreviewInterval)
+	if cfg.PreviewInterval > 0 {
+		go preview.run()
+	}
+
+	// Tracks are routed to the sinks configured for their kind or codec
+	relay := newWHEPRelay(s.api, s.config, s.metrics, cfg.Pacing)
+	if s.segmentFormats, err = parseSegmentFormats(cfg.SegmentFormats); err != nil {
+		return nil, err
+	}
+	if s.playlistTags, err = parsePlaylistTags(cfg.PlaylistTags); err != nil {
+		return nil, err
+	}
+	if cfg.Encoder == "gstreamer" {
+		// hlssink2 only writes MPEG-TS
+		for _, profile := range []string{"audio", "video", "screen"} {
+			s.segmentFormats[profile] = segmentFormatTS
+		}
+	}
+	if s.audioFilters, err = parseAudioFilters(cfg.AudioFilters); err != nil {
+		return nil, err
+	}
+	mixer := newAudioMixer(s.control, s.segmentFormats["mix"], s.audioFilters["mix"], cfg.PlaylistWindow, s.playlistTags)
+	compositor, err := newVideoCompositor(cfg, s.control, s.segmentFormats["composite"], s.playlistTags)
+	if err != nil {
+		return nil, err
+	}
+	s.encryption = newSegmentEncryption(cfg)
+	if s.catalog, err = newRecordingCatalog(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.MaxSessionSize != "" {
+		if s.maxSessionSize, err = parseByteSize(cfg.MaxSessionSize); err != nil {
+			return nil, fmt.Errorf("invalid -max-session-size: %v", err)
+		}
+	}
+	if cfg.FFmpegCPULimit > 0 || cfg.FFmpegMemoryLimit != "" {
+		var memory int64
+		if cfg.FFmpegMemoryLimit != "" {
+			if memory, err = parseByteSize(cfg.FFmpegMemoryLimit); err != nil {
+				return nil, fmt.Errorf("invalid -ffmpeg-memory-limit: %v", err)
+			}
+		}
+		if s.cgroups, err = newFFmpegCgroups(cfg.FFmpegCPULimit, memory); err != nil {
+			return nil, fmt.Errorf("FFmpeg limits unavailable: %v", err)
+		}
+	}
+	if s.retention, err = newRetentionEngine(cfg, s.events, s.catalog); err != nil {
+		return nil, err
+	}
+	if cfg.Retention != "" {
+		s.retention.start()
+	}
+	if s.encoder, err = newEncoder(cfg, s.pool); err != nil {
+		return nil, err
+	}
+	sinks := map[string]Sink{
+		"hls":       &hlsSink{encoder: s.encoder, encryption: s.encryption},
+		"webm":      newWebMSink(),
+		"rtmp":      rtmpSink(cfg.RTMPURL, s.encoder),
+		"whep":      relay,
+		"mix":       mixer,
+		"composite": compositor,
+		"cmaf":      &cmafSink{metrics: s.metrics},
+		"ivf":       ivfSink{},
+		"ogg":       newOggSink(),
+		"discard":   discardSink{},
+	}
+	for name, sink := range cfg.Sinks {
+		sinks[name] = sink
+	}
+	if s.routes, err = newRouter(cfg, sinks); err != nil {
+		return nil, err
+	}
+	s.routes.failed = func(t *Track, sink string, err error) {
+		s.metrics.add(fmt.Sprintf("ingest_sink_failures_total{sink=%q}", sink), 1)
+		t.control.reportError(errCodeSinkFailed, fmt.Sprintf("%s lost its %v, its other sinks continue", t.rendition(), err))
+	}
+
+	// With the sfu feature, tracks are also forwarded to WebRTC subscribers
+	s.sfu = newSFURelay(s.api, s.config, s.metrics, cfg.Pacing)
+
+	s.http = &httpServer{
+		signer:      signer,
+		preview:     preview,
+		relay:       relay,
+		mixer:       mixer,
+		compositor:  compositor,
+		sfu:         s.sfu,
+		metrics:     s.metrics,
+		features:    s.features,
+		sessions:    s.sessions,
+		auth:        auth,
+		publish:     s.publishAs,
+		publishAuth: s.publishAuth,
+		playback:    playback,
+		origins:     origins,
+		encryption:  s.encryption,
+		catalog:     s.catalog,
+		cluster:     s.cluster,
+		drain:       s.Drain,
+		draining:    s.draining.Load,
+		iceLinks:    iceServerLinks(s.config.ICEServers),
+		schedule:    s.schedule,
+	}
+	if s.cfg.MoQ {
+		s.http.moq = s.serveMoQ
+	}
+
+	return s, nil
+}
+
+// Handler serves the output, recording control, preview, WHEP and metrics
+// endpoints, for embedding into another HTTP server
+func (s *Server) Handler() http.Handler {
+	return s.http.handler()
+}
+
+// ListenAndServe serves Handler on the configured HTTP address
+func (s *Server) ListenAndServe() error {
+	server := &http.Server{Addr: s.cfg.HTTPAddr, Handler: s.Handler()}
+	if s.cfg.TLSCert == "" && s.cfg.ACMEDomains == "" {
+		fmt.Println("Serving HLS output on", s.cfg.HTTPAddr)
+		return server.ListenAndServe()
+	}
+
+	fmt.Println("Serving HLS output over HTTPS on", s.cfg.HTTPAddr)
+	return s.listenAndServeTLS(server)
+}
@@ -0,0 +1,772 @@
+package ingest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Session is the WebRTC connection of one publisher, receiving its audio
+// tracks and a video track, and optionally a screen share
+type Session struct {
+	id             string
+	tenant         string // Whose quotas the session counts against, empty without tenants
+	started        time.Time
+	server         *Server
+	peerConnection *webrtc.PeerConnection
+	guard          *sessionGuard
+	control        *recordingControl // Pauses the session's recording and talks to the publisher on its control channels
+	features       *featureFlags
+	startup        *startupTimer
+	outputs        sync.WaitGroup // Sink writers of the tracks not closed yet
+	dir            string         // Intermediate files, removed once the outputs were finalized
+	bandwidth      map[string]int // Bits per second the publisher is asked to send, by kind
+	processes      processGroup   // FFmpeg processes of the tracks
+	buffered       atomic.Int64   // Bytes of payloads queued ahead of the FFmpegs
+	network        *networkEstimator
+	link           *linkMonitor
+	resumeSegments map[string]int // Segment numbers a resumed session continues at, by file pattern
+	resumed        []time.Time    // When the session was resumed after crashes
+	parted         []string       // Recordings a crashed run left parts of
+
+	mu            sync.Mutex
+	priority      string
+	userAgent     string        // Of the publisher's WHIP client
+	transport     string        // udp, tcp or turn-*, once ICE connected
+	ends          time.Time     // Scheduled end, zero if the session isn't scheduled
+	archived      []string      // Links to the recordings in the -output-template layout
+	publisher     string        // Subject of the publish token, or the user ID announced without one
+	verified      bool          // The publisher is the subject of a verified publish token
+	publisherName string        // Display name of the publisher
+	retention     time.Duration // Replaces the age rule of -retention, if set
+	policy        Policy
+	tracks        []*trackReport  // Summarized in the metadata
+	dtmf          []dtmfDigit     // Received on any audio track
+	camera        bool            // A video track that isn't a screen share arrived
+	opened        []*Track        // Tracks routed to sinks, in the order they arrived
+	renditions    map[string]bool // Names taken by the tracks' outputs
+	audioTracks   int             // Audio tracks announced so far
+	ended         time.Time
+
+	done      chan struct{}
+	finished  chan struct{} // Closed once the outputs were finalized
+	closeOnce sync.Once
+}
+
+// NewSession creates the peer connection of a new publisher, to be answered
+// with Answer
+func (s *Server) NewSession() (*Session, error) {
+	return s.newOpenSession(publisherIdentity{})
+}
+
+// Session of a publisher that didn't present a publish token, with a random
+// ID prefixed with the slug of the user ID it announced, if any. The
+// announced identity isn't verified, so it doesn't pick the policy.
+func (s *Server) newOpenSession(identity publisherIdentity) (*Session, error) {
+	random := make([]byte, 8)
+	rand.Read(random) //nolint:errcheck
+	id := hex.EncodeToString(random)
+
+	session, err := s.newSession(id, "")
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	session.publisher, session.publisherName = identity.UserID, identity.Name
+	session.mu.Unlock()
+	session.SetPolicy(s.policy(""))
+	return session, nil
+}
+
+func (s *Server) newSession(id, tenant string) (_ *Session, err error) {
+	if s.draining.Load() {
+		return nil, errDraining
+	}
+
+	// Another node may already publish the session, it is free again if
+	// this one fails to start
+	if err = s.cluster.claim(id); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.cluster.release(id)
+		}
+	}()
+
+	// Create a new RTCPeerConnection
+	api, config := s.ice.publisher()
+	peerConnection, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow us to receive 1 audio track, and 1 video track
+	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		peerConnection.Close()
+		return nil, err
+	} else if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		peerConnection.Close()
+		return nil, err
+	}
+
+	// A session a crash interrupted continues in its directory if it's left
+	state := resumableState(id, s.cfg.ResumeWindow)
+	dir := ""
+	if state != nil {
+		dir = reclaimSessionDir(state.Dir)
+	}
+	if dir == "" {
+		if dir, err = newSessionDir(); err != nil {
+			peerConnection.Close()
+			return nil, err
+		}
+	}
+
+	session := &Session{
+		id:             id,
+		tenant:         tenant,
+		started:        time.Now(),
+		server:         s,
+		peerConnection: peerConnection,
+		features:       s.features.clone(),
+		startup:        newStartupTimer(s.metrics),
+		network:        newNetworkEstimator(s.metrics),
+		link:           newLinkMonitor(),
+		control:        newRecordingControl(dir),
+		dir:            dir,
+		bandwidth:      map[string]int{"audio": s.cfg.AudioBandwidth, "video": s.cfg.VideoBandwidth},
+		priority:       s.cfg.DefaultPriority,
+		done:           make(chan struct{}),
+		finished:       make(chan struct{}),
+	}
+	if state != nil {
+		session.resumeFrom(state)
+	}
+	if session.processes.cgroup, err = s.cgroups.create(id); err != nil {
+		fmt.Println("FFmpegs of session", id, "run without limits:", err)
+	}
+	session.features.onChange = session.writeMetadata
+	session.writeMetadata()
+	s.sessions.add(session)
+	s.events.emit(eventSessionStarted, session.id, nil)
+
+	// A panic in any stage only ends this session
+	session.guard = &sessionGuard{control: session.control, close: func() {
+		if closeErr := session.Close(); closeErr != nil {
+			fmt.Println("Error closing peer connection:", closeErr)
+		}
+	}}
+
+	session.guard.run("session state", session.persistState)
+	session.guard.run("session limits", session.enforceLimits)
+	session.guard.run("stall watchdog", session.watchStalls)
+	session.guard.run("link monitor", session.monitorLink)
+
+	// The encoders of this session's pipelines start while it is negotiated
+	if _, ok := s.encoder.(*ffmpegEncoder); ok {
+		go s.pool.warm(session.hlsArgs("audio"))
+		go s.pool.warm(session.hlsArgs("video"))
+	}
+
+	session.guard.run("startup timer", func() {
+		session.startup.watchPlaylist(filepath.Join(dir, id+".m3u8"), session.done)
+		select {
+		case <-session.done:
+		default:
+			s.events.emit(eventFirstSegment, session.id, nil)
+		}
+	})
+
+	// Set a handler for when a new remote track starts
+	peerConnection.OnTrack(session.handleTrack)
+
+	// Publishers can pause and resume the recording over a data channel, and
+	// are told about pipeline failures and their quality on it
+	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
+		defer session.guard.recover("data channel handler")
+		session.control.handleDataChannel(d)
+	})
+
+	// Set the handler for ICE connection state
+	// This will notify you when the peer has connected/disconnected
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+
+		if connectionState == webrtc.ICEConnectionStateConnected {
+			session.startup.mark(stageICEConnected)
+			session.recordTransport()
+			fmt.Println("Ctrl+C the remote client to stop the demo")
+		} else if connectionState == webrtc.ICEConnectionStateFailed || connectionState == webrtc.ICEConnectionStateClosed {
+			// Gracefully shutdown the peer connection
+			if closeErr := session.Close(); closeErr != nil {
+				fmt.Println("Error closing peer connection:", closeErr)
+			}
+		}
+	})
+
+	return session, nil
+}
+
+// Answer applies the publisher's offer and returns the answer, once ICE
+// gathering completed since there is no trickle ICE
+func (s *Session) Answer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	s.startup.start()
+
+	if err := validateOffer(offer, s.server.offerCodecs); err != nil {
+		return nil, err
+	}
+	if err := s.server.pins.check(offer); err != nil {
+		return nil, WithKind(ErrorSignaling, err)
+	}
+
+	// Set the remote SessionDescription
+	if err := s.peerConnection.SetRemoteDescription(offer); err != nil {
+		return nil, WithKind(ErrorSignaling, err)
+	}
+
+	// Create answer
+	answer, err := s.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return nil, WithKind(ErrorNegotiation, err)
+	}
+
+	// Create channel that is blocked until ICE Gathering is complete
+	gatherComplete := webrtc.GatheringCompletePromise(s.peerConnection)
+
+	// Sets the LocalDescription, and starts our UDP listeners
+	if err = s.peerConnection.SetLocalDescription(answer); err != nil {
+		return nil, WithKind(ErrorNegotiation, err)
+	}
+
+	// Block until ICE Gathering is complete, disabling trickle ICE
+	// we do this because we only can exchange one signaling message
+	// in a production application you should exchange ICE Candidates via OnICECandidate
+	<-gatherComplete
+
+	local := s.peerConnection.LocalDescription()
+	s.server.ice.learn(local)
+	limited, err := limitBandwidth(local, s.bandwidth)
+	if err == nil {
+		limited, err = limitVideoFormat(limited, s.currentPolicy())
+	}
+	return limited, WithKind(ErrorNegotiation, err)
+}
+
+// ID identifies the session in the HTTP API and its metadata
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Done is closed once the session ended
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait blocks until the session ended and its outputs were finalized
+func (s *Session) Wait() {
+	<-s.finished
+}
+
+// Close ends the session and the pipelines of its tracks
+func (s *Session) Close() error {
+	err := s.peerConnection.Close()
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.ended = time.Now()
+		s.mu.Unlock()
+		close(s.done)
+		s.writeMetadata()
+		s.server.events.emit(eventPublisherDisconnected, s.id, nil)
+		s.processes.shutdown(s.server.cfg.FFmpegShutdownTimeout)
+
+		// Recordings are only complete once every sink finalized its output
+		go func() {
+			s.outputs.Wait()
+			s.server.pool.release(s.hlsArgs("audio"))
+			s.server.pool.release(s.hlsArgs("video"))
+			s.mu.Lock()
+			opened := s.opened
+			s.mu.Unlock()
+			for _, t := range opened {
+				if t.hlsArgs != nil {
+					s.server.pool.release(t.hlsArgs)
+				}
+			}
+			s.joinRecordings()
+			s.rotateRecordings(opened)
+			archived := s.archiveRecordings(opened)
+			s.mu.Lock()
+			s.archived = archived
+			s.mu.Unlock()
+			s.server.sessions.remove(s.id)
+			s.server.cluster.release(s.id)
+			s.server.tenants.count(s.tenant, s.server.sessions)
+			s.processes.cgroup.remove()
+			if removeErr := os.RemoveAll(s.dir); removeErr != nil {
+				fmt.Println("Error removing session directory:", removeErr)
+			}
+			s.server.encryption.forget(s.id, s.dir)
+			s.server.metrics.forget(fmt.Sprintf("session=%q", s.id))
+			if removeErr := os.Remove(stateName(s.id)); removeErr != nil && !os.IsNotExist(removeErr) {
+				fmt.Println("Error removing session state:", removeErr)
+			}
+			close(s.finished)
+			s.writeMetadata()
+			s.mu.Lock()
+			publisher := s.publisher
+			if !s.verified {
+				publisher = ""
+			}
+			s.mu.Unlock()
+			if err := s.server.catalog.record(s.metadata(), publisher); err != nil {
+				fmt.Println("Error recording session in catalog:", err)
+			}
+			s.server.events.emit(eventRecordingFinalized, s.id, map[string]any{"recordings": s.recordings()})
+
+			s.server.vod.enqueue(s.id, s.primaryRecording("audio"), s.primaryRecording("video"))
+		}()
+	})
+	return err
+}
+
+// WebM recordings and passthrough archives the session left
+func (s *Session) recordings() []string {
+	s.mu.Lock()
+	opened := s.opened
+	s.mu.Unlock()
+
+	var names []string
+	for _, t := range opened {
+		for _, name := range []string{recordingName(s.id, t.rendition()), ivfName(s.id, t.rendition()), oggName(s.id, t.rendition())} {
+			if fileExists(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// WebM recording of the primary track of a kind, whether or not it exists
+func (s *Session) primaryRecording(kind string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.opened {
+		if t.primary && t.Kind == kind {
+			return recordingName(s.id, t.rendition())
+		}
+	}
+	return recordingName(s.id, kind)
+}
+
+// Arguments of the HLS pipeline FFmpeg of a track kind with Opus or VP8
+func (s *Session) hlsArgs(kind string) []string {
+	args := videoFFmpegArgs(s.server.cfg, s.dir, s.id)
+	if kind == "audio" {
+		args = withAudioFilter(audioFFmpegArgs(opusInputArgs, "copy", s.dir, s.id), s.server.audioFilters["audio"])
+	}
+	return continueSegments(withSegmentFormat(args, s.server.segmentFormats[kind]), s.resumeSegments)
+}
+
+// Metadata recorded for every session in session_<id>.json, next to its
+// recordings. It is rewritten as the session goes, the last time once the
+// outputs were finalized.
+type sessionMetadata struct {
+	ID        string             `json:"id"`
+	Tenant    string             `json:"tenant,omitempty"`
+	Started   time.Time          `json:"started"`
+	Ended     *time.Time         `json:"ended,omitempty"`
+	Features  map[string]bool    `json:"features"`
+	Priority  string             `json:"priority"`
+	UserAgent string             `json:"userAgent,omitempty"`
+	Tracks    []trackSummary     `json:"tracks"`
+	Outputs   []string           `json:"outputs"`             // Recordings, once finalized
+	Retention string             `json:"retention,omitempty"` // Of the session itself
+	Network   *networkSummary    `json:"network,omitempty"`
+	Link      *linkSummary       `json:"link,omitempty"`      // Round trip and packet loss as of the latest Receiver Report interval
+	Policy    *Policy            `json:"policy,omitempty"`    // Limits the publisher was held to
+	Resumed   []time.Time        `json:"resumed,omitempty"`   // When the publisher reconnected after crashes
+	Transport string             `json:"transport,omitempty"` // The ICE connection ended up on
+	Ends      *time.Time         `json:"ends,omitempty"`      // Scheduled end
+	Publisher *publisherIdentity `json:"publisher,omitempty"`
+	Archive   []string           `json:"archive,omitempty"` // Links to the recordings in the -output-template layout
+	DTMF      []dtmfDigit        `json:"dtmf,omitempty"`    // Digits received from a telephony gateway
+	Resources resourceUsage      `json:"resources"`
+}
+
+func (s *Session) metadata() sessionMetadata {
+	metadata := sessionMetadata{ID: s.id, Tenant: s.tenant, Started: s.started, Features: s.features.snapshot(), Priority: s.priorityClass(), Tracks: []trackSummary{}, Outputs: []string{}, Resumed: s.resumed}
+	s.mu.Lock()
+	if !s.ended.IsZero() {
+		ended := s.ended
+		metadata.Ended = &ended
+	}
+	metadata.UserAgent = s.userAgent
+	metadata.Transport = s.transport
+	metadata.Archive = s.archived
+	metadata.DTMF = s.dtmf
+	if s.publisher != "" || s.publisherName != "" {
+		metadata.Publisher = &publisherIdentity{UserID: s.publisher, Name: s.publisherName, Verified: s.verified}
+	}
+	if !s.ends.IsZero() {
+		ends := s.ends
+		metadata.Ends = &ends
+	}
+	if s.retention > 0 {
+		metadata.Retention = s.retention.String()
+	}
+	if s.policy.limited() {
+		policy := s.policy
+		metadata.Policy = &policy
+	}
+	tracks := s.tracks
+	s.mu.Unlock()
+	metadata.Network = s.network.snapshot()
+	metadata.Link = s.link.summary(false)
+	metadata.Resources = s.resourceUsage()
+
+	for _, track := range tracks {
+		metadata.Tracks = append(metadata.Tracks, track.summary())
+	}
+	select {
+	case <-s.finished:
+		metadata.Outputs = append(metadata.Outputs, s.recordings()...)
+	default:
+	}
+	return metadata
+}
+
+func (s *Session) writeMetadata() {
+	metadata := s.metadata()
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(fmt.Sprintf("session_%s.json", s.id), data)
+	}
+	if err != nil {
+		fmt.Println("Error writing session metadata:", err)
+	}
+}
+
+// sessionRegistry tracks the live sessions by ID
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: map[string]*Session{}}
+}
+
+func (r *sessionRegistry) add(s *Session) {
+	r.mu.Lock()
+	r.sessions[s.id] = s
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) remove(id string) {
+	r.mu.Lock()
+	delete(r.sessions, id)
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) get(id string) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.sessions[id]
+}
+
+// Directories of the sessions that may still write intermediate files
+func (r *sessionRegistry) list() []*Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// Feature flags of the session in the request path
+func (r *sessionRegistry) serveFeatures(w http.ResponseWriter, req *http.Request) {
+	session := r.get(req.PathValue("id"))
+	if session == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	if req.Method == http.MethodPatch {
+		session.features.servePatch(w, req)
+	} else {
+		session.features.serveGet(w, req)
+	}
+}
+
+func (s *Session) handleTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	defer s.guard.recover("track handler")
+
+	// Tracks are only announced once their first packet arrived
+	s.startup.mark(stageFirstRTP)
+
+	cfg, control := s.server.cfg, s.control
+	codec := track.Codec()
+
+	// RED tracks carry Opus or VP8 with its FEC, unwrapped ahead of the
+	// pipelines
+	red := strings.EqualFold(codec.MimeType, mimeTypeRED)
+	videoRED := strings.EqualFold(codec.MimeType, mimeTypeVideoRED)
+	if red || videoRED {
+		primary, ok := negotiatedCodec(receiver, webrtc.MimeTypeOpus)
+		if videoRED {
+			primary, ok = negotiatedCodec(receiver, webrtc.MimeTypeVP8)
+		}
+		if !ok {
+			fmt.Printf("Got %s track without its primary codec, ignoring it\n", codec.MimeType)
+			return
+		}
+		codec = primary
+	}
+
+	if strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+		t := &Track{Session: s.id, Dir: s.dir, processes: &s.processes, control: s.control, events: s.server.events, Kind: "audio", Codec: codec}
+		t.Channels = opusChannels(cfg, codec)
+		t.InputArgs = opusTrackInputArgs(t.Channels)
+		name, label, primary := s.nextAudio()
+		t.Name, t.primary = name, primary
+		s.identify(t, track, receiver, label)
+		fmt.Printf("Got Opus track %q, starting ultra-low-latency stream\n", t.Label)
+
+		handler := newStreamHandler(cfg.AudioBuffer, control, s.server.metrics)
+		handler.ring.buffered = &s.buffered
+		handler.writeThrough = cfg.AudioWriteThrough
+		handler.batchSize = cfg.AudioBatchSize
+		handler.flushInterval = cfg.AudioFlushInterval
+		handler.batcher = newAdaptiveBatcher(cfg.AudioLatencyTarget, cfg.AudioBatchSize, cfg.AudioFlushInterval)
+		handler.processors = s.reportTrack(t, cfg.AudioProcessors)
+		handler.vad = newVoiceDetector(headerExtensionID(receiver, sdp.AudioLevelURI), cfg)
+		handler.silences = func(intervals []silenceInterval) { s.recordSilences(t, intervals) }
+		handler.clock = newWallClock(codec.ClockRate)
+		handler.latency = newLatencyTracker(s.id, t, handler.clock, s.server.metrics)
+		handler.drift = newDriftTracker(t.rendition(), handler.clock, cfg, s.server.av)
+		handler.gaps = newGapDetector(t.rendition(), codec.ClockRate, cfg, s.server.metrics, control)
+		handler.headers = s.newHeaderReader(t, receiver)
+		handler.opus = newOpusConcealer(t.rendition(), codec.ClockRate, cfg, s.server.metrics)
+		handler.dtmf = s.newDTMFReceiver(t, receiver)
+		handler.end = s.newTrackEnd(t, track)
+		handler.link = s.link
+		if red {
+			handler.red = newREDDecoder(t.rendition(), s.server.metrics)
+		}
+
+		t.Done = handler.done
+		stdin, err := s.openTrack(t)
+		if err != nil {
+			fmt.Println("Failed to start FFmpeg:", err)
+			control.reportError(errCodeFFmpegStart, err.Error())
+			return
+		}
+		handler.ffmpegStdin = stdin
+
+		// Captions are written for the first audio track only
+		if backend := newTranscriber(cfg); backend != nil && t.primary {
+			captions := newCaptionWriter(backend, cfg, t)
+			if err := captions.start(t.InputArgs); err != nil {
+				fmt.Println("Failed to start captions:", err)
+			} else {
+				handler.taps = append(handler.taps, captions)
+			}
+		}
+
+		s.forwardAudio(track, t, handler)
+		s.reportXR(track, &handler.processors, handler.done)
+		startAudioPipeline(s.done, receiver, handler, s.newPlaylist(t), t, s.guard)
+	} else if legacy := findLegacyCodec(codec.MimeType); legacy != nil {
+		t := &Track{Session: s.id, Dir: s.dir, processes: &s.processes, control: s.control, events: s.server.events, Kind: "audio", Codec: codec, InputArgs: legacy.inputArgs}
+		name, label, primary := s.nextAudio()
+		t.Name, t.primary = name, primary
+		s.identify(t, track, receiver, label)
+		fmt.Printf("Got %s track %q, transcoding to Opus\n", codec.MimeType, t.Label)
+
+		handler := newStreamHandler(cfg.AudioBuffer, control, s.server.metrics)
+		handler.ring.buffered = &s.buffered
+		handler.writeThrough = cfg.AudioWriteThrough
+		handler.batchSize = cfg.AudioBatchSize
+		handler.flushInterval = cfg.AudioFlushInterval
+		handler.batcher = newAdaptiveBatcher(cfg.AudioLatencyTarget, cfg.AudioBatchSize, cfg.AudioFlushInterval)
+		handler.processors = s.reportTrack(t, cfg.AudioProcessors)
+		handler.headers = s.newHeaderReader(t, receiver)
+		handler.clock = newWallClock(codec.ClockRate)
+		handler.latency = newLatencyTracker(s.id, t, handler.clock, s.server.metrics)
+		handler.dtmf = s.newDTMFReceiver(t, receiver)
+		handler.end = s.newTrackEnd(t, track)
+		handler.link = s.link
+
+		t.Done = handler.done
+		stdin, err := s.openTrack(t)
+		if err != nil {
+			fmt.Println("Failed to start FFmpeg:", err)
+			control.reportError(errCodeFFmpegStart, err.Error())
+			return
+		}
+		handler.ffmpegStdin = stdin
+
+		if legacy.header != nil {
+			if _, err := handler.ffmpegStdin.Write(legacy.header(codec.SDPFmtpLine)); err != nil {
+				fmt.Println("Error writing to FFmpeg:", err)
+				// Closes the track's outputs, which the session waits for
+				handler.finish()
+				return
+			}
+		}
+
+		s.forwardAudio(track, t, handler)
+		s.reportXR(track, &handler.processors, handler.done)
+		startAudioPipeline(s.done, receiver, handler, s.newPlaylist(t), t, s.guard)
+	} else if strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) || strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
+		content := s.videoContent(s.trackMID(receiver))
+		t := &Track{Session: s.id, Dir: s.dir, processes: &s.processes, control: s.control, events: s.server.events, Kind: "video", Codec: codec, InputArgs: videoInputArgs, Content: content}
+		if content == contentSlides {
+			t.InputArgs = screenInputArgs(cfg)
+			s.identify(t, track, receiver, "Screen share")
+			fmt.Printf("Got %s screen share track %q, streaming directly to its sinks\n", codec.MimeType, t.Label)
+		} else {
+			t.primary = true
+			s.identify(t, track, receiver, "Camera")
+			fmt.Printf("Got %s track %q, streaming directly to its sinks\n", codec.MimeType, t.Label)
+		}
+
+		trackEnded := make(chan struct{})
+		t.Done = trackEnded
+		ffmpegStdin, err := s.openTrack(t)
+		if err != nil {
+			fmt.Println("Failed to start FFmpeg:", err)
+			control.reportError(errCodeFFmpegStart, err.Error())
+			return
+		}
+
+		stopped := make(chan struct{})
+		if content != contentSlides {
+			s.guard.run("thumbnail track", func() { writeThumbnailTrack(cfg, s.dir, stopped) })
+		}
+
+		video := &videoWriter{writer: ffmpegStdin, control: control, startup: s.startup, processors: s.reportTrack(t, s.policyProcessors(t)), headers: s.newHeaderReader(t, receiver)}
+		clock := newWallClock(codec.ClockRate)
+		video.latency = newLatencyTracker(s.id, t, clock, s.server.metrics)
+		end := s.newTrackEnd(t, track)
+		s.guard.run(t.rendition()+" RTCP reader", func() { readRTCP(receiver, clock, end.bye, s.link.receive) })
+		playlist := s.newPlaylist(t)
+		s.guard.run(t.rendition()+" playlist", func() {
+			playlist.watch(video.lastTimestamp.Load, clock, video.latency.segment, stopped)
+		})
+
+		// The relay forwards one track per kind, the camera's
+		if s.features.enabled(featureSFU) && t.primary {
+			forward := s.server.sfu.publish(track, s.peerConnection)
+			defer forward.unpublish()
+			video.processors = append(video.processors, forward)
+		}
+
+		if videoRED {
+			video.fec = newFECDecoder(receiver, t.rendition(), s.server.metrics)
+		}
+		video.depacketizer = &codecs.VP8Packet{}
+		if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
+			video.depacketizer = &codecs.H264Packet{}
+		}
+		s.reportXR(track, &video.processors, stopped)
+		video.drift = newDriftTracker(t.rendition(), clock, cfg, s.server.av)
+		video.gaps = newGapDetector(t.rendition(), codec.ClockRate, cfg, s.server.metrics, control)
+		if err := video.saveToDisk(end); err == nil {
+			close(trackEnded)
+		}
+		ffmpegStdin.Close()
+		close(stopped)
+	}
+}
+
+// Open the sinks a track is routed to behind a write queue, the session
+// counting it until the returned writer is closed
+func (s *Session) openTrack(t *Track) (io.WriteCloser, error) {
+	t.resumeSegments = s.resumeSegments
+	t.segmentFormat = s.server.segmentFormats[t.segmentProfile()]
+	if t.Kind == "audio" {
+		t.audioFilter = s.server.audioFilters["audio"]
+	}
+	w, err := s.server.routes.Open(t)
+	if err != nil {
+		return nil, WithKind(ErrorPipeline, err)
+	}
+
+	s.mu.Lock()
+	s.opened = append(s.opened, t)
+	s.mu.Unlock()
+	if t.Kind == "audio" {
+		s.writeAudioGroup()
+	}
+
+	s.outputs.Add(1)
+	queue := newWriteQueue(w, t.Kind, s.server.cfg, s.server.metrics, s.control)
+	queue.buffered = &s.buffered
+	return &trackOutput{WriteCloser: queue, done: s.outputs.Done}, nil
+}
+
+type trackOutput struct {
+	io.WriteCloser
+	done      func()
+	closeOnce sync.Once
+}
+
+func (o *trackOutput) Close() error {
+	err := o.WriteCloser.Close()
+	o.closeOnce.Do(o.done)
+	return err
+}
+
+// With -rtcp-xr, send the publisher Extended Reports on the packets of a
+// track that run through processors, until stopped
+func (s *Session) reportXR(track *webrtc.TrackRemote, processors *[]PacketProcessor, stop <-chan struct{}) {
+	interval := s.server.cfg.RTCPXRInterval
+	if interval <= 0 {
+		return
+	}
+
+	xr := newXRReporter(uint32(track.SSRC()))
+	*processors = append(slices.Clip(*processors), xr)
+	s.guard.run(track.Kind().String()+" XR reporter", func() { xr.run(s.peerConnection, interval, stop) })
+}
+
+// With the sfu feature, forward the first audio track to subscribers until
+// the session ends. The relay forwards one track per kind.
+func (s *Session) forwardAudio(track *webrtc.TrackRemote, t *Track, handler *streamHandler) {
+	if !s.features.enabled(featureSFU) || !t.primary {
+		return
+	}
+
+	forward := s.server.sfu.publish(track, s.peerConnection)
+	handler.processors = append(slices.Clip(handler.processors), forward)
+	s.guard.run("audio forwarder", func() {
+		<-handler.done
+		forward.unpublish()
+	})
+}
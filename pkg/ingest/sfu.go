@@ -0,0 +1,319 @@
+package ingest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Packets buffered per subscriber track before it counts as congested
+const sfuQueueSize = 256
+
+// Keyframe requests from subscribers are forwarded to the publisher at most
+// this often
+const sfuPLIInterval = 500 * time.Millisecond
+
+// sfuRelay forwards the RTP packets of published tracks, untouched, to
+// WebRTC subscribers. Unlike the whep sink nothing is repacketized, so
+// subscribers get the publisher's stream at the lowest possible latency.
+type sfuRelay struct {
+	api     *webrtc.API
+	config  webrtc.Configuration
+	metrics *metricRegistry
+	pacing  float64 // Multiple of the average bitrate video is paced at, 0 disables pacing
+
+	mu          sync.Mutex
+	tracks      map[string]*sfuTrack              // By kind
+	subscribers map[string]*webrtc.PeerConnection // By resource ID
+}
+
+func newSFURelay(api *webrtc.API, config webrtc.Configuration, metrics *metricRegistry, pacing float64) *sfuRelay {
+	return &sfuRelay{
+		api:         api,
+		config:      config,
+		metrics:     metrics,
+		pacing:      pacing,
+		tracks:      map[string]*sfuTrack{},
+		subscribers: map[string]*webrtc.PeerConnection{},
+	}
+}
+
+// sfuTrack is a published track and the subscriber tracks it is forwarded to
+type sfuTrack struct {
+	relay *sfuRelay
+	kind  string
+	codec webrtc.RTPCodecCapability
+	pli   func() // Asks the publisher for a keyframe
+
+	mu      sync.Mutex
+	outputs map[*sfuOutput]struct{}
+	lastPLI time.Time
+}
+
+// publish starts forwarding a track of a publisher. The returned track is a
+// PacketProcessor to be run on every packet of the track.
+func (r *sfuRelay) publish(remote *webrtc.TrackRemote, publisher *webrtc.PeerConnection) *sfuTrack {
+	t := &sfuTrack{
+		relay:   r,
+		kind:    remote.Kind().String(),
+		codec:   remote.Codec().RTPCodecCapability,
+		outputs: map[*sfuOutput]struct{}{},
+		pli: func() {
+			err := publisher.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())}})
+			if err != nil {
+				fmt.Println("Error forwarding keyframe request:", err)
+			}
+		},
+	}
+
+	r.mu.Lock()
+	r.tracks[t.kind] = t
+	r.mu.Unlock()
+
+	return t
+}
+
+// unpublish stops forwarding, subscribers keep their connection
+func (t *sfuTrack) unpublish() {
+	t.relay.mu.Lock()
+	if t.relay.tracks[t.kind] == t {
+		delete(t.relay.tracks, t.kind)
+	}
+	t.relay.mu.Unlock()
+
+	t.mu.Lock()
+	for output := range t.outputs {
+		close(output.queue)
+	}
+	t.outputs = map[*sfuOutput]struct{}{}
+	t.mu.Unlock()
+}
+
+// Process fans a packet out to the queues of the subscribers
+func (t *sfuTrack) Process(packet *rtp.Packet) (*rtp.Packet, error) {
+	keyframe := t.kind == "video" && isVP8Keyframe(packet.Payload)
+
+	t.mu.Lock()
+	for output := range t.outputs {
+		output.push(packet, keyframe)
+	}
+	t.mu.Unlock()
+
+	return packet, nil
+}
+
+// Aggregate the keyframe requests of all subscribers into one per interval
+func (t *sfuTrack) requestKeyframe() {
+	t.mu.Lock()
+	if time.Since(t.lastPLI) < sfuPLIInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.lastPLI = time.Now()
+	t.mu.Unlock()
+
+	t.pli()
+}
+
+// sfuOutput is a published track as sent to one subscriber. Each has a queue
+// of its own, so a congested subscriber only hurts itself: its packets are
+// dropped, and video resumes on the next keyframe.
+type sfuOutput struct {
+	source *sfuTrack
+	track  *webrtc.TrackLocalStaticRTP
+	queue  chan *rtp.Packet
+
+	waitKeyframe atomic.Bool
+}
+
+// Called with the source's lock held
+func (o *sfuOutput) push(packet *rtp.Packet, keyframe bool) {
+	if o.waitKeyframe.Load() {
+		if !keyframe {
+			o.drop()
+			return
+		}
+		o.waitKeyframe.Store(false)
+	}
+
+	select {
+	case o.queue <- packet.Clone():
+	default:
+		o.drop()
+		if o.source.kind == "video" {
+			// Frames missing packets can't be decoded, skip to a keyframe
+			o.waitKeyframe.Store(true)
+			go o.source.requestKeyframe()
+		}
+	}
+}
+
+func (o *sfuOutput) drop() {
+	o.source.relay.metrics.add(fmt.Sprintf("ingest_sfu_dropped_packets_total{kind=%q}", o.source.kind), 1)
+}
+
+func (o *sfuOutput) run() {
+	// Audio is sent as it comes, its packets are small and evenly spaced
+	var pacer *pacer
+	if o.source.kind == "video" {
+		pacer = newPacer(o.source.relay.pacing)
+	}
+
+	for packet := range o.queue {
+		if wait := pacer.delay(packet.MarshalSize(), time.Now()); wait > 0 {
+			o.source.relay.metrics.observe(`ingest_pacing_delay_seconds{relay="sfu"}`, wait.Seconds())
+			time.Sleep(wait)
+		}
+		if err := o.track.WriteRTP(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			fmt.Println("Error forwarding packet:", err)
+		}
+	}
+}
+
+// Read the RTCP of a subscriber, forwarding its keyframe requests
+func (o *sfuOutput) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				o.source.requestKeyframe()
+			}
+		}
+	}
+}
+
+// Answer the SDP offer of a subscriber with the published tracks
+func (r *sfuRelay) serveOffer(w http.ResponseWriter, req *http.Request) {
+	offer, err := io.ReadAll(req.Body)
+	if err != nil || len(offer) == 0 {
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	peerConnection, err := r.api.NewPeerConnection(r.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	r.mu.Lock()
+	var outputs []*sfuOutput
+	for _, source := range r.tracks {
+		track, trackErr := webrtc.NewTrackLocalStaticRTP(source.codec, source.kind, "sfu")
+		if trackErr != nil {
+			err = trackErr
+			break
+		}
+		sender, addErr := peerConnection.AddTrack(track)
+		if addErr != nil {
+			err = addErr
+			break
+		}
+
+		output := &sfuOutput{source: source, track: track, queue: make(chan *rtp.Packet, sfuQueueSize)}
+		output.waitKeyframe.Store(source.kind == "video")
+		outputs = append(outputs, output)
+		go output.readRTCP(sender)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id) //nolint:errcheck
+	resource := hex.EncodeToString(id)
+
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		switch s {
+		case webrtc.PeerConnectionStateConnected:
+			// Start forwarding once media can flow, beginning at a keyframe
+			for _, output := range outputs {
+				output.source.mu.Lock()
+				output.source.outputs[output] = struct{}{}
+				output.source.mu.Unlock()
+				go output.run()
+				if output.source.kind == "video" {
+					output.source.requestKeyframe()
+				}
+			}
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected:
+			peerConnection.Close()
+		case webrtc.PeerConnectionStateClosed:
+			for _, output := range outputs {
+				output.source.mu.Lock()
+				if _, ok := output.source.outputs[output]; ok {
+					delete(output.source.outputs, output)
+					close(output.queue)
+				}
+				output.source.mu.Unlock()
+			}
+
+			r.mu.Lock()
+			delete(r.subscribers, resource)
+			r.mu.Unlock()
+		}
+	})
+
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	<-gatherComplete
+
+	r.mu.Lock()
+	r.subscribers[resource] = peerConnection
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/sfu/"+resource)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, peerConnection.LocalDescription().SDP) //nolint:errcheck
+}
+
+// End the session of a subscriber
+func (r *sfuRelay) serveDelete(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	peerConnection := r.subscribers[req.PathValue("id")]
+	r.mu.Unlock()
+
+	if peerConnection == nil {
+		http.Error(w, "unknown subscriber", http.StatusNotFound)
+		return
+	}
+
+	peerConnection.Close()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,57 @@
+package ingest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// ListenSignalSocket serves the signaling endpoints on the Unix socket of
+// -signal-socket, for a control plane on the same host brokering offers and
+// answers without a TCP port, and returns right away without it. Who may
+// connect is up to the socket's permissions, readable and writable by the
+// server's user and group, so credential scopes aren't checked on it;
+// publish tokens still are, as they pick the session.
+func (s *Server) ListenSignalSocket() error {
+	path := s.cfg.SignalSocket
+	if path == "" {
+		return nil
+	}
+
+	// The socket of a previous run is in the way
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(path, 0o660); err != nil {
+		return err
+	}
+
+	fmt.Println("Serving signaling on", path)
+	return (&http.Server{Handler: s.http.signalingHandler()}).Serve(listener)
+}
+
+// The offer and answer endpoints of publishers and viewers, without scopes
+func (s *httpServer) signalingHandler() http.Handler {
+	local := *s
+	local.auth = nil
+	local.playback = nil
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /whip", local.serveWHIP)
+	mux.HandleFunc("DELETE /whip/{id}", local.cluster.redirect(idSession, local.serveWHIPDelete))
+	if local.moq != nil {
+		mux.HandleFunc("POST /moq", local.moq)
+	}
+	mux.HandleFunc("POST /whep", local.cluster.redirect(querySession, local.relay.serveOffer))
+	mux.HandleFunc("DELETE /whep/{id}", local.relay.serveDelete)
+	mux.HandleFunc("POST /sfu", local.sfu.serveOffer)
+	mux.HandleFunc("DELETE /sfu/{id}", local.sfu.serveDelete)
+	mux.HandleFunc("POST /preview", local.preview.serveOffer)
+	return mux
+}
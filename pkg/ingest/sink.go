@@ -0,0 +1,410 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Sink is a destination a track's media can be routed to
+type Sink interface {
+	// Open starts consuming a track, returning the writer its payloads
+	// (Opus packets, or whole video frames) are written to
+	Open(t *Track) (io.WriteCloser, error)
+}
+
+// Track describes a track to the sinks it is routed to
+type Track struct {
+	Kind      string // "audio" or "video"
+	Session   string // ID of the session the track belongs to
+	Codec     webrtc.RTPCodecParameters
+	InputArgs []string      // FFmpeg input arguments describing the payloads
+	Channels  int           // Of an audio track
+	Done      chan struct{} // Closed when the track ends on purpose
+	Dir       string        // For intermediate files, removed once the session ended
+	Content   string        // "slides" for a screen share, empty for the camera and audio
+	Name      string        // Rendition the track's outputs are named after, e.g. "audio2" or "mic"
+	Label     string        // Human-readable name of the track in playlists
+	MID       string        // Of the track's m-line
+	StreamID  string        // MediaStream ID and track ID of the track's msid
+	TrackID   string
+	Publisher string // Display name of the publisher, the title of its recordings
+
+	primary     bool              // First audio track or the camera, its HLS playlist is <session>.m3u8
+	processes   *processGroup     // FFmpeg processes of the session
+	control     *recordingControl // Of the session, its pipeline errors are reported to
+	events      *eventBus
+	orientation *videoOrientation // Of a video track, counted as its frames arrive
+
+	resumeSegments map[string]int // HLS segment numbers to continue at, of a resumed session
+	segmentFormat  string         // Container of the HLS segments, empty for the default
+	audioFilter    string         // FFmpeg filter chain of its HLS audio, see parseAudioFilters
+	hlsArgs        []string       // Of the HLS FFmpeg, whose spares are released once the session ends
+}
+
+// crashed reports the FFmpeg of a track exiting before the track ended
+func (t *Track) crashed(message string) {
+	if t.events != nil {
+		t.events.emit(eventFFmpegCrashed, t.Session, map[string]any{"kind": t.Kind, "message": message})
+	}
+}
+
+// Name of the codec used in routing tables, e.g. "opus" or "pcmu"
+func (t *Track) codecName() string {
+	_, name, _ := strings.Cut(t.Codec.MimeType, "/")
+	return strings.ToLower(name)
+}
+
+// Name of the track's outputs: its kind, "screen" for a screen share, or
+// the name it was given
+func (t *Track) rendition() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	if t.Content == contentSlides {
+		return "screen"
+	}
+	return t.Kind
+}
+
+// Base name of the track's HLS playlist and segments, the session ID for
+// the primary tracks
+func (t *Track) hlsName() string {
+	if t.primary {
+		return t.Session
+	}
+	return t.rendition()
+}
+
+// Audio encoder FFmpeg outputs need, Opus is passed through untouched
+func (t *Track) audioEncoder() string {
+	if t.codecName() == "opus" {
+		return "copy"
+	}
+	return "libopus"
+}
+
+// Parse a routing table like "audio=hls+webm,video=hls,pcmu=discard". Keys
+// are track kinds or codec names, the latter taking precedence.
+func parseRoutes(spec string) (map[string][]string, error) {
+	routes := map[string][]string{}
+	for _, route := range strings.Split(spec, ",") {
+		if strings.TrimSpace(route) == "" {
+			continue
+		}
+
+		key, sinks, ok := strings.Cut(route, "=")
+		if !ok || sinks == "" {
+			return nil, fmt.Errorf("invalid route %q", route)
+		}
+		routes[strings.ToLower(strings.TrimSpace(key))] = strings.Split(sinks, "+")
+	}
+
+	return routes, nil
+}
+
+// router opens the sinks a track is routed to
+type router struct {
+	routes     map[string][]string
+	sinks      map[string]Sink
+	durability map[string]string
+	failed     func(t *Track, sink string, err error) // Called once for a sink of a track that failed a write
+}
+
+func newRouter(cfg *Config, sinks map[string]Sink) (*router, error) {
+	routes, err := parseRoutes(cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, names := range routes {
+		for _, name := range names {
+			if sinks[name] == nil {
+				return nil, fmt.Errorf("unknown sink %q", name)
+			}
+			if name == "rtmp" && cfg.RTMPURL == "" {
+				return nil, errors.New("rtmp sink requires -rtmp-url")
+			}
+		}
+	}
+
+	durability, err := parseDurability(cfg.SinkDurability)
+	if err != nil {
+		return nil, err
+	}
+	for name, mode := range durability {
+		if _, ok := sinks[name].(fileSink); !ok && mode == durabilityFsync {
+			return nil, fmt.Errorf("sink %q writes no files to sync", name)
+		}
+	}
+
+	return &router{routes: routes, sinks: sinks, durability: durability}, nil
+}
+
+// Open starts every sink of a track, unrouted tracks go to HLS as before
+func (r *router) Open(t *Track) (io.WriteCloser, error) {
+	names, ok := r.routes[t.codecName()]
+	if !ok {
+		names, ok = r.routes[t.Kind]
+	}
+	if !ok {
+		names = []string{"hls"}
+	}
+
+	writers := &fanOut{}
+	if r.failed != nil {
+		writers.failed = func(sink string, err error) { r.failed(t, sink, err) }
+	}
+	for _, name := range names {
+		w, err := r.sinks[name].Open(t)
+		if err != nil {
+			writers.Close()
+			return nil, fmt.Errorf("failed to open %s sink: %v", name, err)
+		}
+		if files, ok := r.sinks[name].(fileSink); ok && r.durability[name] == durabilityFsync {
+			dir, pattern := files.files(t)
+			w = newSyncedOutput(w, dir, pattern)
+		}
+		writers.add(name, w)
+	}
+
+	return writers, nil
+}
+
+// fanOut writes every payload to all sinks of a track. A sink whose write
+// fails is closed and left out from then on, so e.g. a passthrough archive
+// keeps recording when the live transcode next to it crashed. Writes only
+// fail once every sink did.
+type fanOut struct {
+	names   []string
+	writers []io.WriteCloser // nil once failed
+	failed  func(sink string, err error)
+}
+
+func (f *fanOut) add(name string, w io.WriteCloser) {
+	f.names = append(f.names, name)
+	f.writers = append(f.writers, w)
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	var errs []error
+	written := false
+	for i, w := range f.writers {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			errs = append(errs, f.fail(i, err))
+			continue
+		}
+		written = true
+	}
+
+	if !written {
+		return 0, fmt.Errorf("every sink failed: %w", errors.Join(errs...))
+	}
+	return len(p), nil
+}
+
+func (f *fanOut) fail(i int, err error) error {
+	err = fmt.Errorf("%s sink: %v", f.names[i], err)
+	if len(f.writers) > 1 && f.failed != nil {
+		f.failed(f.names[i], err)
+	}
+	f.writers[i].Close() //nolint:errcheck
+	f.writers[i] = nil
+	return err
+}
+
+func (f *fanOut) Close() error {
+	var errs []error
+	for _, w := range f.writers {
+		if w != nil {
+			errs = append(errs, w.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// hlsSink is the encoder pipeline writing the HLS playlist and segments
+type hlsSink struct {
+	encoder    Encoder
+	encryption *segmentEncryption // Encrypts the segments at rest, if set
+}
+
+func (s *hlsSink) Open(t *Track) (io.WriteCloser, error) {
+	input, err := s.encoder.HLS(t)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.encryption != nil {
+		dir, pattern := s.files(t)
+		return s.encryption.output(input, t, dir, pattern)
+	}
+	return input, nil
+}
+
+// Arguments of the HLS pipeline FFmpeg of a track
+func hlsFFmpegArgs(cfg *Config, t *Track) []string {
+	args := videoFFmpegArgs(cfg, t.Dir, t.hlsName())
+	if t.Kind == "audio" {
+		args = withAudioFilter(audioFFmpegArgs(t.InputArgs, t.audioEncoder(), t.Dir, t.hlsName()), t.audioFilter)
+	} else if t.Content == contentSlides {
+		args = screenFFmpegArgs(cfg, t.Dir, t.hlsName())
+	}
+	return continueSegments(withSegmentFormat(args, t.segmentFormat), t.resumeSegments)
+}
+
+func (s *hlsSink) files(t *Track) (string, string) {
+	if t.Kind == "audio" {
+		return t.Dir, segmentFilePattern(t.hlsName()+"_%d.ogg", t.segmentFormat, true)
+	}
+	return t.Dir, segmentFilePattern(t.hlsName()+"_%d.mp4", t.segmentFormat, false)
+}
+
+// ffmpegSink feeds a track to an FFmpeg with the given outputs
+type ffmpegSink struct {
+	output func(t *Track) []string
+}
+
+func (s *ffmpegSink) Open(t *Track) (io.WriteCloser, error) {
+	args := append([]string{}, t.InputArgs...)
+	args = append(args, "-i", "pipe:0")
+
+	process, err := startFFmpegProcess(append(args, s.output(t)...))
+	if err != nil {
+		return nil, err
+	}
+
+	t.processes.add(process)
+	go watchFFmpeg(process, t.control, t.Done, t.crashed)
+	return ffmpegInput{process}, nil
+}
+
+// ffmpegInput is the stdin of an FFmpeg, closing it waits until FFmpeg
+// finalized its output
+type ffmpegInput struct {
+	process *ffmpegProcess
+}
+
+func (i ffmpegInput) Write(p []byte) (int, error) {
+	return i.process.stdin.Write(p)
+}
+
+func (i ffmpegInput) Close() error {
+	err := i.process.stdin.Close()
+	i.process.wait() //nolint:errcheck
+	return err
+}
+
+// webmSink records each track to a WebM file of its own
+type webmSink struct {
+	ffmpegSink
+}
+
+func newWebMSink() *webmSink {
+	return &webmSink{ffmpegSink{output: webmOutput}}
+}
+
+func (s *webmSink) files(t *Track) (string, string) {
+	return ".", recordingName(t.Session, t.rendition())
+}
+
+func webmOutput(t *Track) []string {
+	codec := []string{"-c:a", t.audioEncoder()}
+	if t.Kind == "video" {
+		codec = []string{"-c:v", "libvpx", "-deadline", "realtime"}
+	}
+
+	if t.Publisher != "" {
+		codec = append(codec, "-metadata", "title="+t.Publisher)
+	}
+	return append(codec, "-f", "webm", "-y", recordingName(t.Session, t.rendition()))
+}
+
+// WebM recording of a rendition of a session, its track kind or "screen"
+func recordingName(session, rendition string) string {
+	return fmt.Sprintf("recording_%s_%s.webm", session, rendition)
+}
+
+// oggSink archives each audio track to an Ogg file of its own, Opus passed
+// through without a transcode
+type oggSink struct {
+	ffmpegSink
+}
+
+func newOggSink() *oggSink {
+	return &oggSink{ffmpegSink{output: oggOutput}}
+}
+
+func (s *oggSink) Open(t *Track) (io.WriteCloser, error) {
+	if t.Kind != "audio" {
+		return nil, fmt.Errorf("ogg sink only archives audio, not %s", t.Kind)
+	}
+	return s.ffmpegSink.Open(t)
+}
+
+func (s *oggSink) files(t *Track) (string, string) {
+	return ".", oggName(t.Session, t.rendition())
+}
+
+func oggOutput(t *Track) []string {
+	return []string{"-c:a", t.audioEncoder(), "-f", "ogg", "-y", oggName(t.Session, t.rendition())}
+}
+
+// Ogg archive of an audio rendition of a session
+func oggName(session, rendition string) string {
+	return fmt.Sprintf("recording_%s_%s.ogg", session, rendition)
+}
+
+// rtmpSink pushes each track to its own URL with {kind}, or else a
+// session's audio and camera muxed into one stream by FFmpeg
+func rtmpSink(url string, encoder Encoder) Sink {
+	if strings.Contains(url, "{kind}") {
+		return &rtmpPush{encoder: encoder, url: url}
+	}
+	return newAVMux(rtmpMuxOutput(url))
+}
+
+// rtmpPush pushes each track through the encoder
+type rtmpPush struct {
+	encoder Encoder
+	url     string
+}
+
+func (s *rtmpPush) Open(t *Track) (io.WriteCloser, error) {
+	return s.encoder.RTMP(t, strings.ReplaceAll(s.url, "{kind}", t.rendition()))
+}
+
+// Pushes each track to an RTMP server, "{kind}" in the URL is replaced with
+// the track kind (or "screen") since tracks are pushed separately
+func rtmpOutput(url string) func(t *Track) []string {
+	return func(t *Track) []string {
+		codec := []string{"-c:a", "aac", "-ar", "44100"}
+		if t.Kind == "video" {
+			codec = []string{"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency"}
+		}
+
+		return append(codec, "-f", "flv", strings.ReplaceAll(url, "{kind}", t.rendition()))
+	}
+}
+
+// discardSink drops the media, e.g. to accept a track without recording it
+type discardSink struct{}
+
+func (discardSink) Open(*Track) (io.WriteCloser, error) {
+	return nopWriteCloser{io.Discard}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,121 @@
+package ingest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Startup stages of a session, timed from the offer
+const (
+	stageICEConnected  = "ice_connected"
+	stageFirstRTP      = "first_rtp"
+	stageFirstKeyframe = "first_keyframe"
+	stagePlayable      = "first_playable_segment"
+)
+
+// startupTimer measures how long a session takes from the publisher's offer
+// to each startup stage, so signaling and pipeline startup regressions show
+// up in the ingest_startup_seconds histogram
+type startupTimer struct {
+	metrics *metricRegistry
+
+	mu    sync.Mutex
+	offer time.Time
+	seen  map[string]bool
+}
+
+func newStartupTimer(metrics *metricRegistry) *startupTimer {
+	return &startupTimer{metrics: metrics, seen: map[string]bool{}}
+}
+
+// The offer was received, stages are timed from now on
+func (t *startupTimer) start() {
+	t.mu.Lock()
+	t.offer = time.Now()
+	t.mu.Unlock()
+}
+
+// mark records a stage the first time it is reached
+func (t *startupTimer) mark(stage string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.offer.IsZero() || t.seen[stage] {
+		return
+	}
+	t.seen[stage] = true
+
+	elapsed := time.Since(t.offer)
+	t.metrics.observe(fmt.Sprintf("ingest_startup_seconds{stage=%q}", stage), elapsed.Seconds())
+	fmt.Printf("Startup: %s after %s\n", stage, elapsed)
+}
+
+// Wait for the playlist to list a segment written since the offer
+func (t *startupTimer) watchPlaylist(playlist string, stop <-chan struct{}) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		offer := t.offer
+		t.mu.Unlock()
+
+		info, err := os.Stat(playlist)
+		if err != nil || offer.IsZero() || info.ModTime().Before(offer) {
+			continue
+		}
+		if data, err := os.ReadFile(playlist); err == nil && strings.Contains(string(data), "#EXTINF") {
+			t.mark(stagePlayable)
+			return
+		}
+	}
+}
+
+// Whether a VP8 RTP payload starts a keyframe (RFC 7741 section 4)
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	// Only the first packet of the first partition carries the frame header
+	start, partition := payload[0]&0x10 != 0, payload[0]&0x07
+	if !start || partition != 0 {
+		return false
+	}
+
+	offset := 1
+	if payload[0]&0x80 != 0 { // Extended control bits
+		if len(payload) < 2 {
+			return false
+		}
+		x := payload[1]
+		offset++
+		if x&0x80 != 0 { // PictureID
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+		if x&0x40 != 0 { // TL0PICIDX
+			offset++
+		}
+		if x&0x30 != 0 { // TID/KEYIDX
+			offset++
+		}
+	}
+
+	// Inverse key frame flag of the VP8 frame header
+	return len(payload) > offset && payload[offset]&0x01 == 0
+}
@@ -0,0 +1,86 @@
+package ingest
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const mimeTypeILBC = "audio/iLBC"
+
+// legacyCodec is a telephony codec accepted from gateways that bridge calls
+// into WebRTC. These are transcoded to Opus by FFmpeg.
+type legacyCodec struct {
+	params    webrtc.RTPCodecParameters
+	inputArgs []string
+
+	// header returns bytes FFmpeg expects before the first payload
+	header func(fmtp string) []byte
+}
+
+var legacyCodecs = []legacyCodec{
+	{
+		params: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000},
+			PayloadType:        9,
+		},
+		// G.722 advertises an 8kHz clock rate in SDP but samples at 16kHz
+		inputArgs: []string{"-f", "g722", "-ar", "16000"},
+	},
+	{
+		params: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+			PayloadType:        0,
+		},
+		inputArgs: []string{"-f", "mulaw", "-ar", "8000", "-ac", "1"},
+	},
+	{
+		params: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+			PayloadType:        8,
+		},
+		inputArgs: []string{"-f", "alaw", "-ar", "8000", "-ac", "1"},
+	},
+	{
+		params: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeILBC, ClockRate: 8000, SDPFmtpLine: "mode=30"},
+			PayloadType:        102,
+		},
+		inputArgs: []string{"-f", "ilbc"},
+		header:    ilbcHeader,
+	},
+}
+
+// Register the telephony codecs on the MediaEngine
+func registerLegacyCodecs(m *webrtc.MediaEngine) error {
+	for _, codec := range legacyCodecs {
+		if err := m.RegisterCodec(codec.params, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Find the telephony codec for a negotiated MIME type, nil if there is none
+func findLegacyCodec(mimeType string) *legacyCodec {
+	for i := range legacyCodecs {
+		if strings.EqualFold(legacyCodecs[i].params.MimeType, mimeType) {
+			return &legacyCodecs[i]
+		}
+	}
+
+	return nil
+}
+
+// FFmpeg's iLBC demuxer needs the RFC 3952 storage header, which carries
+// the frame mode negotiated in the fmtp line (20ms or 30ms frames)
+func ilbcHeader(fmtp string) []byte {
+	for _, param := range strings.Split(fmtp, ";") {
+		if strings.TrimSpace(param) == "mode=20" {
+			return []byte("#!iLBC20\n")
+		}
+	}
+
+	return []byte("#!iLBC30\n")
+}
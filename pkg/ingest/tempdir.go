@@ -0,0 +1,73 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Prefix of session directories under the system temp dir
+const sessionDirPattern = "ingest-session-*"
+
+// The file in a session directory naming the process that owns it
+const sessionDirOwner = "owner.pid"
+
+// Create the directory a session's intermediate files go to, the live HLS
+// playlist and segments. It is removed once the session's outputs were
+// finalized, and by the next server started after a crash.
+func newSessionDir() (string, error) {
+	dir, err := os.MkdirTemp("", sessionDirPattern)
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, sessionDirOwner), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		os.RemoveAll(dir) //nolint:errcheck
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// Remove the session directories left behind by processes that are gone,
+// except those kept for sessions to resume in
+func sweepSessionDirs(keep map[string]bool) {
+	dirs, _ := filepath.Glob(filepath.Join(os.TempDir(), sessionDirPattern))
+	for _, dir := range dirs {
+		if keep[dir] {
+			continue
+		}
+		owner, err := os.ReadFile(filepath.Join(dir, sessionDirOwner))
+		if err == nil {
+			if pid, _ := strconv.Atoi(strings.TrimSpace(string(owner))); processAlive(pid) {
+				continue
+			}
+		}
+
+		if err = os.RemoveAll(dir); err != nil {
+			fmt.Println("Error removing stale session directory:", err)
+		} else {
+			fmt.Println("Removed stale session directory", dir)
+		}
+	}
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if pid == os.Getpid() {
+		return true
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
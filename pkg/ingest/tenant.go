@@ -0,0 +1,213 @@
+package ingest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tenant names, they prefix session IDs and end up in file names
+var tenantPattern = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// tenantQuota limits a tenant's live sessions and the disk space its
+// finished sessions take up, zero leaving a limit off
+type tenantQuota struct {
+	sessions int
+	storage  int64
+}
+
+// tenantTable holds the quotas of -tenants-file by tenant, "*" for the
+// tenants not listed
+type tenantTable map[string]tenantQuota
+
+// Load a file of "<tenant> sessions=10 storage=50GB" lines, nil without a file
+func loadTenants(path string) (tenantTable, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenants file: %v", err)
+	}
+	defer f.Close()
+
+	table := tenantTable{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "*" && !tenantPattern.MatchString(fields[0]) {
+			return nil, fmt.Errorf("invalid tenant name %q", fields[0])
+		}
+
+		var q tenantQuota
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			var err error
+			switch key {
+			case "sessions":
+				q.sessions, err = strconv.Atoi(value)
+			case "storage":
+				q.storage, err = parseByteSize(value)
+			default:
+				err = errors.New("unknown quota")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid quota %q of %s: %v", field, fields[0], err)
+			}
+		}
+		table[fields[0]] = q
+	}
+
+	return table, scanner.Err()
+}
+
+// Quota of a tenant, false if the tenant may not publish at all
+func (t tenantTable) quota(tenant string) (tenantQuota, bool) {
+	if q, ok := t[tenant]; ok {
+		return q, true
+	}
+	q, ok := t["*"]
+	return q, ok
+}
+
+// tenants admits the sessions of tenants within their quotas
+type tenants struct {
+	table   tenantTable // nil without -tenants-file, every tenant is unlimited
+	metrics *metricRegistry
+
+	mu       sync.Mutex
+	starting map[string]string // Tenants of the sessions admitted and not registered yet, by ID
+}
+
+// ID of a tenant's session, prefixed with the tenant so its outputs are
+// named apart from every other tenant's
+func tenantSessionID(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + "." + id
+}
+
+// Whether an ID can name a session, with or without a tenant
+func validSessionID(id string) bool {
+	tenant, rest, ok := strings.Cut(id, ".")
+	if ok {
+		return tenantPattern.MatchString(tenant) && sessionIDPattern.MatchString(rest)
+	}
+	return sessionIDPattern.MatchString(id)
+}
+
+// admit checks a tenant's quotas before it starts another session, and
+// reserves the session its ID and a slot of the quota until done is called,
+// once it was registered or failed to start. Sessions without a tenant are
+// only admitted without -tenants-file.
+func (t *tenants) admit(tenant, id string, sessions *sessionRegistry) error {
+	t.mu.Lock()
+	table := t.table
+	t.mu.Unlock()
+
+	var quota tenantQuota
+	if table != nil {
+		if tenant == "" {
+			return fmt.Errorf("%w: publish token has no tenant", errUnauthorized)
+		}
+		var ok bool
+		if quota, ok = table.quota(tenant); !ok {
+			return fmt.Errorf("%w: unknown tenant %s", errUnauthorized, tenant)
+		}
+	}
+
+	// Storage is summed up from disk, not while other sessions wait
+	if quota.storage > 0 {
+		used := tenantStorage(tenant)
+		t.metrics.set(fmt.Sprintf("ingest_tenant_storage_bytes{tenant=%q}", tenant), float64(used))
+		if used >= quota.storage {
+			t.reject(tenant, "storage")
+			return fmt.Errorf("%w: tenant %s uses %d of %d bytes", errQuotaExceeded, tenant, used, quota.storage)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.starting[id]; ok || sessions.get(id) != nil {
+		return fmt.Errorf("session %s is already publishing", id)
+	}
+
+	live := 0
+	for _, starting := range t.starting {
+		if starting == tenant {
+			live++
+		}
+	}
+	for _, s := range sessions.list() {
+		if _, ok := t.starting[s.id]; s.tenant == tenant && !ok {
+			live++
+		}
+	}
+	if quota.sessions > 0 && live >= quota.sessions {
+		t.reject(tenant, "sessions")
+		return fmt.Errorf("%w: tenant %s has %d live sessions", errQuotaExceeded, tenant, live)
+	}
+
+	if t.starting == nil {
+		t.starting = map[string]string{}
+	}
+	t.starting[id] = tenant
+	return nil
+}
+
+// setTable replaces the quotas, sessions already admitted keep running
+func (t *tenants) setTable(table tenantTable) {
+	t.mu.Lock()
+	t.table = table
+	t.mu.Unlock()
+}
+
+// done releases what admit reserved a session, once it was registered or
+// failed to start
+func (t *tenants) done(id string) {
+	t.mu.Lock()
+	delete(t.starting, id)
+	t.mu.Unlock()
+}
+
+func (t *tenants) reject(tenant, quota string) {
+	t.metrics.add(fmt.Sprintf("ingest_tenant_rejected_total{tenant=%q,quota=%q}", tenant, quota), 1)
+}
+
+// Count a tenant's live sessions in its metrics
+func (t *tenants) count(tenant string, sessions *sessionRegistry) {
+	if tenant == "" {
+		return
+	}
+
+	live := 0
+	for _, s := range sessions.list() {
+		if s.tenant == tenant {
+			live++
+		}
+	}
+	t.metrics.set(fmt.Sprintf("ingest_tenant_sessions{tenant=%q}", tenant), float64(live))
+}
+
+// Bytes the finished sessions of a tenant take up on disk
+func tenantStorage(tenant string) int64 {
+	var used int64
+	for _, session := range finishedSessions() {
+		if session.tenant == tenant {
+			used += session.bytes
+		}
+	}
+	return used
+}
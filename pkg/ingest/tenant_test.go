@@ -0,0 +1,39 @@
+package ingest
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTenantsAdmit(t *testing.T) {
+	tenants := &tenants{table: tenantTable{"acme": {sessions: 1}}, metrics: newMetricRegistry()}
+	sessions := newSessionRegistry()
+
+	for _, tc := range []struct {
+		tenant, id string
+		err        error
+	}{
+		{tenant: "acme", id: "acme.a"},
+		{tenant: "acme", id: "acme.b", err: errQuotaExceeded}, // The slot is reserved while acme.a starts
+		{tenant: "other", id: "other.a", err: errUnauthorized},
+		{tenant: "", id: "a", err: errUnauthorized},
+	} {
+		if err := tenants.admit(tc.tenant, tc.id, sessions); !errors.Is(err, tc.err) {
+			t.Errorf("admit(%q, %q) = %v", tc.tenant, tc.id, err)
+		}
+	}
+
+	// A session that failed to start gives its slot back
+	tenants.done("acme.a")
+	if err := tenants.admit("acme", "acme.b", sessions); err != nil {
+		t.Errorf("admit after done = %v", err)
+	}
+
+	tenants.setTable(nil)
+	if err := tenants.admit("", "a", sessions); err != nil {
+		t.Errorf("admit without tenants = %v", err)
+	}
+	if err := tenants.admit("", "a", sessions); err == nil {
+		t.Error("admitted a session ID that is starting")
+	}
+}
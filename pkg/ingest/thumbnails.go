@@ -0,0 +1,102 @@
+package ingest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	spriteColumns = 5
+	spriteRows    = 5
+	spriteWidth   = 160
+	spriteHeight  = 90
+)
+
+// Extra FFmpeg outputs writing the latest frame to thumbnail.jpg in a
+// session's directory every interval and, optionally, a tiled sprite sheet of
+// those frames
+func thumbnailArgs(cfg *Config, dir string) []string {
+	if cfg.ThumbnailInterval <= 0 {
+		return nil
+	}
+
+	fps := fmt.Sprintf("fps=1/%g", cfg.ThumbnailInterval.Seconds())
+	args := []string{
+		"-map", "0:v",
+		"-vf", fps + ",scale=320:-2",
+		"-q:v", "5",
+		"-update", "1",
+		"-atomic_writing", "1",
+		"-f", "image2",
+		filepath.Join(dir, "thumbnail.jpg"),
+	}
+	if cfg.ThumbnailSprites {
+		args = append(args,
+			"-map", "0:v",
+			"-vf", fmt.Sprintf("%s,scale=%d:%d,tile=%dx%d", fps, spriteWidth, spriteHeight, spriteColumns, spriteRows),
+			"-q:v", "5",
+			"-start_number", "0",
+			"-f", "image2",
+			filepath.Join(dir, "sprite_%d.jpg"),
+		)
+	}
+
+	return args
+}
+
+// Keep thumbnails.vtt in sync with the sprite sheets FFmpeg has written to a
+// session's directory so far, mapping every interval of the stream to its
+// tile. The tiles are referenced relative to the track, so they are fetched
+// from the same session.
+func writeThumbnailTrack(cfg *Config, dir string, stop <-chan struct{}) {
+	if cfg.ThumbnailInterval <= 0 || !cfg.ThumbnailSprites {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.ThumbnailInterval)
+	defer ticker.Stop()
+
+	sprites := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// A sprite is complete once FFmpeg moved on to the next one
+		for {
+			if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("sprite_%d.jpg", sprites+1))); err != nil {
+				break
+			}
+			sprites++
+		}
+		if sprites == 0 {
+			continue
+		}
+
+		if err := writeFileAtomic(filepath.Join(dir, "thumbnails.vtt"), []byte(thumbnailTrack(sprites, cfg.ThumbnailInterval))); err != nil {
+			fmt.Println("Error writing thumbnails.vtt:", err)
+		}
+	}
+}
+
+func thumbnailTrack(sprites int, interval time.Duration) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+
+	tiles := spriteColumns * spriteRows
+	for i := 0; i < sprites*tiles; i++ {
+		start := time.Duration(i) * interval
+		x := (i % tiles % spriteColumns) * spriteWidth
+		y := (i % tiles / spriteColumns) * spriteHeight
+
+		fmt.Fprintf(&b, "\n%s --> %s\nsprite_%d.jpg#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(start+interval), i/tiles, x, y, spriteWidth, spriteHeight)
+	}
+
+	return b.String()
+}
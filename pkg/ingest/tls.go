@@ -0,0 +1,275 @@
+package ingest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Certificates are renewed once they expire within this
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// Check the TLS options, certificate files and ACME being exclusive
+func validateTLS(cfg *Config) error {
+	switch {
+	case (cfg.TLSCert == "") != (cfg.TLSKey == ""):
+		return errors.New("-tls-cert and -tls-key go together")
+	case cfg.TLSCert != "" && cfg.ACMEDomains != "":
+		return errors.New("-tls-cert and -acme-domains are exclusive")
+	case cfg.ACMEDomains != "" && cfg.ACMEHTTPAddr == "":
+		return errors.New("-acme-domains needs -acme-http-addr for HTTP-01 challenges")
+	}
+	return nil
+}
+
+// Serve HTTPS with the configured certificate files, or with a certificate
+// obtained from Let's Encrypt for the ACME domains
+func (s *Server) listenAndServeTLS(server *http.Server) error {
+	if s.cfg.TLSCert != "" {
+		return server.ListenAndServeTLS(s.cfg.TLSCert, s.cfg.TLSKey)
+	}
+
+	manager := newACMEManager(s.cfg)
+	go func() {
+		if err := http.ListenAndServe(s.cfg.ACMEHTTPAddr, manager); err != nil {
+			fmt.Println("ACME challenge server stopped:", err)
+		}
+	}()
+	go manager.run()
+
+	server.TLSConfig = &tls.Config{GetCertificate: manager.getCertificate}
+	return server.ListenAndServeTLS("", "")
+}
+
+// acmeManager keeps a certificate for the ACME domains, obtained and renewed
+// with HTTP-01 challenges. The account key and certificate are cached in a
+// directory, so restarts don't run into Let's Encrypt's rate limits.
+type acmeManager struct {
+	domains []string
+	email   string
+	dir     string
+
+	mu     sync.Mutex
+	cert   *tls.Certificate
+	tokens map[string]string // Key authorizations of pending challenges, by token
+}
+
+func newACMEManager(cfg *Config) *acmeManager {
+	m := &acmeManager{email: cfg.ACMEEmail, dir: cfg.ACMECacheDir, tokens: map[string]string{}}
+	for _, domain := range strings.Split(cfg.ACMEDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			m.domains = append(m.domains, domain)
+		}
+	}
+
+	if cert, err := tls.LoadX509KeyPair(m.certFile(), m.certFile()); err == nil {
+		m.cert = &cert
+	}
+	return m
+}
+
+func (m *acmeManager) certFile() string {
+	return filepath.Join(m.dir, "cert.pem")
+}
+
+func (m *acmeManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cert == nil {
+		return nil, errors.New("no certificate obtained yet")
+	}
+	return m.cert, nil
+}
+
+// Answer HTTP-01 challenges, redirecting everything else to HTTPS
+func (m *acmeManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/"); ok {
+		m.mu.Lock()
+		response, ok := m.tokens[token]
+		m.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, response)
+		return
+	}
+
+	http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// Obtain a certificate when there is none or it expires soon, checking
+// twice a day
+func (m *acmeManager) run() {
+	for {
+		if m.expiresSoon() {
+			if err := m.obtain(); err != nil {
+				fmt.Println("Failed to obtain ACME certificate:", err)
+				time.Sleep(time.Minute)
+				continue
+			}
+			fmt.Println("Obtained ACME certificate for", strings.Join(m.domains, ", "))
+		}
+		time.Sleep(12 * time.Hour)
+	}
+}
+
+func (m *acmeManager) expiresSoon() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cert == nil || len(m.cert.Certificate) == 0 {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(m.cert.Certificate[0])
+	return err != nil || time.Until(leaf.NotAfter) < acmeRenewBefore
+}
+
+func (m *acmeManager) obtain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	accountKey, err := m.loadKey("account.key")
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: acme.LetsEncryptURL}
+
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.domains...))
+	if err != nil {
+		return err
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, url); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.domains}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+
+	return m.store(chain, key)
+}
+
+// Complete the HTTP-01 challenge of an authorization
+func (m *acmeManager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil || authz.Status == acme.StatusValid {
+		return err
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no HTTP-01 challenge for %s", authz.Identifier.Value)
+	}
+
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.tokens[challenge.Token] = response
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.tokens, challenge.Token)
+		m.mu.Unlock()
+	}()
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// Load the cached key of a name, generating it on first use
+func (m *acmeManager) loadKey(name string) (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(m.dir, name)
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM key in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+// Cache a certificate chain with its key in one file, and start serving it
+func (m *acmeManager) store(chain [][]byte, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, cert := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.certFile(), data, 0o600); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.cert = &tls.Certificate{Certificate: chain, PrivateKey: key}
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,125 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Why a track ended before its session
+const (
+	trackEndStopped  = "stopped"  // Its transceiver was stopped or its receiver closed
+	trackEndBye      = "bye"      // The publisher sent an RTCP BYE for it
+	trackEndInactive = "inactive" // No packet arrived for -track-end-timeout
+)
+
+// Consecutive read errors after which a track is given up on
+const trackReadErrors = 10
+
+// trackEnd reads the packets of a track until it ended, which a publisher
+// rarely says: a stopped transceiver closes the receiver, a BYE may come
+// along, but muting with replaceTrack(null) just stops the packets
+type trackEnd struct {
+	session *Session
+	t       *Track
+	track   *webrtc.TrackRemote
+	timeout time.Duration // 0 waits for packets forever
+
+	mu     sync.Mutex
+	reason string
+	errors int // Consecutive read errors
+}
+
+func (s *Session) newTrackEnd(t *Track, track *webrtc.TrackRemote) *trackEnd {
+	return &trackEnd{session: s, t: t, track: track, timeout: s.server.cfg.TrackEndTimeout}
+}
+
+// read returns the next packet of the track, io.EOF once it ended
+func (e *trackEnd) read() (*rtp.Packet, error) {
+	for {
+		if e.timeout > 0 {
+			e.track.SetReadDeadline(time.Now().Add(e.timeout))
+		}
+		packet, _, err := e.track.ReadRTP()
+		if err == nil {
+			e.errors = 0
+			return packet, nil
+		}
+		if e.ended() {
+			return nil, io.EOF
+		}
+
+		var netErr net.Error
+		switch {
+		case errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe):
+			e.end(trackEndStopped)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			e.end(trackEndInactive)
+		default:
+			// A malformed packet, as long as the errors don't pile up
+			if e.errors++; e.errors < trackReadErrors {
+				fmt.Println("Error reading RTP:", err)
+				continue
+			}
+			e.end(trackEndStopped)
+		}
+		return nil, io.EOF
+	}
+}
+
+// bye ends the track on an RTCP BYE for its SSRC, waking its reader
+func (e *trackEnd) bye(packet rtcp.Packet) {
+	goodbye, ok := packet.(*rtcp.Goodbye)
+	if !ok {
+		return
+	}
+	for _, ssrc := range goodbye.Sources {
+		if ssrc == uint32(e.track.SSRC()) {
+			e.end(trackEndBye)
+			e.track.SetReadDeadline(time.Now())
+			return
+		}
+	}
+}
+
+func (e *trackEnd) ended() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.reason != ""
+}
+
+// end records why the track ended, unless the whole session is ending
+func (e *trackEnd) end(reason string) {
+	e.mu.Lock()
+	if e.reason != "" {
+		e.mu.Unlock()
+		return
+	}
+	e.reason = reason
+	e.mu.Unlock()
+
+	// Closing the peer connection closes its signaling first
+	s := e.session
+	if s.peerConnection.SignalingState() == webrtc.SignalingStateClosed {
+		return
+	}
+	fmt.Printf("Track %q ended (%s), finalizing its outputs\n", e.t.Label, reason)
+	s.server.metrics.add(fmt.Sprintf(`ingest_tracks_ended_total{reason=%q}`, reason), 1)
+	s.server.events.emit(eventTrackEnded, s.id, map[string]any{"kind": e.t.Kind, "track": e.t.rendition(), "label": e.t.Label, "reason": reason})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, report := range s.tracks {
+		if report.track == e.t {
+			report.end(reason)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	// msid track IDs a publisher chose itself, browsers generate longer
+	// random ones or UUIDs
+	readableTrackID = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9 ._-]{0,31}$`)
+	uuidTrackID     = regexp.MustCompile(`(?i)^[0-9a-f]{8}(-[0-9a-f]{4}){3}-[0-9a-f]{12}$`)
+
+	nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// Names a track's outputs can't take, as they would overwrite the session's
+// other playlists, nor can the session ID that names the primary tracks'
+// live outputs. The primary audio and camera tracks keep their kind. Session
+// IDs can't be the first segment of the routes that overlap /{session}/{file}
+// either.
+var reservedRenditions = []string{"captions", "master", "audio", "video", "play", "keys"}
+
+// identify fills in the MID and msid of a track, and labels it with its msid
+// track ID if the publisher chose a readable one, else with the given label.
+// The outputs of a labelled track are named after the label, made unique in
+// the session.
+func (s *Session) identify(t *Track, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, label string) {
+	t.MID = s.trackMID(receiver)
+	t.StreamID, t.TrackID = track.StreamID(), track.ID()
+
+	name := t.rendition()
+	if readableTrackID.MatchString(t.TrackID) && !uuidTrackID.MatchString(t.TrackID) {
+		label = t.TrackID
+		name = strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(label), "-"), "-")
+	}
+	t.Label = label
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.Publisher = s.publisherName
+	if s.renditions == nil {
+		s.renditions = map[string]bool{}
+		for _, reserved := range reservedRenditions {
+			s.renditions[reserved] = true
+		}
+		s.renditions[s.id] = true
+	}
+	if !t.primary || name != t.Kind {
+		for base, i := name, 2; s.renditions[name]; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+	}
+	s.renditions[name] = true
+	t.Name = name
+}
+
+// MID of the transceiver receiving a track
+func (s *Session) trackMID(receiver *webrtc.RTPReceiver) string {
+	for _, transceiver := range s.peerConnection.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			return transceiver.Mid()
+		}
+	}
+	return ""
+}
+
+// Value of an attribute of the publisher's m-line with the given MID
+func (s *Session) mediaAttribute(mid, key string) string {
+	remote := s.peerConnection.RemoteDescription()
+	if remote == nil || mid == "" {
+		return ""
+	}
+	parsed, err := remote.Unmarshal()
+	if err != nil {
+		return ""
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if value, _ := media.Attribute("mid"); value == mid {
+			value, _ = media.Attribute(key)
+			return value
+		}
+	}
+	return ""
+}
+
+// Tracks of the session in the request path with their live statistics
+func (r *sessionRegistry) serveTracks(w http.ResponseWriter, req *http.Request) {
+	session := r.get(req.PathValue("id"))
+	if session == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session.metadata().Tracks) //nolint:errcheck
+}
@@ -0,0 +1,264 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// trackReport is the PacketProcessor summarizing a track for the session
+// metadata: its codec, the packets received and lost, and for VP8 the
+// resolutions keyframes switched to
+type trackReport struct {
+	mu          sync.Mutex
+	track       *Track
+	received    uint64
+	started     bool
+	first       uint64 // Extended sequence numbers
+	highest     uint64
+	ssrc        uint32
+	timestamp   uint32    // Of the latest packet
+	last        time.Time // When the latest packet arrived
+	jitter      float64   // Interarrival jitter (RFC 3550) in clock units
+	resolutions []resolutionChange
+	bytes       uint64    // Of the packets received
+	window      time.Time // Start of the bitrate window
+	windowBytes uint64
+	bitrate     int               // Bits per second of the last window
+	measured    bool              // A bitrate window closed
+	ended       string            // Why the track ended before its session, see trackEnd
+	silences    []silenceInterval // Long silences of an audio track, once it ended
+}
+
+type resolutionChange struct {
+	Time   time.Time `json:"time"`
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+}
+
+// trackSummary is how a track is recorded in the session metadata
+type trackSummary struct {
+	Kind        string             `json:"kind"`
+	Content     string             `json:"content,omitempty"`
+	Label       string             `json:"label"`
+	Rendition   string             `json:"rendition"` // Name of the track's outputs
+	MID         string             `json:"mid,omitempty"`
+	StreamID    string             `json:"streamId,omitempty"`
+	TrackID     string             `json:"trackId,omitempty"`
+	Codec       string             `json:"codec"`
+	ClockRate   uint32             `json:"clockRate"`
+	Fmtp        string             `json:"fmtp,omitempty"`
+	Received    uint64             `json:"packetsReceived"`
+	Lost        uint64             `json:"packetsLost"`
+	LossRatio   float64            `json:"lossRatio"`
+	Resolutions []resolutionChange `json:"resolutions,omitempty"`
+	Rotation    int                `json:"rotation,omitempty"` // Degrees clockwise most frames were sent rotated by
+	Ended       string             `json:"ended,omitempty"`    // "stopped", "bye" or "inactive" if the track ended before the session
+	Jitter      float64            `json:"jitter"`             // Interarrival jitter in seconds
+	Silences    []silenceInterval  `json:"silences,omitempty"` // Long silences of an audio track
+}
+
+// Start summarizing a track of the session. Packets seen already are dropped
+// first, then the report runs so it sees every other packet as received.
+func (s *Session) reportTrack(t *Track, processors []PacketProcessor) []PacketProcessor {
+	report := &trackReport{track: t}
+	s.mu.Lock()
+	s.tracks = append(s.tracks, report)
+	s.mu.Unlock()
+
+	chain := []PacketProcessor{report}
+	if filter := newReplayFilter(t.rendition(), s.server.cfg.ReplayWindow, s.server.metrics); filter != nil {
+		chain = []PacketProcessor{filter, report}
+	}
+	return append(chain, processors...)
+}
+
+func (r *trackReport) Process(packet *rtp.Packet) (*rtp.Packet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.started && r.track.Codec.ClockRate > 0 {
+		transit := now.Sub(r.last).Seconds()*float64(r.track.Codec.ClockRate) - float64(int32(packet.Timestamp-r.timestamp))
+		r.jitter += (math.Abs(transit) - r.jitter) / 16
+	}
+	r.received++
+	r.ssrc, r.timestamp, r.last = packet.SSRC, packet.Timestamp, now
+	r.count(packet.MarshalSize())
+	if !r.started {
+		r.started = true
+		r.first, r.highest = uint64(packet.SequenceNumber), uint64(packet.SequenceNumber)
+	} else {
+		// Extended by the closest wrap to the highest so far
+		seq := int64(r.highest) + int64(int16(packet.SequenceNumber-uint16(r.highest)))
+		if seq > int64(r.highest) {
+			r.highest = uint64(seq)
+		}
+	}
+
+	if strings.EqualFold(r.track.Codec.MimeType, webrtc.MimeTypeVP8) {
+		if width, height, ok := vp8KeyframeSize(packet.Payload); ok {
+			if n := len(r.resolutions); n == 0 || r.resolutions[n-1].Width != width || r.resolutions[n-1].Height != height {
+				r.resolutions = append(r.resolutions, resolutionChange{Time: time.Now(), Width: width, Height: height})
+			}
+		}
+	}
+	return packet, nil
+}
+
+// Count received bytes into the bitrate, measured over a second at a time
+func (r *trackReport) count(n int) {
+	now := time.Now()
+	if r.window.IsZero() {
+		r.window = now
+	}
+	r.bytes += uint64(n)
+	r.windowBytes += uint64(n)
+	if elapsed := now.Sub(r.window); elapsed >= time.Second {
+		r.bitrate, r.measured = int(float64(r.windowBytes*8)/elapsed.Seconds()), true
+		r.window, r.windowBytes = now, 0
+	}
+}
+
+// Bytes received and the bitrate lately, 0 once the track stopped
+func (r *trackReport) bandwidth() (uint64, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.window) > 2*time.Second {
+		return r.bytes, 0
+	}
+	return r.bytes, r.bitrate
+}
+
+// Last packet received, false before the first
+func (r *trackReport) position() (trackPosition, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return trackPosition{SSRC: r.ssrc, Sequence: uint16(r.highest), Timestamp: r.timestamp}, r.started
+}
+
+// Interarrival jitter in seconds lately, and whether the bitrate was
+// measured yet
+func (r *trackReport) conditions() (float64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.jitterSeconds(), r.measured
+}
+
+// Interarrival jitter in seconds, r.mu must be held
+func (r *trackReport) jitterSeconds() float64 {
+	if r.track.Codec.ClockRate == 0 {
+		return 0
+	}
+	return r.jitter / float64(r.track.Codec.ClockRate)
+}
+
+// Packets expected from the sequence numbers so far, and received
+func (r *trackReport) counts() (uint64, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.started {
+		return 0, 0
+	}
+	return r.highest - r.first + 1, r.received
+}
+
+// When the latest packet arrived, zero before the first, and why the track
+// ended if it did
+func (r *trackReport) activity() (time.Time, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.last, r.ended
+}
+
+func (r *trackReport) end(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ended = reason
+}
+
+// Record the long silences of an audio track in its summary, and the
+// summary in the session metadata
+func (s *Session) recordSilences(t *Track, intervals []silenceInterval) {
+	s.mu.Lock()
+	tracks := s.tracks
+	s.mu.Unlock()
+
+	for _, report := range tracks {
+		if report.track == t {
+			report.mu.Lock()
+			report.silences = intervals
+			report.mu.Unlock()
+		}
+	}
+	s.writeMetadata()
+}
+
+func (r *trackReport) summary() trackSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := r.track
+	summary := trackSummary{
+		Kind:        t.Kind,
+		Content:     t.Content,
+		Label:       t.Label,
+		Rendition:   t.rendition(),
+		MID:         t.MID,
+		StreamID:    t.StreamID,
+		TrackID:     t.TrackID,
+		Codec:       t.Codec.MimeType,
+		ClockRate:   t.Codec.ClockRate,
+		Fmtp:        t.Codec.SDPFmtpLine,
+		Received:    r.received,
+		Resolutions: append([]resolutionChange(nil), r.resolutions...),
+		Rotation:    int(t.orientation.dominant()&0x3) * 90,
+		Ended:       r.ended,
+		Jitter:      r.jitterSeconds(),
+		Silences:    append([]silenceInterval(nil), r.silences...),
+	}
+	if r.started {
+		// Duplicates can make more arrive than were expected
+		if expected := r.highest - r.first + 1; expected > r.received {
+			summary.Lost = expected - r.received
+			summary.LossRatio = float64(summary.Lost) / float64(expected)
+		}
+	}
+	return summary
+}
+
+// Size of the VP8 keyframe starting in an RTP payload
+func vp8KeyframeSize(payload []byte) (int, int, bool) {
+	vp8 := &codecs.VP8Packet{}
+	frame, err := vp8.Unmarshal(payload)
+	if err != nil || vp8.S != 1 || vp8.PID != 0 {
+		return 0, 0, false
+	}
+	return vp8FrameSize(frame)
+}
+
+// Size of a VP8 frame, if it is a keyframe
+func vp8FrameSize(frame []byte) (int, int, bool) {
+	if len(frame) < 10 {
+		return 0, 0, false
+	}
+
+	// The frame tag's lowest bit is clear on keyframes, followed by a start
+	// code and the 14 bit dimensions
+	if frame[0]&1 != 0 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	return int(binary.LittleEndian.Uint16(frame[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(frame[8:]) & 0x3fff), true
+}
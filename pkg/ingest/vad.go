@@ -0,0 +1,126 @@
+package ingest
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Opus encoders running with DTX emit 1-2 byte frames while the speaker is silent
+const opusDTXFrameSize = 2
+
+// Rate packets are decoded at to measure their level, speech needs no more
+const vadSampleRate = 8000
+
+type silenceInterval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// voiceDetector classifies incoming Opus packets as speech or silence.
+// It prefers the ssrc-audio-level header extension (RFC 6464) when the
+// publisher negotiated it, then the level of the decoded audio in builds
+// with native Opus decoding, and falls back to Opus DTX detection otherwise.
+type voiceDetector struct {
+	audioLevelID uint8
+	decoder      *opusDecoder // Without the extension, nil unless nativeOpus
+	pcm          []int16
+	silenceLevel uint8
+	timeout      time.Duration
+	trim         bool
+
+	silenceStart time.Time
+	trimming     bool
+	intervals    []silenceInterval
+}
+
+func newVoiceDetector(audioLevelID uint8, cfg *Config) *voiceDetector {
+	v := &voiceDetector{
+		audioLevelID: audioLevelID,
+		silenceLevel: uint8(min(cfg.SilenceLevel, 127)),
+		timeout:      cfg.SilenceTimeout,
+		trim:         cfg.TrimSilence,
+	}
+	if audioLevelID == 0 {
+		if decoder, err := newOpusDecoder(vadSampleRate, 1); err == nil {
+			v.decoder, v.pcm = decoder, make([]int16, vadSampleRate*120/1000)
+		}
+	}
+	return v
+}
+
+func (v *voiceDetector) isSilent(packet *rtp.Packet) bool {
+	if v.audioLevelID != 0 {
+		if ext := packet.GetExtension(v.audioLevelID); ext != nil {
+			level := rtp.AudioLevelExtension{}
+			if err := level.Unmarshal(ext); err == nil {
+				// Level is expressed in -dBov, so larger values are quieter
+				return level.Level >= v.silenceLevel
+			}
+		}
+	}
+
+	if v.decoder != nil && len(packet.Payload) > opusDTXFrameSize {
+		if n, err := v.decoder.decode(packet.Payload, v.pcm); err == nil {
+			return pcmLevel(v.pcm[:n]) >= v.silenceLevel
+		}
+	}
+
+	return len(packet.Payload) <= opusDTXFrameSize
+}
+
+// pcmLevel is the level of samples in -dBov as RFC 6464 expresses it, from 0
+// for full scale to 127 for digital silence
+func pcmLevel(samples []int16) uint8 {
+	var sum float64
+	for _, sample := range samples {
+		sum += float64(sample) * float64(sample)
+	}
+	if len(samples) == 0 || sum == 0 {
+		return 127
+	}
+	rms := math.Sqrt(sum/float64(len(samples))) / 32768
+	return uint8(min(127, max(0, math.Round(-20*math.Log10(rms)))))
+}
+
+// observe updates the silence state with the given packet and reports
+// whether the packet should be forwarded to the output
+func (v *voiceDetector) observe(packet *rtp.Packet, now time.Time) bool {
+	if v.isSilent(packet) {
+		if v.silenceStart.IsZero() {
+			v.silenceStart = now
+		}
+		if !v.trimming && now.Sub(v.silenceStart) >= v.timeout {
+			v.trimming = true
+			if v.trim {
+				fmt.Println("Long silence detected, pausing audio output")
+			}
+		}
+
+		return !(v.trim && v.trimming)
+	}
+
+	if v.trimming {
+		v.intervals = append(v.intervals, silenceInterval{Start: v.silenceStart, End: now})
+		if v.trim {
+			fmt.Printf("Voice resumed after %s of silence\n", now.Sub(v.silenceStart).Round(time.Millisecond))
+		}
+	}
+	v.silenceStart = time.Time{}
+	v.trimming = false
+
+	return true
+}
+
+// silenceIntervals returns every completed long silence plus the one in
+// progress, if any
+func (v *voiceDetector) silenceIntervals(now time.Time) []silenceInterval {
+	intervals := append([]silenceInterval(nil), v.intervals...)
+	if v.trimming {
+		intervals = append(intervals, silenceInterval{Start: v.silenceStart, End: now})
+	}
+
+	return intervals
+}
@@ -0,0 +1,238 @@
+package ingest
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bitrate of the AAC audio of every VOD rendition
+const vodAudioBitrate = 128000
+
+// vodRendition is one variant of the VOD output of a session
+type vodRendition struct {
+	name    string
+	height  int    // 0 for audio-only recordings
+	bitrate string // FFmpeg video bitrate, e.g. "2800k"
+	codec   string
+}
+
+// Parse renditions like "720p:720:2800k,360p:360:800k:libx265", the codec
+// defaulting to libx264
+func parseRenditions(spec string) ([]vodRendition, error) {
+	var renditions []vodRendition
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		fields := strings.Split(strings.TrimSpace(entry), ":")
+		if len(fields) < 3 || len(fields) > 4 || fields[0] == "" || strings.ContainsAny(fields[0], `/\.`) {
+			return nil, fmt.Errorf("invalid rendition %q", entry)
+		}
+		height, err := strconv.Atoi(fields[1])
+		if err != nil || height <= 0 {
+			return nil, fmt.Errorf("invalid height in rendition %q", entry)
+		}
+		if _, err = parseBitrate(fields[2]); err != nil {
+			return nil, fmt.Errorf("invalid bitrate in rendition %q", entry)
+		}
+
+		rendition := vodRendition{name: fields[0], height: height, bitrate: fields[2], codec: "libx264"}
+		if len(fields) == 4 {
+			rendition.codec = fields[3]
+		}
+		renditions = append(renditions, rendition)
+	}
+
+	return renditions, nil
+}
+
+// Bits per second of an FFmpeg bitrate like "800k" or "2M"
+func parseBitrate(bitrate string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(bitrate, "k"):
+		multiplier, bitrate = 1000, strings.TrimSuffix(bitrate, "k")
+	case strings.HasSuffix(bitrate, "M"):
+		multiplier, bitrate = 1000000, strings.TrimSuffix(bitrate, "M")
+	}
+
+	n, err := strconv.Atoi(bitrate)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", bitrate)
+	}
+	return n * multiplier, nil
+}
+
+// transcodeQueue turns the WebM recordings of ended sessions into a VOD set
+// under vod/<session>/: an HLS playlist per rendition and a master.m3u8.
+// Transcodes run in the background, at most a fixed number at a time.
+type transcodeQueue struct {
+	renditions []vodRendition
+	metrics    *metricRegistry
+	jobs       chan func()
+}
+
+func newTranscodeQueue(cfg *Config, metrics *metricRegistry) (*transcodeQueue, error) {
+	renditions, err := parseRenditions(cfg.VODRenditions)
+	if err != nil || len(renditions) == 0 {
+		return nil, err
+	}
+	if cfg.VODConcurrency <= 0 {
+		return nil, fmt.Errorf("invalid VOD concurrency %d", cfg.VODConcurrency)
+	}
+
+	q := &transcodeQueue{renditions: renditions, metrics: metrics, jobs: make(chan func())}
+	for i := 0; i < cfg.VODConcurrency; i++ {
+		go func() {
+			for job := range q.jobs {
+				job()
+			}
+		}()
+	}
+
+	return q, nil
+}
+
+// enqueue transcodes the audio and video recordings of a session, once they
+// were finalized. Blocks until every rendition was handed to a worker.
+func (q *transcodeQueue) enqueue(session, audio, video string) {
+	if q == nil {
+		return
+	}
+
+	var sources []string
+	for _, source := range []string{video, audio} {
+		if _, err := os.Stat(source); err == nil {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		fmt.Printf("No recording of session %s to transcode, route tracks to the webm sink\n", session)
+		return
+	}
+
+	dir := vodDir(session)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Println("Error creating VOD directory:", err)
+		return
+	}
+
+	// Without video every rendition would be the same
+	renditions := q.renditions
+	if sources[0] != video {
+		renditions = []vodRendition{{name: "audio"}}
+	}
+
+	var wg sync.WaitGroup
+	succeeded := make([]bool, len(renditions))
+	for i, rendition := range renditions {
+		wg.Add(1)
+		q.jobs <- func() {
+			defer wg.Done()
+			succeeded[i] = q.transcode(dir, sources, rendition)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+
+		var done []vodRendition
+		for i, ok := range succeeded {
+			if ok {
+				done = append(done, renditions[i])
+			}
+		}
+		if err := writeMasterPlaylist(dir, done); err != nil {
+			fmt.Println("Error writing VOD master playlist:", err)
+			return
+		}
+		fmt.Printf("VOD of session %s ready in %s\n", session, dir)
+	}()
+}
+
+func (q *transcodeQueue) transcode(dir string, sources []string, rendition vodRendition) bool {
+	var args, maps []string
+	for i, source := range sources {
+		args = append(args, "-i", source)
+		maps = append(maps, "-map", fmt.Sprint(i))
+	}
+	args = append(args, maps...)
+
+	if rendition.height > 0 {
+		args = append(args,
+			"-c:v", rendition.codec,
+			"-b:v", rendition.bitrate,
+			"-vf", fmt.Sprintf("scale=-2:%d", rendition.height),
+		)
+	}
+	args = append(args,
+		"-c:a", "aac",
+		"-b:a", fmt.Sprint(vodAudioBitrate),
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, rendition.name+"_%03d.ts"),
+		"-y", filepath.Join(dir, rendition.name+".m3u8"),
+	)
+
+	process, err := startFFmpegProcess(args)
+	if err == nil {
+		process.stdin.Close()
+		err = process.wait()
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, process.stderr.String())
+		}
+	}
+
+	result := "ok"
+	if err != nil {
+		fmt.Printf("Error transcoding %s rendition of %s: %v\n", rendition.name, dir, err)
+		result = "failed"
+	}
+	q.metrics.add(fmt.Sprintf("ingest_vod_transcodes_total{result=%q}", result), 1)
+	return err == nil
+}
+
+func writeMasterPlaylist(dir string, renditions []vodRendition) error {
+	if len(renditions) == 0 {
+		return fmt.Errorf("no rendition of %s was transcoded", dir)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, rendition := range renditions {
+		bandwidth := vodAudioBitrate
+		if rendition.height > 0 {
+			video, _ := parseBitrate(rendition.bitrate)
+			bandwidth += video
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n%s.m3u8\n", bandwidth, rendition.name)
+	}
+
+	return writeFileAtomic(filepath.Join(dir, "master.m3u8"), []byte(b.String()))
+}
+
+// Serve the VOD files of a session, which never change once written
+func serveVOD(w http.ResponseWriter, r *http.Request) {
+	session, name := r.PathValue("session"), r.PathValue("file")
+	contentType, ok := servedExtensions[filepath.Ext(name)]
+	if !ok || session == ".." || name == ".." {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "max-age=3600")
+	http.ServeFile(w, r, filepath.Join(vodDir(session), name))
+}
+
+// Directory of the VOD renditions of a session
+func vodDir(session string) string {
+	return filepath.Join("vod", session)
+}
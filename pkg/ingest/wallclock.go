@@ -0,0 +1,90 @@
+package ingest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Seconds between the NTP epoch (1900) and the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// wallClock maps RTP timestamps of a track to the sender's wall-clock time,
+// using the NTP/RTP timestamp pair of the latest RTCP Sender Report
+type wallClock struct {
+	clockRate uint32
+
+	mu    sync.Mutex
+	ntp   time.Time
+	rtp   uint32
+	valid bool
+}
+
+func newWallClock(clockRate uint32) *wallClock {
+	return &wallClock{clockRate: clockRate}
+}
+
+func (c *wallClock) update(sr *rtcp.SenderReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.valid {
+		fmt.Println("Got first Sender Report, wall-clock time is", ntpTime(sr.NTPTime).Format(time.RFC3339Nano))
+	}
+	c.ntp = ntpTime(sr.NTPTime)
+	c.rtp = sr.RTPTime
+	c.valid = true
+}
+
+// at returns the wall-clock time of an RTP timestamp, false until the first
+// Sender Report arrived
+func (c *wallClock) at(timestamp uint32) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.valid || c.clockRate == 0 {
+		return time.Time{}, false
+	}
+
+	return c.ntp.Add(c.elapsed(c.rtp, timestamp)), true
+}
+
+// elapsed returns the media time from one RTP timestamp to another, which
+// wraps with the timestamps so it may be negative
+func (c *wallClock) elapsed(from, to uint32) time.Duration {
+	if c.clockRate == 0 {
+		return 0
+	}
+	return time.Duration(int32(to-from)) * time.Second / time.Duration(c.clockRate)
+}
+
+func ntpTime(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	fraction := ntp & 0xffffffff
+
+	return time.Unix(seconds, int64((fraction*1e9)>>32))
+}
+
+// Read the RTCP of a receiver, feeding Sender Reports to the clock and every
+// packet to handlers. Reading is also what lets the interceptors process
+// incoming RTCP.
+func readRTCP(receiver *webrtc.RTPReceiver, clock *wallClock, handlers ...func(rtcp.Packet)) {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			if sr, ok := packet.(*rtcp.SenderReport); ok {
+				clock.update(sr)
+			}
+			for _, handle := range handlers {
+				handle(packet)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package ingest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// How often the tracks of a session are checked for stalls
+const watchdogInterval = 500 * time.Millisecond
+
+const errCodeStalled = "publisher_stalled"
+
+// Stages of a stalled track, each reached once per stall
+const (
+	stallNone      = iota
+	stallRequested // Retransmission of the next packet and a keyframe were asked for
+	stallReported  // Asked again, and the track.stalled event was sent
+)
+
+// Watches the tracks of the session for publishers that stopped sending
+// without hanging up, escalating per track once it sent nothing for
+// -rtp-stall-timeout: the packet after the last one is NACKed and video
+// tracks get a PLI, then after twice as long both are sent again and the
+// stall is reported. With -rtp-stall-teardown, the session is closed once
+// none of its tracks sent anything for that long, so a hung publisher
+// doesn't keep its FFmpegs running.
+func (s *Session) watchStalls() {
+	timeout, teardown := s.server.cfg.RTPStallTimeout, s.server.cfg.RTPStallTeardown
+	if timeout <= 0 && teardown <= 0 {
+		return
+	}
+
+	stages := map[*trackReport]int{}
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		reports := s.tracks
+		s.mu.Unlock()
+
+		now, active := time.Now(), false
+		for _, report := range reports {
+			last, ended := report.activity()
+			if last.IsZero() {
+				continue
+			}
+			idle := now.Sub(last)
+			if teardown <= 0 || idle < teardown {
+				active = true
+			}
+			if timeout > 0 && ended == "" {
+				stages[report] = s.escalateStall(report, stages[report], idle, timeout)
+			}
+		}
+
+		if teardown <= 0 || active || len(reports) == 0 {
+			continue
+		}
+		message := fmt.Sprintf("no packets arrived for %s", teardown)
+		fmt.Printf("Closing session %s: %s\n", s.id, message)
+		s.control.reportError(errCodeStalled, message)
+		s.server.metrics.add("ingest_stalled_sessions_closed_total", 1)
+		if err := s.Close(); err != nil {
+			fmt.Println("Error closing peer connection:", err)
+		}
+		return
+	}
+}
+
+// Take a track that sent nothing for idle to its next stage, returning it
+func (s *Session) escalateStall(report *trackReport, stage int, idle, timeout time.Duration) int {
+	t := report.track
+	switch {
+	case idle < timeout:
+		if stage != stallNone {
+			fmt.Printf("Track %q resumed after stalling\n", t.Label)
+			s.server.metrics.add(fmt.Sprintf(`ingest_track_stalls_resumed_total{kind=%q}`, t.Kind), 1)
+		}
+		return stallNone
+	case stage == stallNone:
+		fmt.Printf("Track %q sent nothing for %s, asking for retransmission\n", t.Label, idle.Round(time.Millisecond))
+		s.requestRecovery(report)
+		return stallRequested
+	case stage == stallRequested && idle >= 2*timeout:
+		fmt.Printf("Track %q stalled for %s\n", t.Label, idle.Round(time.Millisecond))
+		s.requestRecovery(report)
+		s.server.metrics.add(fmt.Sprintf(`ingest_track_stalls_total{kind=%q}`, t.Kind), 1)
+		s.server.events.emit(eventTrackStalled, s.id, map[string]any{"kind": t.Kind, "track": t.rendition(), "label": t.Label, "idleMs": idle.Milliseconds()})
+		return stallReported
+	}
+	return stage
+}
+
+// NACK the packet after the last one of a track, and ask for a keyframe if
+// it is video
+func (s *Session) requestRecovery(report *trackReport) {
+	position, ok := report.position()
+	if !ok {
+		return
+	}
+
+	packets := []rtcp.Packet{&rtcp.TransportLayerNack{MediaSSRC: position.SSRC, Nacks: []rtcp.NackPair{{PacketID: position.Sequence + 1}}}}
+	s.server.metrics.add(`ingest_stall_requests_total{type="nack"}`, 1)
+	if report.track.Kind == "video" {
+		packets = append(packets, &rtcp.PictureLossIndication{MediaSSRC: position.SSRC})
+		s.server.metrics.add(`ingest_stall_requests_total{type="pli"}`, 1)
+	}
+	if err := s.peerConnection.WriteRTCP(packets); err != nil {
+		fmt.Println("Error requesting recovery of a stalled track:", err)
+	}
+}
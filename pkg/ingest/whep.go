@@ -0,0 +1,316 @@
+package ingest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// RTP payload size of the packets video frames are split into
+const whepMTU = 1200
+
+// whepRelay is the sink serving tracks to WebRTC viewers over WHEP
+// (WebRTC-HTTP Egress Protocol). Viewers name the session they watch and
+// get its tracks relayed at the time they connect.
+type whepRelay struct {
+	api     *webrtc.API
+	config  webrtc.Configuration
+	metrics *metricRegistry
+	pacing  float64 // Multiple of the average bitrate video is paced at, 0 disables pacing
+
+	mu      sync.Mutex
+	tracks  map[string]map[string]webrtc.TrackLocal // By session, then kind
+	viewers map[string]*whepViewer                  // By resource ID
+}
+
+type whepViewer struct {
+	session        string
+	peerConnection *webrtc.PeerConnection
+}
+
+func newWHEPRelay(api *webrtc.API, config webrtc.Configuration, metrics *metricRegistry, pacing float64) *whepRelay {
+	return &whepRelay{
+		api:     api,
+		config:  config,
+		metrics: metrics,
+		pacing:  pacing,
+		tracks:  map[string]map[string]webrtc.TrackLocal{},
+		viewers: map[string]*whepViewer{},
+	}
+}
+
+func (w *whepRelay) Open(t *Track) (io.WriteCloser, error) {
+	var payloader rtp.Payloader
+	switch t.codecName() {
+	case "vp8":
+		payloader = &codecs.VP8Payloader{}
+	case "h264":
+		payloader = &codecs.H264Payloader{}
+	}
+
+	// Video is packetized here to pace its packets, audio as samples
+	if t.Kind != "video" || payloader == nil || w.pacing <= 0 {
+		track, err := webrtc.NewTrackLocalStaticSample(t.Codec.RTPCodecCapability, t.Kind, "ingest")
+		if err != nil {
+			return nil, err
+		}
+		w.publish(t.Session, t.Kind, track)
+		return &relayedTrack{relay: w, session: t.Session, kind: t.Kind, track: track}, nil
+	}
+
+	track, err := webrtc.NewTrackLocalStaticRTP(t.Codec.RTPCodecCapability, t.Kind, "ingest")
+	if err != nil {
+		return nil, err
+	}
+	w.publish(t.Session, t.Kind, track)
+
+	// The payload type and SSRC are rewritten for every viewer
+	paced := &pacedTrack{
+		relay:      w,
+		session:    t.Session,
+		track:      track,
+		packetizer: rtp.NewPacketizer(whepMTU, 0, 0, payloader, rtp.NewRandomSequencer(), t.Codec.ClockRate),
+		clockRate:  t.Codec.ClockRate,
+		queue:      make(chan *rtp.Packet, sfuQueueSize),
+		done:       make(chan struct{}),
+	}
+	go paced.run()
+	return paced, nil
+}
+
+func (w *whepRelay) publish(session, kind string, track webrtc.TrackLocal) {
+	w.mu.Lock()
+	if w.tracks[session] == nil {
+		w.tracks[session] = map[string]webrtc.TrackLocal{}
+	}
+	w.tracks[session][kind] = track
+	w.mu.Unlock()
+}
+
+func (w *whepRelay) unpublish(session, kind string, track webrtc.TrackLocal) {
+	w.mu.Lock()
+	if w.tracks[session][kind] == track {
+		delete(w.tracks[session], kind)
+		if len(w.tracks[session]) == 0 {
+			delete(w.tracks, session)
+		}
+	}
+	w.mu.Unlock()
+}
+
+// Session a WHEP viewer watches, of the resource in the request path, empty
+// for an unknown resource
+func (w *whepRelay) viewerSession(r *http.Request) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if viewer := w.viewers[r.PathValue("id")]; viewer != nil {
+		return viewer.session
+	}
+	return ""
+}
+
+// relayedTrack writes payloads as samples of a relayed track
+type relayedTrack struct {
+	relay   *whepRelay
+	session string
+	kind    string
+	track   *webrtc.TrackLocalStaticSample
+}
+
+func (r *relayedTrack) Write(p []byte) (int, error) {
+	duration := videoFrameDuration
+	if r.kind == "audio" {
+		duration = 20 * time.Millisecond
+		if d := opusDuration(p); d > 0 && strings.EqualFold(r.track.Codec().MimeType, webrtc.MimeTypeOpus) {
+			duration = d
+		}
+	}
+
+	// The packetizer keeps no reference to the sample
+	if err := r.track.WriteSample(media.Sample{Data: p, Duration: duration}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *relayedTrack) Close() error {
+	r.relay.unpublish(r.session, r.kind, r.track)
+	return nil
+}
+
+// pacedTrack splits video frames into RTP packets and sends them to the
+// viewers paced, from a queue so the pipeline isn't held up meanwhile
+type pacedTrack struct {
+	relay      *whepRelay
+	session    string
+	track      *webrtc.TrackLocalStaticRTP
+	packetizer rtp.Packetizer
+	clockRate  uint32
+	queue      chan *rtp.Packet
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func (p *pacedTrack) Write(frame []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	samples := uint32(videoFrameDuration.Seconds() * float64(p.clockRate))
+	for _, packet := range p.packetizer.Packetize(frame, samples) {
+		select {
+		case p.queue <- packet:
+		default:
+			p.relay.metrics.add(`ingest_pacing_dropped_packets_total{relay="whep"}`, 1)
+		}
+	}
+	return len(frame), nil
+}
+
+func (p *pacedTrack) run() {
+	pacer := newPacer(p.relay.pacing)
+	for {
+		var packet *rtp.Packet
+		select {
+		case <-p.done:
+			return
+		case packet = <-p.queue:
+		}
+
+		if wait := pacer.delay(packet.MarshalSize(), time.Now()); wait > 0 {
+			p.relay.metrics.observe(`ingest_pacing_delay_seconds{relay="whep"}`, wait.Seconds())
+			time.Sleep(wait)
+		}
+		if err := p.track.WriteRTP(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			fmt.Println("Error relaying packet:", err)
+		}
+	}
+}
+
+func (p *pacedTrack) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.relay.unpublish(p.session, "video", p.track)
+	})
+	return nil
+}
+
+// Answer the SDP offer of a WHEP viewer with the relayed tracks of the
+// session in the session query parameter
+func (w *whepRelay) serveOffer(rw http.ResponseWriter, r *http.Request) {
+	session := querySession(r)
+	if !validSessionID(session) {
+		http.Error(rw, "invalid session", http.StatusBadRequest)
+		return
+	}
+	offer, err := io.ReadAll(r.Body)
+	if err != nil || len(offer) == 0 {
+		http.Error(rw, "invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	peerConnection, err := w.api.NewPeerConnection(w.config)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.mu.Lock()
+	for _, track := range w.tracks[session] {
+		sender, addErr := peerConnection.AddTrack(track)
+		if addErr != nil {
+			err = addErr
+			break
+		}
+
+		// Drain RTCP so the interceptors keep working
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, rtcpErr := sender.Read(buf); rtcpErr != nil {
+					return
+				}
+			}
+		}()
+	}
+	w.mu.Unlock()
+	if err != nil {
+		peerConnection.Close()
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id) //nolint:errcheck
+	resource := hex.EncodeToString(id)
+
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateDisconnected {
+			peerConnection.Close()
+		}
+		if s == webrtc.PeerConnectionStateClosed {
+			w.mu.Lock()
+			delete(w.viewers, resource)
+			w.mu.Unlock()
+		}
+	})
+
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		peerConnection.Close()
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		peerConnection.Close()
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		peerConnection.Close()
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	<-gatherComplete
+
+	w.mu.Lock()
+	w.viewers[resource] = &whepViewer{session: session, peerConnection: peerConnection}
+	w.mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/sdp")
+	rw.Header().Set("Location", "/whep/"+resource)
+	rw.WriteHeader(http.StatusCreated)
+	io.WriteString(rw, peerConnection.LocalDescription().SDP) //nolint:errcheck
+}
+
+// End the session of a WHEP viewer
+func (w *whepRelay) serveDelete(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	viewer := w.viewers[r.PathValue("id")]
+	w.mu.Unlock()
+
+	if viewer == nil {
+		http.Error(rw, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	viewer.peerConnection.Close()
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,182 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a track's write queue does with a payload while it is full
+const (
+	writePolicyDropOldest = "drop-oldest" // Evict the oldest queued payload
+	writePolicyDropNewest = "drop-newest" // Drop the payload being written
+	writePolicyBlock      = "block"       // Wait for room up to the write timeout, then drop the payload
+)
+
+const errCodeFFmpegStalled = "ffmpeg_stalled"
+
+func validWritePolicy(policy string) bool {
+	switch policy {
+	case writePolicyDropOldest, writePolicyDropNewest, writePolicyBlock:
+		return true
+	}
+	return false
+}
+
+// writeQueue decouples a track's pipeline from the sinks it writes to. Writes
+// are queued and handed to the sinks by a goroutine of its own, so a stalled
+// FFmpeg stdin costs payloads according to the policy instead of backing up
+// the whole pipeline.
+type writeQueue struct {
+	w       io.WriteCloser
+	track   string
+	policy  string
+	timeout time.Duration // How long a write may take before FFmpeg counts as stalled
+	metrics *metricRegistry
+	control *recordingControl
+
+	queue    chan []byte
+	written  chan struct{} // Closed once the queue was drained
+	buffered *atomic.Int64 // Bytes queued of the session, nil if not accounted
+	err      atomic.Pointer[error]
+
+	writingSince atomic.Int64 // Unix nanoseconds the pending write started at, 0 when idle
+	stalled      atomic.Bool
+
+	mu     sync.RWMutex // Held for writing to close the queue
+	closed bool
+}
+
+func newWriteQueue(w io.WriteCloser, track string, cfg *Config, metrics *metricRegistry, control *recordingControl) *writeQueue {
+	q := &writeQueue{
+		w:       w,
+		track:   track,
+		policy:  cfg.WritePolicy,
+		timeout: cfg.WriteTimeout,
+		metrics: metrics,
+		control: control,
+		queue:   make(chan []byte, cfg.WriteQueue),
+		written: make(chan struct{}),
+	}
+	go q.run()
+
+	return q
+}
+
+func (q *writeQueue) run() {
+	defer close(q.written)
+
+	for payload := range q.queue {
+		addBuffered(q.buffered, -len(payload))
+		if q.err.Load() != nil {
+			releasePayload(payload)
+			continue
+		}
+
+		q.writingSince.Store(time.Now().UnixNano())
+		_, err := q.w.Write(payload)
+		q.writingSince.Store(0)
+		releasePayload(payload)
+		if err != nil {
+			q.err.Store(&err)
+		}
+		if q.stalled.CompareAndSwap(true, false) {
+			fmt.Printf("FFmpeg of the %s track recovered\n", q.track)
+		}
+	}
+}
+
+// Write queues a copy of the payload, the error of an earlier write is
+// returned once the sinks failed
+func (q *writeQueue) Write(p []byte) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := q.err.Load(); err != nil {
+		return 0, *err
+	}
+
+	payload := copyPayload(p)
+	select {
+	case q.queue <- payload:
+		addBuffered(q.buffered, len(payload))
+		return len(p), nil
+	default:
+	}
+
+	q.checkStall()
+	switch q.policy {
+	case writePolicyDropOldest:
+		for {
+			select {
+			case q.queue <- payload:
+				addBuffered(q.buffered, len(payload))
+				return len(p), nil
+			case oldest := <-q.queue:
+				addBuffered(q.buffered, -len(oldest))
+				releasePayload(oldest)
+				q.drop("oldest")
+			}
+		}
+	case writePolicyBlock:
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+
+		select {
+		case q.queue <- payload:
+			addBuffered(q.buffered, len(payload))
+			return len(p), nil
+		case <-timer.C:
+			q.drop("timeout")
+		}
+	default:
+		q.drop("newest")
+	}
+	releasePayload(payload)
+
+	return len(p), nil
+}
+
+func (q *writeQueue) drop(reason string) {
+	q.metrics.add(fmt.Sprintf("ingest_write_dropped_total{track=%q,reason=%q}", q.track, reason), 1)
+}
+
+// Report a sink write that takes longer than the timeout, once per stall
+func (q *writeQueue) checkStall() {
+	since := q.writingSince.Load()
+	if since == 0 || time.Since(time.Unix(0, since)) < q.timeout {
+		return
+	}
+
+	if q.stalled.CompareAndSwap(false, true) {
+		q.metrics.add(fmt.Sprintf("ingest_write_stalls_total{track=%q}", q.track), 1)
+		q.control.reportError(errCodeFFmpegStalled, fmt.Sprintf("FFmpeg of the %s track stopped reading", q.track))
+	}
+}
+
+// Close flushes what is queued and closes the sinks. A stalled sink gets
+// the write timeout to drain before it is closed under the pending write.
+func (q *writeQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+
+	select {
+	case <-q.written:
+	case <-time.After(q.timeout):
+	}
+	err := q.w.Close()
+	<-q.written
+
+	return err
+}
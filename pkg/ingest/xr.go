@@ -0,0 +1,146 @@
+package ingest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Longest run a Loss RLE run length chunk can describe
+const xrMaxRun = 0x3fff
+
+// Sequence numbers one report may cover, beyond that packets start a new one
+const xrMaxWindow = 0x8000
+
+// xrReporter records which packets of a track arrived, and turns that into
+// RTCP Extended Reports (RFC 3611) for the publisher: a Receiver Reference
+// Time block and a Loss RLE block with the exact loss pattern since the
+// previous report, richer than the counters of a bare Receiver Report
+type xrReporter struct {
+	ssrc uint32
+
+	mu       sync.Mutex
+	started  bool
+	begin    uint16 // First sequence number of the current report
+	received []bool // By offset from begin
+}
+
+func newXRReporter(ssrc uint32) *xrReporter {
+	return &xrReporter{ssrc: ssrc}
+}
+
+func (x *xrReporter) Process(packet *rtp.Packet) (*rtp.Packet, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if !x.started {
+		x.begin = packet.SequenceNumber
+		x.started = true
+	}
+
+	// Packets from before begin were late for their report
+	offset := int(packet.SequenceNumber - x.begin)
+	if offset >= xrMaxWindow {
+		return packet, nil
+	}
+
+	for len(x.received) <= offset {
+		x.received = append(x.received, false)
+	}
+	x.received[offset] = true
+	return packet, nil
+}
+
+// report returns the Extended Report covering the packets since the last
+// one, nil when none arrived
+func (x *xrReporter) report(now time.Time) *rtcp.ExtendedReport {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if len(x.received) == 0 {
+		return nil
+	}
+
+	begin := x.begin
+	end := begin + uint16(len(x.received))
+	chunks := lossChunks(x.received)
+	x.begin = end
+	x.received = x.received[:0]
+
+	return &rtcp.ExtendedReport{
+		Reports: []rtcp.ReportBlock{
+			&rtcp.ReceiverReferenceTimeReportBlock{NTPTimestamp: ntpTimestamp(now)},
+			&rtcp.LossRLEReportBlock{SSRC: x.ssrc, BeginSeq: begin, EndSeq: end, Chunks: chunks},
+		},
+	}
+}
+
+// Encode received flags as Loss RLE chunks, runs of the same state as run
+// length chunks and anything more mixed as 15-bit vectors
+func lossChunks(received []bool) []rtcp.Chunk {
+	var chunks []rtcp.Chunk
+	for i := 0; i < len(received); {
+		run := 1
+		for i+run < len(received) && run < xrMaxRun && received[i+run] == received[i] {
+			run++
+		}
+
+		if run >= 15 {
+			chunk := rtcp.Chunk(run)
+			if received[i] {
+				chunk |= 1 << 14
+			}
+			chunks = append(chunks, chunk)
+			i += run
+			continue
+		}
+
+		chunk := rtcp.Chunk(1 << 15)
+		for bit := 0; bit < 15 && i+bit < len(received); bit++ {
+			if received[i+bit] {
+				chunk |= 1 << (14 - bit)
+			}
+		}
+		chunks = append(chunks, chunk)
+		i += 15
+	}
+
+	// Blocks end on a 32-bit boundary, padded with a null chunk
+	if len(chunks)%2 == 1 {
+		chunks = append(chunks, 0)
+	}
+	return chunks
+}
+
+func ntpTimestamp(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := (uint64(t.Nanosecond()) << 32) / 1e9
+
+	return seconds<<32 | fraction
+}
+
+// Send the reports of a track to the publisher every interval until stopped
+func (x *xrReporter) run(pc *webrtc.PeerConnection, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			report := x.report(now)
+			if report == nil {
+				continue
+			}
+			if err := pc.WriteRTCP([]rtcp.Packet{report}); err != nil {
+				fmt.Println("Failed to send RTCP XR:", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package main
+
+// The "sqlite" driver of the recording catalog, a cgo-free SQLite
+import _ "modernc.org/sqlite"